@@ -0,0 +1,150 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the estimator used to account for memory
+// allocated by a Starlark thread.
+//
+// The estimates are deterministic functions of the values created,
+// not measurements of the Go heap, so a given program charges the same
+// number of bytes on every machine.  They are shallow: the size of a
+// list counts its array of element references but not the elements
+// themselves, which were charged when they were created.
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// Estimated sizes, in bytes, of the parts of values.
+const (
+	sizeofValue     = 16 // an interface value: a reference to a list element, tuple element, etc
+	sizeofString    = 16 // a string header
+	sizeofList      = 48 // a List, excluding its elements
+	sizeofTuple     = 24 // a slice header
+	sizeofHashtable = 96 // a Dict or Set, excluding its entries
+	sizeofEntry     = 64 // a hashtable entry and its share of a bucket
+	sizeofBigInt    = 32 // a big.Int, excluding its words
+)
+
+// EstimateSize returns the estimated number of bytes allocated to
+// represent the value v, not counting the values it refers to.
+// Values whose representation requires no allocation, such as None,
+// Bool and Float, have size zero.
+func EstimateSize(v Value) int64 {
+	switch v := v.(type) {
+	case String:
+		return sizeofString + int64(len(v))
+	case Bytes:
+		return sizeofString + int64(len(v))
+	case *List:
+		// Use the length, not the capacity, which depends on
+		// the growth policy of the Go runtime's append.
+		return sizeofList + sizeofValue*int64(len(v.elems))
+	case Tuple:
+		return sizeofTuple + sizeofValue*int64(len(v))
+	case *Dict:
+		return sizeofHashtable + sizeofEntry*int64(v.ht.len)
+	case *Set:
+		return sizeofHashtable + sizeofEntry*int64(v.ht.len)
+	case Int:
+		if v.big == nil {
+			return 0 // small ints are held inline
+		}
+		return sizeofBigInt + int64(len(v.big.Bits()))*8
+	}
+	return 0
+}
+
+// SetMaxAllocs sets a limit on the estimated number of bytes that may
+// be allocated by Starlark computation in this thread.  If the limit
+// would be exceeded, the interpreter fails with an EvalError wrapping
+// an *AllocLimitError.  A limit of zero, the default, means no limit.
+func (thread *Thread) SetMaxAllocs(max int64) {
+	thread.maxAllocs = max
+}
+
+// Allocs returns the estimated number of bytes allocated by the thread
+// so far.  The counter is cumulative: it is not reduced when values
+// become unreachable, and it is not reset by Exec or Eval.
+func (thread *Thread) Allocs() int64 {
+	return thread.allocs
+}
+
+// AddAllocs charges delta bytes to the thread's allocation counter,
+// and returns an error if that exceeds the limit set by SetMaxAllocs.
+// Built-in functions that allocate memory in proportion to their
+// inputs may use it to account for the values they create.
+func (thread *Thread) AddAllocs(delta int64) error {
+	if delta <= 0 {
+		return nil
+	}
+	thread.allocs = addSize(thread.allocs, delta)
+	if thread.maxAllocs != 0 && thread.allocs > thread.maxAllocs {
+		return &AllocLimitError{MaxAllocs: thread.maxAllocs}
+	}
+	return nil
+}
+
+// CheckAllocs returns an error if charging delta bytes to the thread
+// would exceed the limit set by SetMaxAllocs, without charging them.
+// Built-in functions may use it to fail before attempting a large
+// allocation that would otherwise exhaust the host's memory.
+func (thread *Thread) CheckAllocs(delta int64) error {
+	if thread.maxAllocs != 0 && addSize(thread.allocs, delta) > thread.maxAllocs {
+		return &AllocLimitError{MaxAllocs: thread.maxAllocs}
+	}
+	return nil
+}
+
+// An AllocLimitError reports that a thread exceeded the limit
+// on allocated memory set by SetMaxAllocs.
+type AllocLimitError struct {
+	MaxAllocs int64 // the limit that was exceeded
+}
+
+func (e *AllocLimitError) Error() string {
+	return fmt.Sprintf("out of memory: Starlark computation exceeded allocation limit of %d bytes", e.MaxAllocs)
+}
+
+// addSize returns x+y, saturating at math.MaxInt64.
+func addSize(x, y int64) int64 {
+	if x > math.MaxInt64-y {
+		return math.MaxInt64
+	}
+	return x + y
+}
+
+// binarySize returns the estimated size of the result of x op y
+// if it can be determined before performing the operation, or zero.
+// It is used to reject sequence repetitions such as "x" * 1000000000
+// before they exhaust the host's memory.
+func binarySize(op syntax.Token, x, y Value) int64 {
+	if op != syntax.STAR {
+		return 0
+	}
+	if _, ok := x.(Int); ok {
+		x, y = y, x // int * sequence
+	}
+	n, ok := y.(Int)
+	if !ok {
+		return 0
+	}
+	i, err := AsInt32(n)
+	if err != nil || i <= 0 {
+		return 0
+	}
+	switch x := x.(type) {
+	case String:
+		return sizeofString + int64(len(x))*int64(i)
+	case *List:
+		return sizeofList + sizeofValue*int64(len(x.elems))*int64(i)
+	case Tuple:
+		return sizeofTuple + sizeofValue*int64(len(x))*int64(i)
+	}
+	return 0
+}
@@ -0,0 +1,381 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file defines the debugger: it executes the program, stops it
+// at breakpoints and steps, and inspects its stack and variables
+// while it is stopped.
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// A mode specifies how the program proceeds when resumed.
+type mode int
+
+const (
+	running  mode = iota // until the next breakpoint
+	stepIn               // until the next statement
+	stepOver             // until the next statement in the same or a calling function
+	stepOut              // until the next statement in a calling function
+)
+
+var (
+	errNotStopped = errors.New("program is not stopped")
+	errTerminated = errors.New("terminated by debugger")
+)
+
+// A stop records the state of the program while it is stopped before
+// a statement.  Frames and variable references are valid only for the
+// duration of the stop.
+type stop struct {
+	stmt   syntax.Stmt
+	frames []*starlark.Frame // the stack, innermost first
+	refs   []interface{}     // StringDict or Value to expand, by variable reference - 1
+	resume chan struct{}     // closed to resume the program
+}
+
+// start starts executing the program once the client has launched it
+// and finished configuring breakpoints.
+func (s *server) start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.launch == nil || !s.configured || s.thread != nil || s.terminating {
+		return
+	}
+	s.entry = s.launch.StopOnEntry
+	s.thread = &starlark.Thread{
+		Print: func(_ *starlark.Thread, msg string) {
+			s.event("output", &OutputEvent{Category: "stdout", Output: msg + "\n"})
+		},
+		Load: s.makeLoad(filepath.Dir(s.launch.Program)),
+	}
+	if !s.launch.NoDebug {
+		s.thread.Hook = s
+	}
+	s.exited = make(chan struct{})
+	go s.run(s.thread, s.launch.Program, s.exited)
+}
+
+// run executes the program, reports its outcome, and closes exited.
+func (s *server) run(thread *starlark.Thread, program string, exited chan struct{}) {
+	defer close(exited)
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:   thread,
+		Filename: program,
+		Dialect:  &s.config.dialect,
+	})
+	exitCode := 0
+	if err != nil {
+		exitCode = 1
+		s.mu.Lock()
+		terminating := s.terminating
+		s.mu.Unlock()
+		if !terminating {
+			msg := err.Error()
+			if evalErr, ok := err.(*starlark.EvalError); ok {
+				msg = evalErr.Backtrace()
+			}
+			s.event("output", &OutputEvent{Category: "stderr", Output: msg + "\n"})
+		}
+	}
+	s.event("exited", &ExitedEvent{ExitCode: exitCode})
+	s.event("terminated", nil)
+}
+
+// makeLoad returns the Load function of the program's thread.  It
+// executes each module once, in the same thread, so that the debugger
+// stops at breakpoints in loaded files too.  Relative module names
+// are relative to dir, the program's directory.
+func (s *server) makeLoad(dir string) func(*starlark.Thread, string) (starlark.StringDict, error) {
+	type entry struct {
+		globals starlark.StringDict
+		err     error
+	}
+
+	cache := make(map[string]*entry)
+
+	return func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+		filename := module
+		if !filepath.IsAbs(filename) {
+			filename = filepath.Join(dir, filename)
+		}
+		e, ok := cache[filename]
+		if e == nil {
+			if ok {
+				// request for package whose loading is in progress
+				return nil, fmt.Errorf("cycle in load graph")
+			}
+
+			// Add a placeholder to indicate "load in progress".
+			cache[filename] = nil
+
+			globals, err := starlark.Exec(starlark.ExecOptions{
+				Thread:   thread,
+				Filename: filename,
+				Dialect:  &s.config.dialect,
+			})
+			e = &entry{globals, err}
+
+			cache[filename] = e
+		}
+		return e.globals, e.err
+	}
+}
+
+// BeforeStmt implements starlark.Hook.  If a breakpoint, step or
+// pause requires it, it stops the program before the statement and
+// waits for the client to resume it.
+func (s *server) BeforeStmt(fr *starlark.Frame, stmt syntax.Stmt) error {
+	s.mu.Lock()
+	reason := s.stopReason(fr, stmt)
+	if reason == "" || s.terminating {
+		s.mu.Unlock()
+		return nil
+	}
+	var frames []*starlark.Frame
+	for ; fr != nil; fr = fr.Parent() {
+		frames = append(frames, fr)
+	}
+	stop := &stop{stmt: stmt, frames: frames, resume: make(chan struct{})}
+	s.stopped, s.last = stop, stop
+	s.mode, s.pausing, s.entry = running, false, false
+	s.mu.Unlock()
+
+	s.event("stopped", &StoppedEvent{Reason: reason, ThreadID: threadID, AllThreadsStopped: true})
+	<-stop.resume
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.terminating {
+		return errTerminated
+	}
+	return nil
+}
+
+// stopReason returns the reason to stop before stmt, executing in
+// frame fr, or "" if the program should not stop.
+// It is called with s.mu held.
+func (s *server) stopReason(fr *starlark.Frame, stmt syntax.Stmt) string {
+	pos := fr.Position()
+
+	// A statement nested within the one at which the program last
+	// stopped, and on the same line, is part of the same step:
+	// the body of "if x: f()", for example.
+	if last := s.last; last != nil && last.frames[0] == fr && within(stmt, last.stmt) {
+		if start, _ := last.stmt.Span(); start.Line == pos.Line {
+			return ""
+		}
+	}
+
+	depth := 0
+	for f := fr; f != nil; f = f.Parent() {
+		depth++
+	}
+	switch {
+	case s.entry:
+		return "entry"
+	case s.pausing:
+		return "pause"
+	case s.mode == stepIn,
+		s.mode == stepOver && depth <= s.stepDepth,
+		s.mode == stepOut && depth < s.stepDepth:
+		return "step"
+	}
+	if s.bps[pos.Filename()][int(pos.Line)] != 0 {
+		return "breakpoint"
+	}
+	return ""
+}
+
+// within reports whether the statement x lies within the statement y,
+// and is not y.
+func within(x, y syntax.Stmt) bool {
+	xstart, xend := x.Span()
+	ystart, yend := y.Span()
+	return x != y && !before(xstart, ystart) && !before(yend, xend)
+}
+
+// before reports whether position p is before position q.
+func before(p, q syntax.Position) bool {
+	if p.Line != q.Line {
+		return p.Line < q.Line
+	}
+	return p.Col < q.Col
+}
+
+// resume resumes the stopped program in the specified mode.
+// It is called with s.mu held.
+func (s *server) resume(mode mode) error {
+	stop := s.stopped
+	if stop == nil {
+		return errNotStopped
+	}
+	s.mode = mode
+	s.stepDepth = len(stop.frames)
+	s.stopped = nil
+	close(stop.resume)
+	return nil
+}
+
+// cancel requests the termination of the program, if it is running,
+// and prevents it from starting otherwise.
+// It is called with s.mu held.
+func (s *server) cancel() {
+	s.terminating = true
+	if s.thread != nil {
+		s.thread.Cancel(errTerminated.Error())
+	}
+	if s.stopped != nil {
+		close(s.stopped.resume)
+		s.stopped = nil
+	}
+}
+
+// wait waits for the program, if started, to finish.
+func (s *server) wait() {
+	s.mu.Lock()
+	exited := s.exited
+	s.mu.Unlock()
+	if exited != nil {
+		<-exited
+	}
+}
+
+// stackTrace returns the stack of the stopped program.
+// It is called with s.mu held, as are scopes and variables.
+func (s *server) stackTrace(args StackTraceArguments) (*StackTraceResponse, error) {
+	stop := s.stopped
+	if stop == nil {
+		return nil, errNotStopped
+	}
+	resp := &StackTraceResponse{StackFrames: []StackFrame{}, TotalFrames: len(stop.frames)}
+	for i, fr := range stop.frames {
+		if i < args.StartFrame || args.Levels > 0 && i >= args.StartFrame+args.Levels {
+			continue
+		}
+		name := "<toplevel>"
+		if fn := fr.Function(); fn != nil {
+			name = fn.Name()
+		}
+		pos := fr.Position()
+		resp.StackFrames = append(resp.StackFrames, StackFrame{
+			ID:     i + 1,
+			Name:   name,
+			Source: &Source{Name: filepath.Base(pos.Filename()), Path: pos.Filename()},
+			Line:   int(pos.Line) - 1 + s.lineBase,
+			Column: int(pos.Col) - 1 + s.colBase,
+		})
+	}
+	return resp, nil
+}
+
+// scopes returns the local and global variables of a frame of the
+// stopped program.
+func (s *server) scopes(args ScopesArguments) (*ScopesResponse, error) {
+	stop := s.stopped
+	if stop == nil {
+		return nil, errNotStopped
+	}
+	if args.FrameID < 1 || args.FrameID > len(stop.frames) {
+		return nil, fmt.Errorf("invalid frame ID: %d", args.FrameID)
+	}
+	fr := stop.frames[args.FrameID-1]
+	resp := &ScopesResponse{Scopes: []Scope{}}
+	if fr.Function() != nil {
+		resp.Scopes = append(resp.Scopes, Scope{Name: "Locals", VariablesReference: stop.ref(fr.Locals())})
+	}
+	resp.Scopes = append(resp.Scopes, Scope{Name: "Globals", VariablesReference: stop.ref(fr.Globals())})
+	return resp, nil
+}
+
+// variables returns the variables of a scope, or the elements
+// of a value, of the stopped program.
+func (s *server) variables(args VariablesArguments) (*VariablesResponse, error) {
+	stop := s.stopped
+	if stop == nil {
+		return nil, errNotStopped
+	}
+	ref := args.VariablesReference
+	if ref < 1 || ref > len(stop.refs) {
+		return nil, fmt.Errorf("invalid variables reference: %d", ref)
+	}
+	resp := &VariablesResponse{Variables: []Variable{}}
+	switch x := stop.refs[ref-1].(type) {
+	case starlark.StringDict:
+		names := make([]string, 0, len(x))
+		for name := range x {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			resp.Variables = append(resp.Variables, stop.variable(name, x[name]))
+		}
+	case starlark.Value:
+		names, values := elements(x)
+		for i, name := range names {
+			resp.Variables = append(resp.Variables, stop.variable(name, values[i]))
+		}
+	}
+	return resp, nil
+}
+
+// ref returns a new variable reference for a scope or value.
+func (stop *stop) ref(x interface{}) int {
+	stop.refs = append(stop.refs, x)
+	return len(stop.refs)
+}
+
+// variable describes a variable or element with the specified value.
+func (stop *stop) variable(name string, v starlark.Value) Variable {
+	variable := Variable{Name: name, Value: v.String(), Type: v.Type()}
+	if names, _ := elements(v); len(names) > 0 {
+		variable.VariablesReference = stop.ref(v)
+	}
+	return variable
+}
+
+// elements returns the names and values of the elements of a list,
+// tuple, dict, set or struct, or nil for other values.
+func elements(v starlark.Value) (names []string, values []starlark.Value) {
+	switch v := v.(type) {
+	case *starlark.List, starlark.Tuple:
+		seq := v.(starlark.Indexable)
+		for i := 0; i < seq.Len(); i++ {
+			names = append(names, fmt.Sprintf("[%d]", i))
+			values = append(values, seq.Index(i))
+		}
+	case *starlark.Set:
+		iter := v.Iterate()
+		defer iter.Done()
+		var x starlark.Value
+		for i := 0; iter.Next(&x); i++ {
+			names = append(names, fmt.Sprintf("[%d]", i))
+			values = append(values, x)
+		}
+	case *starlark.Dict:
+		for _, item := range v.Items() {
+			names = append(names, item[0].String())
+			values = append(values, item[1])
+		}
+	case *starlarkstruct.Struct:
+		for _, name := range v.AttrNames() {
+			x, err := v.Attr(name)
+			if err != nil {
+				continue
+			}
+			names = append(names, name)
+			values = append(values, x)
+		}
+	}
+	return names, values
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The starlark-dap command is a Debug Adapter Protocol server for
+// Starlark programs.  It communicates with the editor over its
+// standard input and output.
+//
+// The launch request names the program to execute:
+//
+//	{"program": "build.star", "stopOnEntry": false}
+//
+// Modules loaded by the program are files whose names are relative
+// to the program's directory.  The server supports line breakpoints,
+// in the program and in loaded files; pausing; stepping into, over
+// and out of function calls; stack traces; and the inspection of
+// local and global variables, including the elements of lists,
+// tuples, dicts, sets and structs.
+//
+// The dialect of the program is specified by flags:
+//
+//	starlark-dap -lambda -nesteddef
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+
+	"github.com/aabbtree77/determinism/resolve"
+)
+
+// The dialect accepts the features named by pragmas in each file,
+// and those enabled by the non-standard dialect flags.
+var dialect = resolve.Options{Pragma: true}
+
+// non-standard dialect flags
+func init() {
+	flag.BoolVar(&dialect.AllowFloat, "fp", false, "allow floating-point numbers")
+	flag.BoolVar(&dialect.AllowSet, "set", false, "allow set data type")
+	flag.BoolVar(&dialect.AllowBytes, "bytes", false, "allow bytes data type")
+	flag.BoolVar(&dialect.AllowLambda, "lambda", false, "allow lambda expressions")
+	flag.BoolVar(&dialect.AllowNestedDef, "nesteddef", false, "allow nested def statements")
+	flag.BoolVar(&dialect.AllowRecursion, "recursion", false, "allow recursive functions")
+	flag.BoolVar(&dialect.AllowWhile, "while", false, "allow while loops")
+	flag.BoolVar(&dialect.AllowToplevelLoops, "toplevelloops", false, "allow loops at top level")
+}
+
+func main() {
+	log.SetPrefix("starlark-dap: ")
+	log.SetFlags(0)
+	flag.Parse()
+
+	if err := newServer(os.Stdin, os.Stdout, config{dialect: dialect}).serve(); err != nil {
+		log.Fatal(err)
+	}
+}
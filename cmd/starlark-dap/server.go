@@ -0,0 +1,335 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file defines the server, which dispatches the requests of the
+// protocol.  The debugger proper is in debugger.go.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// threadID identifies the only thread of the debugged program.
+const threadID = 1
+
+// A config specifies the environment in which the server executes
+// Starlark programs.
+type config struct {
+	dialect resolve.Options // optional language features
+}
+
+// A server is a debug adapter connected to a single client.
+// It debugs at most one program.
+type server struct {
+	in     *bufio.Reader
+	config config
+
+	writeMu sync.Mutex // guards out and seq
+	out     io.Writer
+	seq     int // sequence number of the last message sent
+
+	// The fields below are accessed by the goroutine that handles
+	// requests and by the one that executes the program.
+	mu sync.Mutex
+
+	lineBase, colBase int // number of the first line and column: 0 or 1
+
+	launch     *LaunchArguments       // arguments of the launch request, or nil
+	configured bool                   // the client has sent configurationDone
+	bps        map[string]map[int]int // IDs of breakpoints, by file and line
+	nextBpID   int                    // ID of the next breakpoint
+
+	thread *starlark.Thread // executes the program, once started
+	exited chan struct{}    // closed when the program finishes
+
+	// execution control
+	mode        mode  // how to proceed after the next statement
+	stepDepth   int   // depth of the stack at which stepping began
+	pausing     bool  // the client has requested a pause
+	terminating bool  // the client has requested termination
+	stopped     *stop // the current stop, while the program is stopped
+	last        *stop // the most recent stop
+	entry       bool  // stop before the first statement
+}
+
+func newServer(in io.Reader, out io.Writer, config config) *server {
+	return &server{
+		in:       bufio.NewReader(in),
+		out:      out,
+		config:   config,
+		lineBase: 1,
+		colBase:  1,
+		bps:      make(map[string]map[int]int),
+		nextBpID: 1,
+	}
+}
+
+// serve reads and handles requests until the client sends disconnect
+// or closes the connection.  In either case it terminates the program.
+func (s *server) serve() error {
+	defer func() {
+		s.mu.Lock()
+		s.cancel()
+		s.mu.Unlock()
+		s.wait()
+	}()
+	for {
+		msg, err := readMessage(s.in)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if msg.Type != "request" {
+			continue
+		}
+		body, err := s.handle(msg)
+		if msg.Command == "disconnect" {
+			s.wait()
+		}
+		if err := s.respond(msg, body, err); err != nil {
+			return err
+		}
+
+		// Some requests have effects that must follow their response.
+		switch msg.Command {
+		case "initialize":
+			if err := s.event("initialized", nil); err != nil {
+				return err
+			}
+		case "launch", "configurationDone":
+			s.start()
+		case "disconnect":
+			return nil
+		}
+	}
+}
+
+// respond sends the response to the request msg.
+func (s *server) respond(req *message, body interface{}, err error) error {
+	success := err == nil
+	msg := &message{
+		Type:       "response",
+		Command:    req.Command,
+		RequestSeq: req.Seq,
+		Success:    &success,
+	}
+	if err != nil {
+		msg.Message = err.Error()
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = data
+	}
+	return s.send(msg)
+}
+
+// event sends an event to the client.
+func (s *server) event(event string, body interface{}) error {
+	msg := &message{Type: "event", Event: event}
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		msg.Body = data
+	}
+	return s.send(msg)
+}
+
+func (s *server) send(msg *message) error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.seq++
+	msg.Seq = s.seq
+	return writeMessage(s.out, msg)
+}
+
+// handle handles a request and returns the body of its response.
+func (s *server) handle(msg *message) (interface{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch msg.Command {
+	case "initialize":
+		var args InitializeArguments
+		if err := unmarshalArgs(msg, &args); err != nil {
+			return nil, err
+		}
+		if args.LinesStartAt1 != nil && !*args.LinesStartAt1 {
+			s.lineBase = 0
+		}
+		if args.ColumnsStartAt1 != nil && !*args.ColumnsStartAt1 {
+			s.colBase = 0
+		}
+		return &Capabilities{
+			SupportsConfigurationDoneRequest: true,
+			SupportsTerminateRequest:         true,
+		}, nil
+
+	case "launch":
+		if s.launch != nil {
+			return nil, fmt.Errorf("program already launched")
+		}
+		args := new(LaunchArguments)
+		if err := unmarshalArgs(msg, args); err != nil {
+			return nil, err
+		}
+		if args.Program == "" {
+			return nil, fmt.Errorf("no program specified")
+		}
+		program, err := filepath.Abs(args.Program)
+		if err != nil {
+			return nil, err
+		}
+		args.Program = program
+		s.launch = args
+		return nil, nil
+
+	case "configurationDone":
+		s.configured = true
+		return nil, nil
+
+	case "setBreakpoints":
+		var args SetBreakpointsArguments
+		if err := unmarshalArgs(msg, &args); err != nil {
+			return nil, err
+		}
+		return s.setBreakpoints(args), nil
+
+	case "setExceptionBreakpoints":
+		return nil, nil // there are no exception breakpoints
+
+	case "threads":
+		return &ThreadsResponse{Threads: []Thread{{ID: threadID, Name: "main"}}}, nil
+
+	case "stackTrace":
+		var args StackTraceArguments
+		if err := unmarshalArgs(msg, &args); err != nil {
+			return nil, err
+		}
+		return s.stackTrace(args)
+
+	case "scopes":
+		var args ScopesArguments
+		if err := unmarshalArgs(msg, &args); err != nil {
+			return nil, err
+		}
+		return s.scopes(args)
+
+	case "variables":
+		var args VariablesArguments
+		if err := unmarshalArgs(msg, &args); err != nil {
+			return nil, err
+		}
+		return s.variables(args)
+
+	case "continue":
+		return &ContinueResponse{AllThreadsContinued: true}, s.resume(running)
+
+	case "next":
+		return nil, s.resume(stepOver)
+
+	case "stepIn":
+		return nil, s.resume(stepIn)
+
+	case "stepOut":
+		return nil, s.resume(stepOut)
+
+	case "pause":
+		if s.stopped == nil {
+			s.pausing = true
+		}
+		return nil, nil
+
+	case "terminate", "disconnect":
+		s.cancel()
+		return nil, nil
+	}
+	return nil, fmt.Errorf("unsupported command: %s", msg.Command)
+}
+
+func unmarshalArgs(msg *message, args interface{}) error {
+	if len(msg.Arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(msg.Arguments, args); err != nil {
+		return fmt.Errorf("%s: %v", msg.Command, err)
+	}
+	return nil
+}
+
+// setBreakpoints replaces the breakpoints of a file.  Each breakpoint
+// is moved to the first line at or after the requested one on which
+// a statement begins.
+func (s *server) setBreakpoints(args SetBreakpointsArguments) *SetBreakpointsResponse {
+	filename, lines, err := stmtLines(args.Source.Path)
+	ids := make(map[int]int) // breakpoint IDs, by line
+	resp := &SetBreakpointsResponse{Breakpoints: []Breakpoint{}}
+	for _, req := range args.Breakpoints {
+		bp := Breakpoint{Source: &args.Source, Line: req.Line}
+		line := req.Line - s.lineBase + 1
+		if err != nil {
+			bp.Message = err.Error()
+		} else if i := sort.SearchInts(lines, line); i == len(lines) {
+			bp.Message = "no statement at or after this line"
+		} else {
+			line = lines[i]
+			if ids[line] == 0 {
+				ids[line] = s.nextBpID
+				s.nextBpID++
+			}
+			bp.ID = ids[line]
+			bp.Verified = true
+			bp.Line = line + s.lineBase - 1
+		}
+		resp.Breakpoints = append(resp.Breakpoints, bp)
+	}
+	if err == nil {
+		s.bps[filename] = ids
+	}
+	return resp
+}
+
+// stmtLines returns the absolute name of the specified file and, in
+// order, the lines on which its statements begin.
+func stmtLines(path string) (filename string, lines []int, err error) {
+	filename, err = filepath.Abs(path)
+	if err != nil {
+		return "", nil, err
+	}
+	f, err := syntax.Parse(filename, nil, 0)
+	if f == nil {
+		return "", nil, err
+	}
+	// After a syntax error, use the partial syntax tree.
+	seen := make(map[int]bool)
+	for _, stmt := range f.Stmts {
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			if stmt, ok := n.(syntax.Stmt); ok {
+				start, _ := stmt.Span()
+				if line := int(start.Line); !seen[line] {
+					seen[line] = true
+					lines = append(lines, line)
+				}
+			}
+			return true
+		})
+	}
+	sort.Ints(lines)
+	return filename, lines, nil
+}
@@ -0,0 +1,387 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+)
+
+// A client is an in-process DAP client connected to a server
+// running in another goroutine.
+type client struct {
+	t      *testing.T
+	in     *bufio.Reader
+	out    io.WriteCloser
+	seq    int
+	events []*message // events received but not yet awaited
+	done   chan error // result of serve
+}
+
+func newClient(t *testing.T) *client {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	c := &client{
+		t:    t,
+		in:   bufio.NewReader(clientIn),
+		out:  clientOut,
+		done: make(chan error, 1),
+	}
+	go func() {
+		err := newServer(serverIn, serverOut, config{}).serve()
+		serverOut.Close()
+		c.done <- err
+	}()
+	c.call("initialize", &InitializeArguments{ClientID: "test"}, nil)
+	c.await("initialized")
+	return c
+}
+
+// call sends a request and decodes the body of its response into body.
+// It queues the events received in the meantime.
+func (c *client) call(command string, args, body interface{}) {
+	if err := c.try(command, args, body); err != nil {
+		c.t.Fatalf("%s: %v", command, err)
+	}
+}
+
+// try is like call, but returns the error of a failed request.
+func (c *client) try(command string, args, body interface{}) error {
+	c.seq++
+	req := &message{Seq: c.seq, Type: "request", Command: command}
+	if args != nil {
+		req.Arguments = marshal(c.t, args)
+	}
+	if err := writeMessage(c.out, req); err != nil {
+		c.t.Fatal(err)
+	}
+	for {
+		msg := c.receive()
+		if msg.Type == "event" {
+			c.events = append(c.events, msg)
+			continue
+		}
+		if msg.RequestSeq != req.Seq || msg.Command != command {
+			c.t.Fatalf("%s: got response to request %d (%s)", command, msg.RequestSeq, msg.Command)
+		}
+		if !*msg.Success {
+			return fmt.Errorf("%s", msg.Message)
+		}
+		if body != nil {
+			if err := json.Unmarshal(msg.Body, body); err != nil {
+				c.t.Fatalf("%s: decoding body %s: %v", command, msg.Body, err)
+			}
+		}
+		return nil
+	}
+}
+
+// await returns the next event of the specified kind, discarding
+// any others that precede it.
+func (c *client) await(event string) *message {
+	for {
+		if msg := c.next(); msg.Event == event {
+			return msg
+		}
+	}
+}
+
+// next returns the next event.
+func (c *client) next() *message {
+	if len(c.events) > 0 {
+		msg := c.events[0]
+		c.events = c.events[1:]
+		return msg
+	}
+	for {
+		if msg := c.receive(); msg.Type == "event" {
+			return msg
+		}
+	}
+}
+
+// stopped waits for the program to stop and returns the reason and
+// the innermost frame, as "reason function file:line".
+func (c *client) stopped() string {
+	var stopped StoppedEvent
+	if err := json.Unmarshal(c.await("stopped").Body, &stopped); err != nil {
+		c.t.Fatal(err)
+	}
+	frames := c.stack()
+	return stopped.Reason + " " + frames[0]
+}
+
+// stack returns the stack of the stopped program, innermost first.
+func (c *client) stack() []string {
+	var resp StackTraceResponse
+	c.call("stackTrace", &StackTraceArguments{ThreadID: threadID}, &resp)
+	var frames []string
+	for _, fr := range resp.StackFrames {
+		frames = append(frames, fmt.Sprintf("%s %s:%d", fr.Name, fr.Source.Name, fr.Line))
+	}
+	return frames
+}
+
+// variables returns the variables with the specified reference,
+// as "name = value", followed by " +" if they can be expanded.
+func (c *client) variables(ref int) ([]string, []Variable) {
+	var resp VariablesResponse
+	c.call("variables", &VariablesArguments{VariablesReference: ref}, &resp)
+	var vars []string
+	for _, v := range resp.Variables {
+		s := v.Name + " = " + v.Value
+		if v.VariablesReference != 0 {
+			s += " +"
+		}
+		vars = append(vars, s)
+	}
+	return vars, resp.Variables
+}
+
+// launch launches the program after setting the breakpoints of
+// main.star, and returns their verified lines, or 0 if unverified.
+func (c *client) launch(program string, stopOnEntry bool, lines ...int) []int {
+	args := &SetBreakpointsArguments{Source: Source{Path: program}}
+	for _, line := range lines {
+		args.Breakpoints = append(args.Breakpoints, SourceBreakpoint{Line: line})
+	}
+	var resp SetBreakpointsResponse
+	c.call("setBreakpoints", args, &resp)
+	var verified []int
+	for _, bp := range resp.Breakpoints {
+		if bp.Verified {
+			verified = append(verified, bp.Line)
+		} else {
+			verified = append(verified, 0)
+		}
+	}
+	c.call("launch", &LaunchArguments{Program: program, StopOnEntry: stopOnEntry}, nil)
+	c.call("configurationDone", nil, nil)
+	return verified
+}
+
+// exited waits for the program to finish and returns its output
+// and exit code.
+func (c *client) exited() (string, int) {
+	var output strings.Builder
+	for {
+		msg := c.next()
+		switch msg.Event {
+		case "output":
+			var event OutputEvent
+			json.Unmarshal(msg.Body, &event)
+			output.WriteString(event.Output)
+		case "exited":
+			var event ExitedEvent
+			json.Unmarshal(msg.Body, &event)
+			c.await("terminated")
+			return output.String(), event.ExitCode
+		}
+	}
+}
+
+func (c *client) receive() *message {
+	msg, err := readMessage(c.in)
+	if err != nil {
+		c.t.Fatalf("reading message: %v", err)
+	}
+	return msg
+}
+
+// close disconnects from the server.
+func (c *client) close() {
+	c.call("disconnect", nil, nil)
+	c.out.Close()
+	if err := <-c.done; err != nil {
+		c.t.Errorf("serve: %v", err)
+	}
+}
+
+func marshal(t *testing.T, v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeProgram writes the test program to a temporary directory,
+// and returns the name of its main file.
+func writeProgram(t *testing.T, files map[string]string) (string, func()) {
+	dir, err := ioutil.TempDir("", "starlark-dap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(src), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return filepath.Join(dir, "main.star"), func() { os.RemoveAll(dir) }
+}
+
+var program = map[string]string{
+	"lib.star": `def double(x):
+    y = x * 2
+    return y
+`,
+	"main.star": `load("lib.star", "double")
+
+def f(a):
+    b = double(a)
+    return [b, {"k": (b, b)}]
+
+x = f(1)
+print(x)
+`,
+}
+
+func TestBreakpoints(t *testing.T) {
+	main, cleanup := writeProgram(t, program)
+	defer cleanup()
+	c := newClient(t)
+	defer c.close()
+
+	// A breakpoint on a blank line moves to the next statement.
+	if got, want := c.launch(main, false, 4, 6, 100), []int{4, 7, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("verified breakpoints = %v, want %v", got, want)
+	}
+
+	if got, want := c.stopped(), "breakpoint <toplevel> main.star:7"; got != want {
+		t.Errorf("stopped at %q, want %q", got, want)
+	}
+	c.call("continue", nil, nil)
+	if got, want := c.stopped(), "breakpoint f main.star:4"; got != want {
+		t.Errorf("stopped at %q, want %q", got, want)
+	}
+	if got, want := strings.Join(c.stack(), ", "), "f main.star:4, <toplevel> main.star:7"; got != want {
+		t.Errorf("stack = %s, want %s", got, want)
+	}
+
+	var scopes ScopesResponse
+	c.call("scopes", &ScopesArguments{FrameID: 1}, &scopes)
+	if len(scopes.Scopes) != 2 || scopes.Scopes[0].Name != "Locals" || scopes.Scopes[1].Name != "Globals" {
+		t.Fatalf("scopes = %v", scopes.Scopes)
+	}
+	if got, _ := c.variables(scopes.Scopes[0].VariablesReference); !reflect.DeepEqual(got, []string{"a = 1"}) {
+		t.Errorf("locals = %q", got)
+	}
+	if got, _ := c.variables(scopes.Scopes[1].VariablesReference); !reflect.DeepEqual(got, []string{"double = <function double>", "f = <function f>"}) {
+		t.Errorf("globals = %q", got)
+	}
+
+	c.call("continue", nil, nil)
+	if output, code := c.exited(); output != "[2, {\"k\": (2, 2)}]\n" || code != 0 {
+		t.Errorf("program printed %q and exited with %d", output, code)
+	}
+
+	// Requests that need a stopped program fail.
+	if err := c.try("stackTrace", &StackTraceArguments{ThreadID: threadID}, nil); err == nil || err.Error() != errNotStopped.Error() {
+		t.Errorf("stackTrace of running program: got %v", err)
+	}
+}
+
+func TestStepping(t *testing.T) {
+	main, cleanup := writeProgram(t, program)
+	defer cleanup()
+	c := newClient(t)
+	defer c.close()
+
+	c.launch(main, true)
+	for _, test := range []struct{ command, want string }{
+		{"", "entry <toplevel> main.star:1"},
+		{"stepIn", "step <toplevel> lib.star:1"}, // loaded file
+		{"next", "step <toplevel> main.star:3"},
+		{"next", "step <toplevel> main.star:7"},
+		{"stepIn", "step f main.star:4"},
+		{"stepIn", "step double lib.star:2"},
+		{"stepOut", "step f main.star:5"},
+		{"next", "step <toplevel> main.star:8"},
+	} {
+		if test.command != "" {
+			c.call(test.command, &ThreadArguments{ThreadID: threadID}, nil)
+		}
+		if got := c.stopped(); got != test.want {
+			t.Errorf("after %s, stopped at %q, want %q", test.command, got, test.want)
+		}
+	}
+	c.call("next", &ThreadArguments{ThreadID: threadID}, nil)
+	if _, code := c.exited(); code != 0 {
+		t.Errorf("program exited with %d", code)
+	}
+}
+
+func TestVariables(t *testing.T) {
+	main, cleanup := writeProgram(t, program)
+	defer cleanup()
+	c := newClient(t)
+	defer c.close()
+
+	c.launch(main, false, 8)
+	c.stopped()
+	var scopes ScopesResponse
+	c.call("scopes", &ScopesArguments{FrameID: 1}, &scopes)
+	if len(scopes.Scopes) != 1 || scopes.Scopes[0].Name != "Globals" {
+		t.Fatalf("toplevel scopes = %v", scopes.Scopes)
+	}
+	got, vars := c.variables(scopes.Scopes[0].VariablesReference)
+	if want := []string{`double = <function double>`, `f = <function f>`, `x = [2, {"k": (2, 2)}] +`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("globals = %q, want %q", got, want)
+	}
+	got, vars = c.variables(vars[2].VariablesReference)
+	if want := []string{`[0] = 2`, `[1] = {"k": (2, 2)} +`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("elements of list = %q, want %q", got, want)
+	}
+	got, vars = c.variables(vars[1].VariablesReference)
+	if want := []string{`"k" = (2, 2) +`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("elements of dict = %q, want %q", got, want)
+	}
+	got, _ = c.variables(vars[0].VariablesReference)
+	if want := []string{`[0] = 2`, `[1] = 2`}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("elements of tuple = %q, want %q", got, want)
+	}
+
+	// The deferred disconnect terminates the stopped program.
+}
+
+func TestElements(t *testing.T) {
+	s := starlarkstruct.FromStringDict(starlarkstruct.Default, starlark.StringDict{
+		"b": starlark.String("x"),
+		"a": starlark.NewList(nil),
+	})
+	names, values := elements(s)
+	if got := fmt.Sprint(names, values); got != `[a b] [[] "x"]` {
+		t.Errorf("elements of struct = %s", got)
+	}
+	if names, _ := elements(starlark.String("abc")); names != nil {
+		t.Errorf("elements of string = %v", names)
+	}
+}
+
+func TestError(t *testing.T) {
+	main, cleanup := writeProgram(t, map[string]string{
+		"main.star": "def f(x):\n    return x // 0\nf(1)\n",
+	})
+	defer cleanup()
+	c := newClient(t)
+	defer c.close()
+
+	c.launch(main, false)
+	output, code := c.exited()
+	if !strings.Contains(output, "main.star:2:14: in f\nError: floored division by zero") || code != 1 {
+		t.Errorf("program printed %q and exited with %d", output, code)
+	}
+}
@@ -0,0 +1,658 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file defines the language features of the server, which are
+// computed from the resolved syntax tree of each document.
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// analyze parses and resolves the document, and returns its
+// syntax errors, resolver errors and warnings as diagnostics.
+func (s *server) analyze(doc *document) []Diagnostic {
+	var diags []Diagnostic
+	add := func(pos syntax.Position, severity int, source, code, msg string) {
+		diags = append(diags, Diagnostic{
+			Range:    doc.tokenRange(pos),
+			Severity: severity,
+			Code:     code,
+			Source:   source,
+			Message:  msg,
+		})
+	}
+
+	f, err := syntax.Parse(doc.filename(), doc.text, syntax.RetainComments)
+	switch err := err.(type) {
+	case nil:
+	case syntax.ErrorList:
+		for _, e := range err {
+			add(e.Pos, severityError, "syntax", "", e.Msg)
+		}
+	case syntax.Error:
+		add(err.Pos, severityError, "syntax", "", err.Msg)
+	default:
+		add(syntax.Position{}, severityError, "syntax", "", err.Error())
+	}
+	doc.file = f
+	if f == nil {
+		return diags
+	}
+
+	opts := s.config.dialect
+	opts.Warn = func(w resolve.Error) {
+		add(w.Pos, severityWarning, "resolve", w.Code, w.Msg)
+	}
+	if err := resolve.FileOptions(f, s.isPredeclared, starlark.Universe.Has, &opts); err != nil {
+		for _, e := range err.(resolve.ErrorList) {
+			add(e.Pos, severityError, "resolve", e.Code, e.Msg)
+		}
+	}
+	sort.SliceStable(diags, func(i, j int) bool {
+		x, y := diags[i].Range.Start, diags[j].Range.Start
+		return x.Line < y.Line || x.Line == y.Line && x.Character < y.Character
+	})
+	return diags
+}
+
+func (s *server) isPredeclared(name string) bool {
+	for _, x := range s.config.predeclared {
+		if x == name {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenRange returns the range of the word, or else the single
+// character, at pos.
+func (doc *document) tokenRange(pos syntax.Position) Range {
+	start := doc.position(pos)
+	offset := doc.offset(start)
+	end := offset
+	for end < len(doc.text) {
+		r, size := utf8.DecodeRuneInString(doc.text[end:])
+		if !isIdentRune(r) {
+			break
+		}
+		end += size
+	}
+	if end == offset && end < len(doc.text) && doc.text[end] != '\n' {
+		_, size := utf8.DecodeRuneInString(doc.text[end:])
+		end += size
+	}
+	endPos := start
+	for _, r := range doc.text[offset:end] {
+		endPos.Character += utf16Len(r)
+	}
+	return Range{start, endPos}
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// An identifier's role is determined by its parent node.
+type role int
+
+const (
+	variable  role = iota // a reference to, or binding of, a variable
+	attribute             // the name in x.f
+	loadFrom              // the name of a symbol in a load statement
+	keyword               // the name of a keyword argument
+)
+
+// findIdent returns the identifier at the specified position of the
+// document, its role, and the functions enclosing its scope,
+// innermost first.
+func (doc *document) findIdent(pos Position) (id *syntax.Ident, role role, funcs []*syntax.Function) {
+	if doc.file == nil {
+		return nil, variable, nil
+	}
+	line, col := doc.syntaxPos(pos)
+	var stack []syntax.Node
+	syntax.Walk(doc.file, func(n syntax.Node) bool {
+		if n == nil {
+			stack = stack[:len(stack)-1]
+			return true
+		}
+		if x, ok := n.(*syntax.Ident); ok && id == nil &&
+			x.NamePos.Line == line &&
+			x.NamePos.Col <= col && col <= x.NamePos.Col+int32(utf8.RuneCountInString(x.Name)) {
+			id = x
+			role, funcs = identContext(x, stack)
+		}
+		stack = append(stack, n)
+		return true
+	})
+	return id, role, funcs
+}
+
+// identContext returns the role of id and the functions enclosing its
+// scope, innermost first, given the stack of its ancestors.
+func identContext(id *syntax.Ident, stack []syntax.Node) (role, []*syntax.Function) {
+	role := variable
+	switch parent := stack[len(stack)-1].(type) {
+	case *syntax.DotExpr:
+		if parent.Name == id {
+			role = attribute
+		}
+	case *syntax.LoadStmt:
+		for _, from := range parent.From {
+			if from == id {
+				role = loadFrom
+			}
+		}
+	case *syntax.BinaryExpr:
+		if _, ok := stack[len(stack)-2].(*syntax.CallExpr); ok && parent.Op == syntax.EQ && parent.X == id {
+			role = keyword
+		}
+	}
+
+	var funcs []*syntax.Function
+	for i := len(stack) - 1; i >= 0; i-- {
+		var fn *syntax.Function
+		switch n := stack[i].(type) {
+		case *syntax.DefStmt:
+			fn = &n.Function
+		case *syntax.LambdaExpr:
+			fn = &n.Function
+		default:
+			continue
+		}
+		// The name of a def statement and the default values
+		// of parameters belong to the enclosing scope.
+		var child syntax.Node = id
+		if i+1 < len(stack) {
+			child = stack[i+1]
+		}
+		if def, ok := stack[i].(*syntax.DefStmt); ok && child == def.Name {
+			continue
+		}
+		if param, ok := child.(*syntax.BinaryExpr); ok && isParam(fn, param) && param.X != id {
+			continue
+		}
+		funcs = append(funcs, fn)
+	}
+	return role, funcs
+}
+
+func isParam(fn *syntax.Function, x syntax.Expr) bool {
+	for _, param := range fn.Params {
+		if param == x {
+			return true
+		}
+	}
+	return false
+}
+
+// binding returns the first binding occurrence of the variable
+// referred to by id, given the functions enclosing its scope,
+// or nil if it is not bound in the file.
+func binding(f *syntax.File, id *syntax.Ident, funcs []*syntax.Function) *syntax.Ident {
+	scope, index := resolve.Scope(id.Scope), id.Index
+	for _, fn := range funcs {
+		switch scope {
+		case resolve.Local:
+			return fn.Locals[index]
+		case resolve.Free:
+			free := fn.FreeVars[index]
+			scope, index = resolve.Scope(free.Scope), free.Index
+		default:
+			return globalBinding(f, scope, index)
+		}
+	}
+	if scope == resolve.Local {
+		return f.Locals[index] // local to a comprehension
+	}
+	return globalBinding(f, scope, index)
+}
+
+func globalBinding(f *syntax.File, scope resolve.Scope, index int) *syntax.Ident {
+	if scope == resolve.Global && index < len(f.Globals) {
+		return f.Globals[index]
+	}
+	return nil
+}
+
+// loadOf returns the load statement that binds id, and the name of
+// the symbol in the loaded module.
+func loadOf(f *syntax.File, id *syntax.Ident) (*syntax.LoadStmt, *syntax.Ident) {
+	for _, stmt := range f.Stmts {
+		if load, ok := stmt.(*syntax.LoadStmt); ok {
+			for i, to := range load.To {
+				if to == id {
+					return load, load.From[i]
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// defOf returns the def statement whose name is id, if any.
+func defOf(f *syntax.File, id *syntax.Ident) *syntax.DefStmt {
+	var def *syntax.DefStmt
+	syntax.Walk(f, func(n syntax.Node) bool {
+		if d, ok := n.(*syntax.DefStmt); ok && d.Name == id {
+			def = d
+		}
+		return def == nil
+	})
+	return def
+}
+
+// definition returns the location of the binding of the identifier
+// at pos, following a loaded symbol to its module.
+func (s *server) definition(doc *document, pos Position) *Location {
+	id, role, funcs := doc.findIdent(pos)
+	if id == nil {
+		return nil
+	}
+	switch role {
+	case variable:
+		bind := binding(doc.file, id, funcs)
+		if bind == nil {
+			return nil
+		}
+		if load, from := loadOf(doc.file, bind); load != nil {
+			if loc := s.loadedDefinition(doc, load, from.Name); loc != nil {
+				return loc
+			}
+		}
+		return &Location{URI: doc.uri, Range: doc.identRange(bind)}
+
+	case loadFrom:
+		for _, stmt := range doc.file.Stmts {
+			if load, ok := stmt.(*syntax.LoadStmt); ok {
+				for _, from := range load.From {
+					if from == id {
+						return s.loadedDefinition(doc, load, id.Name)
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadedDefinition returns the location of the top-level binding of
+// name in the module loaded by the specified statement of doc,
+// or nil if the module cannot be found.
+func (s *server) loadedDefinition(doc *document, load *syntax.LoadStmt, name string) *Location {
+	module, _ := load.Module.Value.(string)
+	if module == "" {
+		return nil
+	}
+	filename := module
+	if !filepath.IsAbs(filename) {
+		filename = filepath.Join(filepath.Dir(doc.filename()), filepath.FromSlash(module))
+	}
+	uri := fileURI(filename)
+	target, ok := s.docs[uri]
+	if !ok {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil
+		}
+		target = newDocument(uri, 0, string(data))
+	}
+	f := target.file
+	if f == nil {
+		f, _ = syntax.Parse(filename, target.text, 0)
+		if f == nil {
+			return nil
+		}
+	}
+	for _, stmt := range f.Stmts {
+		for _, id := range boundNames(stmt) {
+			if id.Name == name {
+				return &Location{URI: uri, Range: target.identRange(id)}
+			}
+		}
+	}
+	return nil
+}
+
+// boundNames returns the identifiers bound at top level by stmt.
+func boundNames(stmt syntax.Stmt) []*syntax.Ident {
+	switch stmt := stmt.(type) {
+	case *syntax.DefStmt:
+		return []*syntax.Ident{stmt.Name}
+	case *syntax.AssignStmt:
+		return lhsNames(stmt.LHS, nil)
+	case *syntax.ForStmt:
+		return lhsNames(stmt.Vars, nil)
+	case *syntax.LoadStmt:
+		return stmt.To
+	}
+	return nil
+}
+
+// lhsNames appends to ids the identifiers bound by the assignment
+// to lhs.
+func lhsNames(lhs syntax.Expr, ids []*syntax.Ident) []*syntax.Ident {
+	switch lhs := lhs.(type) {
+	case *syntax.Ident:
+		ids = append(ids, lhs)
+	case *syntax.ParenExpr:
+		ids = lhsNames(lhs.X, ids)
+	case *syntax.TupleExpr:
+		for _, x := range lhs.List {
+			ids = lhsNames(x, ids)
+		}
+	case *syntax.ListExpr:
+		for _, x := range lhs.List {
+			ids = lhsNames(x, ids)
+		}
+	}
+	return ids
+}
+
+// hover describes the identifier at pos: the kind of its binding,
+// and for a function, its signature and doc comment.
+func (s *server) hover(doc *document, pos Position) *Hover {
+	id, role, funcs := doc.findIdent(pos)
+	if id == nil {
+		return nil
+	}
+	var desc string
+	switch role {
+	case attribute:
+		desc = "(attribute) " + id.Name
+		if types := methodTypes(id.Name); types != nil {
+			desc = fmt.Sprintf("(method of %s) %s", strings.Join(types, ", "), id.Name)
+		}
+	case loadFrom:
+		desc = "(loaded symbol) " + id.Name
+	case keyword:
+		desc = "(keyword argument) " + id.Name
+	default:
+		desc = s.describe(doc.file, id, funcs)
+	}
+	text := "```python\n" + desc + "\n```"
+
+	// A function has its signature and doc comment.
+	if bind := binding(doc.file, id, funcs); bind != nil {
+		if def := defOf(doc.file, bind); def != nil {
+			text += "\n```python\n" + signature(def) + "\n```"
+			if doc := docComment(def); doc != "" {
+				text += "\n\n" + doc
+			}
+		}
+	}
+	r := doc.identRange(id)
+	return &Hover{
+		Contents: MarkupContent{Kind: "markdown", Value: text},
+		Range:    &r,
+	}
+}
+
+// describe returns the kind of binding of the variable id.
+func (s *server) describe(f *syntax.File, id *syntax.Ident, funcs []*syntax.Function) string {
+	switch resolve.Scope(id.Scope) {
+	case resolve.Local:
+		if len(funcs) > 0 {
+			bind := funcs[0].Locals[id.Index]
+			for _, param := range funcs[0].Params {
+				if paramName(param) == bind {
+					return "(parameter) " + id.Name
+				}
+			}
+			return "(local variable) " + id.Name
+		}
+		return "(comprehension variable) " + id.Name
+	case resolve.Free:
+		return "(free variable) " + id.Name
+	case resolve.Global:
+		if bind := binding(f, id, funcs); bind != nil {
+			if load, _ := loadOf(f, bind); load != nil {
+				return fmt.Sprintf("(loaded from %s) %s", load.Module.Raw, id.Name)
+			}
+		}
+		return "(global variable) " + id.Name
+	case resolve.Predeclared:
+		return "(predeclared) " + id.Name
+	case resolve.Universal:
+		return "(built-in) " + id.Name
+	}
+	return "(undefined) " + id.Name
+}
+
+// paramName returns the identifier of a function parameter.
+func paramName(param syntax.Expr) *syntax.Ident {
+	switch param := param.(type) {
+	case *syntax.Ident:
+		return param
+	case *syntax.BinaryExpr:
+		id, _ := param.X.(*syntax.Ident)
+		return id
+	case *syntax.UnaryExpr:
+		id, _ := param.X.(*syntax.Ident)
+		return id
+	}
+	return nil // e.g. a bad expression in a partial tree
+}
+
+// signature returns the header of a def statement, in canonical form.
+// Any bad parameters of a partial tree appear as their source text.
+func signature(def *syntax.DefStmt) string {
+	header := &syntax.DefStmt{
+		Def:      def.Def,
+		Name:     def.Name,
+		Function: syntax.Function{Params: def.Function.Params},
+	}
+	header.Function.Body = []syntax.Stmt{&syntax.BranchStmt{Token: syntax.PASS}}
+	text := string(syntax.Format(&syntax.File{Stmts: []syntax.Stmt{header}}))
+	return strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(text), "pass"))
+}
+
+// docComment returns the text of the comments preceding a def
+// statement, or of a string literal that begins its body.
+func docComment(def *syntax.DefStmt) string {
+	if stmt, ok := def.Function.Body[0].(*syntax.ExprStmt); ok {
+		if lit, ok := stmt.X.(*syntax.Literal); ok && lit.Token == syntax.STRING {
+			return strings.TrimSpace(lit.Value.(string))
+		}
+	}
+	var lines []string
+	if comments := def.Comments(); comments != nil {
+		for _, c := range comments.Before {
+			lines = append(lines, strings.TrimSpace(strings.TrimPrefix(c.Text, "#")))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// methods lists the built-in types whose methods are offered
+// for completion.
+var methods = []struct {
+	typ   string
+	names []string
+}{
+	{"string", starlark.String("").AttrNames()},
+	{"list", new(starlark.List).AttrNames()},
+	{"dict", new(starlark.Dict).AttrNames()},
+}
+
+// methodTypes returns the built-in types that have a method of the
+// specified name.
+func methodTypes(name string) []string {
+	var types []string
+	for _, m := range methods {
+		for _, x := range m.names {
+			if x == name {
+				types = append(types, m.typ)
+			}
+		}
+	}
+	return types
+}
+
+// symbols returns the functions and global variables of the document,
+// with nested functions as children.
+func (s *server) symbols(doc *document) []DocumentSymbol {
+	symbols := []DocumentSymbol{}
+	if doc.file == nil {
+		return symbols
+	}
+	seen := make(map[string]bool)
+	for _, stmt := range doc.file.Stmts {
+		switch stmt := stmt.(type) {
+		case *syntax.DefStmt:
+			symbols = append(symbols, doc.defSymbol(stmt))
+		case *syntax.AssignStmt:
+			for _, id := range lhsNames(stmt.LHS, nil) {
+				if !seen[id.Name] {
+					seen[id.Name] = true
+					symbols = append(symbols, DocumentSymbol{
+						Name:           id.Name,
+						Kind:           symbolVariable,
+						Range:          doc.nodeRange(stmt),
+						SelectionRange: doc.identRange(id),
+					})
+				}
+			}
+		}
+	}
+	return symbols
+}
+
+func (doc *document) defSymbol(def *syntax.DefStmt) DocumentSymbol {
+	sym := DocumentSymbol{
+		Name:           def.Name.Name,
+		Detail:         signature(def),
+		Kind:           symbolFunction,
+		Range:          doc.nodeRange(def),
+		SelectionRange: doc.identRange(def.Name),
+	}
+	for _, stmt := range def.Function.Body {
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			if nested, ok := n.(*syntax.DefStmt); ok {
+				sym.Children = append(sym.Children, doc.defSymbol(nested))
+				return false
+			}
+			return true
+		})
+	}
+	return sym
+}
+
+// completion returns the names that may complete the identifier
+// before pos: methods of built-in types after a dot, or else the
+// variables in scope, predeclared names and built-ins.
+func (s *server) completion(doc *document, pos Position) *CompletionList {
+	offset := doc.offset(pos)
+	start := offset
+	for start > 0 {
+		r, size := utf8.DecodeLastRuneInString(doc.text[:start])
+		if !isIdentRune(r) {
+			break
+		}
+		start -= size
+	}
+	prefix := doc.text[start:offset]
+
+	list := &CompletionList{Items: []CompletionItem{}}
+	seen := make(map[string]bool)
+	add := func(name string, kind int, detail string) {
+		if strings.HasPrefix(name, prefix) && !seen[name] {
+			seen[name] = true
+			list.Items = append(list.Items, CompletionItem{Label: name, Kind: kind, Detail: detail})
+		}
+	}
+
+	if start > 0 && doc.text[start-1] == '.' {
+		// A method, of a string if the operand is a string literal.
+		str := start > 1 && strings.ContainsRune(`"'`, rune(doc.text[start-2]))
+		for _, m := range methods {
+			if str && m.typ != "string" {
+				continue
+			}
+			for _, name := range m.names {
+				if types := methodTypes(name); !str && len(types) > 1 {
+					add(name, completionMethod, strings.Join(types, ", ")+" method")
+				} else {
+					add(name, completionMethod, m.typ+" method")
+				}
+			}
+		}
+		sortItems(list.Items)
+		return list
+	}
+
+	// Local variables of the enclosing functions, innermost first.
+	if doc.file != nil {
+		line, col := doc.syntaxPos(pos)
+		for _, fn := range enclosingFuncs(doc.file, line, col) {
+			for _, id := range fn.Locals {
+				add(id.Name, completionVariable, "local variable")
+			}
+		}
+		for _, id := range doc.file.Globals {
+			kind, detail := completionVariable, "global variable"
+			if defOf(doc.file, id) != nil {
+				kind, detail = completionFunction, "function"
+			}
+			add(id.Name, kind, detail)
+		}
+	}
+	for _, name := range s.config.predeclared {
+		add(name, completionVariable, "predeclared")
+	}
+	for name, v := range starlark.Universe {
+		if _, ok := v.(*starlark.Builtin); ok {
+			add(name, completionFunction, "built-in function")
+		} else {
+			add(name, completionConstant, "built-in constant")
+		}
+	}
+	sortItems(list.Items)
+	return list
+}
+
+func sortItems(items []CompletionItem) {
+	sort.Slice(items, func(i, j int) bool { return items[i].Label < items[j].Label })
+}
+
+// enclosingFuncs returns the functions whose bodies enclose the
+// specified position, innermost first.
+func enclosingFuncs(f *syntax.File, line, col int32) []*syntax.Function {
+	var funcs []*syntax.Function
+	syntax.Walk(f, func(n syntax.Node) bool {
+		var fn *syntax.Function
+		switch n := n.(type) {
+		case *syntax.DefStmt:
+			fn = &n.Function
+		case *syntax.LambdaExpr:
+			fn = &n.Function
+		default:
+			return true
+		}
+		start, end := fn.Span()
+		if before(line, col, start) || before(end.Line, end.Col, syntax.Position{Line: line, Col: col}) {
+			return false
+		}
+		funcs = append([]*syntax.Function{fn}, funcs...)
+		return true
+	})
+	return funcs
+}
+
+// before reports whether line:col precedes pos.
+func before(line, col int32, pos syntax.Position) bool {
+	return line < pos.Line || line == pos.Line && col < pos.Col
+}
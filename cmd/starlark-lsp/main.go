@@ -0,0 +1,67 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// The starlark-lsp command is a Language Server Protocol server for
+// Starlark files.  It communicates with the editor over its standard
+// input and output.
+//
+// The server reports syntax errors, resolver errors and resolver
+// warnings as diagnostics, and provides go-to-definition for local
+// and global variables and loaded symbols, hover information
+// describing the binding of each name, document symbols, and the
+// completion of built-in functions and methods of built-in types.
+//
+// The names predeclared by the application that executes the files,
+// and its dialect, are specified by flags:
+//
+//	starlark-lsp -predeclared=glob,select -lambda
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aabbtree77/determinism/resolve"
+)
+
+var predeclared = flag.String("predeclared", "", "comma-separated list of predeclared names")
+
+// The dialect accepts the features named by pragmas in each file,
+// and those enabled by the non-standard dialect flags.
+var dialect = resolve.Options{Pragma: true}
+
+// non-standard dialect flags
+func init() {
+	flag.BoolVar(&dialect.AllowFloat, "fp", false, "allow floating-point numbers")
+	flag.BoolVar(&dialect.AllowSet, "set", false, "allow set data type")
+	flag.BoolVar(&dialect.AllowBytes, "bytes", false, "allow bytes data type")
+	flag.BoolVar(&dialect.AllowLambda, "lambda", false, "allow lambda expressions")
+	flag.BoolVar(&dialect.AllowNestedDef, "nesteddef", false, "allow nested def statements")
+	flag.BoolVar(&dialect.AllowRecursion, "recursion", false, "allow recursive functions")
+	flag.BoolVar(&dialect.AllowWhile, "while", false, "allow while loops")
+	flag.BoolVar(&dialect.AllowToplevelLoops, "toplevelloops", false, "allow loops at top level")
+}
+
+func main() {
+	log.SetPrefix("starlark-lsp: ")
+	log.SetFlags(0)
+	flag.Parse()
+
+	config := config{dialect: dialect}
+	for _, name := range strings.Split(*predeclared, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			config.predeclared = append(config.predeclared, name)
+		}
+	}
+
+	shutdown, err := newServer(os.Stdin, os.Stdout, config).serve()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !shutdown {
+		os.Exit(1) // exit without shutdown
+	}
+}
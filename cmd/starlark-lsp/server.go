@@ -0,0 +1,376 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file defines the server, which dispatches the messages of
+// the protocol and maintains the set of open documents.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"unicode/utf8"
+
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// A config specifies the environment in which the server analyzes
+// Starlark files.
+type config struct {
+	predeclared []string        // names predeclared in every file
+	dialect     resolve.Options // optional language features
+}
+
+// A server is a language server connected to a single client.
+type server struct {
+	in       *bufio.Reader
+	out      io.Writer
+	config   config
+	docs     map[string]*document // open documents, by URI
+	shutdown bool                 // the client has requested shutdown
+}
+
+func newServer(in io.Reader, out io.Writer, config config) *server {
+	return &server{
+		in:     bufio.NewReader(in),
+		out:    out,
+		config: config,
+		docs:   make(map[string]*document),
+	}
+}
+
+// serve reads and handles messages until the client sends exit or
+// closes the connection.  It reports whether the client requested
+// shutdown before exiting.
+func (s *server) serve() (bool, error) {
+	for {
+		msg, err := readMessage(s.in)
+		if err == io.EOF {
+			return s.shutdown, nil
+		} else if err != nil {
+			if rpcErr, ok := err.(*rpcError); ok {
+				s.reply(nil, nil, rpcErr)
+				continue
+			}
+			return s.shutdown, err
+		}
+		if msg.Method == "exit" {
+			return s.shutdown, nil
+		}
+		result, err := s.safeHandle(msg)
+		if msg.ID == nil {
+			continue // a notification has no response
+		}
+		if err != nil {
+			rpcErr, ok := err.(*rpcError)
+			if !ok {
+				rpcErr = &rpcError{codeInternalError, err.Error()}
+			}
+			err = s.reply(msg.ID, nil, rpcErr)
+		} else {
+			err = s.reply(msg.ID, result, nil)
+		}
+		if err != nil {
+			return s.shutdown, err
+		}
+	}
+}
+
+// safeHandle calls handle, reporting a panic as an internal error
+// so that a single bad request does not bring down the server.
+func (s *server) safeHandle(msg *message) (result interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			result, err = nil, &rpcError{codeInternalError, fmt.Sprintf("%s: %v", msg.Method, r)}
+		}
+	}()
+	return s.handle(msg)
+}
+
+// reply sends the response to the request with the specified ID.
+func (s *server) reply(id *json.RawMessage, result interface{}, rpcErr *rpcError) error {
+	msg := &message{ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		data, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		msg.Result = data
+	}
+	return writeMessage(s.out, msg)
+}
+
+// notify sends a notification to the client.
+func (s *server) notify(method string, params interface{}) error {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	return writeMessage(s.out, &message{Method: method, Params: data})
+}
+
+// handle handles a request or notification and returns its result.
+func (s *server) handle(msg *message) (interface{}, error) {
+	switch msg.Method {
+	case "initialize":
+		return &InitializeResult{
+			Capabilities: ServerCapabilities{
+				TextDocumentSync:       1,
+				HoverProvider:          true,
+				DefinitionProvider:     true,
+				DocumentSymbolProvider: true,
+				CompletionProvider:     &CompletionOptions{TriggerCharacters: []string{"."}},
+			},
+			ServerInfo: &ServerInfo{Name: "starlark-lsp"},
+		}, nil
+
+	case "initialized", "$/cancelRequest", "textDocument/didSave":
+		return nil, nil
+
+	case "shutdown":
+		s.shutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params DidOpenTextDocumentParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc := newDocument(params.TextDocument.URI, params.TextDocument.Version, params.TextDocument.Text)
+		s.docs[doc.uri] = doc
+		return nil, s.publishDiagnostics(doc)
+
+	case "textDocument/didChange":
+		var params DidChangeTextDocumentParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		text := doc.text
+		for _, change := range params.ContentChanges {
+			if change.Range == nil {
+				text = change.Text
+			} else {
+				// Each change applies to the result of the previous one.
+				cur := newDocument(doc.uri, 0, text)
+				start, end := cur.offset(change.Range.Start), cur.offset(change.Range.End)
+				text = text[:start] + change.Text + text[end:]
+			}
+		}
+		doc = newDocument(doc.uri, params.TextDocument.Version, text)
+		s.docs[doc.uri] = doc
+		return nil, s.publishDiagnostics(doc)
+
+	case "textDocument/didClose":
+		var params DidCloseTextDocumentParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		delete(s.docs, params.TextDocument.URI)
+		// Clear the document's diagnostics.
+		return nil, s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+			URI:         params.TextDocument.URI,
+			Diagnostics: []Diagnostic{},
+		})
+
+	case "textDocument/definition":
+		var params TextDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		loc := s.definition(doc, params.Position)
+		if loc == nil {
+			return nil, nil
+		}
+		return loc, nil
+
+	case "textDocument/hover":
+		var params TextDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		hover := s.hover(doc, params.Position)
+		if hover == nil {
+			return nil, nil
+		}
+		return hover, nil
+
+	case "textDocument/documentSymbol":
+		var params DocumentSymbolParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return s.symbols(doc), nil
+
+	case "textDocument/completion":
+		var params TextDocumentPositionParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, err := s.document(params.TextDocument.URI)
+		if err != nil {
+			return nil, err
+		}
+		return s.completion(doc, params.Position), nil
+	}
+	return nil, &rpcError{codeMethodNotFound, "method not supported: " + msg.Method}
+}
+
+func unmarshalParams(msg *message, params interface{}) error {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &rpcError{codeInvalidParams, fmt.Sprintf("%s: %v", msg.Method, err)}
+	}
+	return nil
+}
+
+// document returns the open document with the specified URI.
+func (s *server) document(uri string) (*document, error) {
+	doc, ok := s.docs[uri]
+	if !ok {
+		return nil, &rpcError{codeInvalidParams, "document not open: " + uri}
+	}
+	return doc, nil
+}
+
+// publishDiagnostics analyzes the document and sends its diagnostics
+// to the client.
+func (s *server) publishDiagnostics(doc *document) error {
+	diags := s.analyze(doc)
+	if diags == nil {
+		diags = []Diagnostic{} // the client expects an array
+	}
+	return s.notify("textDocument/publishDiagnostics", &PublishDiagnosticsParams{
+		URI:         doc.uri,
+		Version:     doc.version,
+		Diagnostics: diags,
+	})
+}
+
+// A document is the text of a Starlark file, as seen by the client,
+// along with its syntax tree, which is resolved by analyze.
+type document struct {
+	uri     string
+	version int
+	text    string
+	lines   []int        // offset of the start of each line
+	file    *syntax.File // possibly partial syntax tree, or nil
+}
+
+func newDocument(uri string, version int, text string) *document {
+	lines := []int{0}
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\n' {
+			lines = append(lines, i+1)
+		}
+	}
+	return &document{uri: uri, version: version, text: text, lines: lines}
+}
+
+// filename returns the name of the document's file.
+func (doc *document) filename() string {
+	if u, err := url.Parse(doc.uri); err == nil && u.Scheme == "file" {
+		return filepath.FromSlash(u.Path)
+	}
+	return doc.uri
+}
+
+// fileURI returns the URI of the named file.
+func fileURI(filename string) string {
+	u := url.URL{Scheme: "file", Path: filepath.ToSlash(filename)}
+	return u.String()
+}
+
+// line returns the text of the specified zero-based line,
+// without its newline.
+func (doc *document) line(line int) (start int, text string) {
+	if line < 0 {
+		return 0, ""
+	}
+	if line >= len(doc.lines) {
+		return len(doc.text), ""
+	}
+	start, end := doc.lines[line], len(doc.text)
+	if line+1 < len(doc.lines) {
+		end = doc.lines[line+1] - 1
+	}
+	return start, doc.text[start:end]
+}
+
+// utf16Len returns the number of UTF-16 code units that encode r.
+func utf16Len(r rune) int {
+	if r >= 0x10000 {
+		return 2
+	}
+	return 1
+}
+
+// position converts a syntax position to a protocol position.
+func (doc *document) position(pos syntax.Position) Position {
+	line := int(pos.Line) - 1
+	_, text := doc.line(line)
+	char, col := 0, 1
+	for _, r := range text {
+		if col >= int(pos.Col) {
+			break
+		}
+		char += utf16Len(r)
+		col++
+	}
+	return Position{Line: line, Character: char}
+}
+
+// offset converts a protocol position to a byte offset in the text.
+func (doc *document) offset(pos Position) int {
+	start, text := doc.line(pos.Line)
+	char := 0
+	for i, r := range text {
+		if char >= pos.Character {
+			return start + i
+		}
+		char += utf16Len(r)
+	}
+	return start + len(text)
+}
+
+// syntaxPos converts a protocol position to the line and column of
+// a syntax position.
+func (doc *document) syntaxPos(pos Position) (line, col int32) {
+	start, _ := doc.line(pos.Line)
+	col = int32(utf8.RuneCountInString(doc.text[start:doc.offset(pos)])) + 1
+	return int32(pos.Line) + 1, col
+}
+
+// identRange returns the range of the identifier id.
+func (doc *document) identRange(id *syntax.Ident) Range {
+	start := doc.position(id.NamePos)
+	end := id.NamePos
+	end.Col += int32(utf8.RuneCountInString(id.Name))
+	return Range{start, doc.position(end)}
+}
+
+// nodeRange returns the range of the syntax node n.
+func (doc *document) nodeRange(n syntax.Node) Range {
+	start, end := n.Span()
+	return Range{doc.position(start), doc.position(end)}
+}
@@ -0,0 +1,393 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism/resolve"
+)
+
+// A client is an in-process LSP client connected to a server
+// running in another goroutine.
+type client struct {
+	t      *testing.T
+	in     *bufio.Reader
+	out    io.WriteCloser
+	nextID int
+	done   chan error // result of serve
+}
+
+func newClient(t *testing.T, config config) *client {
+	serverIn, clientOut := io.Pipe()
+	clientIn, serverOut := io.Pipe()
+	c := &client{
+		t:    t,
+		in:   bufio.NewReader(clientIn),
+		out:  clientOut,
+		done: make(chan error, 1),
+	}
+	go func() {
+		_, err := newServer(serverIn, serverOut, config).serve()
+		serverOut.Close()
+		c.done <- err
+	}()
+	c.call("initialize", struct{}{}, nil)
+	c.notify("initialized", struct{}{})
+	return c
+}
+
+// call sends a request and decodes its result into result.
+// It discards the notifications received in the meantime.
+func (c *client) call(method string, params, result interface{}) {
+	c.nextID++
+	id := json.RawMessage(fmt.Sprint(c.nextID))
+	c.send(&message{ID: &id, Method: method, Params: marshal(c.t, params)})
+	for {
+		msg := c.receive()
+		if msg.ID == nil {
+			continue // notification
+		}
+		if string(*msg.ID) != string(id) {
+			c.t.Fatalf("%s: got response to request %s, want %s", method, *msg.ID, id)
+		}
+		if msg.Error != nil {
+			c.t.Fatalf("%s: %v", method, msg.Error)
+		}
+		if result != nil {
+			if err := json.Unmarshal(msg.Result, result); err != nil {
+				c.t.Fatalf("%s: decoding result %s: %v", method, msg.Result, err)
+			}
+		}
+		return
+	}
+}
+
+// notify sends a notification.
+func (c *client) notify(method string, params interface{}) {
+	c.send(&message{Method: method, Params: marshal(c.t, params)})
+}
+
+// open opens a document and returns its diagnostics.
+func (c *client) open(uri, text string) []Diagnostic {
+	c.notify("textDocument/didOpen", &DidOpenTextDocumentParams{
+		TextDocument: TextDocumentItem{URI: uri, LanguageID: "starlark", Version: 1, Text: text},
+	})
+	return c.awaitDiagnostics(uri)
+}
+
+// awaitDiagnostics reads messages until the server publishes the
+// diagnostics of the specified document.
+func (c *client) awaitDiagnostics(uri string) []Diagnostic {
+	for {
+		msg := c.receive()
+		if msg.Method == "textDocument/publishDiagnostics" {
+			var params PublishDiagnosticsParams
+			if err := json.Unmarshal(msg.Params, &params); err != nil {
+				c.t.Fatal(err)
+			}
+			if params.URI == uri {
+				return params.Diagnostics
+			}
+		}
+	}
+}
+
+func (c *client) send(msg *message) {
+	if err := writeMessage(c.out, msg); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) receive() *message {
+	msg, err := readMessage(c.in)
+	if err != nil {
+		c.t.Fatalf("reading message: %v", err)
+	}
+	return msg
+}
+
+// close shuts the server down.
+func (c *client) close() {
+	c.call("shutdown", nil, nil)
+	c.notify("exit", nil)
+	if err := <-c.done; err != nil {
+		c.t.Errorf("serve: %v", err)
+	}
+}
+
+func marshal(t *testing.T, v interface{}) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// at returns the position of the nth occurrence (from 1) of substr
+// in text, plus offset characters.
+func at(text, substr string, n, offset int) Position {
+	i := -1
+	for ; n > 0; n-- {
+		j := strings.Index(text[i+1:], substr)
+		if j < 0 {
+			panic("no occurrence of " + substr)
+		}
+		i += 1 + j
+	}
+	i += offset
+	line := strings.Count(text[:i], "\n")
+	return Position{Line: line, Character: i - strings.LastIndex(text[:i], "\n") - 1}
+}
+
+func position(uri string, pos Position) *TextDocumentPositionParams {
+	return &TextDocumentPositionParams{
+		TextDocument: TextDocumentIdentifier{URI: uri},
+		Position:     pos,
+	}
+}
+
+const uri = "file:///work/main.star"
+
+func TestDiagnostics(t *testing.T) {
+	c := newClient(t, config{predeclared: []string{"glob"}})
+	defer c.close()
+
+	const src = `def f(x):
+    y = 1
+    return x + z
+
+def g(:
+    pass
+
+w = glob("*") + λ
+`
+	var got []string
+	for _, d := range c.open(uri, src) {
+		got = append(got, fmt.Sprintf("%d:%d-%d:%d %d %s %s: %s",
+			d.Range.Start.Line, d.Range.Start.Character, d.Range.End.Line, d.Range.End.Character,
+			d.Severity, d.Source, d.Code, d.Message))
+	}
+	want := []string{
+		"1:4-1:5 2 resolve unused-local: local variable y is assigned but never used",
+		"2:15-2:16 1 resolve undefined: undefined: z",
+		"4:7-4:7 1 syntax : got ':', want ')'",
+		"7:16-7:17 1 resolve undefined: undefined: λ",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("diagnostics:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+
+	// A change that fixes the errors clears the diagnostics.
+	c.notify("textDocument/didChange", &DidChangeTextDocumentParams{
+		TextDocument:   VersionedTextDocumentIdentifier{URI: uri, Version: 2},
+		ContentChanges: []TextDocumentContentChangeEvent{{Text: "x = 1\n"}},
+	})
+	if diags := c.awaitDiagnostics(uri); len(diags) != 0 {
+		t.Errorf("after change, diagnostics = %v, want none", diags)
+	}
+}
+
+func TestDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "starlark-lsp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	const lib = "# The library.\n\ndef helper():\n    pass\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "lib.star"), []byte(lib), 0666); err != nil {
+		t.Fatal(err)
+	}
+	uri := fileURI(filepath.Join(dir, "main.star"))
+	libURI := fileURI(filepath.Join(dir, "lib.star"))
+
+	c := newClient(t, config{dialect: resolve.Options{AllowNestedDef: true}})
+	defer c.close()
+	const src = `load("lib.star", "helper", h="helper")
+
+G = 1
+
+def f(a, b=G):
+    c = [a for a in b]
+    def inner():
+        return c
+    return inner, a, G, helper, h, len
+`
+	c.open(uri, src)
+
+	for _, test := range []struct {
+		pos  Position
+		want string // uri:line:char, or "" for no definition
+	}{
+		{at(src, "a, G, helper", 1, 0), uri + ":4:6"}, // parameter
+		{at(src, "c\n", 1, 0), uri + ":5:4"},          // free variable
+		{at(src, "a for", 1, 0), uri + ":5:15"},       // comprehension variable
+		{at(src, "b=G", 1, 2), uri + ":2:0"},          // global, in a default value
+		{at(src, "G, helper", 1, 0), uri + ":2:0"},    // global
+		{at(src, "inner, a", 1, 0), uri + ":6:8"},     // nested function
+		{at(src, "helper, h", 1, 1), libURI + ":2:4"}, // loaded symbol
+		{at(src, "h, len", 1, 0), libURI + ":2:4"},    // renamed loaded symbol
+		{at(src, `"helper"`, 1, 1), libURI + ":2:4"},  // load statement
+		{at(src, "len", 1, 0), ""},                    // built-in
+	} {
+		var loc *Location
+		c.call("textDocument/definition", position(uri, test.pos), &loc)
+		got := ""
+		if loc != nil {
+			got = fmt.Sprintf("%s:%d:%d", loc.URI, loc.Range.Start.Line, loc.Range.Start.Character)
+		}
+		if got != test.want {
+			t.Errorf("definition at %v = %q, want %q", test.pos, got, test.want)
+		}
+	}
+}
+
+func TestHover(t *testing.T) {
+	c := newClient(t, config{predeclared: []string{"glob"}})
+	defer c.close()
+	const src = `load("lib.star", "x")
+
+# f returns its argument.
+def f(a, b=1):
+    c = a
+    return c.upper(), glob, len, x, f(a, b=b)
+`
+	c.open(uri, src)
+
+	for _, test := range []struct {
+		pos  Position
+		want string
+	}{
+		{at(src, "a\n", 1, 0), "(parameter) a"},
+		{at(src, "c.upper", 1, 0), "(local variable) c"},
+		{at(src, "upper", 1, 0), "(method of string) upper"},
+		{at(src, "glob", 1, 0), "(predeclared) glob"},
+		{at(src, "len", 1, 0), "(built-in) len"},
+		{at(src, "x, f", 1, 0), `(loaded from "lib.star") x`},
+		{at(src, "f(a", 1, 0), "(global variable) f\n```\n```python\ndef f(a, b=1):\n```\n\nf returns its argument."},
+		{at(src, "b=b", 1, 0), "(keyword argument) b"},
+	} {
+		var hover *Hover
+		c.call("textDocument/hover", position(uri, test.pos), &hover)
+		if hover == nil {
+			t.Errorf("no hover at %v", test.pos)
+			continue
+		}
+		got := strings.TrimSuffix(strings.TrimPrefix(hover.Contents.Value, "```python\n"), "\n```")
+		if got != test.want {
+			t.Errorf("hover at %v = %q, want %q", test.pos, got, test.want)
+		}
+	}
+}
+
+func TestSymbols(t *testing.T) {
+	c := newClient(t, config{dialect: resolve.Options{AllowNestedDef: true}})
+	defer c.close()
+	const src = `x, y = 1, 2
+
+def f(a):
+    def g():
+        pass
+    return g
+`
+	c.open(uri, src)
+
+	var symbols []DocumentSymbol
+	c.call("textDocument/documentSymbol", &DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols)
+	var got []string
+	var visit func(prefix string, symbols []DocumentSymbol)
+	visit = func(prefix string, symbols []DocumentSymbol) {
+		for _, sym := range symbols {
+			got = append(got, fmt.Sprintf("%s%s %d %d:%d", prefix, sym.Name, sym.Kind,
+				sym.SelectionRange.Start.Line, sym.SelectionRange.Start.Character))
+			visit(prefix+sym.Name+".", sym.Children)
+		}
+	}
+	visit("", symbols)
+	if want := "x 13 0:0, y 13 0:3, f 12 2:4, f.g 12 3:8"; strings.Join(got, ", ") != want {
+		t.Errorf("symbols = %s, want %s", strings.Join(got, ", "), want)
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	c := newClient(t, config{predeclared: []string{"glob"}})
+	defer c.close()
+	const src = `def f(param):
+    s = "abc".
+    return param.
+    l
+`
+	c.open(uri, src)
+
+	complete := func(pos Position) map[string]string {
+		var list CompletionList
+		c.call("textDocument/completion", position(uri, pos), &list)
+		items := make(map[string]string)
+		for _, item := range list.Items {
+			items[item.Label] = item.Detail
+		}
+		return items
+	}
+
+	// After a string literal, only string methods.
+	items := complete(at(src, `".`, 1, 2))
+	if items["split"] != "string method" || items["append"] != "" {
+		t.Errorf("string completions = %v", items)
+	}
+
+	// After another operand, methods of all types.
+	items = complete(at(src, "param.", 1, 6))
+	if items["append"] != "list method" || items["keys"] != "dict method" || items["pop"] != "list, dict method" {
+		t.Errorf("method completions = %v", items)
+	}
+
+	// Otherwise, names in scope with the prefix.
+	items = complete(at(src, "l\n", 1, 1))
+	if items["len"] != "built-in function" || items["list"] != "built-in function" || items["glob"] != "" || items["s"] != "" {
+		t.Errorf("name completions = %v", items)
+	}
+	items = complete(at(src, "return", 1, 0))
+	if items["param"] != "local variable" || items["f"] != "function" || items["glob"] != "predeclared" || items["None"] != "built-in constant" {
+		t.Errorf("name completions = %v", items)
+	}
+}
+
+// TestMalformed checks that the server answers requests about a file
+// whose syntax errors leave bad nodes in the tree.
+func TestMalformed(t *testing.T) {
+	c := newClient(t, config{})
+	defer c.close()
+	const src = `def f(x, y=g(,)):
+    return x
+
+f(1)
+`
+	if diags := c.open(uri, src); len(diags) == 0 {
+		t.Errorf("no diagnostics for malformed file")
+	}
+
+	var symbols []DocumentSymbol
+	c.call("textDocument/documentSymbol", &DocumentSymbolParams{TextDocument: TextDocumentIdentifier{URI: uri}}, &symbols)
+	if len(symbols) != 1 || symbols[0].Name != "f" {
+		t.Errorf("symbols = %v, want f", symbols)
+	}
+
+	var hover *Hover
+	c.call("textDocument/hover", position(uri, at(src, "f(1", 1, 0)), &hover)
+	if hover == nil {
+		t.Fatalf("no hover for f")
+	}
+	if want := "def f(x, y=g("; !strings.Contains(hover.Contents.Value, want) {
+		t.Errorf("hover = %q, want it to contain %q", hover.Contents.Value, want)
+	}
+}
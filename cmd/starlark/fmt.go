@@ -0,0 +1,159 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package main
+
+// This file defines the fmt subcommand, which prints Starlark files
+// in canonical form.
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/aabbtree77/determinism/repl"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+const fmtUsage = `usage: starlark fmt [-w] [-d] [files...]
+
+Fmt prints the canonical form of each Starlark file, or of the
+standard input if no files are given.
+`
+
+// fmtMain runs the fmt subcommand with the specified arguments and
+// returns the exit status.
+func fmtMain(args []string) int {
+	flags := flag.NewFlagSet("fmt", flag.ExitOnError)
+	write := flags.Bool("w", false, "write result to (source) file instead of standard output")
+	diff := flags.Bool("d", false, "display diffs instead of rewriting files")
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, fmtUsage)
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "starlark fmt: cannot use -w with standard input")
+			return 2
+		}
+		src, err := ioutil.ReadAll(os.Stdin)
+		if err == nil {
+			err = formatFile("<stdin>", src, false, *diff)
+		}
+		if err != nil {
+			repl.PrintError(err)
+			return 1
+		}
+		return 0
+	}
+
+	status := 0
+	for _, filename := range flags.Args() {
+		src, err := ioutil.ReadFile(filename)
+		if err == nil {
+			err = formatFile(filename, src, *write, *diff)
+		}
+		if err != nil {
+			repl.PrintError(err)
+			status = 1
+		}
+	}
+	return status
+}
+
+// formatFile formats the contents src of the named file, and either
+// writes the result back to the file, displays the differences, or
+// prints the result.
+func formatFile(filename string, src []byte, write, diff bool) error {
+	f, err := syntax.Parse(filename, src, syntax.RetainComments)
+	if err != nil {
+		return err
+	}
+	res := syntax.Format(f)
+	if bytes.Equal(src, res) {
+		if !write && !diff {
+			_, err = os.Stdout.Write(res)
+		}
+		return err
+	}
+
+	if write {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filename, res, info.Mode().Perm()); err != nil {
+			return err
+		}
+	}
+	if diff {
+		d, err := diffBytes(filename, src, res)
+		if err != nil {
+			return fmt.Errorf("computing diff: %s", err)
+		}
+		os.Stdout.Write(d)
+	}
+	if !write && !diff {
+		_, err = os.Stdout.Write(res)
+	}
+	return err
+}
+
+// diffBytes returns the unified diff of the original contents a and
+// the formatted contents b of the named file, computed by the diff
+// command.
+func diffBytes(filename string, a, b []byte) ([]byte, error) {
+	fa, err := writeTemp("starlark-fmt", a)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fa)
+	fb, err := writeTemp("starlark-fmt", b)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(fb)
+
+	data, err := exec.Command("diff", "-u", fa, fb).Output()
+	if len(data) > 0 {
+		// diff exits with a non-zero status when the files differ.
+		return relabel(data, filename), nil
+	}
+	return data, err
+}
+
+// writeTemp writes data to a new temporary file and returns its name.
+func writeTemp(prefix string, data []byte) (string, error) {
+	f, err := ioutil.TempFile("", prefix)
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	_, err = f.Write(data)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		os.Remove(name)
+		return "", err
+	}
+	return name, nil
+}
+
+// relabel replaces the two header lines of the output of diff -u,
+// which name the temporary files, by ones that name the file.
+func relabel(diff []byte, filename string) []byte {
+	for i := 0; i < 2; i++ {
+		if j := bytes.IndexByte(diff, '\n'); j >= 0 {
+			diff = diff[j+1:]
+		}
+	}
+	header := fmt.Sprintf("--- %s.orig\n+++ %s\n", filename, filename)
+	return append([]byte(header), diff...)
+}
@@ -4,6 +4,9 @@
 
 // The starlark command interprets a Starlark file.
 // With no arguments, it starts a read-eval-print loop (REPL).
+//
+// The command 'starlark fmt [-w] [-d] [files...]' instead prints
+// the files in canonical form.
 package main
 
 import (
@@ -18,25 +21,40 @@ import (
 	"github.com/aabbtree77/determinism"
 	"github.com/aabbtree77/determinism/repl"
 	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarktrace"
 )
 
 // flags
 var (
 	cpuprofile = flag.String("cpuprofile", "", "gather CPU profile in this file")
 	showenv    = flag.Bool("showenv", false, "on success, print final global environment")
+	bytecode   = flag.Bool("bytecode", false, "execute the file using the bytecode interpreter")
+	tracefile  = flag.String("trace", "", "write a Chrome trace of Starlark execution to this file")
+	profile    = flag.String("starlark_profile", "", "gather Starlark-level profile in this file")
 )
 
+// The dialect accepts the features named by pragmas in each file,
+// and those enabled by the non-standard dialect flags.
+var dialect = resolve.Options{Pragma: true}
+
 // non-standard dialect flags
 func init() {
-	flag.BoolVar(&resolve.AllowFloat, "fp", resolve.AllowFloat, "allow floating-point numbers")
-	flag.BoolVar(&resolve.AllowSet, "set", resolve.AllowSet, "allow set data type")
-	flag.BoolVar(&resolve.AllowLambda, "lambda", resolve.AllowLambda, "allow lambda expressions")
-	flag.BoolVar(&resolve.AllowNestedDef, "nesteddef", resolve.AllowNestedDef, "allow nested def statements")
+	flag.BoolVar(&dialect.AllowFloat, "fp", false, "allow floating-point numbers")
+	flag.BoolVar(&dialect.AllowSet, "set", false, "allow set data type")
+	flag.BoolVar(&dialect.AllowBytes, "bytes", false, "allow bytes data type")
+	flag.BoolVar(&dialect.AllowLambda, "lambda", false, "allow lambda expressions")
+	flag.BoolVar(&dialect.AllowNestedDef, "nesteddef", false, "allow nested def statements")
+	flag.BoolVar(&dialect.AllowRecursion, "recursion", false, "allow recursive functions")
+	flag.BoolVar(&dialect.AllowWhile, "while", false, "allow while loops")
+	flag.BoolVar(&dialect.AllowToplevelLoops, "toplevelloops", false, "allow loops at top level")
 }
 
 func main() {
 	log.SetPrefix("starlark: ")
 	log.SetFlags(0)
+	if len(os.Args) > 1 && os.Args[1] == "fmt" {
+		os.Exit(fmtMain(os.Args[2:]))
+	}
 	flag.Parse()
 
 	if *cpuprofile != "" {
@@ -50,20 +68,37 @@ func main() {
 		defer pprof.StopCPUProfile()
 	}
 
-	thread := &starlark.Thread{Load: repl.MakeLoad()}
+	thread := &starlark.Thread{Load: repl.MakeLoadOptions(&dialect)}
+	stopTrace := func() {}
+	if *tracefile != "" {
+		stopTrace = startTrace(thread, *tracefile)
+	}
+	defer stopTrace()
+
+	stopProfile := func() {}
+	if *profile != "" {
+		stopProfile = startProfile(*profile)
+	}
+	defer stopProfile()
 	globals := make(starlark.StringDict)
 
 	switch len(flag.Args()) {
 	case 0:
 		fmt.Println("Welcome to Starlark (github.com/aabbtree77/starlark)")
-		repl.REPL(thread, globals)
+		repl.REPLOptions(thread, globals, &dialect)
 	case 1:
 		// Execute specified file.
 		filename := flag.Args()[0]
+		opts := starlark.ExecOptions{Thread: thread, Filename: filename, Dialect: &dialect}
+		if *bytecode {
+			opts.Engine = starlark.Bytecode
+		}
 		var err error
-		globals, err = starlark.ExecFile(thread, filename, nil, nil)
+		globals, err = starlark.Exec(opts)
 		if err != nil {
 			repl.PrintError(err)
+			stopTrace()
+			stopProfile()
 			os.Exit(1)
 		}
 	default:
@@ -84,3 +119,44 @@ func main() {
 		}
 	}
 }
+
+// startTrace starts writing a Chrome trace of the execution of the
+// thread, and of the threads that load modules for it, to the named
+// file.  It returns a function that completes the trace.
+func startTrace(thread *starlark.Thread, filename string) (stop func()) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tracer := starlarktrace.NewChromeTracer(f)
+	thread.Trace = tracer.Trace
+	return func() {
+		if err := tracer.Close(); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+// startProfile starts recording a Starlark-level profile in the
+// format of pprof in the named file.  It returns a function that
+// completes the profile.
+func startProfile(filename string) (stop func()) {
+	f, err := os.Create(filename)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := starlark.StartProfile(f); err != nil {
+		log.Fatal(err)
+	}
+	return func() {
+		if err := starlark.StopProfile(); err != nil {
+			log.Fatal(err)
+		}
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
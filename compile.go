@@ -0,0 +1,898 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the compiler that translates a resolved syntax
+// tree into the bytecode executed by the virtual machine in interp.go.
+//
+// The tree-walking evaluator in eval.go is the reference
+// implementation, and the two engines must agree not only on results
+// but on errors, backtraces, step counts and allocation estimates.
+// So the compiler emits instructions that perform the evaluator's
+// checks in the same order, and the machine implements them by
+// calling the same helpers (getIndex, binary, callValue, and so on).
+//
+// The machine is a stack machine.  Each instruction is an opcode byte,
+// followed, for opcodes at or above opArgMin, by a 4-byte little-endian
+// operand.  Instructions that may fail record the source position to
+// report in a table sorted by program counter.
+
+import (
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// An opcode is a bytecode instruction.  The comment beside each one
+// shows its effect on the operand stack, whose top is on the right.
+type opcode uint8
+
+const (
+	opPop      opcode = iota // x POP -
+	opDup                    // x DUP x x
+	opDup2                   // x y DUP2 x y x y
+	opExch                   // x y EXCH y x
+	opRot                    // x y z ROT z x y
+	opNone                   // - NONE None
+	opTick                   // - TICK -  (counts a computation step)
+	opIterPush               // iterable ITERPUSH -  (pushes its iterator on the iterator stack)
+	opIterPop                // - ITERPOP -  (pops the innermost iterator and calls Done)
+	opReturn                 // x RETURN
+	opIndex                  // x y INDEX x[y]
+	opSetIndex               // z x y SETINDEX -  (x[y] = z)
+	opSlice                  // x lo hi step SLICE x[lo:hi:step]
+	opMakeDict               // - MAKEDICT dict
+	opCharge                 // x CHARGE x  (charges the size of x to the thread)
+	opAppend                 // list x APPEND list
+	opSetDict                // dict k v SETDICT dict
+	opStarArgs               // iterable STARARGS tuple  (the *args of a call)
+	opKwargs                 // dict KWARGS items  (the **kwargs of a call)
+
+	// opcodes with an operand must go below this line
+
+	opJmp         // - JMP<addr> -
+	opIfTrue      // x IFTRUE<addr> -
+	opIfFalse     // x IFFALSE<addr> -
+	opIterJmp     // - ITERJMP<addr> elem  (or jumps, if the iterator is exhausted)
+	opConstant    // - CONSTANT<index> value
+	opLocal       // - LOCAL<ident> value
+	opFree        // - FREE<index> value
+	opGlobal      // - GLOBAL<ident> value
+	opLookup      // - LOOKUP<ident> value  (a predeclared or universal name)
+	opSetLocal    // value SETLOCAL<index> -
+	opSetGlobal   // value SETGLOBAL<index> -
+	opUnary       // x UNARY<op> (op x)
+	opBinary      // x y BINARY<op> (x op y)
+	opCompare     // x y COMPARE<op> (x op y)
+	opInplace     // x y INPLACE<op> (x op= y)
+	opMakeList    // x1 ... xn MAKELIST<n> list
+	opMakeTuple   // x1 ... xn MAKETUPLE<n> tuple
+	opSetDictUniq // dict k v SETDICTUNIQ<i> dict  (k is the key of the ith entry)
+	opAttr        // x ATTR<name> x.name
+	opSetField    // y x SETFIELD<name> -  (x.name = y)
+	opUnpack      // seq UNPACK<n> xn ... x1
+	opMethod      // x METHOD<name> x fn  (fn is nil for a built-in method of x)
+	opCall        // fn args... CALL<callsite> result
+	opMakeFunc    // defaults... MAKEFUNC<func> fn
+	opLoad        // - LOAD<stmt> -
+
+	opArgMin = opJmp
+)
+
+var opcodeNames = [...]string{
+	opPop:         "pop",
+	opDup:         "dup",
+	opDup2:        "dup2",
+	opExch:        "exch",
+	opRot:         "rot",
+	opNone:        "none",
+	opTick:        "tick",
+	opIterPush:    "iterpush",
+	opIterPop:     "iterpop",
+	opReturn:      "return",
+	opIndex:       "index",
+	opSetIndex:    "setindex",
+	opSlice:       "slice",
+	opMakeDict:    "makedict",
+	opCharge:      "charge",
+	opAppend:      "append",
+	opSetDict:     "setdict",
+	opStarArgs:    "starargs",
+	opKwargs:      "kwargs",
+	opJmp:         "jmp",
+	opIfTrue:      "iftrue",
+	opIfFalse:     "iffalse",
+	opIterJmp:     "iterjmp",
+	opConstant:    "constant",
+	opLocal:       "local",
+	opFree:        "free",
+	opGlobal:      "global",
+	opLookup:      "lookup",
+	opSetLocal:    "setlocal",
+	opSetGlobal:   "setglobal",
+	opUnary:       "unary",
+	opBinary:      "binary",
+	opCompare:     "compare",
+	opInplace:     "inplace",
+	opMakeList:    "makelist",
+	opMakeTuple:   "maketuple",
+	opSetDictUniq: "setdictuniq",
+	opAttr:        "attr",
+	opSetField:    "setfield",
+	opUnpack:      "unpack",
+	opMethod:      "method",
+	opCall:        "call",
+	opMakeFunc:    "makefunc",
+	opLoad:        "load",
+}
+
+func (op opcode) String() string {
+	if int(op) < len(opcodeNames) {
+		return opcodeNames[op]
+	}
+	return fmt.Sprintf("opcode(%d)", op)
+}
+
+// stackEffect records the effect on the stack depth of each opcode.
+// Opcodes whose effect depends on their operand are marked variable.
+const variable = 127
+
+var stackEffect = [...]int8{
+	opPop:         -1,
+	opDup:         +1,
+	opDup2:        +2,
+	opExch:        0,
+	opRot:         0,
+	opNone:        +1,
+	opTick:        0,
+	opIterPush:    -1,
+	opIterPop:     0,
+	opReturn:      -1,
+	opIndex:       -1,
+	opSetIndex:    -3,
+	opSlice:       -3,
+	opMakeDict:    +1,
+	opCharge:      0,
+	opAppend:      -1,
+	opSetDict:     -2,
+	opStarArgs:    0,
+	opKwargs:      0,
+	opJmp:         0,
+	opIfTrue:      -1,
+	opIfFalse:     -1,
+	opIterJmp:     +1,
+	opConstant:    +1,
+	opLocal:       +1,
+	opFree:        +1,
+	opGlobal:      +1,
+	opLookup:      +1,
+	opSetLocal:    -1,
+	opSetGlobal:   -1,
+	opUnary:       0,
+	opBinary:      -1,
+	opCompare:     -1,
+	opInplace:     -1,
+	opMakeList:    variable,
+	opMakeTuple:   variable,
+	opSetDictUniq: -2,
+	opAttr:        0,
+	opSetField:    -2,
+	opUnpack:      variable,
+	opMethod:      +1,
+	opCall:        variable,
+	opMakeFunc:    variable,
+	opLoad:        0,
+}
+
+// A funcode is the compiled form of a function or of a module's
+// top-level statements.
+type funcode struct {
+	name      string           // name of the function, or "<toplevel>"
+	pos       syntax.Position  // position of def or lambda token
+	syntax    *syntax.Function // nil for a module's top level
+	ndefaults int              // number of parameters with default values
+	code      []byte           // the instructions
+	posns     []pcpos          // positions of instructions that may fail, by pc
+	maxStack  int              // maximum depth of the operand stack
+
+	// operand tables
+	constants []Value
+	names     []string           // for ATTR, SETFIELD, METHOD
+	idents    []*syntax.Ident    // for LOCAL, GLOBAL, LOOKUP
+	callsites []*callsite        // for CALL
+	funcs     []*funcode         // for MAKEFUNC
+	loads     []*syntax.LoadStmt // for LOAD
+}
+
+// A pcpos records the source position of the instruction at pc.
+type pcpos struct {
+	pc  uint32
+	pos syntax.Position
+}
+
+// position returns the source position recorded for the instruction at pc.
+func (fc *funcode) position(pc int) syntax.Position {
+	i := sort.Search(len(fc.posns), func(i int) bool { return int(fc.posns[i].pc) > pc })
+	if i == 0 {
+		return syntax.Position{}
+	}
+	return fc.posns[i-1].pos
+}
+
+// A callsite describes the arguments of a call.
+type callsite struct {
+	method string    // name of the method in a call x.f(...), or ""
+	args   []argKind // kind of each argument, in order
+	names  []String  // names of the keyword arguments, in order
+	nstar  int       // number of *args arguments (0 or 1)
+}
+
+// nslots returns the number of operand stack slots consumed by the call.
+func (cs *callsite) nslots() int {
+	if cs.method != "" {
+		return len(cs.args) + 2
+	}
+	return len(cs.args) + 1
+}
+
+// An argKind is the kind of an argument at a callsite.
+type argKind uint8
+
+const (
+	argPositional argKind = iota // x
+	argKeyword                   // k=x
+	argStar                      // *x
+	argStarStar                  // **x
+)
+
+// compileFile compiles the top-level statements of a resolved file.
+func compileFile(f *syntax.File) *funcode {
+	fc := newFcomp("<toplevel>", syntax.Position{}, nil)
+	fc.stmts(f.Stmts)
+	return fc.finish()
+}
+
+// compileFunction compiles the body of a resolved function.
+func compileFunction(pos syntax.Position, name string, f *syntax.Function) *funcode {
+	fc := newFcomp(name, pos, f)
+	for _, param := range f.Params {
+		if _, ok := param.(*syntax.BinaryExpr); ok {
+			fc.fn.ndefaults++
+		}
+	}
+	fc.stmts(f.Body)
+	return fc.finish()
+}
+
+// An fcomp holds the state of the compiler for a single funcode.
+type fcomp struct {
+	fn     *funcode
+	depth  int                 // current depth of the operand stack
+	pos    *syntax.Position    // position for the next instruction, if any
+	loops  []*loop             // enclosing loops, innermost last
+	consts map[constKey]uint32 // index of each constant
+	names  map[string]uint32   // index of each name
+}
+
+// A loop records the targets of the break and continue
+// statements of a for or while loop.
+type loop struct {
+	head   int   // target of continue
+	breaks []int // jumps to patch with the loop's exit
+}
+
+func newFcomp(name string, pos syntax.Position, f *syntax.Function) *fcomp {
+	return &fcomp{
+		fn:     &funcode{name: name, pos: pos, syntax: f},
+		consts: make(map[constKey]uint32),
+		names:  make(map[string]uint32),
+	}
+}
+
+// finish terminates the code with an implicit "return None".
+func (fc *fcomp) finish() *funcode {
+	fc.emit(opNone)
+	fc.emit(opReturn)
+	return fc.fn
+}
+
+// at sets the source position of the next instruction.
+func (fc *fcomp) at(pos syntax.Position) {
+	fc.pos = &pos
+}
+
+func (fc *fcomp) pc() int { return len(fc.fn.code) }
+
+// emit appends an instruction with no operand.
+func (fc *fcomp) emit(op opcode) {
+	if op >= opArgMin {
+		panic(fmt.Sprintf("internal error: emit %s: missing operand", op))
+	}
+	fc.record()
+	fc.fn.code = append(fc.fn.code, byte(op))
+	fc.setDepth(fc.depth + int(stackEffect[op]))
+}
+
+// emit1 appends an instruction with an operand and returns the pc
+// of the operand, for use by patch.
+func (fc *fcomp) emit1(op opcode, arg uint32) int {
+	if op < opArgMin {
+		panic(fmt.Sprintf("internal error: emit1 %s: unexpected operand", op))
+	}
+	fc.record()
+	fc.fn.code = append(fc.fn.code, byte(op), 0, 0, 0, 0)
+	pc := len(fc.fn.code) - 4
+	putUint32(fc.fn.code[pc:], arg)
+
+	effect := int(stackEffect[op])
+	if effect == variable {
+		switch op {
+		case opMakeList, opMakeTuple:
+			effect = 1 - int(arg)
+		case opUnpack:
+			effect = int(arg) - 1
+		case opCall:
+			effect = 1 - fc.fn.callsites[arg].nslots()
+		case opMakeFunc:
+			effect = 1 - fc.fn.funcs[arg].ndefaults
+		}
+	}
+	fc.setDepth(fc.depth + effect)
+	return pc
+}
+
+// record records the pending source position, if any,
+// for the instruction about to be emitted.
+func (fc *fcomp) record() {
+	if fc.pos != nil {
+		fc.fn.posns = append(fc.fn.posns, pcpos{uint32(fc.pc()), *fc.pos})
+		fc.pos = nil
+	}
+}
+
+func (fc *fcomp) setDepth(depth int) {
+	fc.depth = depth
+	if depth > fc.fn.maxStack {
+		fc.fn.maxStack = depth
+	}
+}
+
+// patch sets the target of the jump whose operand is at pc
+// to the current end of the code.
+func (fc *fcomp) patch(pc int) {
+	putUint32(fc.fn.code[pc:], uint32(fc.pc()))
+}
+
+// A constKey identifies a literal in the constant table.
+type constKey struct {
+	token syntax.Token
+	value interface{}
+}
+
+// putUint32 encodes x in little-endian order in b[:4].
+func putUint32(b []byte, x uint32) {
+	b[0], b[1], b[2], b[3] = byte(x), byte(x>>8), byte(x>>16), byte(x>>24)
+}
+
+func (fc *fcomp) constantIndex(v Value, key constKey) uint32 {
+	i, ok := fc.consts[key]
+	if !ok {
+		i = uint32(len(fc.fn.constants))
+		fc.fn.constants = append(fc.fn.constants, v)
+		fc.consts[key] = i
+	}
+	return i
+}
+
+func (fc *fcomp) nameIndex(name string) uint32 {
+	i, ok := fc.names[name]
+	if !ok {
+		i = uint32(len(fc.fn.names))
+		fc.fn.names = append(fc.fn.names, name)
+		fc.names[name] = i
+	}
+	return i
+}
+
+func (fc *fcomp) identIndex(id *syntax.Ident) uint32 {
+	fc.fn.idents = append(fc.fn.idents, id)
+	return uint32(len(fc.fn.idents) - 1)
+}
+
+func (fc *fcomp) stmts(stmts []syntax.Stmt) {
+	for _, stmt := range stmts {
+		fc.stmt(stmt)
+	}
+}
+
+func (fc *fcomp) stmt(stmt syntax.Stmt) {
+	// Like ExecStmts, count a step before each statement.
+	start, _ := stmt.Span()
+	fc.at(start)
+	fc.emit(opTick)
+
+	switch stmt := stmt.(type) {
+	case *syntax.ExprStmt:
+		fc.expr(stmt.X)
+		fc.emit(opPop)
+
+	case *syntax.BranchStmt:
+		switch stmt.Token {
+		case syntax.PASS:
+			// no-op
+		case syntax.BREAK:
+			l := fc.loops[len(fc.loops)-1]
+			l.breaks = append(l.breaks, fc.emit1(opJmp, 0))
+		case syntax.CONTINUE:
+			l := fc.loops[len(fc.loops)-1]
+			fc.emit1(opJmp, uint32(l.head))
+		}
+
+	case *syntax.IfStmt:
+		fc.expr(stmt.Cond)
+		ifFalse := fc.emit1(opIfFalse, 0)
+		fc.stmts(stmt.True)
+		if len(stmt.False) > 0 {
+			end := fc.emit1(opJmp, 0)
+			fc.patch(ifFalse)
+			fc.stmts(stmt.False)
+			fc.patch(end)
+		} else {
+			fc.patch(ifFalse)
+		}
+
+	case *syntax.AssignStmt:
+		switch stmt.Op {
+		case syntax.EQ:
+			// simple assignment: x = y
+			fc.expr(stmt.RHS)
+			fc.assign(stmt.OpPos, stmt.LHS)
+
+		case syntax.PLUS_EQ,
+			syntax.MINUS_EQ,
+			syntax.STAR_EQ,
+			syntax.SLASH_EQ,
+			syntax.SLASHSLASH_EQ,
+			syntax.PERCENT_EQ,
+			syntax.AMP_EQ,
+			syntax.PIPE_EQ,
+			syntax.CIRCUMFLEX_EQ,
+			syntax.LTLT_EQ,
+			syntax.GTGT_EQ:
+			// augmented assignment: x += y
+			// The "address" of x is evaluated exactly once.
+			switch lhs := stmt.LHS.(type) {
+			case *syntax.Ident:
+				// x += ...
+				fc.lookup(lhs)
+				fc.expr(stmt.RHS)
+				fc.at(stmt.OpPos)
+				fc.emit1(opInplace, uint32(stmt.Op))
+				fc.set(lhs)
+
+			case *syntax.IndexExpr:
+				// x[y] += ...
+				fc.expr(lhs.X)
+				fc.expr(lhs.Y)
+				fc.emit(opDup2)
+				fc.at(lhs.Lbrack)
+				fc.emit(opIndex)
+				fc.expr(stmt.RHS)
+				fc.at(stmt.OpPos)
+				fc.emit1(opInplace, uint32(stmt.Op))
+				fc.emit(opRot)
+				fc.at(lhs.Lbrack)
+				fc.emit(opSetIndex)
+
+			case *syntax.DotExpr:
+				// x.f += ...
+				name := fc.nameIndex(lhs.Name.Name)
+				fc.expr(lhs.X)
+				fc.emit(opDup)
+				fc.at(lhs.Dot)
+				fc.emit1(opAttr, name)
+				fc.expr(stmt.RHS)
+				fc.at(stmt.OpPos)
+				fc.emit1(opInplace, uint32(stmt.Op))
+				fc.emit(opExch)
+				fc.at(lhs.Dot)
+				fc.emit1(opSetField, name)
+
+			default:
+				panic(fmt.Sprintf("internal error: %s: compile: unexpected augmented assignment to %T", stmt.OpPos, lhs))
+			}
+
+		default:
+			panic(fmt.Sprintf("internal error: %s: unexpected assignment operator: %s", stmt.OpPos, stmt.Op))
+		}
+
+	case *syntax.DefStmt:
+		fc.function(stmt.Def, stmt.Name.Name, &stmt.Function)
+		fc.set(stmt.Name)
+
+	case *syntax.ForStmt:
+		fc.expr(stmt.X)
+		fc.at(stmt.For)
+		fc.emit(opIterPush)
+		l := &loop{head: fc.pc()}
+		fc.loops = append(fc.loops, l)
+		done := fc.emit1(opIterJmp, 0)
+		fc.assign(stmt.For, stmt.Vars)
+		fc.stmts(stmt.Body)
+		fc.emit1(opJmp, uint32(l.head))
+		fc.loops = fc.loops[:len(fc.loops)-1]
+		fc.patch(done)
+		for _, pc := range l.breaks {
+			fc.patch(pc)
+		}
+		fc.emit(opIterPop)
+
+	case *syntax.WhileStmt:
+		l := &loop{head: fc.pc()}
+		fc.loops = append(fc.loops, l)
+		fc.expr(stmt.Cond)
+		done := fc.emit1(opIfFalse, 0)
+		fc.stmts(stmt.Body)
+		fc.emit1(opJmp, uint32(l.head))
+		fc.loops = fc.loops[:len(fc.loops)-1]
+		fc.patch(done)
+		for _, pc := range l.breaks {
+			fc.patch(pc)
+		}
+
+	case *syntax.ReturnStmt:
+		if stmt.Result != nil {
+			fc.expr(stmt.Result)
+		} else {
+			fc.emit(opNone)
+		}
+		fc.emit(opReturn)
+
+	case *syntax.LoadStmt:
+		fc.fn.loads = append(fc.fn.loads, stmt)
+		fc.emit1(opLoad, uint32(len(fc.fn.loads)-1))
+
+	default:
+		panic(fmt.Sprintf("internal error: %s: compile: unexpected statement %T", start, stmt))
+	}
+}
+
+// assign compiles an assignment to lhs of the value on top of the stack.
+func (fc *fcomp) assign(pos syntax.Position, lhs syntax.Expr) {
+	switch lhs := lhs.(type) {
+	case *syntax.Ident:
+		// x = rhs
+		fc.set(lhs)
+
+	case *syntax.TupleExpr:
+		// (x, y) = rhs
+		fc.assignSequence(pos, lhs.List)
+
+	case *syntax.ListExpr:
+		// [x, y] = rhs
+		fc.assignSequence(pos, lhs.List)
+
+	case *syntax.IndexExpr:
+		// x[y] = rhs
+		fc.expr(lhs.X)
+		fc.expr(lhs.Y)
+		fc.at(lhs.Lbrack)
+		fc.emit(opSetIndex)
+
+	case *syntax.DotExpr:
+		// x.f = rhs
+		fc.expr(lhs.X)
+		fc.at(lhs.Dot)
+		fc.emit1(opSetField, fc.nameIndex(lhs.Name.Name))
+
+	case *syntax.ParenExpr:
+		fc.assign(pos, lhs.X)
+
+	default:
+		panic(fmt.Sprintf("internal error: %s: compile: ill-formed assignment: %T", pos, lhs))
+	}
+}
+
+func (fc *fcomp) assignSequence(pos syntax.Position, lhs []syntax.Expr) {
+	fc.at(pos)
+	fc.emit1(opUnpack, uint32(len(lhs)))
+	for _, x := range lhs {
+		fc.assign(pos, x)
+	}
+}
+
+// set compiles a store of the value on top of the stack to id.
+func (fc *fcomp) set(id *syntax.Ident) {
+	switch resolve.Scope(id.Scope) {
+	case resolve.Local:
+		fc.emit1(opSetLocal, uint32(id.Index))
+	case resolve.Global:
+		fc.emit1(opSetGlobal, uint32(id.Index))
+	default:
+		panic(fmt.Sprintf("internal error: %s: set(%s): neither global nor local (%d)", id.NamePos, id.Name, id.Scope))
+	}
+}
+
+// lookup compiles a load of the value of id.
+func (fc *fcomp) lookup(id *syntax.Ident) {
+	switch resolve.Scope(id.Scope) {
+	case resolve.Local:
+		fc.emit1(opLocal, fc.identIndex(id))
+	case resolve.Free:
+		fc.emit1(opFree, uint32(id.Index))
+	case resolve.Global:
+		fc.emit1(opGlobal, fc.identIndex(id))
+	default:
+		fc.emit1(opLookup, fc.identIndex(id))
+	}
+}
+
+func (fc *fcomp) expr(e syntax.Expr) {
+	switch e := e.(type) {
+	case *syntax.ParenExpr:
+		fc.expr(e.X)
+
+	case *syntax.Ident:
+		fc.lookup(e)
+
+	case *syntax.Literal:
+		var v Value
+		switch e.Token {
+		case syntax.INT:
+			switch x := e.Value.(type) {
+			case int64:
+				v = MakeInt64(x)
+			case *big.Int:
+				v = makeBigInt(x)
+			}
+		case syntax.FLOAT:
+			v = Float(e.Value.(float64))
+		case syntax.STRING:
+			v = String(e.Value.(string))
+		case syntax.BYTES:
+			v = Bytes(e.Value.(string))
+		}
+		if v == nil {
+			panic(fmt.Sprintf("internal error: %s: compile: unexpected literal %s", e.TokenPos, e.Token))
+		}
+		fc.emit1(opConstant, fc.constantIndex(v, constKey{e.Token, e.Value}))
+
+	case *syntax.ListExpr:
+		for _, x := range e.List {
+			fc.expr(x)
+		}
+		fc.at(e.Lbrack)
+		fc.emit1(opMakeList, uint32(len(e.List)))
+
+	case *syntax.CondExpr:
+		fc.expr(e.Cond)
+		ifFalse := fc.emit1(opIfFalse, 0)
+		depth := fc.depth
+		fc.expr(e.True)
+		end := fc.emit1(opJmp, 0)
+		fc.patch(ifFalse)
+		fc.depth = depth
+		fc.expr(e.False)
+		fc.patch(end)
+
+	case *syntax.IndexExpr:
+		fc.expr(e.X)
+		fc.expr(e.Y)
+		fc.at(e.Lbrack)
+		fc.emit(opIndex)
+
+	case *syntax.SliceExpr:
+		fc.expr(e.X)
+		for _, x := range []syntax.Expr{e.Lo, e.Hi, e.Step} {
+			if x != nil {
+				fc.expr(x)
+			} else {
+				fc.emit(opNone)
+			}
+		}
+		fc.at(e.Lbrack)
+		fc.emit(opSlice)
+
+	case *syntax.Comprehension:
+		fc.comprehension(e)
+
+	case *syntax.TupleExpr:
+		for _, x := range e.List {
+			fc.expr(x)
+		}
+		start, _ := e.Span()
+		fc.at(start)
+		fc.emit1(opMakeTuple, uint32(len(e.List)))
+
+	case *syntax.DictExpr:
+		fc.emit(opMakeDict)
+		for i, entry := range e.List {
+			entry := entry.(*syntax.DictEntry)
+			fc.expr(entry.Key)
+			fc.expr(entry.Value)
+			fc.at(e.Lbrace)
+			fc.emit1(opSetDictUniq, uint32(i))
+		}
+		fc.at(e.Lbrace)
+		fc.emit(opCharge)
+
+	case *syntax.UnaryExpr:
+		fc.expr(e.X)
+		fc.at(e.OpPos)
+		fc.emit1(opUnary, uint32(e.Op))
+
+	case *syntax.BinaryExpr:
+		fc.expr(e.X)
+
+		switch e.Op {
+		// short-circuit operators
+		case syntax.OR, syntax.AND:
+			op := opIfTrue
+			if e.Op == syntax.AND {
+				op = opIfFalse
+			}
+			fc.emit(opDup)
+			end := fc.emit1(op, 0)
+			fc.emit(opPop)
+			fc.expr(e.Y)
+			fc.patch(end)
+
+		// comparisons
+		case syntax.EQL, syntax.NEQ, syntax.GT, syntax.LT, syntax.LE, syntax.GE:
+			fc.expr(e.Y)
+			fc.at(e.OpPos)
+			fc.emit1(opCompare, uint32(e.Op))
+
+		// binary operators
+		default:
+			fc.expr(e.Y)
+			fc.at(e.OpPos)
+			fc.emit1(opBinary, uint32(e.Op))
+		}
+
+	case *syntax.DotExpr:
+		fc.expr(e.X)
+		fc.at(e.Dot)
+		fc.emit1(opAttr, fc.nameIndex(e.Name.Name))
+
+	case *syntax.CallExpr:
+		fc.call(e)
+
+	case *syntax.LambdaExpr:
+		fc.function(e.Lambda, "lambda", &e.Function)
+
+	default:
+		start, _ := e.Span()
+		panic(fmt.Sprintf("internal error: %s: compile: unexpected expr %T", start, e))
+	}
+}
+
+func (fc *fcomp) call(call *syntax.CallExpr) {
+	cs := new(callsite)
+
+	// Calls of the form x.f(...) may use the built-in methods of x.
+	if dot, ok := call.Fn.(*syntax.DotExpr); ok {
+		fc.expr(dot.X)
+		fc.at(dot.Dot)
+		fc.emit1(opMethod, fc.nameIndex(dot.Name.Name))
+		cs.method = dot.Name.Name
+	} else {
+		fc.expr(call.Fn)
+	}
+
+	for _, arg := range call.Args {
+		// keyword argument, k=v
+		if binop, ok := arg.(*syntax.BinaryExpr); ok && binop.Op == syntax.EQ {
+			fc.expr(binop.Y)
+			cs.args = append(cs.args, argKeyword)
+			cs.names = append(cs.names, String(binop.X.(*syntax.Ident).Name))
+			continue
+		}
+
+		// *args and **kwargs arguments
+		if unop, ok := arg.(*syntax.UnaryExpr); ok {
+			if unop.Op == syntax.STAR {
+				fc.expr(unop.X)
+				fc.at(unop.OpPos)
+				fc.emit(opStarArgs)
+				cs.args = append(cs.args, argStar)
+				cs.nstar++
+				continue
+			}
+			if unop.Op == syntax.STARSTAR {
+				fc.expr(unop.X)
+				fc.at(unop.OpPos)
+				fc.emit(opKwargs)
+				cs.args = append(cs.args, argStarStar)
+				continue
+			}
+		}
+
+		// ordinary argument
+		fc.expr(arg)
+		cs.args = append(cs.args, argPositional)
+	}
+
+	fc.fn.callsites = append(fc.fn.callsites, cs)
+	fc.at(call.Lparen)
+	fc.emit1(opCall, uint32(len(fc.fn.callsites)-1))
+}
+
+func (fc *fcomp) comprehension(comp *syntax.Comprehension) {
+	if comp.Curly {
+		fc.emit(opMakeDict)
+		fc.at(comp.Lbrack)
+		fc.emit(opCharge)
+	} else {
+		fc.at(comp.Lbrack)
+		fc.emit1(opMakeList, 0)
+	}
+	fc.clauses(comp, 0)
+}
+
+// clauses compiles the clauses of comp starting at index i,
+// followed by its body.  The result is on top of the stack.
+func (fc *fcomp) clauses(comp *syntax.Comprehension, i int) {
+	if i == len(comp.Clauses) {
+		if comp.Curly {
+			// dict: {k:v for ...}
+			entry := comp.Body.(*syntax.DictEntry)
+			fc.expr(entry.Key)
+			fc.expr(entry.Value)
+			fc.at(entry.Colon)
+			fc.emit(opSetDict)
+		} else {
+			// list: [body for vars in x]
+			fc.expr(comp.Body)
+			start, _ := comp.Body.Span()
+			fc.at(start)
+			fc.emit(opAppend)
+		}
+		return
+	}
+
+	switch clause := comp.Clauses[i].(type) {
+	case *syntax.IfClause:
+		fc.expr(clause.Cond)
+		skip := fc.emit1(opIfFalse, 0)
+		fc.clauses(comp, i+1)
+		fc.patch(skip)
+
+	case *syntax.ForClause:
+		fc.expr(clause.X)
+		fc.at(clause.For)
+		fc.emit(opIterPush)
+		head := fc.pc()
+		done := fc.emit1(opIterJmp, 0)
+		fc.at(clause.For)
+		fc.emit(opTick)
+		fc.assign(clause.For, clause.Vars)
+		fc.clauses(comp, i+1)
+		fc.emit1(opJmp, uint32(head))
+		fc.patch(done)
+		fc.emit(opIterPop)
+
+	default:
+		start, _ := clause.Span()
+		panic(fmt.Sprintf("internal error: %s: compile: unexpected comprehension clause %T", start, clause))
+	}
+}
+
+// function compiles a def statement or lambda expression:
+// it evaluates the parameter defaults and creates the function.
+func (fc *fcomp) function(pos syntax.Position, name string, f *syntax.Function) {
+	for _, param := range f.Params {
+		if binary, ok := param.(*syntax.BinaryExpr); ok {
+			// e.g. y=dflt
+			fc.expr(binary.Y)
+		}
+	}
+	fc.fn.funcs = append(fc.fn.funcs, compileFunction(pos, name, f))
+	fc.at(pos)
+	fc.emit1(opMakeFunc, uint32(len(fc.fn.funcs)-1))
+}
@@ -12,8 +12,10 @@ import (
 	"math/big"
 	"sort"
 	"strings"
+	"sync/atomic"
 	"unicode"
 	"unicode/utf8"
+	"unsafe"
 
 	"github.com/aabbtree77/determinism/resolve"
 	"github.com/aabbtree77/determinism/syntax"
@@ -41,9 +43,249 @@ type Thread struct {
 	// See example_test.go for some example implementations of Load.
 	Load func(thread *Thread, module string) (StringDict, error)
 
+	// Hook, if non-nil, observes the execution of the thread,
+	// for example on behalf of a debugger.
+	Hook Hook
+
+	// Trace, if non-nil, is called on entry to and exit from each
+	// Starlark function and module toplevel, before and after each
+	// statement, and at each branch.  See TraceEvent.
+	Trace func(thread *Thread, event *TraceEvent)
+
 	// locals holds arbitrary "thread-local" Go values belonging to the client.
 	// They are accessible to the client but not to any Starlark program.
 	locals map[string]interface{}
+
+	// cancelReason, if non-nil, points to the reason given to Cancel.
+	// It is accessed atomically as it may be set by another goroutine.
+	cancelReason *string
+
+	// steps counts the statements, comprehension iterations and
+	// function calls executed by the thread; maxSteps, if nonzero,
+	// is the limit imposed by SetMaxExecutionSteps.
+	steps, maxSteps uint64
+
+	// allocs is the estimated number of bytes allocated by the
+	// thread; maxAllocs, if nonzero, is the limit imposed by
+	// SetMaxAllocs.  See alloc.go.
+	allocs, maxAllocs int64
+
+	// depth is the number of frames on the stack; maxDepth, if
+	// nonzero, is the limit imposed by SetMaxCallDepth.
+	depth, maxDepth int
+
+	// active records the syntactic functions with an active call,
+	// for the detection of recursion when it is not allowed.
+	active map[*syntax.Function]bool
+
+	// prof holds the thread's state for the active profiler, if any.
+	// See profile.go.
+	prof *threadProfile
+}
+
+// A Hook observes the execution of a thread, for example on behalf
+// of a debugger.
+//
+// BeforeStmt is called before each statement is executed, with the
+// frame in which it executes, whose Position is the start of the
+// statement.  The hook may inspect the frame and its parents, and may
+// block, for example while the program is stopped at a breakpoint.
+// If it returns an error, execution fails with an EvalError at the
+// statement.
+//
+// Hooks are called only by the TreeWalker engine.
+type Hook interface {
+	BeforeStmt(fr *Frame, stmt syntax.Stmt) error
+}
+
+// A TraceKind identifies the point of execution at which a thread's
+// Trace function is called.
+type TraceKind int
+
+const (
+	TraceCall    TraceKind = iota // entry to a function or module toplevel
+	TraceReturn                   // exit from a function or module toplevel
+	TraceStmt                     // before a statement
+	TraceStmtEnd                  // after a statement
+	TraceBranch                   // after the condition of an if statement or conditional expression
+)
+
+func (k TraceKind) String() string {
+	switch k {
+	case TraceCall:
+		return "call"
+	case TraceReturn:
+		return "return"
+	case TraceStmt:
+		return "stmt"
+	case TraceStmtEnd:
+		return "stmtend"
+	case TraceBranch:
+		return "branch"
+	}
+	return fmt.Sprintf("TraceKind(%d)", int(k))
+}
+
+// A TraceEvent describes a point of execution reported to a thread's
+// Trace function.  The event must not be retained after the call.
+//
+// Statements and branches are reported only by the TreeWalker engine.
+type TraceEvent struct {
+	Kind TraceKind
+
+	// Frame is the frame of the function, module toplevel or
+	// statement.  On entry to a function, its parameters are not
+	// yet bound.
+	Frame *Frame
+
+	// Node is the *syntax.Function of a function, the *syntax.File
+	// of a module, the syntax.Stmt of a statement, or the
+	// *syntax.IfStmt or *syntax.CondExpr of a branch.
+	Node syntax.Node
+
+	// Result is the result of a function, reported on return from it,
+	// or nil if it failed.  For a branch, it is the truth value of
+	// the condition, which selects the branch taken.
+	Result Value
+
+	// Err is the error, if any, with which a function, module or
+	// statement failed.
+	Err error
+}
+
+// trace calls the thread's Trace function, if any.
+func (fr *Frame) trace(kind TraceKind, node syntax.Node, result Value, err error) {
+	if trace := fr.thread.Trace; trace != nil {
+		trace(fr.thread, &TraceEvent{Kind: kind, Frame: fr, Node: node, Result: result, Err: err})
+	}
+}
+
+// DefaultMaxCallDepth is the maximum depth of the call stack
+// of a thread for which SetMaxCallDepth has not been called.
+const DefaultMaxCallDepth = 1000
+
+// SetMaxCallDepth sets the maximum depth of the thread's call stack.
+// A call that would exceed it fails with a "stack overflow" error.
+// A limit of zero means DefaultMaxCallDepth.
+//
+// Recursion is permitted only if the dialect allows it
+// (see resolve.Options.AllowRecursion);
+// otherwise the depth is bounded by the number of functions.
+func (thread *Thread) SetMaxCallDepth(max int) {
+	thread.maxDepth = max
+}
+
+// SetMaxExecutionSteps sets a limit on the number of Starlark
+// computation steps that may be executed by this thread.  If the
+// thread's step counter exceeds this limit, the interpreter fails
+// with an EvalError wrapping a *StepLimitError.  A limit of zero,
+// the default, means no limit.
+//
+// A step is the execution of a statement, an iteration of a
+// comprehension, or a call to a Starlark function.  The count is
+// deterministic: it does not depend on the machine or on timing,
+// so a given limit is reached at the same point on every run.
+func (thread *Thread) SetMaxExecutionSteps(max uint64) {
+	thread.maxSteps = max
+}
+
+// ExecutionSteps returns the number of computation steps executed by
+// the thread so far.  The counter is not reset by Exec or Eval, so
+// it accumulates across all uses of the thread.
+func (thread *Thread) ExecutionSteps() uint64 {
+	return thread.steps
+}
+
+// AddExecutionSteps charges delta computation steps to the thread, and
+// returns an error if that exceeds the limit set by
+// SetMaxExecutionSteps.  Built-in functions whose work grows with
+// their inputs may use it to account for that work, which the
+// interpreter otherwise counts as part of the single step of the call.
+func (thread *Thread) AddExecutionSteps(delta uint64) error {
+	if delta == 0 {
+		return nil
+	}
+	if thread.steps > math.MaxUint64-delta {
+		thread.steps = math.MaxUint64
+	} else {
+		thread.steps += delta
+	}
+	if thread.maxSteps != 0 && thread.steps > thread.maxSteps {
+		return &StepLimitError{MaxSteps: thread.maxSteps}
+	}
+	if tp := thread.profile(); tp != nil {
+		thread.profileEvent(tp, int64(delta))
+	}
+	return nil
+}
+
+// BytesPerStep is the number of bytes of input that AddByteSteps
+// charges as one computation step.
+const BytesPerStep = 64
+
+// AddByteSteps charges the work of processing n bytes, such as a
+// string that a built-in function searches, hashes or encodes, to the
+// thread's computation steps, one step for each BytesPerStep bytes.
+// It returns an error if that exceeds the limit set by
+// SetMaxExecutionSteps.
+func (thread *Thread) AddByteSteps(n int) error {
+	if n <= 0 {
+		return nil
+	}
+	return thread.AddExecutionSteps(uint64(n / BytesPerStep))
+}
+
+// A StepLimitError reports that a thread exceeded the limit
+// on computation steps set by SetMaxExecutionSteps.
+type StepLimitError struct {
+	MaxSteps uint64 // the limit that was exceeded
+}
+
+func (e *StepLimitError) Error() string {
+	return fmt.Sprintf("Starlark computation exceeded %d steps", e.MaxSteps)
+}
+
+// tick accounts for one computation step.
+// It returns an error if the step limit is exceeded
+// or the thread has been cancelled.
+func (thread *Thread) tick() error {
+	thread.steps++
+	if thread.maxSteps != 0 && thread.steps > thread.maxSteps {
+		return &StepLimitError{MaxSteps: thread.maxSteps}
+	}
+	if tp := thread.profile(); tp != nil {
+		thread.profileEvent(tp, 1)
+	}
+	return thread.cancelled()
+}
+
+// Cancel causes execution of Starlark code in the specified thread to
+// promptly fail with an EvalError that includes the specified reason.
+// The evaluator checks for cancellation before each statement,
+// comprehension iteration and function call.  There may be a delay
+// before the interpreter observes the cancellation if the thread is
+// currently in a call to a built-in function.
+//
+// Cancel may be called from any goroutine, even after the thread has
+// finished.  Only the first reason is retained.
+func (thread *Thread) Cancel(reason string) {
+	// Atomically set cancelReason, preserving earlier reason if any.
+	atomic.CompareAndSwapPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason)), nil, unsafe.Pointer(&reason))
+}
+
+// Uncancel resets the cancellation state of the thread so that it may
+// be used again, for example by a REPL to evaluate its next input.
+// It must not be called while the thread is executing.
+func (thread *Thread) Uncancel() {
+	atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason)), nil)
+}
+
+// cancelled returns a non-nil error if the thread has been cancelled.
+func (thread *Thread) cancelled() error {
+	if reason := atomic.LoadPointer((*unsafe.Pointer)(unsafe.Pointer(&thread.cancelReason))); reason != nil {
+		return fmt.Errorf("Starlark computation cancelled: %s", *(*string)(reason))
+	}
+	return nil
 }
 
 // SetLocal sets the thread-local value associated with the specified key.
@@ -102,17 +344,31 @@ func (d StringDict) Freeze() {
 // Has reports whether the dictionary contains the specified key.
 func (d StringDict) Has(key string) bool { _, ok := d[key]; return ok }
 
+// Keys returns a new sorted slice of d's keys.
+func (d StringDict) Keys() []string {
+	names := make([]string, 0, len(d))
+	for name := range d {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
 // A Frame holds the execution state of a single Starlark function call
 // or module toplevel.
 type Frame struct {
 	thread      *Thread         // thread-associated state
 	parent      *Frame          // caller's frame (or nil)
-	posn        syntax.Position // source position of PC (set during call and error)
+	posn        syntax.Position // source position of PC (set during call, error and hook)
 	fn          *Function       // current function (nil at toplevel)
 	predeclared StringDict      // names predeclared for this module
 	globals     []Value         // global variables of enclosing module
 	locals      []Value         // local variables, starting with parameters
+	stack       []Value         // operand stack of the bytecode interpreter
 	result      Value           // operand of current function's return statement
+
+	// names of globals and locals, if known, for Globals and Locals
+	globalNames, localNames []*syntax.Ident
 }
 
 func (fr *Frame) errorf(posn syntax.Position, format string, args ...interface{}) *EvalError {
@@ -121,6 +377,32 @@ func (fr *Frame) errorf(posn syntax.Position, format string, args ...interface{}
 	return &EvalError{Msg: msg, Frame: fr}
 }
 
+// wrap returns an EvalError at the specified position whose message
+// is that of err and whose underlying cause is err.
+func (fr *Frame) wrap(posn syntax.Position, err error) *EvalError {
+	e := fr.errorf(posn, "%s", err.Error())
+	e.cause = err
+	return e
+}
+
+// charge charges the estimated size of the newly allocated value v
+// to the thread, reporting an error at posn if the limit is exceeded.
+func (fr *Frame) charge(posn syntax.Position, v Value) error {
+	if err := fr.thread.AddAllocs(EstimateSize(v)); err != nil {
+		return fr.wrap(posn, err)
+	}
+	return nil
+}
+
+// chargeGrowth charges the growth in the estimated size of the value v,
+// whose size was previously before, to the thread.
+func (fr *Frame) chargeGrowth(posn syntax.Position, v Value, before int64) error {
+	if err := fr.thread.AddAllocs(EstimateSize(v) - before); err != nil {
+		return fr.wrap(posn, err)
+	}
+	return nil
+}
+
 // Position returns the source position of the current point of execution in this frame.
 func (fr *Frame) Position() syntax.Position { return fr.posn }
 
@@ -130,6 +412,39 @@ func (fr *Frame) Function() *Function { return fr.fn }
 // Parent returns the frame of the enclosing function call, if any.
 func (fr *Frame) Parent() *Frame { return fr.parent }
 
+// Locals returns the local variables of the frame that are bound at
+// the current point of execution, and the free variables of its
+// function.  It is intended for use by debuggers.
+func (fr *Frame) Locals() StringDict {
+	locals := make(StringDict)
+	if fr.fn != nil {
+		for i, id := range fr.fn.syntax.FreeVars {
+			locals[id.Name] = fr.fn.freevars[i]
+		}
+	}
+	for i, id := range fr.localNames {
+		// A comprehension variable may share the name of another
+		// local; the one bound later in the list is innermost.
+		if v := fr.locals[i]; v != nil {
+			locals[id.Name] = v
+		}
+	}
+	return locals
+}
+
+// Globals returns the global variables of the frame's module that are
+// bound at the current point of execution.  It is intended for use by
+// debuggers.
+func (fr *Frame) Globals() StringDict {
+	globals := make(StringDict)
+	for i, id := range fr.globalNames {
+		if v := fr.globals[i]; v != nil {
+			globals[id.Name] = v
+		}
+	}
+	return globals
+}
+
 // set updates the environment binding for name to value.
 func (fr *Frame) set(id *syntax.Ident, v Value) {
 	switch resolve.Scope(id.Scope) {
@@ -178,10 +493,15 @@ func (fr *Frame) lookup(id *syntax.Ident) (Value, error) {
 type EvalError struct {
 	Msg   string
 	Frame *Frame
+	cause error // underlying error, if any
 }
 
 func (e *EvalError) Error() string { return e.Msg }
 
+// Unwrap returns the underlying error, if any, such as a *StepLimitError
+// or the error returned by a built-in function.
+func (e *EvalError) Unwrap() error { return e.cause }
+
 // Backtrace returns a user-friendly error message describing the stack
 // of calls that led to this error.
 func (e *EvalError) Backtrace() string {
@@ -191,26 +511,40 @@ func (e *EvalError) Backtrace() string {
 	return buf.String()
 }
 
+// backtraceFrames is the number of outermost and of innermost frames
+// shown by WriteBacktrace for a deep stack; those in between are elided.
+const backtraceFrames = 10
+
 // WriteBacktrace writes a user-friendly description of the stack to buf.
+// If the stack is very deep, as after a stack overflow,
+// only its outermost and innermost frames are shown.
 func (fr *Frame) WriteBacktrace(out *bytes.Buffer) {
 	fmt.Fprintf(out, "Traceback (most recent call last):\n")
-	var print func(fr *Frame)
-	print = func(fr *Frame) {
-		if fr != nil {
-			print(fr.parent)
-
-			name := "<toplevel>"
-			if fr.fn != nil {
-				name = fr.fn.Name()
-			}
-			fmt.Fprintf(out, "  %s:%d:%d: in %s\n",
-				fr.posn.Filename(),
-				fr.posn.Line,
-				fr.posn.Col,
-				name)
+	var stack []*Frame // outermost first
+	for ; fr != nil; fr = fr.parent {
+		stack = append(stack, fr)
+	}
+	for i, j := 0, len(stack)-1; i < j; i, j = i+1, j-1 {
+		stack[i], stack[j] = stack[j], stack[i]
+	}
+	for i := 0; i < len(stack); i++ {
+		if i == backtraceFrames && len(stack) > 2*backtraceFrames+1 {
+			n := len(stack) - 2*backtraceFrames
+			fmt.Fprintf(out, "  ... %d frames elided ...\n", n)
+			i += n - 1
+			continue
+		}
+		fr := stack[i]
+		name := "<toplevel>"
+		if fr.fn != nil {
+			name = fr.fn.Name()
 		}
+		fmt.Fprintf(out, "  %s:%d:%d: in %s\n",
+			fr.posn.Filename(),
+			fr.posn.Line,
+			fr.posn.Col,
+			name)
 	}
-	print(fr)
 }
 
 // Stack returns the stack of frames, innermost first.
@@ -259,6 +593,42 @@ type ExecOptions struct {
 	// syntax tree has been resolved but before execution.  If it
 	// returns an error, execution is not attempted.
 	BeforeExec func(*Thread, syntax.Node) error
+
+	// Engine selects the mechanism used to execute the file.
+	// Functions defined by the file are executed by the same engine.
+	Engine Engine
+
+	// Dialect specifies the optional language features accepted
+	// in the file.  If nil, the deprecated package-level variables
+	// of the resolve package apply.
+	Dialect *resolve.Options
+}
+
+// An Engine is a mechanism for executing Starlark code.
+//
+// The engines are interchangeable: a program produces the same
+// results, errors, backtraces, step counts and allocation estimates
+// whichever one executes it.
+type Engine int
+
+const (
+	// TreeWalker evaluates the syntax tree directly.
+	// It is the default and the reference implementation.
+	TreeWalker Engine = iota
+
+	// Bytecode compiles the syntax tree to the instructions of a
+	// stack machine, then executes them.
+	Bytecode
+)
+
+func (e Engine) String() string {
+	switch e {
+	case TreeWalker:
+		return "treewalker"
+	case Bytecode:
+		return "bytecode"
+	}
+	return fmt.Sprintf("Engine(%d)", int(e))
 }
 
 // Exec is a variant of ExecFile that gives the client greater control
@@ -274,7 +644,7 @@ func Exec(opts ExecOptions) (StringDict, error) {
 	}
 
 	predeclared := opts.Predeclared
-	if err := resolve.File(f, predeclared.Has, Universe.Has); err != nil {
+	if err := resolve.FileOptions(f, predeclared.Has, Universe.Has, opts.Dialect); err != nil {
 		return nil, err
 	}
 
@@ -287,8 +657,21 @@ func Exec(opts ExecOptions) (StringDict, error) {
 	}
 
 	globals := make([]Value, len(f.Globals))
-	fr := thread.Push(predeclared, globals, len(f.Locals))
-	err = fr.ExecStmts(f.Stmts)
+	switch opts.Engine {
+	case Bytecode:
+		code := compileFile(f)
+		fr := thread.push(predeclared, globals, len(f.Locals), code.maxStack)
+		fr.globalNames, fr.localNames = f.Globals, f.Locals
+		fr.trace(TraceCall, f, nil, nil)
+		_, err = run(fr, code)
+		fr.trace(TraceReturn, f, nil, err)
+	default:
+		fr := thread.Push(predeclared, globals, len(f.Locals))
+		fr.globalNames, fr.localNames = f.Globals, f.Locals
+		fr.trace(TraceCall, f, nil, nil)
+		err = fr.ExecStmts(f.Stmts)
+		fr.trace(TraceReturn, f, nil, err)
+	}
 	thread.Pop()
 
 	// Convert the global environment to a map, and freeze it.
@@ -309,14 +692,23 @@ func Exec(opts ExecOptions) (StringDict, error) {
 //
 // Most clients do not need this low-level function; use ExecFile or Eval instead.
 func (thread *Thread) Push(predeclared StringDict, globals []Value, nlocals int) *Frame {
+	return thread.push(predeclared, globals, nlocals, 0)
+}
+
+// push is like Push, but also allocates an operand stack
+// of nstack values for the bytecode interpreter.
+func (thread *Thread) push(predeclared StringDict, globals []Value, nlocals, nstack int) *Frame {
+	space := make([]Value, nlocals+nstack)
 	fr := &Frame{
 		thread:      thread,
 		parent:      thread.frame,
 		predeclared: predeclared,
 		globals:     globals,
-		locals:      make([]Value, nlocals),
+		locals:      space[:nlocals:nlocals],
+		stack:       space[nlocals:],
 	}
 	thread.frame = fr
+	thread.depth++
 	return fr
 }
 
@@ -325,6 +717,7 @@ func (thread *Thread) Push(predeclared StringDict, globals []Value, nlocals int)
 // Most clients do not need this low-level function; use ExecFile or Eval instead.
 func (thread *Thread) Pop() {
 	thread.frame = thread.frame.parent
+	thread.depth--
 }
 
 // Eval parses, resolves, and evaluates an expression within the
@@ -338,18 +731,26 @@ func (thread *Thread) Pop() {
 // If Eval fails during evaluation, it returns an *EvalError
 // containing a backtrace.
 func Eval(thread *Thread, filename string, src interface{}, env StringDict) (Value, error) {
+	return EvalOptions(thread, filename, src, env, nil)
+}
+
+// EvalOptions is like Eval, but accepts the expression in the
+// specified dialect.  If dialect is nil, the deprecated package-level
+// variables of the resolve package apply.
+func EvalOptions(thread *Thread, filename string, src interface{}, env StringDict, dialect *resolve.Options) (Value, error) {
 	expr, err := syntax.ParseExpr(filename, src, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	locals, err := resolve.Expr(expr, env.Has, Universe.Has)
+	locals, err := resolve.ExprOptions(expr, env.Has, Universe.Has, dialect)
 	if err != nil {
 		return nil, err
 	}
 
 	// There are no globals.
 	fr := thread.Push(env, nil, len(locals))
+	fr.localNames = locals
 	v, err := eval(fr, expr)
 	thread.Pop()
 	return v, err
@@ -368,6 +769,14 @@ var (
 // Most clients do not need this function; use Exec or Eval instead.
 func (fr *Frame) ExecStmts(stmts []syntax.Stmt) error {
 	for _, stmt := range stmts {
+		if profiling() {
+			// Record the current line for the profiler.
+			fr.posn, _ = stmt.Span()
+		}
+		if err := fr.thread.tick(); err != nil {
+			start, _ := stmt.Span()
+			return fr.wrap(start, err)
+		}
 		if err := exec(fr, stmt); err != nil {
 			return err
 		}
@@ -376,6 +785,28 @@ func (fr *Frame) ExecStmts(stmts []syntax.Stmt) error {
 }
 
 func exec(fr *Frame, stmt syntax.Stmt) error {
+	if hook := fr.thread.Hook; hook != nil {
+		start, _ := stmt.Span()
+		fr.posn = start
+		if err := hook.BeforeStmt(fr, stmt); err != nil {
+			return fr.wrap(start, err)
+		}
+	}
+	if fr.thread.Trace != nil {
+		fr.trace(TraceStmt, stmt, nil, nil)
+		err := execStmt(fr, stmt)
+		switch err {
+		case errBreak, errContinue, errReturn:
+			fr.trace(TraceStmtEnd, stmt, nil, nil) // control flow, not failure
+		default:
+			fr.trace(TraceStmtEnd, stmt, nil, err)
+		}
+		return err
+	}
+	return execStmt(fr, stmt)
+}
+
+func execStmt(fr *Frame, stmt syntax.Stmt) error {
 	switch stmt := stmt.(type) {
 	case *syntax.ExprStmt:
 		_, err := eval(fr, stmt.X)
@@ -396,7 +827,11 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 		if err != nil {
 			return err
 		}
-		if cond.Truth() {
+		truth := cond.Truth()
+		if fr.thread.Trace != nil {
+			fr.trace(TraceBranch, stmt, truth, nil)
+		}
+		if truth {
 			return fr.ExecStmts(stmt.True)
 		} else {
 			return fr.ExecStmts(stmt.False)
@@ -417,7 +852,12 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 			syntax.STAR_EQ,
 			syntax.SLASH_EQ,
 			syntax.SLASHSLASH_EQ,
-			syntax.PERCENT_EQ:
+			syntax.PERCENT_EQ,
+			syntax.AMP_EQ,
+			syntax.PIPE_EQ,
+			syntax.CIRCUMFLEX_EQ,
+			syntax.LTLT_EQ,
+			syntax.GTGT_EQ:
 			// augmented assignment: x += y
 
 			var old Value // old value loaded from "address" x
@@ -461,12 +901,12 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 				if err != nil {
 					return err
 				}
-				old, err = getAttr(fr, x, lhs)
+				old, err = getAttr(fr, lhs.Dot, x, lhs.Name.Name)
 				if err != nil {
 					return err
 				}
 				set = func(fr *Frame, new Value) error {
-					return setField(fr, x, lhs, new)
+					return setField(fr, lhs.Dot, x, lhs.Name.Name, new)
 				}
 			}
 
@@ -475,24 +915,9 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 				return err
 			}
 
-			// Special case, following Python:
-			// If x is a list, x += y is sugar for x.extend(y).
-			if xlist, ok := old.(*List); ok && stmt.Op == syntax.PLUS_EQ {
-				// It's possible that y is not Iterable but
-				// nonetheless defines x+y, in which case we
-				// should fall back to the general case.
-				if yiter, ok := y.(Iterable); ok {
-					if err := xlist.checkMutable("apply += to", true); err != nil {
-						return fr.errorf(stmt.OpPos, "%v", err)
-					}
-					listExtend(xlist, yiter)
-					return nil
-				}
-			}
-
-			new, err := Binary(stmt.Op-syntax.PLUS_EQ+syntax.PLUS, old, y)
+			new, err := inplaceBinary(fr, stmt.OpPos, stmt.Op, old, y)
 			if err != nil {
-				return fr.errorf(stmt.OpPos, "%v", err)
+				return err
 			}
 			return set(fr, new)
 
@@ -535,6 +960,27 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 		}
 		return nil
 
+	case *syntax.WhileStmt:
+		for {
+			cond, err := eval(fr, stmt.Cond)
+			if err != nil {
+				return err
+			}
+			if !cond.Truth() {
+				break
+			}
+			if err := fr.ExecStmts(stmt.Body); err != nil {
+				if err == errBreak {
+					break
+				} else if err == errContinue {
+					continue
+				} else {
+					return err
+				}
+			}
+		}
+		return nil
+
 	case *syntax.ReturnStmt:
 		if stmt.Result != nil {
 			x, err := eval(fr, stmt.Result)
@@ -548,23 +994,7 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 		return errReturn
 
 	case *syntax.LoadStmt:
-		module := stmt.ModuleName()
-		if fr.thread.Load == nil {
-			return fr.errorf(stmt.Load, "load not implemented by this application")
-		}
-		fr.posn = stmt.Load
-		dict, err := fr.thread.Load(fr.thread, module)
-		if err != nil {
-			return fr.errorf(stmt.Load, "cannot load %s: %v", module, err)
-		}
-		for i, from := range stmt.From {
-			v, ok := dict[from.Name]
-			if !ok {
-				return fr.errorf(stmt.From[i].NamePos, "load: name %s not found in module %s", from.Name, module)
-			}
-			fr.set(stmt.To[i], v)
-		}
-		return nil
+		return execLoad(fr, stmt)
 	}
 
 	start, _ := stmt.Span()
@@ -572,6 +1002,49 @@ func exec(fr *Frame, stmt syntax.Stmt) error {
 	panic("unreachable")
 }
 
+// execLoad executes a load statement.
+func execLoad(fr *Frame, stmt *syntax.LoadStmt) error {
+	module := stmt.ModuleName()
+	if fr.thread.Load == nil {
+		return fr.errorf(stmt.Load, "load not implemented by this application")
+	}
+	fr.posn = stmt.Load
+	dict, err := fr.thread.Load(fr.thread, module)
+	if err != nil {
+		return fr.errorf(stmt.Load, "cannot load %s: %v", module, err)
+	}
+	for i, from := range stmt.From {
+		v, ok := dict[from.Name]
+		if !ok {
+			return fr.errorf(stmt.From[i].NamePos, "load: name %s not found in module %s", from.Name, module)
+		}
+		fr.set(stmt.To[i], v)
+	}
+	return nil
+}
+
+// inplaceBinary computes the new value of x in the augmented
+// assignment x op= y, where op is an augmented assignment operator
+// such as PLUS_EQ.
+func inplaceBinary(fr *Frame, opPos syntax.Position, op syntax.Token, x, y Value) (Value, error) {
+	// Special case, following Python:
+	// If x is a list, x += y is sugar for x.extend(y).
+	if xlist, ok := x.(*List); ok && op == syntax.PLUS_EQ {
+		// It's possible that y is not Iterable but
+		// nonetheless defines x+y, in which case we
+		// should fall back to the general case.
+		if yiter, ok := y.(Iterable); ok {
+			if err := xlist.checkMutable("apply += to", true); err != nil {
+				return nil, fr.errorf(opPos, "%v", err)
+			}
+			before := EstimateSize(xlist)
+			listExtend(xlist, yiter)
+			return xlist, fr.chargeGrowth(opPos, xlist, before)
+		}
+	}
+	return binary(fr, opPos, op-syntax.PLUS_EQ+syntax.PLUS, x, y)
+}
+
 // list += iterable
 func listExtend(x *List, y Iterable) {
 	if ylist, ok := y.(*List); ok {
@@ -587,27 +1060,25 @@ func listExtend(x *List, y Iterable) {
 	}
 }
 
-// getAttr implements x.dot.
-func getAttr(fr *Frame, x Value, dot *syntax.DotExpr) (Value, error) {
-	name := dot.Name.Name
-
+// getAttr implements x.name, where dot is the position of the dot.
+func getAttr(fr *Frame, dot syntax.Position, x Value, name string) (Value, error) {
 	// field or method?
 	if x, ok := x.(HasAttrs); ok {
 		if v, err := x.Attr(name); v != nil || err != nil {
-			return v, wrapError(fr, dot.Dot, err)
+			return v, wrapError(fr, dot, err)
 		}
 	}
 
-	return nil, fr.errorf(dot.Dot, "%s has no .%s field or method", x.Type(), name)
+	return nil, fr.errorf(dot, "%s has no .%s field or method", x.Type(), name)
 }
 
-// setField implements x.name = y.
-func setField(fr *Frame, x Value, dot *syntax.DotExpr, y Value) error {
+// setField implements x.name = y, where dot is the position of the dot.
+func setField(fr *Frame, dot syntax.Position, x Value, name string, y Value) error {
 	if x, ok := x.(HasSetField); ok {
-		err := x.SetField(dot.Name.Name, y)
-		return wrapError(fr, dot.Dot, err)
+		err := x.SetField(name, y)
+		return wrapError(fr, dot, err)
 	}
-	return fr.errorf(dot.Dot, "can't assign to .%s field of %s", dot.Name.Name, x.Type())
+	return fr.errorf(dot, "can't assign to .%s field of %s", name, x.Type())
 }
 
 // getIndex implements x[y].
@@ -645,9 +1116,11 @@ func getIndex(fr *Frame, lbrack syntax.Position, x, y Value) (Value, error) {
 func setIndex(fr *Frame, lbrack syntax.Position, x, y, z Value) error {
 	switch x := x.(type) {
 	case *Dict:
+		before := EstimateSize(x)
 		if err := x.Set(y, z); err != nil {
 			return fr.errorf(lbrack, "%v", err)
 		}
+		return fr.chargeGrowth(lbrack, x, before)
 
 	case HasSetIndex:
 		i, err := AsInt32(y)
@@ -665,7 +1138,37 @@ func setIndex(fr *Frame, lbrack syntax.Position, x, y, z Value) error {
 	default:
 		return fr.errorf(lbrack, "%s value does not support item assignment", x.Type())
 	}
-	return nil
+}
+
+// unpack returns the elements of rhs, a sequence of nlhs elements,
+// that is to be assigned to the operands of a tuple or list on the
+// left side of an assignment.
+func unpack(fr *Frame, pos syntax.Position, nlhs int, rhs Value) (Indexable, error) {
+	n := Len(rhs)
+	if n < 0 {
+		return nil, fr.errorf(pos, "got %s in sequence assignment", rhs.Type())
+	} else if n > nlhs {
+		return nil, fr.errorf(pos, "too many values to unpack (got %d, want %d)", n, nlhs)
+	} else if n < nlhs {
+		return nil, fr.errorf(pos, "too few values to unpack (got %d, want %d)", n, nlhs)
+	}
+
+	// If the rhs is not indexable, extract its elements into a
+	// temporary tuple before doing the assignment.
+	ix, ok := rhs.(Indexable)
+	if !ok {
+		tuple := make(Tuple, n)
+		iter := Iterate(rhs)
+		if iter == nil {
+			return nil, fr.errorf(pos, "non-iterable sequence: %s", rhs.Type())
+		}
+		for i := 0; i < n; i++ {
+			iter.Next(&tuple[i])
+		}
+		iter.Done()
+		ix = tuple
+	}
+	return ix, nil
 }
 
 // assign implements lhs = rhs for arbitrary expressions lhs.
@@ -701,7 +1204,7 @@ func assign(fr *Frame, pos syntax.Position, lhs syntax.Expr, rhs Value) error {
 		if err != nil {
 			return err
 		}
-		return setField(fr, x, lhs, rhs)
+		return setField(fr, lhs.Dot, x, lhs.Name.Name, rhs)
 
 	case *syntax.ParenExpr:
 		return assign(fr, pos, lhs.X, rhs)
@@ -713,33 +1216,11 @@ func assign(fr *Frame, pos syntax.Position, lhs syntax.Expr, rhs Value) error {
 }
 
 func assignSequence(fr *Frame, pos syntax.Position, lhs []syntax.Expr, rhs Value) error {
-	nlhs := len(lhs)
-	n := Len(rhs)
-	if n < 0 {
-		return fr.errorf(pos, "got %s in sequence assignment", rhs.Type())
-	} else if n > nlhs {
-		return fr.errorf(pos, "too many values to unpack (got %d, want %d)", n, nlhs)
-	} else if n < nlhs {
-		return fr.errorf(pos, "too few values to unpack (got %d, want %d)", n, nlhs)
-	}
-
-	// If the rhs is not indexable, extract its elements into a
-	// temporary tuple before doing the assignment.
-	ix, ok := rhs.(Indexable)
-	if !ok {
-		tuple := make(Tuple, n)
-		iter := Iterate(rhs)
-		if iter == nil {
-			return fr.errorf(pos, "non-iterable sequence: %s", rhs.Type())
-		}
-		for i := 0; i < n; i++ {
-			iter.Next(&tuple[i])
-		}
-		iter.Done()
-		ix = tuple
+	ix, err := unpack(fr, pos, len(lhs), rhs)
+	if err != nil {
+		return err
 	}
-
-	for i := 0; i < n; i++ {
+	for i := range lhs {
 		if err := assign(fr, pos, lhs[i], ix.Index(i)); err != nil {
 			return err
 		}
@@ -757,14 +1238,16 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		case syntax.INT:
 			switch e.Value.(type) {
 			case int64:
-				return MakeInt64(e.Value.(int64)), nil
+				return intValue(MakeInt64(e.Value.(int64))), nil
 			case *big.Int:
-				return Int{e.Value.(*big.Int)}, nil
+				return makeBigInt(e.Value.(*big.Int)), nil
 			}
 		case syntax.FLOAT:
 			return Float(e.Value.(float64)), nil
 		case syntax.STRING:
 			return String(e.Value.(string)), nil
+		case syntax.BYTES:
+			return Bytes(e.Value.(string)), nil
 		}
 
 	case *syntax.ListExpr:
@@ -776,14 +1259,19 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 			}
 			vals[i] = v
 		}
-		return NewList(vals), nil
+		list := NewList(vals)
+		return list, fr.charge(e.Lbrack, list)
 
 	case *syntax.CondExpr:
 		cond, err := eval(fr, e.Cond)
 		if err != nil {
 			return nil, err
 		}
-		if cond.Truth() {
+		truth := cond.Truth()
+		if fr.thread.Trace != nil {
+			fr.trace(TraceBranch, e, truth, nil)
+		}
+		if truth {
 			return eval(fr, e.True)
 		} else {
 			return eval(fr, e.False)
@@ -810,6 +1298,9 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		} else {
 			result = new(List)
 		}
+		if err := fr.charge(e.Lbrack, result); err != nil {
+			return nil, err
+		}
 		return result, evalComprehension(fr, e, result, 0)
 
 	case *syntax.TupleExpr:
@@ -822,7 +1313,8 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 			}
 			tuple[i] = v
 		}
-		return tuple, nil
+		start, _ := e.Span()
+		return tuple, fr.charge(start, tuple)
 
 	case *syntax.DictExpr:
 		dict := new(Dict)
@@ -843,7 +1335,7 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 				return nil, fr.errorf(e.Lbrace, "duplicate key: %v", k)
 			}
 		}
-		return dict, nil
+		return dict, fr.charge(e.Lbrace, dict)
 
 	case *syntax.UnaryExpr:
 		x, err := eval(fr, e.X)
@@ -892,18 +1384,14 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 		}
 
 		// binary operators
-		z, err := Binary(e.Op, x, y)
-		if err != nil {
-			return nil, fr.errorf(e.OpPos, "%s", err)
-		}
-		return z, nil
+		return binary(fr, e.OpPos, e.Op, x, y)
 
 	case *syntax.DotExpr:
 		x, err := eval(fr, e.X)
 		if err != nil {
 			return nil, err
 		}
-		return getAttr(fr, x, e)
+		return getAttr(fr, e.Dot, x, e.Name.Name)
 
 	case *syntax.CallExpr:
 		return evalCall(fr, e)
@@ -920,13 +1408,13 @@ func eval(fr *Frame, e syntax.Expr) (Value, error) {
 	panic("unreachable")
 }
 
-// Unary applies a unary operator (+, -, not) to its operand.
+// Unary applies a unary operator (+, -, ~, not) to its operand.
 func Unary(op syntax.Token, x Value) (Value, error) {
 	switch op {
 	case syntax.MINUS:
 		switch x := x.(type) {
 		case Int:
-			return zero.Sub(x), nil
+			return intValue(zero.Sub(x)), nil
 		case Float:
 			return -x, nil
 		}
@@ -935,6 +1423,10 @@ func Unary(op syntax.Token, x Value) (Value, error) {
 		case Int, Float:
 			return x, nil
 		}
+	case syntax.TILDE:
+		if x, ok := x.(Int); ok {
+			return intValue(x.Not()), nil
+		}
 	case syntax.NOT:
 		return !x.Truth(), nil
 	}
@@ -951,10 +1443,14 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			if y, ok := y.(String); ok {
 				return x + y, nil
 			}
+		case Bytes:
+			if y, ok := y.(Bytes); ok {
+				return x + y, nil
+			}
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x.Add(y), nil
+				return intValue(x.Add(y)), nil
 			case Float:
 				return x.Float() + y, nil
 			}
@@ -1001,7 +1497,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x.Sub(y), nil
+				return intValue(x.Sub(y)), nil
 			case Float:
 				return x.Float() - y, nil
 			}
@@ -1012,6 +1508,12 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			case Int:
 				return x - y.Float(), nil
 			}
+		case *Set: // difference
+			if y, ok := y.(*Set); ok {
+				iter := Iterate(y)
+				defer iter.Done()
+				return x.Difference(iter)
+			}
 		}
 
 	case syntax.STAR:
@@ -1019,7 +1521,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		case Int:
 			switch y := y.(type) {
 			case Int:
-				return x.Mul(y), nil
+				return intValue(x.Mul(y)), nil
 			case Float:
 				return x.Float() * y, nil
 			case String:
@@ -1109,7 +1611,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y.Sign() == 0 {
 					return nil, fmt.Errorf("floored division by zero")
 				}
-				return x.Div(y), nil
+				return intValue(x.Div(y)), nil
 			case Float:
 				if y == 0.0 {
 					return nil, fmt.Errorf("floored division by zero")
@@ -1140,7 +1642,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				if y.Sign() == 0 {
 					return nil, fmt.Errorf("integer modulo by zero")
 				}
-				return x.Mod(y), nil
+				return intValue(x.Mod(y)), nil
 			case Float:
 				if y == 0 {
 					return nil, fmt.Errorf("float modulo by zero")
@@ -1205,6 +1707,18 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 				return nil, fmt.Errorf("'in <string>' requires string as left operand, not %s", x.Type())
 			}
 			return Bool(strings.Contains(string(y), string(needle))), nil
+		case Bytes:
+			switch needle := x.(type) {
+			case Bytes:
+				return Bool(strings.Contains(string(y), string(needle))), nil
+			case Int:
+				b, err := AsInt32(needle)
+				if err != nil || b < 0 || b > 255 {
+					return nil, fmt.Errorf("int in bytes: %s out of range", needle)
+				}
+				return Bool(strings.IndexByte(string(y), byte(b)) >= 0), nil
+			}
+			return nil, fmt.Errorf("'in <bytes>' requires bytes or int as left operand, not %s", x.Type())
 		case rangeValue:
 			i, err := NumberToInt(x)
 			if err != nil {
@@ -1217,7 +1731,7 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		switch x := x.(type) {
 		case Int:
 			if y, ok := y.(Int); ok {
-				return x.Or(y), nil
+				return intValue(x.Or(y)), nil
 			}
 		case *Set: // union
 			if y, ok := y.(*Set); ok {
@@ -1231,14 +1745,13 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 		switch x := x.(type) {
 		case Int:
 			if y, ok := y.(Int); ok {
-				return x.And(y), nil
+				return intValue(x.And(y)), nil
 			}
 		case *Set: // intersection
 			if y, ok := y.(*Set); ok {
 				set := new(Set)
-				if x.Len() > y.Len() {
-					x, y = y, x // opt: range over smaller set
-				}
+				// The result has the order of the left operand,
+				// like the intersection method.
 				for _, xelem := range x.elems() {
 					// Has, Insert cannot fail here.
 					if found, _ := y.Has(xelem); found {
@@ -1249,6 +1762,44 @@ func Binary(op syntax.Token, x, y Value) (Value, error) {
 			}
 		}
 
+	case syntax.CIRCUMFLEX:
+		switch x := x.(type) {
+		case Int:
+			if y, ok := y.(Int); ok {
+				return intValue(x.Xor(y)), nil
+			}
+		case *Set: // symmetric difference
+			if y, ok := y.(*Set); ok {
+				iter := Iterate(y)
+				defer iter.Done()
+				return x.SymmetricDifference(iter)
+			}
+		}
+
+	case syntax.LTLT, syntax.GTGT:
+		if x, ok := x.(Int); ok {
+			if y, ok := y.(Int); ok {
+				if y.Sign() < 0 {
+					return nil, fmt.Errorf("negative shift count: %v", y)
+				}
+				n, err := AsInt32(y)
+				if op == syntax.LTLT {
+					if err != nil || n >= maxShift {
+						return nil, fmt.Errorf("shift count too large: %v", y)
+					}
+					return intValue(x.Lsh(uint(n))), nil
+				}
+				if err != nil {
+					// All bits are shifted out.
+					if x.Sign() < 0 {
+						return MakeInt(-1), nil
+					}
+					return zero, nil
+				}
+				return intValue(x.Rsh(uint(n))), nil
+			}
+		}
+
 	default:
 		// unknown operator
 		goto unknown
@@ -1273,6 +1824,23 @@ unknown:
 	return nil, fmt.Errorf("unknown binary op: %s %s %s", x.Type(), op, y.Type())
 }
 
+// binary applies a binary operator on behalf of the evaluator,
+// accounting for the memory allocated by the result.
+func binary(fr *Frame, opPos syntax.Position, op syntax.Token, x, y Value) (Value, error) {
+	if err := fr.thread.CheckAllocs(binarySize(op, x, y)); err != nil {
+		return nil, fr.wrap(opPos, err)
+	}
+	z, err := Binary(op, x, y)
+	if err != nil {
+		return nil, fr.errorf(opPos, "%s", err)
+	}
+	return z, fr.charge(opPos, z)
+}
+
+// maxShift is the exclusive upper bound on the count of a left shift x << y.
+// It prevents a single operation from allocating an arbitrarily large int.
+const maxShift = 512
+
 func repeat(elems []Value, n int) (res []Value) {
 	if n > 0 {
 		res = make([]Value, 0, len(elems)*n)
@@ -1299,14 +1867,11 @@ func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
 			if err != nil {
 				return nil, err
 			}
-
-			// Make the call.
-			res, err := method(name, recv, args, kwargs)
-			return res, wrapError(fr, call.Lparen, err)
+			return callMethod(fr, call.Lparen, recv, name, method, args, kwargs)
 		}
 
 		// Fall back to usual path.
-		fn, err = getAttr(fr, recv, dot)
+		fn, err = getAttr(fr, dot.Dot, recv, name)
 		if err != nil {
 			return nil, err
 		}
@@ -1323,10 +1888,44 @@ func evalCall(fr *Frame, call *syntax.CallExpr) (Value, error) {
 		return nil, err
 	}
 
-	// Make the call.
-	fr.posn = call.Lparen
+	return callValue(fr, call.Lparen, fn, args, kwargs)
+}
+
+// callValue calls the function value fn on behalf of the evaluator.
+// lparen is the position of the call's open parenthesis.
+func callValue(fr *Frame, lparen syntax.Position, fn Value, args Tuple, kwargs []Tuple) (Value, error) {
+	fr.posn = lparen
 	res, err := Call(fr.thread, fn, args, kwargs)
-	return res, wrapError(fr, call.Lparen, err)
+	return res, wrapError(fr, lparen, err)
+}
+
+// callMethod calls the named built-in method of recv on behalf of the
+// evaluator, accounting for the memory it allocates.
+func callMethod(fr *Frame, lparen syntax.Position, recv Value, name string, method builtinMethod, args Tuple, kwargs []Tuple) (Value, error) {
+	before := EstimateSize(recv)
+	fr.thread.beginBuiltin(recv.Type() + "." + name)
+	res, err := method(name, recv, args, kwargs)
+	fr.thread.endBuiltin()
+	if err != nil {
+		return nil, wrapError(fr, lparen, err)
+	}
+	// Account for growth of the receiver and for the result,
+	// unless it is an existing element of the receiver.
+	if err := fr.chargeGrowth(lparen, recv, before); err != nil {
+		return nil, err
+	}
+	if elementMethods[name] {
+		return res, nil
+	}
+	return res, fr.charge(lparen, res)
+}
+
+// elementMethods is the set of names of built-in methods whose results
+// are existing elements of the receiver, and so allocate nothing.
+var elementMethods = map[string]bool{
+	"get":        true,
+	"pop":        true,
+	"setdefault": true,
 }
 
 // wrapError wraps the error in a starlark.EvalError only if needed.
@@ -1335,7 +1934,7 @@ func wrapError(fr *Frame, posn syntax.Position, err error) error {
 	case nil, *EvalError:
 		return err
 	}
-	return fr.errorf(posn, "%s", err.Error())
+	return fr.wrap(posn, err)
 }
 
 func evalArgs(fr *Frame, call *syntax.CallExpr) (args Tuple, kwargs []Tuple, err error) {
@@ -1504,6 +2103,8 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 			switch x := x.(type) {
 			case String:
 				return String(x[start:end]), nil
+			case Bytes:
+				return Bytes(x[start:end]), nil
 			case *List:
 				elems := append([]Value{}, x.elems[start:end]...)
 				return NewList(elems), nil
@@ -1547,6 +2148,12 @@ func slice(x, lo, hi, step_ Value) (Value, error) {
 			str = append(str, x[i])
 		}
 		return String(str), nil
+	case Bytes:
+		var str []byte
+		for i := start; signum(end-i) == sign; i += step {
+			str = append(str, x[i])
+		}
+		return Bytes(str), nil
 	case *List:
 		var list []Value
 		for i := start; signum(end-i) == sign; i += step {
@@ -1631,19 +2238,16 @@ func evalComprehension(fr *Frame, comp *syntax.Comprehension, result Value, clau
 			if err != nil {
 				return err
 			}
-			if err := result.(*Dict).Set(k, v); err != nil {
-				return fr.errorf(entry.Colon, "%v", err)
-			}
+			return comprehensionSet(fr, entry.Colon, result.(*Dict), k, v)
 		} else {
 			// list: [body for vars in x]
 			x, err := eval(fr, comp.Body)
 			if err != nil {
 				return err
 			}
-			list := result.(*List)
-			list.elems = append(list.elems, x)
+			start, _ := comp.Body.Span()
+			return comprehensionAppend(fr, start, result.(*List), x)
 		}
-		return nil
 	}
 
 	clause := comp.Clauses[clauseIndex]
@@ -1670,6 +2274,9 @@ func evalComprehension(fr *Frame, comp *syntax.Comprehension, result Value, clau
 		defer iter.Done()
 		var elem Value
 		for iter.Next(&elem) {
+			if err := fr.thread.tick(); err != nil {
+				return fr.wrap(clause.For, err)
+			}
 			if err := assign(fr, clause.For, clause.Vars, elem); err != nil {
 				return err
 			}
@@ -1686,6 +2293,31 @@ func evalComprehension(fr *Frame, comp *syntax.Comprehension, result Value, clau
 	panic("unreachable")
 }
 
+// comprehensionSet adds the entry k: v to the result of a dict
+// comprehension.  colon is the position of the body's colon.
+func comprehensionSet(fr *Frame, colon syntax.Position, dict *Dict, k, v Value) error {
+	before := dict.Len()
+	if err := dict.Set(k, v); err != nil {
+		return fr.errorf(colon, "%v", err)
+	}
+	if dict.Len() > before {
+		if err := fr.thread.AddAllocs(sizeofEntry); err != nil {
+			return fr.wrap(colon, err)
+		}
+	}
+	return nil
+}
+
+// comprehensionAppend appends x to the result of a list comprehension.
+// start is the position of the comprehension's body.
+func comprehensionAppend(fr *Frame, start syntax.Position, list *List, x Value) error {
+	list.elems = append(list.elems, x)
+	if err := fr.thread.AddAllocs(sizeofValue); err != nil {
+		return fr.wrap(start, err)
+	}
+	return nil
+}
+
 func evalFunction(fr *Frame, pos syntax.Position, name string, function *syntax.Function) (Value, error) {
 	// Example: f(x, y=dflt, *args, **kwargs)
 
@@ -1702,6 +2334,12 @@ func evalFunction(fr *Frame, pos syntax.Position, name string, function *syntax.
 		}
 	}
 
+	return makeFunction(fr, pos, name, function, defaults)
+}
+
+// makeFunction returns a new function value for the specified
+// syntactic function, given the values of its parameter defaults.
+func makeFunction(fr *Frame, pos syntax.Position, name string, function *syntax.Function, defaults Tuple) (*Function, error) {
 	// Capture the values of the function's
 	// free variables from the lexical environment.
 	freevars := make([]Value, len(function.FreeVars))
@@ -1719,6 +2357,7 @@ func evalFunction(fr *Frame, pos syntax.Position, name string, function *syntax.
 		syntax:      function,
 		predeclared: fr.predeclared,
 		globals:     fr.globals,
+		globalNames: fr.globalNames,
 		defaults:    defaults,
 		freevars:    freevars,
 	}, nil
@@ -1729,31 +2368,65 @@ func (fn *Function) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, err
 		fmt.Printf("call of %s %v %v\n", fn.Name(), args, kwargs)
 	}
 
+	if err := thread.tick(); err != nil {
+		return nil, err
+	}
+
+	maxDepth := thread.maxDepth
+	if maxDepth == 0 {
+		maxDepth = DefaultMaxCallDepth
+	}
+	if thread.depth >= maxDepth {
+		return nil, fmt.Errorf("Starlark stack overflow: maximum call depth (%d) exceeded", maxDepth)
+	}
+
 	// detect recursion
-	for fr := thread.frame; fr != nil; fr = fr.parent {
+	allowRecursion := fn.syntax.AllowRecursion
+	if !allowRecursion {
 		// We look for the same syntactic function,
 		// not function value, otherwise the user could
 		// defeat the check by writing the Y combinator.
-		if fr.fn != nil && fr.fn.syntax == fn.syntax {
+		if thread.active[fn.syntax] {
 			return nil, fmt.Errorf("function %s called recursively", fn.Name())
 		}
+		if thread.active == nil {
+			thread.active = make(map[*syntax.Function]bool)
+		}
+		thread.active[fn.syntax] = true
 	}
 
-	fr := thread.Push(fn.predeclared, fn.globals, len(fn.syntax.Locals))
+	var nstack int
+	if fn.funcode != nil {
+		nstack = fn.funcode.maxStack
+	}
+	fr := thread.push(fn.predeclared, fn.globals, len(fn.syntax.Locals), nstack)
 	fr.fn = fn
+	fr.globalNames, fr.localNames = fn.globalNames, fn.syntax.Locals
+	fr.trace(TraceCall, fn.syntax, nil, nil)
+	var result Value = None
 	err := fn.setArgs(fr, args, kwargs)
 	if err == nil {
-		err = fr.ExecStmts(fn.syntax.Body)
+		if fn.funcode != nil {
+			result, err = run(fr, fn.funcode)
+		} else if err = fr.ExecStmts(fn.syntax.Body); err == errReturn {
+			result, err = fr.result, nil
+		}
+	}
+	if err != nil {
+		fr.trace(TraceReturn, fn.syntax, nil, err)
+	} else {
+		fr.trace(TraceReturn, fn.syntax, result, nil)
 	}
 	thread.Pop()
 
+	if !allowRecursion {
+		delete(thread.active, fn.syntax)
+	}
+
 	if err != nil {
-		if err == errReturn {
-			return fr.result, nil
-		}
 		return nil, err
 	}
-	return None, nil
+	return result, nil
 }
 
 // setArgs sets the values of the formal parameters of function fn in
@@ -1990,13 +2663,13 @@ func interpolate(format string, x Value) (Value, error) {
 			}
 			switch c {
 			case 'd', 'i':
-				buf.WriteString(i.bigint.Text(10))
+				buf.WriteString(i.text(10))
 			case 'o':
-				buf.WriteString(i.bigint.Text(8))
+				buf.WriteString(i.text(8))
 			case 'x':
-				buf.WriteString(i.bigint.Text(16))
+				buf.WriteString(i.text(16))
 			case 'X':
-				buf.WriteString(strings.ToUpper(i.bigint.Text(16)))
+				buf.WriteString(strings.ToUpper(i.text(16)))
 			}
 		case 'e', 'f', 'g', 'E', 'F', 'G':
 			f, ok := AsFloat(arg)
@@ -6,6 +6,7 @@ package starlark_test
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"math"
 	"path/filepath"
@@ -25,8 +26,14 @@ func init() {
 	resolve.AllowNestedDef = true
 	resolve.AllowFloat = true
 	resolve.AllowSet = true
+	resolve.AllowBytes = true
+	resolve.AllowWhile = true
 }
 
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
 func TestEvalExpr(t *testing.T) {
 	// This is mostly redundant with the new *.star tests.
 	// TODO(adonovan): move checks into *.star files and
@@ -91,33 +98,50 @@ func TestEvalExpr(t *testing.T) {
 	}
 }
 
+// testdataFiles lists the test scripts executed by TestExecFile.
+var testdataFiles = []string{
+	"testdata/assign.star",
+	"testdata/bool.star",
+	"testdata/builtins.star",
+	"testdata/bytes.star",
+	"testdata/control.star",
+	"testdata/dict.star",
+	"testdata/float.star",
+	"testdata/function.star",
+	"testdata/int.star",
+	"testdata/list.star",
+	"testdata/misc.star",
+	"testdata/set.star",
+	"testdata/string.star",
+	"testdata/tuple.star",
+	"testdata/while.star",
+}
+
+// engines lists the execution engines, the reference first.
+var engines = []starlark.Engine{starlark.TreeWalker, starlark.Bytecode}
+
 func TestExecFile(t *testing.T) {
+	for _, engine := range engines {
+		t.Run(engine.String(), func(t *testing.T) { testExecFile(t, engine) })
+	}
+}
+
+func testExecFile(t *testing.T, engine starlark.Engine) {
 	testdata := starlarktest.DataFile(".", ".")
 	//fmt.Printf("Inspecting testdata, %s!\n", testdata)
 	thread := &starlark.Thread{Load: load}
 	starlarktest.SetReporter(thread, t)
-	for _, file := range []string{
-		"testdata/assign.star",
-		"testdata/bool.star",
-		"testdata/builtins.star",
-		"testdata/control.star",
-		"testdata/dict.star",
-		"testdata/float.star",
-		"testdata/function.star",
-		"testdata/int.star",
-		"testdata/list.star",
-		"testdata/misc.star",
-		"testdata/set.star",
-		"testdata/string.star",
-		"testdata/tuple.star",
-	} {
+	starlarktest.RecordCoverage(thread)
+	for _, file := range testdataFiles {
 		filename := filepath.Join(testdata, file)
 		for _, chunk := range chunkedfile.Read(filename, t) {
-			predeclared := starlark.StringDict{
-				"hasfields": starlark.NewBuiltin("hasfields", newHasFields),
-				"fibonacci": fib{},
-			}
-			_, err := starlark.ExecFile(thread, filename, chunk.Source, predeclared)
+			_, err := starlark.Exec(starlark.ExecOptions{
+				Thread:      thread,
+				Filename:    filename,
+				Source:      chunk.Source,
+				Predeclared: testPredeclared(),
+				Engine:      engine,
+			})
 			switch err := err.(type) {
 			case *starlark.EvalError:
 				found := false
@@ -142,6 +166,14 @@ func TestExecFile(t *testing.T) {
 	}
 }
 
+// testPredeclared returns the predeclared environment of the test scripts.
+func testPredeclared() starlark.StringDict {
+	return starlark.StringDict{
+		"hasfields": starlark.NewBuiltin("hasfields", newHasFields),
+		"fibonacci": fib{},
+	}
+}
+
 // A fib is an iterable value representing the infinite Fibonacci sequence.
 type fib struct{}
 
@@ -348,23 +380,29 @@ func Benchmark(b *testing.B) {
 	} {
 		filename := filepath.Join(testdata, file)
 
-		// Evaluate the file once.
-		globals, err := starlark.ExecFile(thread, filename, nil, nil)
-		if err != nil {
-			reportEvalError(b, err)
-		}
+		for _, engine := range engines {
+			// Evaluate the file once.
+			globals, err := starlark.Exec(starlark.ExecOptions{
+				Thread:   thread,
+				Filename: filename,
+				Engine:   engine,
+			})
+			if err != nil {
+				reportEvalError(b, err)
+			}
 
-		// Repeatedly call each global function named bench_* as a benchmark.
-		for name, value := range globals {
-			if fn, ok := value.(*starlark.Function); ok && strings.HasPrefix(name, "bench_") {
-				b.Run(name, func(b *testing.B) {
-					for i := 0; i < b.N; i++ {
-						_, err := starlark.Call(thread, fn, nil, nil)
-						if err != nil {
-							reportEvalError(b, err)
+			// Repeatedly call each global function named bench_* as a benchmark.
+			for name, value := range globals {
+				if fn, ok := value.(*starlark.Function); ok && strings.HasPrefix(name, "bench_") {
+					b.Run(engine.String()+"/"+name, func(b *testing.B) {
+						for i := 0; i < b.N; i++ {
+							_, err := starlark.Call(thread, fn, nil, nil)
+							if err != nil {
+								reportEvalError(b, err)
+							}
 						}
-					}
-				})
+					})
+				}
 			}
 		}
 	}
@@ -505,3 +543,492 @@ func TestUnpackUserDefined(t *testing.T) {
 		t.Errorf("unpack args error = %q, want %q", err, want)
 	}
 }
+
+// TestCancel ensures that Thread.Cancel stops a running Starlark
+// computation at the next loop iteration or function call.
+func TestCancel(t *testing.T) {
+	// A thread cancelled before execution begins fails
+	// at the first statement.
+	{
+		thread := new(starlark.Thread)
+		thread.Cancel("nope")
+		_, err := starlark.ExecFile(thread, "precancel.star", `x = [y for y in range(3)]`, nil)
+		if fmt.Sprint(err) != "Starlark computation cancelled: nope" {
+			t.Errorf("execution returned error %q, want cancellation", err)
+		}
+
+		// cancellation is sticky
+		_, err = starlark.ExecFile(thread, "precancel.star", `x = [y for y in range(3)]`, nil)
+		if fmt.Sprint(err) != "Starlark computation cancelled: nope" {
+			t.Errorf("execution returned error %q, want cancellation", err)
+		}
+
+		// until the thread is reset
+		thread.Uncancel()
+		if _, err := starlark.ExecFile(thread, "precancel.star", `x = [y for y in range(3)]`, nil); err != nil {
+			t.Errorf("execution after Uncancel failed: %v", err)
+		}
+	}
+	// A thread cancelled during a built-in executes until the next statement.
+	{
+		thread := new(starlark.Thread)
+		cancel := func(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			thread.Cancel("stop!")
+			return starlark.None, nil
+		}
+		const src = `
+def f():
+	for i in range(1000000):
+		if i == 3:
+			cancel()
+f()
+`
+		predeclared := starlark.StringDict{"cancel": starlark.NewBuiltin("cancel", cancel)}
+		_, err := starlark.ExecFile(thread, "cancel.star", src, predeclared)
+		evalErr, ok := err.(*starlark.EvalError)
+		if !ok {
+			t.Fatalf("execution returned %v, want *EvalError", err)
+		}
+		if got, want := evalErr.Backtrace(), `Traceback (most recent call last):
+  cancel.star:6:2: in <toplevel>
+  cancel.star:4:3: in f
+Error: Starlark computation cancelled: stop!`; got != want {
+			t.Errorf("backtrace was %s, want %s", got, want)
+		}
+	}
+	// A thread cancelled from another goroutine stops an unbounded loop.
+	{
+		thread := new(starlark.Thread)
+		go thread.Cancel("timeout")
+		_, err := starlark.ExecFile(thread, "loop.star", `
+def f():
+	for x in range(1000000000):
+		pass
+f()
+`, nil)
+		if fmt.Sprint(err) != "Starlark computation cancelled: timeout" {
+			t.Errorf("execution returned error %q, want cancellation", err)
+		}
+	}
+}
+
+// TestExecutionSteps ensures that the step counter is deterministic
+// and that exceeding the limit fails with a *StepLimitError.
+func TestExecutionSteps(t *testing.T) {
+	const src = `
+def f(n):
+	return [x * x for x in range(n)]
+def g():
+	for i in range(10):
+		f(i)
+g()
+`
+	countSteps := func(max uint64) (uint64, error) {
+		thread := new(starlark.Thread)
+		thread.SetMaxExecutionSteps(max)
+		_, err := starlark.ExecFile(thread, "steps.star", src, nil)
+		return thread.ExecutionSteps(), err
+	}
+
+	// The count is reproducible.
+	steps, err := countSteps(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := countSteps(0); again != steps {
+		t.Errorf("step count varies between runs: %d, then %d", steps, again)
+	}
+	// 3 toplevel statements, 1 call of g, 1 statement in g,
+	// 10 iterations of 1 statement, 10 calls of f, 10 return statements,
+	// and 0+1+...+9 comprehension iterations.
+	if want := uint64(3 + 1 + 1 + 10 + 10 + 10 + 45); steps != want {
+		t.Errorf("executed %d steps, want %d", steps, want)
+	}
+
+	// A limit equal to the count suffices.
+	if _, err := countSteps(steps); err != nil {
+		t.Errorf("with limit %d: %v", steps, err)
+	}
+
+	// A smaller one does not.
+	_, err = countSteps(steps - 1)
+	if _, ok := err.(*starlark.EvalError); !ok {
+		t.Fatalf("with limit %d: got %v, want *EvalError", steps-1, err)
+	}
+	var stepErr *starlark.StepLimitError
+	if !errors.As(err, &stepErr) || stepErr.MaxSteps != steps-1 {
+		t.Errorf("with limit %d: got %v, want StepLimitError", steps-1, err)
+	}
+	if want := fmt.Sprintf("Starlark computation exceeded %d steps", steps-1); err.Error() != want {
+		t.Errorf("got error %q, want %q", err, want)
+	}
+}
+
+// TestAddExecutionSteps ensures that built-in functions may charge
+// steps to the thread, subject to its limit.
+func TestAddExecutionSteps(t *testing.T) {
+	work := starlark.NewBuiltin("work", func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var n int
+		if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &n); err != nil {
+			return nil, err
+		}
+		return starlark.None, thread.AddExecutionSteps(uint64(n))
+	})
+	predeclared := starlark.StringDict{"work": work}
+
+	thread := new(starlark.Thread)
+	if _, err := starlark.ExecFile(thread, "work.star", "work(100)\nwork(0)", predeclared); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := thread.ExecutionSteps(), uint64(2+100); got != want {
+		t.Errorf("executed %d steps, want %d", got, want)
+	}
+
+	thread = new(starlark.Thread)
+	thread.SetMaxExecutionSteps(100)
+	_, err := starlark.ExecFile(thread, "work.star", "work(100)", predeclared)
+	var stepErr *starlark.StepLimitError
+	if !errors.As(err, &stepErr) || stepErr.MaxSteps != 100 {
+		t.Errorf("with limit 100: got %v, want StepLimitError", err)
+	}
+
+	// AddByteSteps charges one step for each BytesPerStep bytes.
+	thread = new(starlark.Thread)
+	for _, n := range []int{0, starlark.BytesPerStep - 1, 100 * starlark.BytesPerStep} {
+		if err := thread.AddByteSteps(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := thread.ExecutionSteps(), uint64(100); got != want {
+		t.Errorf("AddByteSteps charged %d steps, want %d", got, want)
+	}
+}
+
+// TestAllocLimit ensures that programs that allocate too much memory
+// fail with an *AllocLimitError before they exhaust the host's memory.
+func TestAllocLimit(t *testing.T) {
+	const limit = 100000
+	for _, test := range []struct{ src, wantLine string }{
+		{`x = "abc" * 1000000000`, "alloc.star:1:11"},
+		{`x = [None] * 1000000000`, "alloc.star:1:12"},
+		{`x = list(range(1000000000))`, "alloc.star:1:9"},
+		{`x = sorted(range(1000000000))`, "alloc.star:1:11"},
+		{`x = [i for i in range(1000000000)]`, "alloc.star:1:6"},
+		{`x = {i: i for i in range(1000000000)}`, "alloc.star:1:7"},
+		{`
+def f():
+	s = "x"
+	for i in range(100):
+		s += s
+f()`, "alloc.star:5:5"},
+		{`
+def f():
+	l = []
+	for i in range(1000000000):
+		l.append(i)
+f()`, "alloc.star:5:11"},
+		{`
+def f():
+	d = {}
+	for i in range(1000000000):
+		d[i] = i
+f()`, "alloc.star:5:4"},
+	} {
+		thread := new(starlark.Thread)
+		thread.SetMaxAllocs(limit)
+		_, err := starlark.ExecFile(thread, "alloc.star", test.src, nil)
+		evalErr, ok := err.(*starlark.EvalError)
+		if !ok {
+			t.Errorf("%s: got %v, want *EvalError", test.src, err)
+			continue
+		}
+		var allocErr *starlark.AllocLimitError
+		if !errors.As(err, &allocErr) || allocErr.MaxAllocs != limit {
+			t.Errorf("%s: got %v, want AllocLimitError", test.src, err)
+		}
+		if got := evalErr.Frame.Position().String(); got != test.wantLine {
+			t.Errorf("%s: error reported at %s, want %s", test.src, got, test.wantLine)
+		}
+		if !strings.HasPrefix(err.Error(), "out of memory") {
+			t.Errorf("%s: got error %q, want out of memory", test.src, err)
+		}
+		// The failing allocation may overshoot the limit, but not by much.
+		if got := thread.Allocs(); got > 2*limit {
+			t.Errorf("%s: allocated %d bytes, want at most %d", test.src, got, 2*limit)
+		}
+	}
+
+	// Allocation accounting is deterministic.
+	const src = `
+def f(n):
+	return {str(i): [i] * 3 for i in range(n)}
+x = [f(i) for i in range(30)]
+`
+	var allocs []int64
+	for i := 0; i < 2; i++ {
+		thread := new(starlark.Thread)
+		if _, err := starlark.ExecFile(thread, "alloc.star", src, nil); err != nil {
+			t.Fatal(err)
+		}
+		allocs = append(allocs, thread.Allocs())
+	}
+	if allocs[0] == 0 || allocs[0] != allocs[1] {
+		t.Errorf("allocation counts = %v, want equal nonzero values", allocs)
+	}
+
+	// A list is charged for its length, not for the capacity
+	// that append happens to give it.
+	for _, n := range []int{1000, 1001, 2000} {
+		thread := new(starlark.Thread)
+		src := fmt.Sprintf("def f():\n\tl = []\n\tfor i in range(%d):\n\t\tl.append(i)\nf()\n", n)
+		if _, err := starlark.ExecFile(thread, "alloc.star", src, nil); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := thread.Allocs(), int64(48+16*n); got != want {
+			t.Errorf("appending %d elements allocated %d bytes, want %d", n, got, want)
+		}
+	}
+}
+
+// TestDialect checks that each call of Exec or EvalOptions uses its
+// own dialect, and that a file may extend it by a pragma.
+func TestDialect(t *testing.T) {
+	thread := new(starlark.Thread)
+	exec := func(src string, dialect *resolve.Options) error {
+		_, err := starlark.Exec(starlark.ExecOptions{
+			Thread:   thread,
+			Filename: "dialect.star",
+			Source:   src,
+			Dialect:  dialect,
+		})
+		return err
+	}
+
+	const lambda = "f = lambda: 1\n"
+	if err := exec(lambda, &resolve.Options{}); err == nil {
+		t.Error("lambda accepted by standard dialect")
+	}
+	if err := exec(lambda, &resolve.Options{AllowLambda: true}); err != nil {
+		t.Errorf("lambda rejected by extended dialect: %v", err)
+	}
+	if _, err := starlark.EvalOptions(thread, "dialect.star", "(lambda: 1)()", nil, &resolve.Options{}); err == nil {
+		t.Error("lambda expression accepted by standard dialect")
+	}
+
+	const pragma = `# dialect: recursion
+def fib(x):
+	return x if x < 2 else fib(x-2) + fib(x-1)
+x = fib(10)
+`
+	if err := exec(pragma, &resolve.Options{}); err == nil {
+		t.Error("dialect pragma honored without Options.Pragma")
+	}
+	if err := exec(pragma, &resolve.Options{Pragma: true}); err != nil {
+		t.Errorf("dialect pragma not honored: %v", err)
+	}
+}
+
+// TestRecursion exercises the AllowRecursion dialect option
+// and the limit on call depth.
+func TestRecursion(t *testing.T) {
+	const src = `
+def fib(x):
+	if x < 2:
+		return x
+	return fib(x-2) + fib(x-1)
+def deep(n):
+	return n if n == 0 else deep(n - 1)
+`
+	thread := new(starlark.Thread)
+
+	// By default, recursion is an error.
+	globals, err := starlark.Exec(starlark.ExecOptions{
+		Thread:   thread,
+		Filename: "rec.star",
+		Source:   src,
+		Dialect:  &resolve.Options{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := starlark.Call(thread, globals["fib"], starlark.Tuple{starlark.MakeInt(10)}, nil); fmt.Sprint(err) != "function fib called recursively" {
+		t.Errorf("fib(10) returned error %v, want recursion error", err)
+	}
+
+	// With the option, it is permitted...
+	globals, err = starlark.Exec(starlark.ExecOptions{
+		Thread:   thread,
+		Filename: "rec.star",
+		Source:   src,
+		Dialect:  &resolve.Options{AllowRecursion: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := starlark.Call(thread, globals["fib"], starlark.Tuple{starlark.MakeInt(10)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if v.String() != "55" {
+		t.Errorf("fib(10) = %v, want 55", v)
+	}
+
+	// ...up to the maximum depth.
+	thread.SetMaxCallDepth(100)
+	if _, err := starlark.Call(thread, globals["deep"], starlark.Tuple{starlark.MakeInt(98)}, nil); err != nil {
+		t.Errorf("deep(98) failed: %v", err)
+	}
+	_, err = starlark.ExecFile(thread, "overflow.star", `x = deep(200)`, starlark.StringDict{"deep": globals["deep"]})
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		t.Fatalf("deep(200) returned %v, want *EvalError", err)
+	}
+	const want = `Traceback (most recent call last):
+  overflow.star:1:9: in <toplevel>
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  ... 80 frames elided ...
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+  rec.star:7:30: in deep
+Error: Starlark stack overflow: maximum call depth (100) exceeded`
+	if got := evalErr.Backtrace(); got != want {
+		t.Errorf("backtrace was %s, want %s", got, want)
+	}
+}
+
+// A recordingHook records the frames observed by BeforeStmt.
+type recordingHook struct {
+	events []string
+	fail   int // if nonzero, fail at the statement on this line
+}
+
+func (h *recordingHook) BeforeStmt(fr *starlark.Frame, stmt syntax.Stmt) error {
+	depth := 0
+	for p := fr.Parent(); p != nil; p = p.Parent() {
+		depth++
+	}
+	line := fr.Position().Line
+	h.events = append(h.events, fmt.Sprintf("%d %d %s %s", line, depth, fr.Locals(), fr.Globals()))
+	if int(line) == h.fail {
+		return errors.New("stopped by hook")
+	}
+	return nil
+}
+
+func TestHook(t *testing.T) {
+	const src = `
+G = 1
+def f(a):
+	b = [x for x in [a]]
+	return b
+H = f(G)
+`
+	hook := new(recordingHook)
+	thread := &starlark.Thread{Hook: hook}
+	if _, err := starlark.ExecFile(thread, "hook.star", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	want := `2 0 {} {}
+3 0 {} {G: 1}
+6 0 {} {G: 1, f: <function f>}
+4 1 {a: 1} {G: 1, f: <function f>}
+5 1 {a: 1, b: [1], x: 1} {G: 1, f: <function f>}`
+	if got := strings.Join(hook.events, "\n"); got != want {
+		t.Errorf("hook events:\n%s\nwant:\n%s", got, want)
+	}
+
+	// An error from the hook stops execution at the statement.
+	hook = &recordingHook{fail: 5}
+	thread = &starlark.Thread{Hook: hook}
+	_, err := starlark.ExecFile(thread, "hook.star", src, nil)
+	evalErr, ok := err.(*starlark.EvalError)
+	if !ok {
+		t.Fatalf("got %v, want *EvalError", err)
+	}
+	if got, want := evalErr.Backtrace(), `Traceback (most recent call last):
+  hook.star:6:6: in <toplevel>
+  hook.star:5:2: in f
+Error: stopped by hook`; got != want {
+		t.Errorf("backtrace:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	const src = `
+def f(x):
+	if x:
+		return 1 // 0
+	return x
+f(0)
+f(1)
+`
+	for _, engine := range []starlark.Engine{starlark.TreeWalker, starlark.Bytecode} {
+		var events []string
+		thread := &starlark.Thread{
+			Trace: func(thread *starlark.Thread, ev *starlark.TraceEvent) {
+				start, _ := ev.Node.Span()
+				s := fmt.Sprintf("%s %T %d", ev.Kind, ev.Node, start.Line)
+				if ev.Result != nil {
+					s += " = " + ev.Result.String()
+				}
+				if ev.Err != nil {
+					s += " error"
+				}
+				events = append(events, s)
+			},
+		}
+		starlark.Exec(starlark.ExecOptions{Thread: thread, Filename: "trace.star", Source: src, Engine: engine})
+
+		var want string
+		switch engine {
+		case starlark.TreeWalker:
+			want = `call *syntax.File 2
+stmt *syntax.DefStmt 2
+stmtend *syntax.DefStmt 2
+stmt *syntax.ExprStmt 6
+call *syntax.Function 2
+stmt *syntax.IfStmt 3
+branch *syntax.IfStmt 3 = False
+stmtend *syntax.IfStmt 3
+stmt *syntax.ReturnStmt 5
+stmtend *syntax.ReturnStmt 5
+return *syntax.Function 2 = 0
+stmtend *syntax.ExprStmt 6
+stmt *syntax.ExprStmt 7
+call *syntax.Function 2
+stmt *syntax.IfStmt 3
+branch *syntax.IfStmt 3 = True
+stmt *syntax.ReturnStmt 4
+stmtend *syntax.ReturnStmt 4 error
+stmtend *syntax.IfStmt 3 error
+return *syntax.Function 2 error
+stmtend *syntax.ExprStmt 7 error
+return *syntax.File 2 error`
+		case starlark.Bytecode:
+			// The bytecode engine does not report statements.
+			want = `call *syntax.File 2
+call *syntax.Function 2
+return *syntax.Function 2 = 0
+call *syntax.Function 2
+return *syntax.Function 2 error
+return *syntax.File 2 error`
+		}
+		if got := strings.Join(events, "\n"); got != want {
+			t.Errorf("%s: trace:\n%s\nwant:\n%s", engine, got, want)
+		}
+	}
+}
@@ -8,90 +8,108 @@ import (
 	"fmt"
 	"math"
 	"math/big"
+	"strconv"
 
 	"github.com/aabbtree77/determinism/syntax"
 )
 
 // Int is the type of a Starlark int.
-type Int struct{ bigint *big.Int }
+//
+// An Int whose value fits in an int64 holds it directly, avoiding
+// allocation; only larger values are represented by a big.Int.
+// The representation of each value is unique: big is non-nil
+// only if the value does not fit in an int64.
+type Int struct {
+	small int64    // the value, if big is nil
+	big   *big.Int // the value, if it does not fit in small; immutable
+}
 
 // MakeInt returns a Starlark int for the specified signed integer.
 func MakeInt(x int) Int { return MakeInt64(int64(x)) }
 
 // MakeInt64 returns a Starlark int for the specified int64.
-func MakeInt64(x int64) Int {
-	if 0 <= x && x < int64(len(smallint)) {
-		if !smallintok {
-			panic("MakeInt64 used before initialization")
-		}
-		return Int{&smallint[x]}
-	}
-	return Int{new(big.Int).SetInt64(x)}
-}
+func MakeInt64(x int64) Int { return Int{small: x} }
 
 // MakeUint returns a Starlark int for the specified unsigned integer.
 func MakeUint(x uint) Int { return MakeUint64(uint64(x)) }
 
 // MakeUint64 returns a Starlark int for the specified uint64.
 func MakeUint64(x uint64) Int {
-	if x < uint64(len(smallint)) {
-		if !smallintok {
-			panic("MakeUint64 used before initialization")
-		}
-		return Int{&smallint[x]}
+	if x <= math.MaxInt64 {
+		return Int{small: int64(x)}
 	}
-	return Int{new(big.Int).SetUint64(uint64(x))}
+	return Int{big: new(big.Int).SetUint64(x)}
+}
+
+// MakeBigInt returns a Starlark int for the specified big.Int.
+// The int holds a copy of x, which the caller may subsequently modify.
+func MakeBigInt(x *big.Int) Int { return makeBigInt(new(big.Int).Set(x)) }
+
+// makeBigInt returns a Starlark int for the specified big.Int,
+// which the caller must not subsequently modify.
+func makeBigInt(x *big.Int) Int {
+	if x.IsInt64() {
+		return Int{small: x.Int64()}
+	}
+	return Int{big: x}
 }
 
 var (
-	smallint   [256]big.Int
-	smallintok bool
-	zero, one  Int
+	zero = MakeInt64(0)
+	one  = MakeInt64(1)
 )
 
+// smallints holds the Values of the ints 0 to 255, which are common
+// as loop counters, indices and lengths.  Unlike the conversion of an
+// Int to a Value, which allocates, intValue returns them for free.
+var smallints [256]Value
+
 func init() {
-	for i := range smallint {
-		smallint[i].SetInt64(int64(i))
+	for i := range smallints {
+		smallints[i] = MakeInt(i)
 	}
-	smallintok = true
+}
 
-	zero = MakeInt64(0)
-	one = MakeInt64(1)
+// intValue returns x as a Value, avoiding allocation for small ints.
+func intValue(x Int) Value {
+	if x.big == nil && 0 <= x.small && x.small < int64(len(smallints)) {
+		return smallints[x.small]
+	}
+	return x
+}
+
+// bigInt returns the value of i as a big.Int.
+// The result must not be modified.
+func (i Int) bigInt() *big.Int {
+	if i.big != nil {
+		return i.big
+	}
+	return new(big.Int).SetInt64(i.small)
 }
 
 // Int64 returns the value as an int64.
 // If it is not exactly representable the result is undefined and ok is false.
 func (i Int) Int64() (_ int64, ok bool) {
-	x, acc := bigintToInt64(i.bigint)
-	if acc != big.Exact {
+	if i.big != nil {
 		return // inexact
 	}
-	return x, true
+	return i.small, true
 }
 
 // Uint64 returns the value as a uint64.
 // If it is not exactly representable the result is undefined and ok is false.
 func (i Int) Uint64() (_ uint64, ok bool) {
-	x, acc := bigintToUint64(i.bigint)
-	if acc != big.Exact {
-		return // inexact
-	}
-	return x, true
-}
-
-// The math/big API should provide this function.
-func bigintToInt64(i *big.Int) (int64, big.Accuracy) {
-	sign := i.Sign()
-	if sign > 0 {
-		if i.Cmp(maxint64) > 0 {
-			return math.MaxInt64, big.Below
-		}
-	} else if sign < 0 {
-		if i.Cmp(minint64) < 0 {
-			return math.MinInt64, big.Above
+	if i.big != nil {
+		x, acc := bigintToUint64(i.big)
+		if acc != big.Exact {
+			return // inexact
 		}
+		return x, true
 	}
-	return i.Int64(), big.Exact
+	if i.small < 0 {
+		return // inexact
+	}
+	return uint64(i.small), true
 }
 
 // The math/big API should provide this function.
@@ -107,62 +125,189 @@ func bigintToUint64(i *big.Int) (uint64, big.Accuracy) {
 	return i.Uint64(), big.Exact
 }
 
-var (
-	minint64 = new(big.Int).SetInt64(math.MinInt64)
-	maxint64 = new(big.Int).SetInt64(math.MaxInt64)
-)
-
-func (i Int) String() string { return i.bigint.String() }
+func (i Int) String() string { return i.text(10) }
 func (i Int) Type() string   { return "int" }
 func (i Int) Freeze()        {} // immutable
 func (i Int) Truth() Bool    { return i.Sign() != 0 }
 func (i Int) Hash() (uint32, error) {
-	var lo big.Word
-	if i.bigint.Sign() != 0 {
-		lo = i.bigint.Bits()[0]
+	// The hash depends on the low word of the absolute value.
+	var lo uint64
+	if i.big != nil {
+		lo = uint64(i.big.Bits()[0])
+	} else if i.small < 0 {
+		lo = uint64(-i.small)
+	} else {
+		lo = uint64(i.small)
 	}
 	return 12582917 * uint32(lo+3), nil
 }
 func (x Int) CompareSameType(op syntax.Token, y Value, depth int) (bool, error) {
-	return threeway(op, x.bigint.Cmp(y.(Int).bigint)), nil
+	return threeway(op, x.Cmp(y.(Int))), nil
+}
+
+// Cmp returns -1, 0 or +1 according to whether x is less than,
+// equal to, or greater than y.
+func (x Int) Cmp(y Int) int {
+	if x.big == nil && y.big == nil {
+		switch {
+		case x.small < y.small:
+			return -1
+		case x.small > y.small:
+			return +1
+		}
+		return 0
+	}
+	return x.bigInt().Cmp(y.bigInt())
+}
+
+// text returns the representation of i in the specified base,
+// using lower-case letters for digits above 9.
+func (i Int) text(base int) string {
+	if i.big != nil {
+		return i.big.Text(base)
+	}
+	return strconv.FormatInt(i.small, base)
 }
 
 // Float returns the float value nearest i.
 func (i Int) Float() Float {
-	// TODO(adonovan): opt: handle common values without allocation.
-	f, _ := new(big.Float).SetInt(i.bigint).Float64()
+	if i.big == nil {
+		return Float(i.small)
+	}
+	f, _ := new(big.Float).SetInt(i.big).Float64()
 	return Float(f)
 }
 
-func (x Int) Sign() int     { return x.bigint.Sign() }
-func (x Int) Add(y Int) Int { return Int{new(big.Int).Add(x.bigint, y.bigint)} }
-func (x Int) Sub(y Int) Int { return Int{new(big.Int).Sub(x.bigint, y.bigint)} }
-func (x Int) Mul(y Int) Int { return Int{new(big.Int).Mul(x.bigint, y.bigint)} }
-func (x Int) Or(y Int) Int  { return Int{new(big.Int).Or(x.bigint, y.bigint)} }
-func (x Int) And(y Int) Int { return Int{new(big.Int).And(x.bigint, y.bigint)} }
+func (x Int) Sign() int {
+	if x.big != nil {
+		return x.big.Sign()
+	}
+	switch {
+	case x.small < 0:
+		return -1
+	case x.small > 0:
+		return +1
+	}
+	return 0
+}
+
+func (x Int) Add(y Int) Int {
+	if x.big == nil && y.big == nil {
+		z := x.small + y.small
+		if (z > x.small) == (y.small > 0) { // no overflow
+			return Int{small: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Add(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) Sub(y Int) Int {
+	if x.big == nil && y.big == nil {
+		z := x.small - y.small
+		if (z < x.small) == (y.small > 0) { // no overflow
+			return Int{small: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Sub(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) Mul(y Int) Int {
+	if x.big == nil && y.big == nil {
+		// Products of 32-bit operands cannot overflow.
+		if int64(int32(x.small)) == x.small && int64(int32(y.small)) == y.small {
+			return Int{small: x.small * y.small}
+		}
+	}
+	return makeBigInt(new(big.Int).Mul(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) Or(y Int) Int {
+	if x.big == nil && y.big == nil {
+		return Int{small: x.small | y.small}
+	}
+	return makeBigInt(new(big.Int).Or(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) And(y Int) Int {
+	if x.big == nil && y.big == nil {
+		return Int{small: x.small & y.small}
+	}
+	return makeBigInt(new(big.Int).And(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) Xor(y Int) Int {
+	if x.big == nil && y.big == nil {
+		return Int{small: x.small ^ y.small}
+	}
+	return makeBigInt(new(big.Int).Xor(x.bigInt(), y.bigInt()))
+}
+
+func (x Int) Not() Int {
+	if x.big == nil {
+		return Int{small: ^x.small}
+	}
+	return makeBigInt(new(big.Int).Not(x.big))
+}
+
+func (x Int) Lsh(y uint) Int {
+	if x.big == nil && y < 64 {
+		if z := x.small << y; z>>y == x.small { // no bits lost
+			return Int{small: z}
+		}
+	}
+	return makeBigInt(new(big.Int).Lsh(x.bigInt(), y))
+}
+
+func (x Int) Rsh(y uint) Int {
+	if x.big == nil {
+		return Int{small: x.small >> y}
+	}
+	return makeBigInt(new(big.Int).Rsh(x.big, y))
+}
 
 // Precondition: y is nonzero.
 func (x Int) Div(y Int) Int {
 	// http://python-history.blogspot.com/2010/08/why-pythons-integer-division-floors.html
+	if x.big == nil && y.big == nil && !(x.small == math.MinInt64 && y.small == -1) {
+		quo, rem := x.small/y.small, x.small%y.small
+		if (x.small < 0) != (y.small < 0) && rem != 0 {
+			quo--
+		}
+		return Int{small: quo}
+	}
+	xb, yb := x.bigInt(), y.bigInt()
 	var quo, rem big.Int
-	quo.QuoRem(x.bigint, y.bigint, &rem)
-	if (x.bigint.Sign() < 0) != (y.bigint.Sign() < 0) && rem.Sign() != 0 {
-		quo.Sub(&quo, one.bigint)
+	quo.QuoRem(xb, yb, &rem)
+	if (xb.Sign() < 0) != (yb.Sign() < 0) && rem.Sign() != 0 {
+		quo.Sub(&quo, big.NewInt(1))
 	}
-	return Int{&quo}
+	return makeBigInt(&quo)
 }
 
 // Precondition: y is nonzero.
 func (x Int) Mod(y Int) Int {
+	if x.big == nil && y.big == nil {
+		rem := x.small % y.small
+		if (x.small < 0) != (y.small < 0) && rem != 0 {
+			rem += y.small
+		}
+		return Int{small: rem}
+	}
+	xb, yb := x.bigInt(), y.bigInt()
 	var quo, rem big.Int
-	quo.QuoRem(x.bigint, y.bigint, &rem)
-	if (x.bigint.Sign() < 0) != (y.bigint.Sign() < 0) && rem.Sign() != 0 {
-		rem.Add(&rem, y.bigint)
+	quo.QuoRem(xb, yb, &rem)
+	if (xb.Sign() < 0) != (yb.Sign() < 0) && rem.Sign() != 0 {
+		rem.Add(&rem, yb)
 	}
-	return Int{&rem}
+	return makeBigInt(&rem)
 }
 
-func (i Int) rational() *big.Rat { return new(big.Rat).SetInt(i.bigint) }
+func (i Int) rational() *big.Rat {
+	if i.big == nil {
+		return new(big.Rat).SetInt64(i.small)
+	}
+	return new(big.Rat).SetInt(i.big)
+}
 
 // AsInt32 returns the value of x if is representable as an int32.
 func AsInt32(x Value) (int, error) {
@@ -170,11 +315,8 @@ func AsInt32(x Value) (int, error) {
 	if !ok {
 		return 0, fmt.Errorf("got %s, want int", x.Type())
 	}
-	if i.bigint.BitLen() <= 32 {
-		v := i.bigint.Int64()
-		if v >= math.MinInt32 && v <= math.MaxInt32 {
-			return int(v), nil
-		}
+	if i.big == nil && math.MinInt32 <= i.small && i.small <= math.MaxInt32 {
+		return int(i.small), nil
 	}
 	return 0, fmt.Errorf("%s out of range", i)
 }
@@ -202,16 +344,13 @@ func NumberToInt(x Value) (Int, error) {
 // finiteFloatToInt converts f to an Int, truncating towards zero.
 // f must be finite.
 func finiteFloatToInt(f Float) Int {
-	var i big.Int
-	if math.MinInt64 <= f && f <= math.MaxInt64 {
+	if math.MinInt64 <= f && f < math.MaxInt64 {
 		// small values
-		i.SetInt64(int64(f))
-	} else {
-		rat := f.rational()
-		if rat == nil {
-			panic(f) // non-finite
-		}
-		i.Div(rat.Num(), rat.Denom())
+		return MakeInt64(int64(f))
+	}
+	rat := f.rational()
+	if rat == nil {
+		panic(f) // non-finite
 	}
-	return Int{&i}
+	return makeBigInt(new(big.Int).Quo(rat.Num(), rat.Denom()))
 }
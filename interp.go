@@ -0,0 +1,427 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines the virtual machine that executes the bytecode
+// produced by compile.go.
+
+import (
+	"fmt"
+
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// run executes the code of fc in the frame fr, which must provide
+// sufficient local variables and operand stack, and returns the
+// operand of its return statement.
+func run(fr *Frame, fc *funcode) (Value, error) {
+	if debug {
+		fmt.Printf("run %s\n", fc.name)
+		defer fmt.Printf("run %s done\n", fc.name)
+	}
+
+	code := fc.code
+	stack := fr.stack
+	sp := 0
+
+	// iterstack holds the active iterators of for loops,
+	// comprehensions and *args arguments, innermost last.
+	var iterstack []Iterator
+	defer func() {
+		for i := len(iterstack) - 1; i >= 0; i-- {
+			iterstack[i].Done()
+		}
+	}()
+
+	pc := 0
+	for {
+		op := opcode(code[pc])
+		pc0 := pc
+		pc++
+		var arg uint32
+		if op >= opArgMin {
+			arg = uint32(code[pc]) | uint32(code[pc+1])<<8 | uint32(code[pc+2])<<16 | uint32(code[pc+3])<<24
+			pc += 4
+		}
+
+		switch op {
+		case opPop:
+			sp--
+
+		case opDup:
+			stack[sp] = stack[sp-1]
+			sp++
+
+		case opDup2:
+			stack[sp] = stack[sp-2]
+			stack[sp+1] = stack[sp-1]
+			sp += 2
+
+		case opExch:
+			stack[sp-2], stack[sp-1] = stack[sp-1], stack[sp-2]
+
+		case opRot:
+			x, y, z := stack[sp-3], stack[sp-2], stack[sp-1]
+			stack[sp-3], stack[sp-2], stack[sp-1] = z, x, y
+
+		case opNone:
+			stack[sp] = None
+			sp++
+
+		case opTick:
+			if profiling() {
+				// Record the current line for the profiler.
+				fr.posn = fc.position(pc0)
+			}
+			if err := fr.thread.tick(); err != nil {
+				return nil, fr.wrap(fc.position(pc0), err)
+			}
+
+		case opIterPush:
+			sp--
+			x := stack[sp]
+			iter := Iterate(x)
+			if iter == nil {
+				return nil, fr.errorf(fc.position(pc0), "%s value is not iterable", x.Type())
+			}
+			iterstack = append(iterstack, iter)
+
+		case opIterJmp:
+			if iterstack[len(iterstack)-1].Next(&stack[sp]) {
+				sp++
+			} else {
+				pc = int(arg)
+			}
+
+		case opIterPop:
+			n := len(iterstack) - 1
+			iterstack[n].Done()
+			iterstack = iterstack[:n]
+
+		case opReturn:
+			return stack[sp-1], nil
+
+		case opJmp:
+			pc = int(arg)
+
+		case opIfTrue:
+			sp--
+			if stack[sp].Truth() {
+				pc = int(arg)
+			}
+
+		case opIfFalse:
+			sp--
+			if !stack[sp].Truth() {
+				pc = int(arg)
+			}
+
+		case opConstant:
+			stack[sp] = fc.constants[arg]
+			sp++
+
+		case opLocal:
+			id := fc.idents[arg]
+			v := fr.locals[id.Index]
+			if v == nil {
+				var err error
+				if v, err = fr.lookup(id); err != nil {
+					return nil, err
+				}
+			}
+			stack[sp] = v
+			sp++
+
+		case opFree:
+			stack[sp] = fr.fn.freevars[arg]
+			sp++
+
+		case opGlobal:
+			id := fc.idents[arg]
+			v := fr.globals[id.Index]
+			if v == nil {
+				var err error
+				if v, err = fr.lookup(id); err != nil {
+					return nil, err
+				}
+			}
+			stack[sp] = v
+			sp++
+
+		case opLookup:
+			v, err := fr.lookup(fc.idents[arg])
+			if err != nil {
+				return nil, err
+			}
+			stack[sp] = v
+			sp++
+
+		case opSetLocal:
+			sp--
+			fr.locals[arg] = stack[sp]
+
+		case opSetGlobal:
+			sp--
+			fr.globals[arg] = stack[sp]
+
+		case opUnary:
+			y, err := Unary(syntax.Token(arg), stack[sp-1])
+			if err != nil {
+				return nil, fr.errorf(fc.position(pc0), "%s", err)
+			}
+			stack[sp-1] = y
+
+		case opBinary:
+			z, err := binary(fr, fc.position(pc0), syntax.Token(arg), stack[sp-2], stack[sp-1])
+			if err != nil {
+				return nil, err
+			}
+			sp--
+			stack[sp-1] = z
+
+		case opCompare:
+			ok, err := Compare(syntax.Token(arg), stack[sp-2], stack[sp-1])
+			if err != nil {
+				return nil, fr.errorf(fc.position(pc0), "%s", err)
+			}
+			sp--
+			stack[sp-1] = Bool(ok)
+
+		case opInplace:
+			z, err := inplaceBinary(fr, fc.position(pc0), syntax.Token(arg), stack[sp-2], stack[sp-1])
+			if err != nil {
+				return nil, err
+			}
+			sp--
+			stack[sp-1] = z
+
+		case opMakeList:
+			n := int(arg)
+			vals := make([]Value, n)
+			sp -= n
+			copy(vals, stack[sp:sp+n])
+			list := NewList(vals)
+			stack[sp] = list
+			sp++
+			if err := fr.charge(fc.position(pc0), list); err != nil {
+				return nil, err
+			}
+
+		case opMakeTuple:
+			n := int(arg)
+			tuple := make(Tuple, n)
+			sp -= n
+			copy(tuple, stack[sp:sp+n])
+			stack[sp] = tuple
+			sp++
+			if err := fr.charge(fc.position(pc0), tuple); err != nil {
+				return nil, err
+			}
+
+		case opMakeDict:
+			stack[sp] = new(Dict)
+			sp++
+
+		case opSetDictUniq:
+			dict := stack[sp-3].(*Dict)
+			k, v := stack[sp-2], stack[sp-1]
+			sp -= 2
+			if err := dict.Set(k, v); err != nil {
+				return nil, fr.errorf(fc.position(pc0), "%v", err)
+			}
+			if dict.Len() != int(arg)+1 {
+				return nil, fr.errorf(fc.position(pc0), "duplicate key: %v", k)
+			}
+
+		case opCharge:
+			if err := fr.charge(fc.position(pc0), stack[sp-1]); err != nil {
+				return nil, err
+			}
+
+		case opAppend:
+			sp--
+			if err := comprehensionAppend(fr, fc.position(pc0), stack[sp-1].(*List), stack[sp]); err != nil {
+				return nil, err
+			}
+
+		case opSetDict:
+			sp -= 2
+			if err := comprehensionSet(fr, fc.position(pc0), stack[sp-1].(*Dict), stack[sp], stack[sp+1]); err != nil {
+				return nil, err
+			}
+
+		case opIndex:
+			z, err := getIndex(fr, fc.position(pc0), stack[sp-2], stack[sp-1])
+			if err != nil {
+				return nil, err
+			}
+			sp--
+			stack[sp-1] = z
+
+		case opSetIndex:
+			sp -= 3
+			if err := setIndex(fr, fc.position(pc0), stack[sp+1], stack[sp+2], stack[sp]); err != nil {
+				return nil, err
+			}
+
+		case opAttr:
+			v, err := getAttr(fr, fc.position(pc0), stack[sp-1], fc.names[arg])
+			if err != nil {
+				return nil, err
+			}
+			stack[sp-1] = v
+
+		case opSetField:
+			sp -= 2
+			if err := setField(fr, fc.position(pc0), stack[sp+1], fc.names[arg], stack[sp]); err != nil {
+				return nil, err
+			}
+
+		case opSlice:
+			sp -= 3
+			v, err := slice(stack[sp-1], stack[sp], stack[sp+1], stack[sp+2])
+			if err != nil {
+				return nil, fr.errorf(fc.position(pc0), "%s", err)
+			}
+			stack[sp-1] = v
+
+		case opUnpack:
+			n := int(arg)
+			ix, err := unpack(fr, fc.position(pc0), n, stack[sp-1])
+			if err != nil {
+				return nil, err
+			}
+			sp--
+			for i := n - 1; i >= 0; i-- {
+				stack[sp] = ix.Index(i)
+				sp++
+			}
+
+		case opMethod:
+			recv := stack[sp-1]
+			name := fc.names[arg]
+			var fn Value
+			if builtinMethodOf(recv, name) == nil {
+				var err error
+				if fn, err = getAttr(fr, fc.position(pc0), recv, name); err != nil {
+					return nil, err
+				}
+			}
+			stack[sp] = fn
+			sp++
+
+		case opStarArgs:
+			x := stack[sp-1]
+			iter := Iterate(x)
+			if iter == nil {
+				return nil, fr.errorf(fc.position(pc0), "argument after * must be iterable, not %s", x.Type())
+			}
+			// The iterator remains active until the call.
+			iterstack = append(iterstack, iter)
+			var elems Tuple
+			var elem Value
+			for iter.Next(&elem) {
+				elems = append(elems, elem)
+			}
+			stack[sp-1] = elems
+
+		case opKwargs:
+			x := stack[sp-1]
+			xdict, ok := x.(*Dict)
+			if !ok {
+				return nil, fr.errorf(fc.position(pc0), "argument after ** must be a mapping, not %s", x.Type())
+			}
+			items := xdict.Items()
+			for _, item := range items {
+				if _, ok := item[0].(String); !ok {
+					return nil, fr.errorf(fc.position(pc0), "keywords must be strings, not %s", item[0].Type())
+				}
+			}
+			pairs := make(Tuple, len(items))
+			for i, item := range items {
+				pairs[i] = item
+			}
+			stack[sp-1] = pairs
+
+		case opCall:
+			cs := fc.callsites[arg]
+			sp -= len(cs.args)
+			args, kwargs := callArgs(cs, stack[sp:sp+len(cs.args)])
+			for i := 0; i < cs.nstar; i++ {
+				n := len(iterstack) - 1
+				iterstack[n].Done()
+				iterstack = iterstack[:n]
+			}
+
+			lparen := fc.position(pc0)
+			var res Value
+			var err error
+			if cs.method != "" {
+				sp -= 2
+				recv, fn := stack[sp], stack[sp+1]
+				if fn == nil {
+					method := builtinMethodOf(recv, cs.method)
+					res, err = callMethod(fr, lparen, recv, cs.method, method, args, kwargs)
+				} else {
+					res, err = callValue(fr, lparen, fn, args, kwargs)
+				}
+			} else {
+				sp--
+				res, err = callValue(fr, lparen, stack[sp], args, kwargs)
+			}
+			if err != nil {
+				return nil, err
+			}
+			stack[sp] = res
+			sp++
+
+		case opMakeFunc:
+			child := fc.funcs[arg]
+			var defaults Tuple
+			if n := child.ndefaults; n > 0 {
+				sp -= n
+				defaults = make(Tuple, n)
+				copy(defaults, stack[sp:sp+n])
+			}
+			fn, err := makeFunction(fr, child.pos, child.name, child.syntax, defaults)
+			if err != nil {
+				return nil, err
+			}
+			fn.funcode = child
+			stack[sp] = fn
+			sp++
+
+		case opLoad:
+			if err := execLoad(fr, fc.loads[arg]); err != nil {
+				return nil, err
+			}
+
+		default:
+			panic(fmt.Sprintf("internal error: %s: run: unexpected opcode %s at pc %d", fc.name, op, pc0))
+		}
+	}
+}
+
+// callArgs returns the positional and keyword arguments of a call
+// whose argument values, as described by cs, are vals.
+func callArgs(cs *callsite, vals []Value) (args Tuple, kwargs []Tuple) {
+	names := cs.names
+	for i, kind := range cs.args {
+		switch kind {
+		case argPositional:
+			args = append(args, vals[i])
+		case argKeyword:
+			kwargs = append(kwargs, Tuple{names[0], vals[i]})
+			names = names[1:]
+		case argStar:
+			args = append(args, vals[i].(Tuple)...)
+		case argStarStar:
+			for _, pair := range vals[i].(Tuple) {
+				kwargs = append(kwargs, pair.(Tuple))
+			}
+		}
+	}
+	return args, kwargs
+}
@@ -0,0 +1,234 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark_test
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/internal/chunkedfile"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// A limits value specifies the resource limits of a thread.
+type limits struct {
+	maxSteps  uint64
+	maxAllocs int64
+}
+
+// execTrace executes a file with the specified engine and limits and
+// returns a transcript of everything observable about the execution:
+// the output of print, errors reported by assert, the backtrace of
+// the failure if any, the final globals, and the resources consumed.
+func execTrace(engine starlark.Engine, filename string, src interface{}, lim limits) string {
+	var buf bytes.Buffer
+	thread := &starlark.Thread{
+		Load:  load,
+		Print: func(_ *starlark.Thread, msg string) { fmt.Fprintln(&buf, msg) },
+	}
+	thread.SetMaxExecutionSteps(lim.maxSteps)
+	thread.SetMaxAllocs(lim.maxAllocs)
+	starlarktest.SetReporter(thread, transcript{&buf})
+	globals, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Source:      src,
+		Predeclared: testPredeclared(),
+		Engine:      engine,
+	})
+	if evalErr, ok := err.(*starlark.EvalError); ok {
+		fmt.Fprintln(&buf, evalErr.Backtrace())
+	} else if err != nil {
+		fmt.Fprintln(&buf, err)
+	}
+	fmt.Fprintf(&buf, "globals: %v\nsteps: %d\nallocs: %d\n", globals, thread.ExecutionSteps(), thread.Allocs())
+	return buf.String()
+}
+
+// A transcript is a starlarktest.Reporter that records errors in a buffer.
+type transcript struct{ buf *bytes.Buffer }
+
+func (t transcript) Error(args ...interface{}) { fmt.Fprintln(t.buf, args...) }
+
+// checkEngines reports an error if the engines disagree about
+// the execution of the specified file.
+func checkEngines(t *testing.T, filename string, src interface{}, lim limits) {
+	t.Helper()
+	want := execTrace(engines[0], filename, src, lim)
+	for _, engine := range engines[1:] {
+		if got := execTrace(engine, filename, src, lim); got != want {
+			t.Errorf("%s: with %s engine and limits %+v, got:\n%s\nwant (from %s):\n%s",
+				filename, engine, lim, got, engines[0], want)
+		}
+	}
+}
+
+// TestEngines executes the test scripts and a number of failing
+// programs using each engine, and checks that the engines agree.
+func TestEngines(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	for _, file := range testdataFiles {
+		filename := filepath.Join(testdata, file)
+		for _, chunk := range chunkedfile.Read(filename, t) {
+			checkEngines(t, filename, chunk.Source, limits{})
+		}
+	}
+
+	for i, src := range []string{
+		// operators
+		`x = 1 + "a"`,
+		`x = -"a"`,
+		`x = 1 < "a"`,
+		`x = [] < {}`,
+		`x = "abc"[::0]`,
+		`x = 1 and 2 or 3; y = 0 or "" or None; z = not (x and y)`,
+		`x = [1, 2] if 3 > 4 else (5, 6)`,
+
+		// indexing, fields and sequence assignment
+		`x = [1][5]`,
+		`x = {}["k"]`,
+		`x = (1).foo`,
+		`x = 1; x.f = 2`,
+		`x = [1]; x["a"] = 2`,
+		`x = (1,); x[0] = 2`,
+		`a, b = 1`,
+		`a, b = [1, 2, 3]`,
+		`[a, (b, c)] = 1, "xy"; print(a, b, c)`,
+		`x = {}; x["a"] += 1`,
+		`x = {"a": 1}; x["a"] += 1; print(x)`,
+		`x = hasfields(); x.a = 1; x.a += 1; print(x.a)`,
+		`x = hasfields(); x.b += 1`,
+		`x = [1]; y = x; x += [2]; x += (3,); print(x, y)`,
+
+		// literals
+		`x = {1: 1, 1: 2}`,
+		`x = {[]: 1}`,
+		`x = {"a": 1, "b": [2, 3], "c": (4,), "d": b"\x00"}`,
+
+		// calls
+		`x = 1()`,
+		`def f(*args, **kwargs): return args, kwargs
+print(f(1, *[2, 3], k=4, **{"v": 5}))`,
+		`def f(*args): pass
+f(*1)`,
+		`def f(**kwargs): pass
+f(**1)`,
+		`def f(**kwargs): pass
+f(**{1: 2})`,
+		`def f(x): pass
+f(1, x=2)`,
+		`def f(*args): pass
+x = [1]
+f(*x, x.append(2))`,
+		`x = [].append()`,
+		`x = "".nosuch()`,
+		`x = {}; x.update(1)`,
+		`x = {}; print(x.setdefault("k", []), x.get("k"), x.pop("k"))`,
+		`x = [3, 1, 2]; x.sort(); print(x, "a,b".split(","), sorted(x, reverse=True))`,
+
+		// functions, closures and lambdas
+		`def f(x): return 1 // x
+def g(): return [f(x) for x in [1, 0]]
+def h(): return g()
+h()`,
+		`def f():
+	y = 1
+	def g(z=y): return y + z
+	return g
+print(f()(), f()(2))`,
+		`f = lambda x, y=2: x * y; print(f(3), f(3, 4))`,
+		`def f():
+	print(x)
+	x = 1
+f()`,
+		`def f(): return g
+x = f()
+g = 1`,
+		`x = len`,
+
+		// loops and comprehensions
+		`def f():
+	for x in 1:
+		pass
+f()`,
+		`x = [y for y in 1]`,
+		`x = [(a, b) for a in range(3) if a for b in "xy" if b != "x"]; print(x)`,
+		`x = {k: v for k, v in [(1, 2), (3, 4), (1, 5)]}; print(x)`,
+		`def f():
+	x = [1]
+	for y in x:
+		x += [2]
+f()`,
+		`def f():
+	n = 0
+	for x in range(10):
+		if x == 2:
+			continue
+		for y in range(x):
+			if y == 3:
+				break
+			n += y
+		if x == 7:
+			break
+	return n
+print(f())`,
+		`def f():
+	i = 0
+	while True:
+		i += 1
+		if i < 5:
+			continue
+		break
+	while i > 0:
+		i -= 2
+	return i
+print(f())`,
+		`def f():
+	for x in [1, 2, 3]:
+		for y in [4, 5]:
+			return x, y
+print(f())`,
+
+		// load
+		`load("assert.star", "assert"); assert.eq(1, 2)`,
+		`load("assert.star", "nosuch")`,
+		`load("nosuch.star", "x")`,
+	} {
+		filename := fmt.Sprintf("engines%d.star", i)
+		checkEngines(t, filename, src, limits{})
+	}
+
+	// The engines agree on the point at which a limit is exceeded.
+	const src = `
+def f(n):
+	return {str(i): [i] * 3 for i in range(n)}
+def g():
+	x = []
+	for i in range(10):
+		x.append(f(i))
+		x += [i, "s" * i]
+	return x
+y = [len(str(z)) for z in g()]
+`
+	maxSteps := execSteps(t, src)
+	for n := uint64(1); n <= maxSteps; n++ {
+		checkEngines(t, "steps.star", src, limits{maxSteps: n})
+	}
+	for n := int64(0); n <= 10000; n += 97 {
+		checkEngines(t, "allocs.star", src, limits{maxAllocs: n + 1})
+	}
+}
+
+// execSteps returns the number of steps taken to execute src.
+func execSteps(t *testing.T, src string) uint64 {
+	thread := new(starlark.Thread)
+	if _, err := starlark.ExecFile(thread, "steps.star", src, nil); err != nil {
+		t.Fatal(err)
+	}
+	return thread.ExecutionSteps()
+}
@@ -42,6 +42,7 @@ func init() {
 		"any":       NewBuiltin("any", any),
 		"all":       NewBuiltin("all", all),
 		"bool":      NewBuiltin("bool", bool_),
+		"bytes":     NewBuiltin("bytes", bytes_), // requires resolve.AllowBytes
 		"chr":       NewBuiltin("chr", chr),
 		"dict":      NewBuiltin("dict", dict),
 		"dir":       NewBuiltin("dir", dir),
@@ -74,6 +75,10 @@ type builtinMethod func(fnname string, recv Value, args Tuple, kwargs []Tuple) (
 // methods of built-in types
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#built-in-methods
 var (
+	bytesMethods = map[string]builtinMethod{
+		"elems": bytes_elems,
+	}
+
 	dictMethods = map[string]builtinMethod{
 		"clear":      dict_clear,
 		"get":        dict_get,
@@ -133,7 +138,22 @@ var (
 	}
 
 	setMethods = map[string]builtinMethod{
-		"union": set_union,
+		"add":                         set_add,
+		"clear":                       set_clear,
+		"difference":                  set_combine,
+		"difference_update":           set_update,
+		"discard":                     set_remove, // sic
+		"intersection":                set_combine,
+		"intersection_update":         set_update,
+		"isdisjoint":                  set_test,
+		"issubset":                    set_test,
+		"issuperset":                  set_test,
+		"pop":                         set_pop,
+		"remove":                      set_remove,
+		"symmetric_difference":        set_combine,
+		"symmetric_difference_update": set_update,
+		"union":                       set_combine,
+		"update":                      set_update,
 	}
 )
 
@@ -141,6 +161,8 @@ func builtinMethodOf(recv Value, name string) builtinMethod {
 	switch recv.(type) {
 	case String:
 		return stringMethods[name]
+	case Bytes:
+		return bytesMethods[name]
 	case *List:
 		return listMethods[name]
 	case *Dict:
@@ -385,6 +407,47 @@ func bool_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	return x.Truth(), nil
 }
 
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#bytes
+func bytes_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
+	var x Value
+	if err := UnpackPositionalArgs("bytes", args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	switch x := x.(type) {
+	case Bytes:
+		return x, nil
+	case String:
+		// Strings are already byte sequences (conventionally UTF-8),
+		// so the conversion is lossless.
+		b := Bytes(x)
+		return b, thread.AddAllocs(EstimateSize(b))
+	case Iterable:
+		iter := x.Iterate()
+		defer iter.Done()
+		var buf []byte
+		if n := Len(x); n > 0 {
+			if err := thread.CheckAllocs(sizeofString + int64(n)); err != nil {
+				return nil, err
+			}
+			buf = make([]byte, 0, n) // preallocate if length is known
+		}
+		var elem Value
+		for iter.Next(&elem) {
+			i, err := AsInt32(elem)
+			if err != nil {
+				return nil, fmt.Errorf("bytes: at index %d, got %s, want int", len(buf), elem.Type())
+			}
+			if i < 0 || i > 255 {
+				return nil, fmt.Errorf("bytes: at index %d, %d out of range [0, 255]", len(buf), i)
+			}
+			buf = append(buf, byte(i))
+		}
+		b := Bytes(buf)
+		return b, thread.AddAllocs(EstimateSize(b))
+	}
+	return nil, fmt.Errorf("bytes: got %s, want string, bytes, or iterable of ints", x.Type())
+}
+
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#chr
 func chr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	if len(kwargs) > 0 {
@@ -416,7 +479,7 @@ func dict(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := updateDict(dict, args, kwargs); err != nil {
 		return nil, fmt.Errorf("dict: %v", err)
 	}
-	return dict, nil
+	return dict, thread.AddAllocs(EstimateSize(dict))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#dir
@@ -436,7 +499,8 @@ func dir(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	for i, name := range names {
 		elems[i] = String(name)
 	}
-	return NewList(elems), nil
+	list := NewList(elems)
+	return list, thread.AddAllocs(EstimateSize(list))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#enumerate
@@ -458,24 +522,28 @@ func enumerate(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, e
 
 	if n := Len(iterable); n >= 0 {
 		// common case: known length
+		if err := thread.CheckAllocs(int64(n) * (sizeofValue + sizeofTuple + 2*sizeofValue)); err != nil {
+			return nil, err
+		}
 		pairs = make([]Value, 0, n)
 		array := make(Tuple, 2*n) // allocate a single backing array
 		for i := 0; iter.Next(&x); i++ {
 			pair := array[:2:2]
 			array = array[2:]
-			pair[0] = MakeInt(start + i)
+			pair[0] = intValue(MakeInt(start + i))
 			pair[1] = x
 			pairs = append(pairs, pair)
 		}
 	} else {
 		// non-sequence (unknown length)
 		for i := 0; iter.Next(&x); i++ {
-			pair := Tuple{MakeInt(start + i), x}
+			pair := Tuple{intValue(MakeInt(start + i)), x}
 			pairs = append(pairs, pair)
 		}
 	}
 
-	return NewList(pairs), nil
+	list := NewList(pairs)
+	return list, thread.AddAllocs(EstimateSize(list) + int64(len(pairs))*(sizeofTuple+2*sizeofValue))
 }
 
 func float(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
@@ -648,7 +716,7 @@ func int_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 
 		// NOTE: int(x) permits arbitrary precision, unlike the scanner.
 		if i, ok := new(big.Int).SetString(s, b); ok {
-			return Int{i}, nil
+			return makeBigInt(i), nil
 		}
 
 	invalid:
@@ -684,7 +752,7 @@ func len_(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if len < 0 {
 		return nil, fmt.Errorf("value of type %s has no len", x.Type())
 	}
-	return MakeInt(len), nil
+	return intValue(MakeInt(len)), nil
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#list
@@ -698,6 +766,9 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		iter := iterable.Iterate()
 		defer iter.Done()
 		if n := Len(iterable); n > 0 {
+			if err := thread.CheckAllocs(sizeofValue * int64(n)); err != nil {
+				return nil, err
+			}
 			elems = make([]Value, 0, n) // preallocate if length known
 		}
 		var x Value
@@ -705,7 +776,8 @@ func list(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			elems = append(elems, x)
 		}
 	}
-	return NewList(elems), nil
+	list := NewList(elems)
+	return list, thread.AddAllocs(EstimateSize(list))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#min
@@ -882,7 +954,7 @@ var (
 )
 
 func (r rangeValue) Len() int          { return r.len }
-func (r rangeValue) Index(i int) Value { return MakeInt(r.start + i*r.step) }
+func (r rangeValue) Index(i int) Value { return intValue(MakeInt(r.start + i*r.step)) }
 func (r rangeValue) Iterate() Iterator { return &rangeIterator{r, 0} }
 func (r rangeValue) Freeze()           {} // immutable
 func (r rangeValue) String() string {
@@ -947,7 +1019,8 @@ func repr(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	if err := UnpackPositionalArgs("repr", args, kwargs, 1, &x); err != nil {
 		return nil, err
 	}
-	return String(x.String()), nil
+	str := String(x.String())
+	return str, thread.AddAllocs(EstimateSize(str))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#reversed
@@ -960,6 +1033,9 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	defer iter.Done()
 	var elems []Value
 	if n := Len(args[0]); n >= 0 {
+		if err := thread.CheckAllocs(sizeofValue * int64(n)); err != nil {
+			return nil, err
+		}
 		elems = make([]Value, 0, n) // preallocate if length known
 	}
 	var x Value
@@ -970,7 +1046,8 @@ func reversed(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, er
 	for i := 0; i < n>>1; i++ {
 		elems[i], elems[n-1-i] = elems[n-1-i], elems[i]
 	}
-	return NewList(elems), nil
+	list := NewList(elems)
+	return list, thread.AddAllocs(EstimateSize(list))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set
@@ -990,7 +1067,7 @@ func set(thread *Thread, fn *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			}
 		}
 	}
-	return set, nil
+	return set, thread.AddAllocs(EstimateSize(set))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#sorted
@@ -1010,6 +1087,9 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	defer iter.Done()
 	var values []Value
 	if n := Len(iterable); n > 0 {
+		if err := thread.CheckAllocs(sizeofValue * int64(n)); err != nil {
+			return nil, err
+		}
 		values = make(Tuple, 0, n) // preallocate if length is known
 	}
 	var x Value
@@ -1036,7 +1116,11 @@ func sorted(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, erro
 	} else {
 		sort.Stable(slice)
 	}
-	return NewList(slice.values), slice.err
+	if slice.err != nil {
+		return nil, slice.err
+	}
+	list := NewList(slice.values)
+	return list, thread.AddAllocs(EstimateSize(list))
 }
 
 type sortSlice struct {
@@ -1073,12 +1157,34 @@ func str(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 		return nil, fmt.Errorf("str: got %d arguments, want exactly 1", len(args))
 	}
 	x := args[0]
-	if _, ok := AsString(x); !ok {
+	if b, ok := x.(Bytes); ok {
+		// Decode as UTF-8, replacing each invalid byte by U+FFFD.
+		x = String(utf8Transcode(string(b)))
+		if err := thread.AddAllocs(EstimateSize(x)); err != nil {
+			return nil, err
+		}
+	} else if _, ok := AsString(x); !ok {
 		x = String(x.String())
+		if err := thread.AddAllocs(EstimateSize(x)); err != nil {
+			return nil, err
+		}
 	}
 	return x, nil
 }
 
+// utf8Transcode returns s, with each byte that is not part of a valid
+// UTF-8 encoding replaced by the encoding of U+FFFD.
+func utf8Transcode(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	var buf bytes.Buffer
+	for _, r := range s {
+		buf.WriteRune(r) // invalid bytes decode as utf8.RuneError, one at a time
+	}
+	return buf.String()
+}
+
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#tuple
 func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
@@ -1092,13 +1198,16 @@ func tuple(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error
 	defer iter.Done()
 	var elems Tuple
 	if n := Len(iterable); n > 0 {
+		if err := thread.CheckAllocs(sizeofValue * int64(n)); err != nil {
+			return nil, err
+		}
 		elems = make(Tuple, 0, n) // preallocate if length is known
 	}
 	var x Value
 	for iter.Next(&x) {
 		elems = append(elems, x)
 	}
-	return elems, nil
+	return elems, thread.AddAllocs(EstimateSize(elems))
 }
 
 // https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#type
@@ -1140,6 +1249,9 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 	var result []Value
 	if rows >= 0 {
 		// length known
+		if err := thread.CheckAllocs(int64(rows) * (sizeofValue + sizeofTuple + sizeofValue*int64(cols))); err != nil {
+			return nil, err
+		}
 		result = make([]Value, rows)
 		array := make(Tuple, cols*rows) // allocate a single backing array
 		for i := 0; i < rows; i++ {
@@ -1163,7 +1275,8 @@ func zip(thread *Thread, _ *Builtin, args Tuple, kwargs []Tuple) (Value, error)
 			result = append(result, tuple)
 		}
 	}
-	return NewList(result), nil
+	list := NewList(result)
+	return list, thread.AddAllocs(EstimateSize(list) + int64(len(result))*(sizeofTuple+sizeofValue*int64(cols)))
 }
 
 // ---- methods of built-in types ---
@@ -1423,6 +1536,14 @@ func string_capitalize(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 	return String(strings.Title(string(recv.(String)))), nil
 }
 
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#bytes·elems
+func bytes_elems(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	return bytesIterable{recv.(Bytes)}, nil
+}
+
 // string_iterable returns an unspecified iterable value whose iterator yields:
 // - elems: successive 1-byte substrings
 // - codepoints: successive substrings that encode a single Unicode code point.
@@ -2022,19 +2143,192 @@ func string_splitlines(fnname string, recv Value, args Tuple, kwargs []Tuple) (V
 	return NewList(list), nil
 }
 
-// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·union.
-func set_union(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·add
+func set_add(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var elem Value
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &elem); err != nil {
+		return nil, err
+	}
+	if err := recv.(*Set).Insert(elem); err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	return None, nil
+}
+
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·clear
+func set_clear(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	if err := recv.(*Set).Clear(); err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	return None, nil
+}
+
+// set_combine implements the methods that return a new set computed
+// from the receiver and zero or more iterable arguments:
+// difference, intersection, symmetric_difference and union.
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·union
+func set_combine(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	iterables, err := setMethodArgs(fnname, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if fnname == "symmetric_difference" && len(iterables) != 1 {
+		return nil, fmt.Errorf("%s: got %d arguments, want 1", fnname, len(iterables))
+	}
+	set := recv.(*Set).clone()
+	for _, iterable := range iterables {
+		iter := iterable.Iterate()
+		var z Value
+		switch fnname {
+		case "difference":
+			z, err = set.Difference(iter)
+		case "intersection":
+			z, err = set.Intersection(iter)
+		case "symmetric_difference":
+			z, err = set.SymmetricDifference(iter)
+		case "union":
+			z, err = set.Union(iter)
+		}
+		iter.Done()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fnname, err)
+		}
+		set = z.(*Set)
+	}
+	return set, nil
+}
+
+// set_update implements the methods that update the receiver in place
+// using zero or more iterable arguments: update, difference_update,
+// intersection_update and symmetric_difference_update.
+// The arguments are fully iterated before the receiver is modified,
+// so a set may be updated using itself as an argument.
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·update
+func set_update(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+	iterables, err := setMethodArgs(fnname, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	if fnname == "symmetric_difference_update" && len(iterables) != 1 {
+		return nil, fmt.Errorf("%s: got %d arguments, want 1", fnname, len(iterables))
+	}
+	recv := recv_.(*Set)
+	if err := recv.ht.checkMutable("update"); err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	others := make([]*Set, len(iterables))
+	for i, iterable := range iterables {
+		iter := iterable.Iterate()
+		others[i], err = setOf(iter)
+		iter.Done()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", fnname, err)
+		}
+	}
+	for _, other := range others {
+		switch fnname {
+		case "update":
+			for _, elem := range other.elems() {
+				recv.Insert(elem) // can't fail
+			}
+		case "difference_update":
+			for _, elem := range other.elems() {
+				recv.Delete(elem) // can't fail
+			}
+		case "intersection_update":
+			for _, elem := range recv.elems() {
+				if found, _ := other.Has(elem); !found {
+					recv.Delete(elem) // can't fail
+				}
+			}
+		case "symmetric_difference_update":
+			for _, elem := range other.elems() {
+				if found, _ := recv.Delete(elem); !found {
+					recv.Insert(elem) // can't fail
+				}
+			}
+		}
+	}
+	return None, nil
+}
+
+// setMethodArgs returns the arguments of a set method that
+// accepts any number of iterable positional arguments.
+func setMethodArgs(fnname string, args Tuple, kwargs []Tuple) ([]Iterable, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s does not accept keyword arguments", fnname)
+	}
+	iterables := make([]Iterable, len(args))
+	for i, arg := range args {
+		iterable, ok := arg.(Iterable)
+		if !ok {
+			return nil, fmt.Errorf("%s: for parameter %d: got %s, want iterable", fnname, i+1, arg.Type())
+		}
+		iterables[i] = iterable
+	}
+	return iterables, nil
+}
+
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·pop
+func set_pop(fnname string, recv_ Value, args Tuple, kwargs []Tuple) (Value, error) {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	recv := recv_.(*Set)
+	k, ok := recv.ht.first()
+	if !ok {
+		return nil, fmt.Errorf("pop: empty set")
+	}
+	if _, err := recv.Delete(k); err != nil {
+		return nil, fmt.Errorf("pop: %v", err) // set is frozen
+	}
+	return k, nil
+}
+
+// set_remove implements remove, which fails if the element is not
+// present, and discard, which does not.
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·remove
+func set_remove(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
+	var elem Value
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &elem); err != nil {
+		return nil, err
+	}
+	found, err := recv.(*Set).Delete(elem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", fnname, err)
+	}
+	if !found && fnname == "remove" {
+		return nil, fmt.Errorf("remove: element not found")
+	}
+	return None, nil
+}
+
+// set_test implements the methods isdisjoint, issubset and issuperset.
+// https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#set·issubset
+func set_test(fnname string, recv Value, args Tuple, kwargs []Tuple) (Value, error) {
 	var iterable Iterable
-	if err := UnpackPositionalArgs(fnname, args, kwargs, 0, &iterable); err != nil {
+	if err := UnpackPositionalArgs(fnname, args, kwargs, 1, &iterable); err != nil {
 		return nil, err
 	}
 	iter := iterable.Iterate()
 	defer iter.Done()
-	union, err := recv.(*Set).Union(iter)
+	var ok bool
+	var err error
+	switch fnname {
+	case "isdisjoint":
+		ok, err = recv.(*Set).IsDisjoint(iter)
+	case "issubset":
+		ok, err = recv.(*Set).IsSubset(iter)
+	case "issuperset":
+		ok, err = recv.(*Set).IsSuperset(iter)
+	}
 	if err != nil {
-		return nil, fmt.Errorf("union: %v", err)
+		return nil, fmt.Errorf("%s: %v", fnname, err)
 	}
-	return union, nil
+	return Bool(ok), nil
 }
 
 // Common implementation of string_{r}{find,index}.
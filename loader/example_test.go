@@ -0,0 +1,36 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader_test
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/loader"
+)
+
+func Example() {
+	l := loader.New(loader.Map(map[string]string{
+		"rules/greet.star": `
+load("./words.star", "hello")
+
+def greet(name):
+	return hello + ", " + name
+`,
+		"rules/words.star": `hello = "Hello"`,
+	}))
+
+	thread := &starlark.Thread{Load: l.Load}
+	const src = `load("rules/greet.star", "greet"); msg = greet("world")`
+	globals, err := starlark.ExecFile(thread, "main.star", src, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println(globals["msg"])
+
+	// Output:
+	// "Hello, world"
+}
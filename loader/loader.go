@@ -0,0 +1,254 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package loader implements the loading of Starlark modules: the
+// Load function of a starlark.Thread.
+//
+// A Loader executes each module at most once, and caches its globals,
+// or the error with which it failed, for subsequent loads.  It may be
+// used by threads that execute concurrently: a module loaded by several
+// threads at once is executed by one of them while the others wait,
+// and a cycle of loads, which would otherwise wait forever, is reported
+// as an error that lists the modules of the cycle.
+//
+// The text of modules comes from a Source, such as a directory of the
+// file system (Dir), an fs.FS (FS), or a map in memory (Map):
+//
+//	l := loader.New(loader.Dir("lib"))
+//	thread := &starlark.Thread{Load: l.Load}
+//	globals, err := l.LoadModule("defs.star")
+//
+// Modules are identified by canonical names: slash-separated paths
+// relative to the root of the source, such as "rules/go.star", that
+// contain no "." or ".." elements.  A module name in a load statement
+// that begins with "./" or "../" is relative to the directory of the
+// module containing the statement; other names are relative to the
+// root.
+package loader
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+)
+
+// A Loader loads modules from a Source, and caches them.
+//
+// The fields other than the Source configure the execution of each
+// module.  They must not be changed once the Loader is in use.
+type Loader struct {
+	source Source
+
+	// Predeclared defines the predeclared names of each module.
+	Predeclared starlark.StringDict
+
+	// Dialect specifies the optional language features accepted
+	// in each module.  See starlark.ExecOptions.
+	Dialect *resolve.Options
+
+	// Engine selects the engine that executes each module.
+	Engine starlark.Engine
+
+	// NewThread, if non-nil, returns the thread in which to execute
+	// the specified module, for example to set its Print function.
+	// The Loader sets the thread's Load function.  By default, each
+	// module executes in a new thread.
+	NewThread func(module string) *starlark.Thread
+
+	mu    sync.Mutex
+	cache map[string]*entry // by canonical name
+}
+
+// New returns a Loader that loads modules from the specified source.
+func New(source Source) *Loader {
+	return &Loader{source: source, cache: make(map[string]*entry)}
+}
+
+// An entry is a module in the cache.
+type entry struct {
+	name    string
+	owner   *loadThread   // the logical thread loading the module, until ready
+	ready   chan struct{} // closed once globals and err are set
+	globals starlark.StringDict
+	err     error
+}
+
+// A loadThread is a logical thread of loading: a call of Load or
+// LoadModule by a thread that the Loader did not create, and all the
+// loads that it executes, directly or indirectly.  Modules loaded by
+// one loadThread are executed one at a time, each nested within the
+// execution of the module that loads it.
+//
+// The modules being loaded and the module awaited by each loadThread
+// form a waits-for graph whose cycles are cycles of the load graph.
+type loadThread struct {
+	stack    []*entry // modules being loaded, outermost first
+	waitsFor *entry   // the module loaded by another loadThread that this one awaits, if any
+}
+
+// localKey is the key of the thread-local state of the threads that
+// execute modules.
+const localKey = "loader"
+
+// A threadState identifies the module that a thread executes.
+type threadState struct {
+	loader *Loader
+	lt     *loadThread
+	module string // canonical name
+}
+
+// Load loads a module, named as in a load statement of the module
+// that the thread executes.  It is suitable for use as the Load
+// function of a starlark.Thread.
+//
+// Only the threads in which the Loader executes modules know the
+// module that they execute.  For other threads, all module names are
+// relative to the root of the source.
+func (l *Loader) Load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	lt, from := new(loadThread), ""
+	if thread != nil {
+		if st, ok := thread.Local(localKey).(*threadState); ok && st.loader == l {
+			lt, from = st.lt, st.module
+		}
+	}
+	name, err := canonical(from, module)
+	if err != nil {
+		return nil, err
+	}
+	return l.get(lt, name)
+}
+
+// LoadModule loads the module with the specified canonical name.
+func (l *Loader) LoadModule(name string) (starlark.StringDict, error) {
+	return l.Load(nil, name)
+}
+
+// canonical returns the canonical name of a module, named as in a load
+// statement of the module from, or "" at top level.
+func canonical(from, module string) (string, error) {
+	name := module
+	if strings.HasPrefix(module, "./") || strings.HasPrefix(module, "../") {
+		name = path.Join(path.Dir(from), module)
+	} else {
+		name = path.Clean(module)
+	}
+	if !fs.ValidPath(name) || name == "." {
+		return "", fmt.Errorf("invalid module name %q", module)
+	}
+	return name, nil
+}
+
+// get returns the globals of the named module, loading it if it is
+// not in the cache, or waiting for it if another logical thread is
+// loading it.
+func (l *Loader) get(lt *loadThread, name string) (starlark.StringDict, error) {
+	l.mu.Lock()
+	e := l.cache[name]
+	if e == nil {
+		// First request for this module.
+		e = &entry{name: name, owner: lt, ready: make(chan struct{})}
+		l.cache[name] = e
+		lt.stack = append(lt.stack, e)
+		l.mu.Unlock()
+
+		e.globals, e.err = l.exec(lt, name)
+
+		l.mu.Lock()
+		lt.stack = lt.stack[:len(lt.stack)-1]
+		e.owner = nil
+		l.mu.Unlock()
+
+		// Broadcast that the entry is now ready.
+		close(e.ready)
+		return e.globals, e.err
+	}
+
+	// Some logical thread, perhaps this one, is loading the module,
+	// or has loaded it.  Check that waiting for it would not deadlock.
+	if cycle := cycle(lt, e); cycle != nil {
+		l.mu.Unlock()
+		return nil, &CycleError{Cycle: cycle}
+	}
+	lt.waitsFor = e
+	l.mu.Unlock()
+
+	<-e.ready
+
+	l.mu.Lock()
+	lt.waitsFor = nil
+	l.mu.Unlock()
+	return e.globals, e.err
+}
+
+// cycle returns the modules of the cycle of loads that waiting for
+// entry e would complete, starting and ending with e, or nil if there
+// is no such cycle.
+// It is called with l.mu held.
+//
+// The cycle follows the waits-for graph from e to its owner, then to
+// the module that the owner awaits, and so on.  If the path reaches
+// the waiting thread, me, there is a cycle.  Its modules are those
+// being loaded by each thread along the path, from the module awaited
+// to the module that awaits the next.
+func cycle(me *loadThread, e *entry) []string {
+	var modules []string
+	for x := e; x != nil; {
+		lt := x.owner
+		if lt == nil {
+			return nil // ready, or about to be
+		}
+		i := 0
+		for lt.stack[i] != x {
+			i++
+		}
+		for _, y := range lt.stack[i:] {
+			modules = append(modules, y.name)
+		}
+		if lt == me {
+			return append(modules, e.name)
+		}
+		x = lt.waitsFor
+	}
+	return nil
+}
+
+// exec executes the named module.
+func (l *Loader) exec(lt *loadThread, name string) (starlark.StringDict, error) {
+	filename, data, err := l.source.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	var thread *starlark.Thread
+	if l.NewThread != nil {
+		thread = l.NewThread(name)
+	} else {
+		thread = new(starlark.Thread)
+	}
+	thread.Load = l.Load
+	thread.SetLocal(localKey, &threadState{loader: l, lt: lt, module: name})
+	return starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Source:      data,
+		Predeclared: l.Predeclared,
+		Engine:      l.Engine,
+		Dialect:     l.Dialect,
+	})
+}
+
+// A CycleError reports a cycle in the load graph.
+type CycleError struct {
+	// Cycle lists the canonical names of the modules of the cycle,
+	// each loaded by its predecessor.  The first and last are the same.
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "cycle in load graph: " + strings.Join(e.Cycle, " -> ")
+}
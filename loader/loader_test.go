@@ -0,0 +1,195 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/loader"
+)
+
+// counter counts the executions of each module, as reported by the
+// print statements of the modules.
+type counter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newLoader(src loader.Source) (*loader.Loader, *counter) {
+	c := &counter{counts: make(map[string]int)}
+	l := loader.New(src)
+	l.NewThread = func(module string) *starlark.Thread {
+		return &starlark.Thread{
+			Print: func(_ *starlark.Thread, msg string) {
+				c.mu.Lock()
+				c.counts[msg]++
+				c.mu.Unlock()
+			},
+		}
+	}
+	return l, c
+}
+
+func TestRelative(t *testing.T) {
+	l, _ := newLoader(loader.Map(map[string]string{
+		"main.star":      `load("lib/a.star", "a"); main = a`,
+		"lib/a.star":     `load("./b.star", "b"); load("../top.star", "top"); load("lib/sub/c.star", "c"); a = b + top + c`,
+		"lib/b.star":     `load("sub/c.star", "c"); b = "b"`,
+		"top.star":       `top = "top"`,
+		"lib/sub/c.star": `c = "c"`,
+		"sub/c.star":     `c = "other"`,
+		"escape.star":    `load("../x.star", "x")`,
+	}))
+	globals, err := l.LoadModule("main.star")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := globals["main"], starlark.String("btopc"); got != want {
+		t.Errorf("main = %v, want %v", got, want)
+	}
+
+	_, err = l.LoadModule("escape.star")
+	if want := `cannot load ../x.star: invalid module name "../x.star"`; err == nil || err.Error() != want {
+		t.Errorf("load escape.star: got error %v, want %s", err, want)
+	}
+	for _, name := range []string{"", ".", "/a.star", "../a.star"} {
+		if _, err := l.LoadModule(name); err == nil || !strings.Contains(err.Error(), "invalid module name") {
+			t.Errorf("LoadModule(%q): got error %v, want invalid module name", name, err)
+		}
+	}
+}
+
+// TestOnce checks that each module executes once, even when loaded
+// concurrently, and that errors are cached.
+func TestOnce(t *testing.T) {
+	modules := map[string]string{
+		"common.star": `print("common"); common = 1`,
+		"bad.star":    `print("bad"); x = 1 // 0`,
+	}
+	for i := 0; i < 10; i++ {
+		modules[fmt.Sprintf("m%d.star", i)] = fmt.Sprintf(`load("common.star", "common"); x = common + %d`, i)
+	}
+	l, c := newLoader(loader.Map(modules))
+
+	var wg sync.WaitGroup
+	errs := make([]error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			globals, err := l.LoadModule(fmt.Sprintf("m%d.star", i))
+			if err != nil {
+				t.Error(err)
+			} else if got, want := globals["x"], starlark.MakeInt(1+i); got != want {
+				t.Errorf("m%d.x = %v, want %v", i, got, want)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = l.LoadModule("bad.star")
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs[:10] {
+		if err == nil || err.Error() != "floored division by zero" {
+			t.Errorf("load #%d of bad.star: got error %v, want division by zero", i, err)
+		} else if err != errs[0] {
+			t.Errorf("load #%d of bad.star: error was not cached", i)
+		}
+	}
+	if c.counts["common"] != 1 || c.counts["bad"] != 1 {
+		t.Errorf("modules executed %v times, want once each", c.counts)
+	}
+}
+
+func TestCycle(t *testing.T) {
+	l, _ := newLoader(loader.Map(map[string]string{
+		"a.star": `load("b.star", "b")`,
+		"b.star": `load("./c.star", "c")`,
+		"c.star": `load("a.star", "a")`,
+		"d.star": `load("d.star", "d")`,
+	}))
+	_, err := l.LoadModule("a.star")
+	want := "cannot load b.star: cannot load ./c.star: cannot load a.star: " +
+		"cycle in load graph: a.star -> b.star -> c.star -> a.star"
+	if err == nil || err.Error() != want {
+		t.Errorf("load a.star: got error %v, want %s", err, want)
+	}
+	_, err = l.LoadModule("d.star")
+	if want := "cannot load d.star: cycle in load graph: d.star -> d.star"; err == nil || err.Error() != want {
+		t.Errorf("load d.star: got error %v, want %s", err, want)
+	}
+}
+
+// TestCycleParallel checks that concurrent loads that form a cycle
+// fail instead of waiting for each other.
+func TestCycleParallel(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		l, _ := newLoader(loader.Map(map[string]string{
+			"a.star": `load("b.star", "b")`,
+			"b.star": `load("c.star", "c")`,
+			"c.star": `load("a.star", "a")`,
+		}))
+		var wg sync.WaitGroup
+		for _, name := range []string{"a.star", "b.star", "c.star"} {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				_, err := l.LoadModule(name)
+				if err == nil || !strings.Contains(err.Error(), "cycle in load graph: ") {
+					t.Errorf("load %s: got error %v, want cycle", name, err)
+				}
+			}(name)
+		}
+		wg.Wait()
+	}
+}
+
+func TestSources(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "lib"), 0777); err != nil {
+		t.Fatal(err)
+	}
+	for name, text := range map[string]string{
+		"main.star":     `load("lib/util.star", "f"); x = f()`,
+		"lib/util.star": "def f():\n\treturn 1 // 0\n",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, filepath.FromSlash(name)), []byte(text), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		src      loader.Source
+		filename string // of lib/util.star
+	}{
+		{loader.Dir(dir), filepath.Join(dir, "lib", "util.star")},
+		{loader.FS(os.DirFS(dir)), "lib/util.star"},
+		{loader.FS(fstest.MapFS{
+			"main.star":     {Data: []byte(`load("lib/util.star", "f"); x = f()`)},
+			"lib/util.star": {Data: []byte("def f():\n\treturn 1 // 0\n")},
+		}), "lib/util.star"},
+	} {
+		_, err := loader.New(test.src).LoadModule("main.star")
+		evalErr, ok := err.(*starlark.EvalError)
+		if !ok {
+			t.Errorf("%T: got error %v, want EvalError", test.src, err)
+			continue
+		}
+		if want := test.filename + ":2:11: in f"; !strings.Contains(evalErr.Backtrace(), want) {
+			t.Errorf("%T: backtrace does not contain %q:\n%s", test.src, want, evalErr.Backtrace())
+		}
+		if _, err := loader.New(test.src).LoadModule("missing.star"); !os.IsNotExist(err) {
+			t.Errorf("%T: load of missing module: got error %v, want not exist", test.src, err)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package loader
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// A Source provides the text of modules.
+type Source interface {
+	// Read returns the text of the module with the specified
+	// canonical name, and the name of the file that contains it,
+	// which appears in error messages and backtraces.
+	Read(module string) (filename string, data []byte, err error)
+}
+
+// Dir returns a Source that reads modules from the files of a
+// directory tree, rooted at dir, of the operating system.
+func Dir(dir string) Source { return dirSource(dir) }
+
+type dirSource string
+
+func (dir dirSource) Read(module string) (string, []byte, error) {
+	filename := filepath.Join(string(dir), filepath.FromSlash(module))
+	data, err := os.ReadFile(filename)
+	return filename, data, err
+}
+
+// FS returns a Source that reads modules from the files of fsys.
+// Its filenames are the canonical names of the modules.
+func FS(fsys fs.FS) Source { return fsSource{fsys} }
+
+type fsSource struct{ fsys fs.FS }
+
+func (src fsSource) Read(module string) (string, []byte, error) {
+	data, err := fs.ReadFile(src.fsys, module)
+	return module, data, err
+}
+
+// Map returns a Source that provides the modules of a map, which holds
+// the text of each module by canonical name.  Its filenames are the
+// canonical names of the modules.
+func Map(modules map[string]string) Source { return mapSource(modules) }
+
+type mapSource map[string]string
+
+func (m mapSource) Read(module string) (string, []byte, error) {
+	text, ok := m[module]
+	if !ok {
+		return module, nil, &fs.PathError{Op: "open", Path: module, Err: fs.ErrNotExist}
+	}
+	return module, []byte(text), nil
+}
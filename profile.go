@@ -0,0 +1,345 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark
+
+// This file defines a profiler that attributes computation steps and
+// time to Starlark call stacks, and writes them in the format of pprof.
+//
+// Each thread reports an event at every step (see Thread.tick) and
+// on entry to and exit from each built-in function or method.  The
+// step is charged to the call stack at the event, and the time since
+// the previous event of the thread to the call stack at that event.
+// Built-in calls appear in the stacks, above the frame that made them.
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// activeProfiler points to the active profiler, if any.
+// It is accessed atomically.
+var activeProfiler unsafe.Pointer // *profiler
+
+func loadProfiler() *profiler {
+	return (*profiler)(atomic.LoadPointer(&activeProfiler))
+}
+
+// StartProfile enables profiling of the execution of all threads.
+// The profile is written to w, when StopProfile is called, as a
+// gzipped protocol buffer in the format read by 'go tool pprof'.
+//
+// The profile has two sample types: the number of computation steps
+// (see SetMaxExecutionSteps), which is deterministic, and the elapsed
+// time.  Each is attributed to the call stack of Starlark functions,
+// and of the built-in functions and methods they call, at which it
+// occurred.
+//
+// StartProfile fails if a profile is already being recorded.
+func StartProfile(w io.Writer) error {
+	p := &profiler{
+		w:         w,
+		start:     time.Now(),
+		functions: make(map[profFunction]uint64),
+		locations: make(map[profLocation]uint64),
+		index:     make(map[string]int),
+	}
+	if !atomic.CompareAndSwapPointer(&activeProfiler, nil, unsafe.Pointer(p)) {
+		return fmt.Errorf("profiler already active")
+	}
+	return nil
+}
+
+// StopProfile stops profiling and writes the profile started by
+// StartProfile.  Events of threads still executing are discarded.
+func StopProfile() error {
+	p := loadProfiler()
+	if p == nil || !atomic.CompareAndSwapPointer(&activeProfiler, unsafe.Pointer(p), nil) {
+		return fmt.Errorf("profiler not active")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	gz := gzip.NewWriter(p.w)
+	if _, err := gz.Write(p.encode(time.Now())); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// A profiler accumulates the samples of a profile.
+type profiler struct {
+	w     io.Writer
+	start time.Time
+
+	mu        sync.Mutex
+	functions map[profFunction]uint64 // IDs of functions
+	locations map[profLocation]uint64 // IDs of locations
+	funcList  []profFunction          // functions, by ID - 1
+	locList   []profLocation          // locations, by ID - 1
+	samples   []*profSample           // in order of first occurrence
+	index     map[string]int          // index of each sample, by stack key
+}
+
+// A profFunction is a Starlark function, module toplevel, or built-in.
+type profFunction struct {
+	name, file string
+	start      int32 // line
+}
+
+// A profLocation is a line of a function.
+type profLocation struct {
+	function uint64 // ID
+	line     int32
+}
+
+// A profSample records the steps and time charged to a call stack.
+type profSample struct {
+	stack        []uint64 // location IDs, innermost first
+	steps, nanos int64
+}
+
+// A threadProfile is the state of a thread needed by the profiler.
+type threadProfile struct {
+	p        *profiler     // the profiler for which the state was recorded
+	builtins []profBuiltin // active built-in calls, innermost last
+	last     time.Time     // time of the previous event
+	key      string        // key of the stack at the previous event, if any
+}
+
+// A profBuiltin is an active call of a built-in function or method.
+type profBuiltin struct {
+	name  string
+	depth int // depth of the calling frame
+}
+
+// profiling reports whether a profiler is active.
+func profiling() bool { return atomic.LoadPointer(&activeProfiler) != nil }
+
+// profile returns the profiling state of the thread, or nil if there
+// is no active profiler.
+func (thread *Thread) profile() *threadProfile {
+	p := loadProfiler()
+	if p == nil {
+		thread.prof = nil
+		return nil
+	}
+	if thread.prof == nil || thread.prof.p != p {
+		thread.prof = &threadProfile{p: p}
+	}
+	return thread.prof
+}
+
+// beginBuiltin records the start of a call to the named built-in
+// function or method, if profiling is enabled.  It must be followed by
+// a call to endBuiltin.
+func (thread *Thread) beginBuiltin(name string) {
+	if tp := thread.profile(); tp != nil {
+		tp.builtins = append(tp.builtins, profBuiltin{name, thread.depth})
+		thread.profileEvent(tp, 0)
+	}
+}
+
+// endBuiltin records the end of the call to the innermost built-in.
+func (thread *Thread) endBuiltin() {
+	if tp := thread.profile(); tp != nil && len(tp.builtins) > 0 {
+		tp.builtins = tp.builtins[:len(tp.builtins)-1]
+		thread.profileEvent(tp, 0)
+	}
+}
+
+// profileEvent charges the elapsed time since the previous event to
+// the stack at that event, and the specified number of steps to the
+// current stack.
+func (thread *Thread) profileEvent(tp *threadProfile, steps int64) {
+	now := time.Now()
+	p := tp.p
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if tp.key != "" {
+		p.samples[p.index[tp.key]].nanos += now.Sub(tp.last).Nanoseconds()
+	}
+
+	// Compute the current stack, innermost first.
+	var stack []uint64
+	builtins := tp.builtins
+	for fr, depth := thread.frame, thread.depth; fr != nil; fr, depth = fr.parent, depth-1 {
+		for len(builtins) > 0 && builtins[len(builtins)-1].depth >= depth {
+			b := builtins[len(builtins)-1]
+			builtins = builtins[:len(builtins)-1]
+			stack = append(stack, p.location(profFunction{b.name, "<builtin>", 0}, 0))
+		}
+		// A module's toplevel is named after its file, as pprof
+		// would remove a name in angle brackets.
+		f := profFunction{name: fr.posn.Filename(), file: fr.posn.Filename()}
+		if fr.fn != nil {
+			f.name, f.file, f.start = fr.fn.name, fr.fn.position.Filename(), fr.fn.position.Line
+		}
+		line := fr.posn.Line
+		if line == 0 {
+			line = f.start
+		}
+		stack = append(stack, p.location(f, line))
+	}
+	if len(stack) == 0 {
+		tp.key = ""
+		return
+	}
+
+	var buf protobuf
+	for _, id := range stack {
+		buf.varint(id)
+	}
+	key := buf.String()
+	i, ok := p.index[key]
+	if !ok {
+		i = len(p.samples)
+		p.index[key] = i
+		p.samples = append(p.samples, &profSample{stack: stack})
+	}
+	p.samples[i].steps += steps
+	tp.last, tp.key = now, key
+}
+
+// location returns the ID of the location of a line of a function.
+// It is called with p.mu held.
+func (p *profiler) location(f profFunction, line int32) uint64 {
+	fid, ok := p.functions[f]
+	if !ok {
+		p.funcList = append(p.funcList, f)
+		fid = uint64(len(p.funcList))
+		p.functions[f] = fid
+	}
+	loc := profLocation{fid, line}
+	id, ok := p.locations[loc]
+	if !ok {
+		p.locList = append(p.locList, loc)
+		id = uint64(len(p.locList))
+		p.locations[loc] = id
+	}
+	return id
+}
+
+// encode returns the profile as a protocol buffer.  The message
+// types and field numbers are those of profile.proto, in
+// github.com/google/pprof/proto.
+func (p *profiler) encode(end time.Time) []byte {
+	table := []string{""}
+	stringIndex := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		i, ok := stringIndex[s]
+		if !ok {
+			i = int64(len(table))
+			table = append(table, s)
+			stringIndex[s] = i
+		}
+		return i
+	}
+
+	var prof protobuf
+	for _, st := range [][2]string{{"steps", "count"}, {"time", "nanoseconds"}} {
+		var vt protobuf
+		vt.int64(1, str(st[0])) // type
+		vt.int64(2, str(st[1])) // unit
+		prof.message(1, &vt)    // sample_type
+	}
+	for _, s := range p.samples {
+		var sample protobuf
+		sample.packedUint64(1, s.stack)                  // location_id
+		sample.packedInt64(2, []int64{s.steps, s.nanos}) // value
+		prof.message(2, &sample)
+	}
+	for i, loc := range p.locList {
+		var line protobuf
+		line.uint64(1, loc.function)   // function_id
+		line.int64(2, int64(loc.line)) // line
+		var location protobuf
+		location.uint64(1, uint64(i+1)) // id
+		location.message(4, &line)      // line
+		prof.message(4, &location)
+	}
+	for i, f := range p.funcList {
+		var function protobuf
+		function.uint64(1, uint64(i+1))   // id
+		function.int64(2, str(f.name))    // name
+		function.int64(3, str(f.name))    // system_name
+		function.int64(4, str(f.file))    // filename
+		function.int64(5, int64(f.start)) // start_line
+		prof.message(5, &function)
+	}
+	prof.int64(9, p.start.UnixNano())              // time_nanos
+	prof.int64(10, end.Sub(p.start).Nanoseconds()) // duration_nanos
+	for _, s := range table {
+		prof.string(6, s) // string_table
+	}
+	return prof.Bytes()
+}
+
+// A protobuf is a buffer for the encoding of a protocol buffer message.
+type protobuf struct{ bytes.Buffer }
+
+func (b *protobuf) varint(x uint64) {
+	for ; x >= 0x80; x >>= 7 {
+		b.WriteByte(byte(x) | 0x80)
+	}
+	b.WriteByte(byte(x))
+}
+
+// key writes the key of a field with the specified wire type.
+func (b *protobuf) key(field int, wireType uint64) { b.varint(uint64(field)<<3 | wireType) }
+
+func (b *protobuf) uint64(field int, x uint64) {
+	if x != 0 {
+		b.key(field, 0)
+		b.varint(x)
+	}
+}
+
+func (b *protobuf) int64(field int, x int64) { b.uint64(field, uint64(x)) }
+
+// string writes a string field, even if empty, as it is used only
+// for the elements of the string table.
+func (b *protobuf) string(field int, s string) {
+	b.key(field, 2)
+	b.varint(uint64(len(s)))
+	b.WriteString(s)
+}
+
+func (b *protobuf) message(field int, m *protobuf) {
+	b.key(field, 2)
+	b.varint(uint64(m.Len()))
+	b.Write(m.Bytes())
+}
+
+func (b *protobuf) packedUint64(field int, xs []uint64) {
+	var packed protobuf
+	for _, x := range xs {
+		packed.varint(x)
+	}
+	b.message(field, &packed)
+}
+
+func (b *protobuf) packedInt64(field int, xs []int64) {
+	var packed protobuf
+	for _, x := range xs {
+		packed.varint(uint64(x))
+	}
+	b.message(field, &packed)
+}
+
+// profiledCall calls the built-in, recording the call for the profiler.
+func (b *Builtin) profiledCall(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	name := b.name
+	if b.recv != nil {
+		name = b.recv.Type() + "." + name
+	}
+	thread.beginBuiltin(name)
+	defer thread.endBuiltin()
+	return b.fn(thread, b, args, kwargs)
+}
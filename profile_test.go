@@ -0,0 +1,102 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlark_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+)
+
+// TestProfile checks that 'go tool pprof' accepts the profile, and
+// that it attributes steps to functions and built-ins.
+func TestProfile(t *testing.T) {
+	gotool := filepath.Join(runtime.GOROOT(), "bin", "go")
+	if _, err := os.Stat(gotool); err != nil {
+		t.Skipf("go tool not available: %v", err)
+	}
+	dir, err := ioutil.TempDir("", "starlark-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	profile := filepath.Join(dir, "profile.pb.gz")
+
+	const src = `
+def fib(n):
+	a, b = 0, 1
+	for _ in range(n):
+		a, b = b, a + b
+	return a
+
+def work():
+	for i in range(100):
+		fib(i % 10)
+	return sorted([i for i in range(100)], key=fib)
+
+work()
+`
+	for _, engine := range []starlark.Engine{starlark.TreeWalker, starlark.Bytecode} {
+		f, err := os.Create(profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := starlark.StartProfile(f); err != nil {
+			t.Fatal(err)
+		}
+		if err := starlark.StartProfile(f); err == nil {
+			t.Error("second StartProfile succeeded")
+		}
+		thread := new(starlark.Thread)
+		_, err = starlark.Exec(starlark.ExecOptions{Thread: thread, Filename: "profile.star", Source: src, Engine: engine})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := starlark.StopProfile(); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		cmd := exec.Command(gotool, "tool", "pprof", "-top", "-sample_index=steps", profile)
+		var out bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &out, &out
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("pprof failed: %v\n%s", err, out.String())
+		}
+
+		// Check the flat and cumulative steps of each function.
+		// A call of fib(n) executes 3+n statements, and is itself a
+		// step, charged to the caller.
+		got := make(map[string]string)
+		for _, line := range strings.Split(out.String(), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) == 6 && regexp.MustCompile(`^\d+$`).MatchString(fields[0]) {
+				got[fields[5]] = fields[0] + " " + fields[3]
+			}
+		}
+		for name, want := range map[string]string{
+			"fib":          "6000 6000", // 750 for the calls from work, 5250 from sorted
+			"work":         "302 6402",  // 102 statements, 100 calls, 100 comprehension iterations
+			"sorted":       "100 5350",  // 100 calls
+			"profile.star": "4 6406",    // 3 statements, 1 call
+		} {
+			if got[name] != want {
+				t.Errorf("%s: flat and cumulative steps of %s = %q, want %q\n%s", engine, name, got[name], want, out.String())
+			}
+		}
+	}
+
+	if err := starlark.StopProfile(); err == nil {
+		t.Error("StopProfile of inactive profiler succeeded")
+	}
+}
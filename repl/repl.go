@@ -44,8 +44,17 @@ var interrupted = make(chan os.Signal, 1)
 // variable named "context" to a context.Context that is cancelled by a
 // SIGINT (Control-C). Client-supplied global functions may use this
 // context to make long-running operations interruptable.
+// A SIGINT also cancels the thread itself (see Thread.Cancel),
+// so that long-running Starlark loops can be interrupted.
 //
+// The dialect is that of the deprecated package-level variables of
+// the resolve package.
 func REPL(thread *starlark.Thread, globals starlark.StringDict) {
+	REPLOptions(thread, globals, nil)
+}
+
+// REPLOptions is like REPL, but accepts input in the specified dialect.
+func REPLOptions(thread *starlark.Thread, globals starlark.StringDict, dialect *resolve.Options) {
 	signal.Notify(interrupted, os.Interrupt)
 	defer signal.Stop(interrupted)
 
@@ -56,7 +65,7 @@ func REPL(thread *starlark.Thread, globals starlark.StringDict) {
 	}
 	defer rl.Close()
 	for {
-		if err := rep(rl, thread, globals); err != nil {
+		if err := rep(rl, thread, globals, dialect); err != nil {
 			if err == readline.ErrInterrupt {
 				fmt.Println(err)
 				continue
@@ -71,7 +80,7 @@ func REPL(thread *starlark.Thread, globals starlark.StringDict) {
 //
 // It returns an error (possibly readline.ErrInterrupt)
 // only if readline failed. Starlark errors are printed.
-func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.StringDict) error {
+func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.StringDict, dialect *resolve.Options) error {
 	// Each item gets its own context,
 	// which is cancelled by a SIGINT.
 	//
@@ -79,10 +88,12 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 	// ErrInterrupt but does not generate a SIGINT.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	thread.Uncancel()
 	go func() {
 		select {
 		case <-interrupted:
 			cancel()
+			thread.Cancel("interrupted")
 		case <-ctx.Done():
 		}
 	}()
@@ -101,7 +112,7 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 
 	// If the line contains a well-formed expression, evaluate it.
 	if _, err := syntax.ParseExpr("<stdin>", line, 0); err == nil {
-		if v, err := starlark.Eval(thread, "<stdin>", line, globals); err != nil {
+		if v, err := starlark.EvalOptions(thread, "<stdin>", line, globals, dialect); err != nil {
 			PrintError(err)
 		} else if v != starlark.None {
 			fmt.Println(v)
@@ -115,7 +126,7 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 		switch f.Stmts[0].(type) {
 		case *syntax.AssignStmt, *syntax.LoadStmt:
 			// Execute it as a file.
-			if err := execFileNoFreeze(thread, line, globals); err != nil {
+			if err := execFileNoFreeze(thread, line, globals, dialect); err != nil {
 				PrintError(err)
 			}
 			return nil
@@ -146,7 +157,7 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 	//     2
 	//   )
 	if _, err := syntax.ParseExpr("<stdin>", text, 0); err == nil {
-		if v, err := starlark.Eval(thread, "<stdin>", text, globals); err != nil {
+		if v, err := starlark.EvalOptions(thread, "<stdin>", text, globals, dialect); err != nil {
 			PrintError(err)
 		} else if v != starlark.None {
 			fmt.Println(v)
@@ -155,7 +166,7 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 	}
 
 	// Execute it as a file.
-	if err := execFileNoFreeze(thread, text, globals); err != nil {
+	if err := execFileNoFreeze(thread, text, globals, dialect); err != nil {
 		PrintError(err)
 	}
 
@@ -163,7 +174,7 @@ func rep(rl *readline.Instance, thread *starlark.Thread, globals starlark.String
 }
 
 // execFileNoFreeze is starlark.ExecFile without globals.Freeze().
-func execFileNoFreeze(thread *starlark.Thread, src interface{}, globals starlark.StringDict) error {
+func execFileNoFreeze(thread *starlark.Thread, src interface{}, globals starlark.StringDict, dialect *resolve.Options) error {
 	// parse
 	f, err := syntax.Parse("<stdin>", src, 0)
 	if err != nil {
@@ -171,7 +182,7 @@ func execFileNoFreeze(thread *starlark.Thread, src interface{}, globals starlark
 	}
 
 	// resolve
-	if err := resolve.File(f, globals.Has, starlark.Universe.Has); err != nil {
+	if err := resolve.FileOptions(f, globals.Has, starlark.Universe.Has, dialect); err != nil {
 		return err
 	}
 
@@ -194,11 +205,21 @@ func execFileNoFreeze(thread *starlark.Thread, src interface{}, globals starlark
 }
 
 // PrintError prints the error to stderr,
-// or its backtrace if it is a Starlark evaluation error.
+// or its backtrace if it is a Starlark evaluation error,
+// or each of its errors if it is a list of syntax or resolver errors.
 func PrintError(err error) {
-	if evalErr, ok := err.(*starlark.EvalError); ok {
-		fmt.Fprintln(os.Stderr, evalErr.Backtrace())
-	} else {
+	switch err := err.(type) {
+	case *starlark.EvalError:
+		fmt.Fprintln(os.Stderr, err.Backtrace())
+	case syntax.ErrorList:
+		for _, e := range err {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	case resolve.ErrorList:
+		for _, e := range err {
+			fmt.Fprintln(os.Stderr, e)
+		}
+	default:
 		fmt.Fprintln(os.Stderr, err)
 	}
 }
@@ -206,7 +227,14 @@ func PrintError(err error) {
 // MakeLoad returns a simple sequential implementation of module loading
 // suitable for use in the REPL.
 // Each function returned by MakeLoad accesses a distinct private cache.
+// Programs that load modules concurrently should use package loader.
 func MakeLoad() func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	return MakeLoadOptions(nil)
+}
+
+// MakeLoadOptions is like MakeLoad, but the modules it loads are
+// executed in the specified dialect.
+func MakeLoadOptions(dialect *resolve.Options) func(thread *starlark.Thread, module string) (starlark.StringDict, error) {
 	type entry struct {
 		globals starlark.StringDict
 		err     error
@@ -226,8 +254,12 @@ func MakeLoad() func(thread *starlark.Thread, module string) (starlark.StringDic
 			cache[module] = nil
 
 			// Load it.
-			thread := &starlark.Thread{Load: thread.Load}
-			globals, err := starlark.ExecFile(thread, module, nil, nil)
+			thread := &starlark.Thread{Load: thread.Load, Trace: thread.Trace}
+			globals, err := starlark.Exec(starlark.ExecOptions{
+				Thread:   thread,
+				Filename: module,
+				Dialect:  dialect,
+			})
 			e = &entry{globals, err}
 
 			// Update the cache.
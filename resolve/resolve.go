@@ -73,6 +73,7 @@ package resolve
 import (
 	"fmt"
 	"log"
+	"sort"
 	"strings"
 
 	"github.com/aabbtree77/determinism/syntax"
@@ -84,12 +85,20 @@ const doesnt = "this Starlark dialect does not "
 // global options
 // These features are either not standard Starlark (yet), or deprecated
 // features of the BUILD language, so we put them behind flags.
+//
+// Deprecated: these variables are shared by every use of the resolver
+// in the process.  Use the corresponding fields of Options instead.
+// They apply only when the options are nil.
 var (
 	AllowNestedDef      = false // allow def statements within function bodies
 	AllowLambda         = false // allow lambda expressions
 	AllowFloat          = false // allow floating point literals, the 'float' built-in, and x / y
 	AllowSet            = false // allow the 'set' built-in
+	AllowBytes          = false // allow byte string literals and the 'bytes' built-in
 	AllowGlobalReassign = false // allow reassignment to globals declared in same file (deprecated)
+	AllowRecursion      = false // allow recursive function calls (checked by the evaluator)
+	AllowWhile          = false // allow while loops
+	AllowToplevelLoops  = false // allow for and while loops at top level
 )
 
 // File resolves the specified file.
@@ -104,11 +113,92 @@ var (
 // The isUniverse predicate is supplied a parameter to avoid a cyclic
 // dependency upon starlark.Universe, not because users should ever need
 // to redefine it.
+//
+// The dialect is that of the deprecated package-level variables.
 func File(file *syntax.File, isPredeclared, isUniversal func(name string) bool) error {
-	r := newResolver(isPredeclared, isUniversal)
+	return FileOptions(file, isPredeclared, isUniversal, nil)
+}
+
+// Options specifies the dialect of Starlark accepted by the resolver,
+// and other optional behavior.  The zero value accepts only standard
+// Starlark.  A nil *Options means the options given by the deprecated
+// package-level variables.
+type Options struct {
+	// Optional features of the dialect.
+	AllowNestedDef      bool // allow def statements within function bodies
+	AllowLambda         bool // allow lambda expressions
+	AllowFloat          bool // allow floating point literals, the 'float' built-in, and x / y
+	AllowSet            bool // allow the 'set' built-in
+	AllowBytes          bool // allow byte string literals and the 'bytes' built-in
+	AllowGlobalReassign bool // allow reassignment to globals declared in same file (deprecated)
+	AllowRecursion      bool // allow recursive function calls (checked by the evaluator)
+	AllowWhile          bool // allow while loops
+	AllowToplevelLoops  bool // allow for and while loops at top level
+
+	// Pragma permits a file to enable further features by means of
+	// pragma comments preceding its first statement (see
+	// syntax.File.Dialect), such as:
+	//
+	//	# dialect: lambda, set
+	//
+	// The feature names are nesteddef, lambda, float, set, bytes,
+	// global_reassign, recursion, while and toplevelloops.
+	Pragma bool
+
+	// Warn, if non-nil, enables the resolver's warnings about
+	// suspicious but legal code, and is called once for each of
+	// them, in order of position.  Warnings do not cause
+	// resolution to fail.
+	Warn func(Error)
+}
+
+// features maps each feature name of a dialect pragma to the
+// corresponding field of Options.
+var features = map[string]func(*Options) *bool{
+	"nesteddef":       func(o *Options) *bool { return &o.AllowNestedDef },
+	"lambda":          func(o *Options) *bool { return &o.AllowLambda },
+	"float":           func(o *Options) *bool { return &o.AllowFloat },
+	"set":             func(o *Options) *bool { return &o.AllowSet },
+	"bytes":           func(o *Options) *bool { return &o.AllowBytes },
+	"global_reassign": func(o *Options) *bool { return &o.AllowGlobalReassign },
+	"recursion":       func(o *Options) *bool { return &o.AllowRecursion },
+	"while":           func(o *Options) *bool { return &o.AllowWhile },
+	"toplevelloops":   func(o *Options) *bool { return &o.AllowToplevelLoops },
+}
+
+// legacyOptions returns the options given by the deprecated
+// package-level variables.
+func legacyOptions() *Options {
+	return &Options{
+		AllowNestedDef:      AllowNestedDef,
+		AllowLambda:         AllowLambda,
+		AllowFloat:          AllowFloat,
+		AllowSet:            AllowSet,
+		AllowBytes:          AllowBytes,
+		AllowGlobalReassign: AllowGlobalReassign,
+		AllowRecursion:      AllowRecursion,
+		AllowWhile:          AllowWhile,
+		AllowToplevelLoops:  AllowToplevelLoops,
+	}
+}
+
+// FileOptions is like File, but its behavior is specified by opts.
+// If opts.Pragma is set, the file's dialect pragmas enable further
+// features; an unknown feature name is an error.
+func FileOptions(file *syntax.File, isPredeclared, isUniversal func(name string) bool, opts *Options) error {
+	r := newResolver(isPredeclared, isUniversal, opts)
+	if r.opts.Pragma {
+		for _, id := range file.Dialect {
+			if feature, ok := features[id.Name]; ok {
+				*feature(&r.opts) = true
+			} else {
+				r.errorf(id.NamePos, "invalid-dialect", "unknown dialect feature: %s", id.Name)
+			}
+		}
+	}
 	r.stmts(file.Stmts)
 
-	r.env.resolveLocalUses()
+	r.resolveLocalUses(r.env)
 
 	// At the end of the module, resolve all non-local variable references,
 	// computing closures.
@@ -118,6 +208,18 @@ func File(file *syntax.File, isPredeclared, isUniversal func(name string) bool)
 	file.Locals = r.moduleLocals
 	file.Globals = r.moduleGlobals
 
+	if r.used != nil {
+		r.vars = append(r.vars, r.moduleLocals...)
+		r.checkUnused()
+		sort.SliceStable(r.warnings, func(i, j int) bool {
+			x, y := r.warnings[i].Pos, r.warnings[j].Pos
+			return x.Line < y.Line || x.Line == y.Line && x.Col < y.Col
+		})
+		for _, w := range r.warnings {
+			r.opts.Warn(w)
+		}
+	}
+
 	if len(r.errors) > 0 {
 		return r.errors
 	}
@@ -129,9 +231,17 @@ func File(file *syntax.File, isPredeclared, isUniversal func(name string) bool)
 //
 // The isPredeclared and isUniversal predicates behave as for the File function.
 func Expr(expr syntax.Expr, isPredeclared, isUniversal func(name string) bool) ([]*syntax.Ident, error) {
-	r := newResolver(isPredeclared, isUniversal)
+	return ExprOptions(expr, isPredeclared, isUniversal, nil)
+}
+
+// ExprOptions is like Expr, but its behavior is specified by opts.
+// Expressions have no pragmas, and the resolver reports no warnings
+// about them.
+func ExprOptions(expr syntax.Expr, isPredeclared, isUniversal func(name string) bool, opts *Options) ([]*syntax.Ident, error) {
+	r := newResolver(isPredeclared, isUniversal, opts)
+	r.used = nil
 	r.expr(expr)
-	r.env.resolveLocalUses()
+	r.resolveLocalUses(r.env)
 	r.resolveNonLocalUses(r.env) // globals & universals
 	if len(r.errors) > 0 {
 		return nil, r.errors
@@ -142,15 +252,71 @@ func Expr(expr syntax.Expr, isPredeclared, isUniversal func(name string) bool) (
 // An ErrorList is a non-empty list of resolver error messages.
 type ErrorList []Error // len > 0
 
-func (e ErrorList) Error() string { return e[0].Error() }
+// Error returns the messages of all the errors, one per line.
+func (e ErrorList) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
 
-// An Error describes the nature and position of a resolver error.
+// An Error describes the nature and position of a resolver error,
+// or of a warning.
+//
+// Its Code classifies the problem.  The codes are stable, so that
+// tools may filter or suppress diagnostics by code.  Errors have
+// these codes:
+//
+//	undefined             use of an undefined name
+//	reassign-global       second binding of a global name
+//	unsupported           feature not enabled in this dialect
+//	misplaced-statement   statement not permitted in its context,
+//	                      such as if at top level or load in a function
+//	not-in-loop           break or continue outside a loop
+//	invalid-load          malformed load statement
+//	invalid-assign        assignment to an expression that is not a variable
+//	invalid-params        malformed or duplicate parameters
+//	invalid-args          malformed arguments in a call
+//	invalid-dialect       unknown feature name in a dialect pragma
+//
+// and warnings these:
+//
+//	unused-local          local variable assigned but never used
+//	unused-load           name loaded but never used
+//	shadowed-predeclared  binding of a predeclared or universal name
+//	unreachable           statement following return, break or continue
+//
+// Unused variables whose names begin with an underscore are not
+// reported.
 type Error struct {
-	Pos syntax.Position
-	Msg string
+	Pos      syntax.Position
+	Msg      string
+	Code     string
+	Severity Severity
 }
 
-func (e Error) Error() string { return e.Pos.String() + ": " + e.Msg }
+func (e Error) Error() string {
+	if e.Severity == Warning {
+		return e.Pos.String() + ": warning: " + e.Msg
+	}
+	return e.Pos.String() + ": " + e.Msg
+}
+
+// The Severity of an Error distinguishes errors from warnings.
+type Severity uint8
+
+const (
+	Fatal   Severity = iota // an error; resolution fails
+	Warning                 // suspicious but legal code
+)
+
+func (sev Severity) String() string {
+	if sev == Warning {
+		return "warning"
+	}
+	return "error"
+}
 
 // The Scope of a syntax.Ident indicates what kind of scope it has.
 type Scope uint8
@@ -175,13 +341,21 @@ var scopeNames = [...]string{
 
 func (scope Scope) String() string { return scopeNames[scope] }
 
-func newResolver(isPredeclared, isUniversal func(name string) bool) *resolver {
-	return &resolver{
+func newResolver(isPredeclared, isUniversal func(name string) bool, opts *Options) *resolver {
+	if opts == nil {
+		opts = legacyOptions()
+	}
+	r := &resolver{
 		env:           new(block), // module block
 		isPredeclared: isPredeclared,
 		isUniversal:   isUniversal,
 		globals:       make(map[string]*syntax.Ident),
+		opts:          *opts,
+	}
+	if opts.Warn != nil {
+		r.used = make(map[*syntax.Ident]bool)
 	}
+	return r
 }
 
 type resolver struct {
@@ -204,16 +378,31 @@ type resolver struct {
 	// pre-declared, either in this module or universally.
 	isPredeclared, isUniversal func(name string) bool
 
-	loops int // number of enclosing for loops
+	opts Options // dialect, including features enabled by pragmas
+
+	loops int // number of enclosing for or while loops
 
 	errors ErrorList
+
+	// Warnings are computed only if used is non-nil.
+	// used records each local or global binding that is
+	// referenced, identified by its first binding occurrence;
+	// vars and loads are the local variables (other than
+	// parameters) and loaded names that should be referenced.
+	used     map[*syntax.Ident]bool
+	vars     []*syntax.Ident
+	loads    []*syntax.Ident
+	warnings []Error
 }
 
 // container returns the innermost enclosing "container" block:
 // a function (function != nil) or module (function == nil).
 // Container blocks accumulate local variable bindings.
-func (r *resolver) container() *block {
-	for b := r.env; ; b = b.parent {
+func (r *resolver) container() *block { return container(r.env) }
+
+// container returns the innermost container block enclosing b.
+func container(b *block) *block {
+	for ; ; b = b.parent {
 		if b.function != nil || b.isModule() {
 			return b
 		}
@@ -275,14 +464,24 @@ func (b *block) String() string {
 	return "module block"
 }
 
-func (r *resolver) errorf(posn syntax.Position, format string, args ...interface{}) {
-	r.errors = append(r.errors, Error{posn, fmt.Sprintf(format, args...)})
+func (r *resolver) errorf(posn syntax.Position, code, format string, args ...interface{}) {
+	r.errors = append(r.errors, Error{posn, fmt.Sprintf(format, args...), code, Fatal})
+}
+
+func (r *resolver) warnf(posn syntax.Position, code, format string, args ...interface{}) {
+	if r.used != nil {
+		r.warnings = append(r.warnings, Error{posn, fmt.Sprintf(format, args...), code, Warning})
+	}
 }
 
 // A use records an identifier and the environment in which it appears.
+// A binding occurrence of a local is recorded as a use too, so that
+// it is resolved along with the others, but it does not count as a
+// reference to the variable.
 type use struct {
-	id  *syntax.Ident
-	env *block
+	id   *syntax.Ident
+	env  *block
+	read bool // the use refers to the variable's value
 }
 
 // bind creates a binding for id in the current block,
@@ -299,12 +498,13 @@ func (r *resolver) bind(id *syntax.Ident, allowRebind bool) bool {
 			// they are of the form x += y.  We can't tell
 			// statically whether it's a reassignment
 			// (e.g. int += int) or a mutation (list += list).
-			if !allowRebind && !AllowGlobalReassign {
-				r.errorf(id.NamePos, "cannot reassign global %s declared at %s", id.Name, prev.NamePos)
+			if !allowRebind && !r.opts.AllowGlobalReassign {
+				r.errorf(id.NamePos, "reassign-global", "cannot reassign global %s declared at %s", id.Name, prev.NamePos)
 			}
 			id.Index = prev.Index
 		} else {
 			// first global binding of this name
+			r.checkShadow(id)
 			r.globals[id.Name] = id
 			id.Index = len(r.moduleGlobals)
 			r.moduleGlobals = append(r.moduleGlobals, id)
@@ -316,6 +516,7 @@ func (r *resolver) bind(id *syntax.Ident, allowRebind bool) bool {
 	// Assign it a new local (positive) index in the current container.
 	_, ok := r.env.bindings[id.Name]
 	if !ok {
+		r.checkShadow(id)
 		var locals *[]*syntax.Ident
 		if fn := r.container().function; fn != nil {
 			locals = &fn.Locals
@@ -326,10 +527,19 @@ func (r *resolver) bind(id *syntax.Ident, allowRebind bool) bool {
 		*locals = append(*locals, id)
 	}
 
-	r.use(id)
+	b := r.container()
+	b.uses = append(b.uses, use{id, r.env, false})
 	return ok
 }
 
+// checkShadow warns if id, the first binding of its name in its
+// block, hides a predeclared name.
+func (r *resolver) checkShadow(id *syntax.Ident) {
+	if r.used != nil && (r.isPredeclared(id.Name) || r.isUniversal(id.Name)) {
+		r.warnf(id.NamePos, "shadowed-predeclared", "%s shadows a predeclared name", id.Name)
+	}
+}
+
 func (r *resolver) use(id *syntax.Ident) {
 	// Reference outside any local (comprehension/function) block?
 	if r.env.isModule() {
@@ -338,29 +548,36 @@ func (r *resolver) use(id *syntax.Ident) {
 	}
 
 	b := r.container()
-	b.uses = append(b.uses, use{id, r.env})
+	b.uses = append(b.uses, use{id, r.env, true})
 }
 
+// useGlobal resolves a reference to a non-local name.
 func (r *resolver) useGlobal(id *syntax.Ident) binding {
 	var scope Scope
 	if prev, ok := r.globals[id.Name]; ok {
 		scope = Global // use of global declared by module
 		id.Index = prev.Index
+		if r.used != nil {
+			r.used[prev] = true
+		}
 	} else if r.isPredeclared(id.Name) {
 		scope = Predeclared // use of pre-declared
 	} else if id.Name == "PACKAGE_NAME" {
 		scope = Predeclared // nasty hack in Starlark spec; will go away (b/34240042).
 	} else if r.isUniversal(id.Name) {
 		scope = Universal // use of universal name
-		if !AllowFloat && id.Name == "float" {
-			r.errorf(id.NamePos, doesnt+"support floating point")
+		if !r.opts.AllowFloat && id.Name == "float" {
+			r.errorf(id.NamePos, "unsupported", doesnt+"support floating point")
 		}
-		if !AllowSet && id.Name == "set" {
-			r.errorf(id.NamePos, doesnt+"support sets")
+		if !r.opts.AllowSet && id.Name == "set" {
+			r.errorf(id.NamePos, "unsupported", doesnt+"support sets")
+		}
+		if !r.opts.AllowBytes && id.Name == "bytes" {
+			r.errorf(id.NamePos, "unsupported", doesnt+"support bytes")
 		}
 	} else {
 		scope = Undefined
-		r.errorf(id.NamePos, "undefined: %s", id.Name)
+		r.errorf(id.NamePos, "undefined", "undefined: %s", id.Name)
 	}
 	id.Scope = uint8(scope)
 	return binding{scope, id.Index}
@@ -368,12 +585,15 @@ func (r *resolver) useGlobal(id *syntax.Ident) binding {
 
 // resolveLocalUses is called when leaving a container (function/module)
 // block.  It resolves all uses of locals within that block.
-func (b *block) resolveLocalUses() {
+func (r *resolver) resolveLocalUses(b *block) {
 	unresolved := b.uses[:0]
 	for _, use := range b.uses {
 		if bind := lookupLocal(use); bind.scope == Local {
 			use.id.Scope = uint8(bind.scope)
 			use.id.Index = bind.index
+			if use.read {
+				r.markLocalUsed(b, bind.index)
+			}
 		} else {
 			unresolved = append(unresolved, use)
 		}
@@ -381,12 +601,57 @@ func (b *block) resolveLocalUses() {
 	b.uses = unresolved
 }
 
+// markLocalUsed records a reference to the local variable
+// with the specified index in container block b.
+func (r *resolver) markLocalUsed(b *block, index int) {
+	if r.used == nil {
+		return
+	}
+	if b.function != nil {
+		r.used[b.function.Locals[index]] = true
+	} else {
+		r.used[r.moduleLocals[index]] = true
+	}
+}
+
+// checkUnused warns about each local variable and loaded name
+// that is never referenced.
+func (r *resolver) checkUnused() {
+	for _, id := range r.vars {
+		if !r.used[id] && !strings.HasPrefix(id.Name, "_") {
+			r.warnf(id.NamePos, "unused-local", "local variable %s is assigned but never used", id.Name)
+		}
+	}
+	for _, id := range r.loads {
+		if !r.used[id] && !strings.HasPrefix(id.Name, "_") {
+			r.warnf(id.NamePos, "unused-load", "%s is loaded but never used", id.Name)
+		}
+	}
+}
+
 func (r *resolver) stmts(stmts []syntax.Stmt) {
-	for _, stmt := range stmts {
+	unreachable := false // reported
+	for i, stmt := range stmts {
 		r.stmt(stmt)
+		if i+1 < len(stmts) && !unreachable && isJump(stmt) {
+			r.warnf(syntax.Start(stmts[i+1]), "unreachable", "unreachable statement")
+			unreachable = true
+		}
 	}
 }
 
+// isJump reports whether stmt transfers control elsewhere,
+// so that the statement after it cannot be reached.
+func isJump(stmt syntax.Stmt) bool {
+	switch stmt := stmt.(type) {
+	case *syntax.ReturnStmt:
+		return true
+	case *syntax.BranchStmt:
+		return stmt.Token != syntax.PASS
+	}
+	return false
+}
+
 func (r *resolver) stmt(stmt syntax.Stmt) {
 	switch stmt := stmt.(type) {
 	case *syntax.ExprStmt:
@@ -394,12 +659,12 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 
 	case *syntax.BranchStmt:
 		if r.loops == 0 && (stmt.Token == syntax.BREAK || stmt.Token == syntax.CONTINUE) {
-			r.errorf(stmt.TokenPos, "%s not in a loop", stmt.Token)
+			r.errorf(stmt.TokenPos, "not-in-loop", "%s not in a loop", stmt.Token)
 		}
 
 	case *syntax.IfStmt:
 		if r.container().function == nil {
-			r.errorf(stmt.If, "if statement not within a function")
+			r.errorf(stmt.If, "misplaced-statement", "if statement not within a function")
 		}
 		r.expr(stmt.Cond)
 		r.stmts(stmt.True)
@@ -414,18 +679,21 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		// but we suppress the error if it's an already-bound global.
 		isAugmented := stmt.Op != syntax.EQ
 		r.assign(stmt.LHS, isAugmented)
+		if id, ok := stmt.LHS.(*syntax.Ident); ok && isAugmented {
+			r.use(id) // x += y also reads x
+		}
 
 	case *syntax.DefStmt:
-		if !AllowNestedDef && r.container().function != nil {
-			r.errorf(stmt.Def, doesnt+"support nested def")
+		if !r.opts.AllowNestedDef && r.container().function != nil {
+			r.errorf(stmt.Def, "unsupported", doesnt+"support nested def")
 		}
 		const allowRebind = false
 		r.bind(stmt.Name, allowRebind)
 		r.function(stmt.Def, stmt.Name.Name, &stmt.Function)
 
 	case *syntax.ForStmt:
-		if r.container().function == nil {
-			r.errorf(stmt.For, "for loop not within a function")
+		if !r.opts.AllowToplevelLoops && r.container().function == nil {
+			r.errorf(stmt.For, "misplaced-statement", "for loop not within a function")
 		}
 		r.expr(stmt.X)
 		const allowRebind = false
@@ -434,9 +702,21 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 		r.stmts(stmt.Body)
 		r.loops--
 
+	case *syntax.WhileStmt:
+		if !r.opts.AllowWhile {
+			r.errorf(stmt.While, "unsupported", doesnt+"support while loops")
+		}
+		if !r.opts.AllowToplevelLoops && r.container().function == nil {
+			r.errorf(stmt.While, "misplaced-statement", "while loop not within a function")
+		}
+		r.expr(stmt.Cond)
+		r.loops++
+		r.stmts(stmt.Body)
+		r.loops--
+
 	case *syntax.ReturnStmt:
 		if r.container().function == nil {
-			r.errorf(stmt.Return, "return statement not within a function")
+			r.errorf(stmt.Return, "misplaced-statement", "return statement not within a function")
 		}
 		if stmt.Result != nil {
 			r.expr(stmt.Result)
@@ -444,21 +724,26 @@ func (r *resolver) stmt(stmt syntax.Stmt) {
 
 	case *syntax.LoadStmt:
 		if r.container().function != nil {
-			r.errorf(stmt.Load, "load statement within a function")
+			r.errorf(stmt.Load, "misplaced-statement", "load statement within a function")
 		}
 
 		const allowRebind = false
 		for i, from := range stmt.From {
 			if from.Name == "" {
-				r.errorf(from.NamePos, "load: empty identifier")
+				r.errorf(from.NamePos, "invalid-load", "load: empty identifier")
 				continue
 			}
 			if from.Name[0] == '_' {
-				r.errorf(from.NamePos, "load: names with leading underscores are not exported: %s", from.Name)
+				r.errorf(from.NamePos, "invalid-load", "load: names with leading underscores are not exported: %s", from.Name)
+			}
+			if !r.bind(stmt.To[i], allowRebind) {
+				r.loads = append(r.loads, stmt.To[i])
 			}
-			r.bind(stmt.To[i], allowRebind)
 		}
 
+	case *syntax.BadStmt:
+		// The parser has reported the error.
+
 	default:
 		log.Fatalf("unexpected stmt %T", stmt)
 	}
@@ -483,10 +768,10 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	case *syntax.TupleExpr:
 		// (x, y) = ...
 		if len(lhs.List) == 0 {
-			r.errorf(syntax.Start(lhs), "can't assign to ()")
+			r.errorf(syntax.Start(lhs), "invalid-assign", "can't assign to ()")
 		}
 		if isAugmented {
-			r.errorf(syntax.Start(lhs), "can't use tuple expression in augmented assignment")
+			r.errorf(syntax.Start(lhs), "invalid-assign", "can't use tuple expression in augmented assignment")
 		}
 		for _, elem := range lhs.List {
 			r.assign(elem, isAugmented)
@@ -495,10 +780,10 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	case *syntax.ListExpr:
 		// [x, y, z] = ...
 		if len(lhs.List) == 0 {
-			r.errorf(syntax.Start(lhs), "can't assign to []")
+			r.errorf(syntax.Start(lhs), "invalid-assign", "can't assign to []")
 		}
 		if isAugmented {
-			r.errorf(syntax.Start(lhs), "can't use list expression in augmented assignment")
+			r.errorf(syntax.Start(lhs), "invalid-assign", "can't use list expression in augmented assignment")
 		}
 		for _, elem := range lhs.List {
 			r.assign(elem, isAugmented)
@@ -507,9 +792,12 @@ func (r *resolver) assign(lhs syntax.Expr, isAugmented bool) {
 	case *syntax.ParenExpr:
 		r.assign(lhs.X, isAugmented)
 
+	case *syntax.BadExpr:
+		// The parser has reported the error.
+
 	default:
 		name := strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", lhs), "*syntax."))
-		r.errorf(syntax.Start(lhs), "can't assign to %s", name)
+		r.errorf(syntax.Start(lhs), "invalid-assign", "can't assign to %s", name)
 	}
 }
 
@@ -519,8 +807,11 @@ func (r *resolver) expr(e syntax.Expr) {
 		r.use(e)
 
 	case *syntax.Literal:
-		if !AllowFloat && e.Token == syntax.FLOAT {
-			r.errorf(e.TokenPos, doesnt+"support floating point")
+		if !r.opts.AllowFloat && e.Token == syntax.FLOAT {
+			r.errorf(e.TokenPos, "unsupported", doesnt+"support floating point")
+		}
+		if !r.opts.AllowBytes && e.Token == syntax.BYTES {
+			r.errorf(e.TokenPos, "unsupported", doesnt+"support bytes")
 		}
 
 	case *syntax.ListExpr:
@@ -596,8 +887,8 @@ func (r *resolver) expr(e syntax.Expr) {
 		r.expr(e.X)
 
 	case *syntax.BinaryExpr:
-		if !AllowFloat && e.Op == syntax.SLASH {
-			r.errorf(e.OpPos, doesnt+"support floating point (use //)")
+		if !r.opts.AllowFloat && e.Op == syntax.SLASH {
+			r.errorf(e.OpPos, "unsupported", doesnt+"support floating point (use //)")
 		}
 		r.expr(e.X)
 		r.expr(e.Y)
@@ -614,23 +905,23 @@ func (r *resolver) expr(e syntax.Expr) {
 			if unop, ok := arg.(*syntax.UnaryExpr); ok && unop.Op == syntax.STARSTAR {
 				// **kwargs
 				if seenKwargs {
-					r.errorf(pos, "multiple **kwargs not allowed")
+					r.errorf(pos, "invalid-args", "multiple **kwargs not allowed")
 				}
 				seenKwargs = true
 				r.expr(arg)
 			} else if ok && unop.Op == syntax.STAR {
 				// *args
 				if seenKwargs {
-					r.errorf(pos, "*args may not follow **kwargs")
+					r.errorf(pos, "invalid-args", "*args may not follow **kwargs")
 				} else if seenVarargs {
-					r.errorf(pos, "multiple *args not allowed")
+					r.errorf(pos, "invalid-args", "multiple *args not allowed")
 				}
 				seenVarargs = true
 				r.expr(arg)
 			} else if binop, ok := arg.(*syntax.BinaryExpr); ok && binop.Op == syntax.EQ {
 				// k=v
 				if seenKwargs {
-					r.errorf(pos, "argument may not follow **kwargs")
+					r.errorf(pos, "invalid-args", "argument may not follow **kwargs")
 				}
 				// ignore binop.X
 				r.expr(binop.Y)
@@ -638,25 +929,28 @@ func (r *resolver) expr(e syntax.Expr) {
 			} else {
 				// positional argument
 				if seenVarargs {
-					r.errorf(pos, "argument may not follow *args")
+					r.errorf(pos, "invalid-args", "argument may not follow *args")
 				} else if seenKwargs {
-					r.errorf(pos, "argument may not follow **kwargs")
+					r.errorf(pos, "invalid-args", "argument may not follow **kwargs")
 				} else if seenNamed {
-					r.errorf(pos, "positional argument may not follow named")
+					r.errorf(pos, "invalid-args", "positional argument may not follow named")
 				}
 				r.expr(arg)
 			}
 		}
 
 	case *syntax.LambdaExpr:
-		if !AllowLambda {
-			r.errorf(e.Lambda, doesnt+"support lambda")
+		if !r.opts.AllowLambda {
+			r.errorf(e.Lambda, "unsupported", doesnt+"support lambda")
 		}
 		r.function(e.Lambda, "lambda", &e.Function)
 
 	case *syntax.ParenExpr:
 		r.expr(e.X)
 
+	case *syntax.BadExpr:
+		// The parser has reported the error.
+
 	default:
 		log.Fatalf("unexpected expr %T", e)
 	}
@@ -681,25 +975,25 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 		case *syntax.Ident:
 			// e.g. x
 			if seenKwargs {
-				r.errorf(pos, "parameter may not follow **kwargs")
+				r.errorf(pos, "invalid-params", "parameter may not follow **kwargs")
 			} else if seenVarargs {
-				r.errorf(pos, "parameter may not follow *args")
+				r.errorf(pos, "invalid-params", "parameter may not follow *args")
 			} else if seenOptional {
-				r.errorf(pos, "required parameter may not follow optional")
+				r.errorf(pos, "invalid-params", "required parameter may not follow optional")
 			}
 			if r.bind(param, allowRebind) {
-				r.errorf(pos, "duplicate parameter: %s", param.Name)
+				r.errorf(pos, "invalid-params", "duplicate parameter: %s", param.Name)
 			}
 
 		case *syntax.BinaryExpr:
 			// e.g. y=dflt
 			if seenKwargs {
-				r.errorf(pos, "parameter may not follow **kwargs")
+				r.errorf(pos, "invalid-params", "parameter may not follow **kwargs")
 			} else if seenVarargs {
-				r.errorf(pos, "parameter may not follow *args")
+				r.errorf(pos, "invalid-params", "parameter may not follow *args")
 			}
 			if id := param.X.(*syntax.Ident); r.bind(id, allowRebind) {
-				r.errorf(pos, "duplicate parameter: %s", id.Name)
+				r.errorf(pos, "invalid-params", "duplicate parameter: %s", id.Name)
 			}
 			seenOptional = true
 
@@ -707,29 +1001,32 @@ func (r *resolver) function(pos syntax.Position, name string, function *syntax.F
 			// *args or **kwargs
 			if param.Op == syntax.STAR {
 				if seenKwargs {
-					r.errorf(pos, "*args may not follow **kwargs")
+					r.errorf(pos, "invalid-params", "*args may not follow **kwargs")
 				} else if seenVarargs {
-					r.errorf(pos, "multiple *args not allowed")
+					r.errorf(pos, "invalid-params", "multiple *args not allowed")
 				}
 				seenVarargs = true
 			} else {
 				if seenKwargs {
-					r.errorf(pos, "multiple **kwargs not allowed")
+					r.errorf(pos, "invalid-params", "multiple **kwargs not allowed")
 				}
 				seenKwargs = true
 			}
 			if id := param.X.(*syntax.Ident); r.bind(id, allowRebind) {
-				r.errorf(pos, "duplicate parameter: %s", id.Name)
+				r.errorf(pos, "invalid-params", "duplicate parameter: %s", id.Name)
 			}
 		}
 	}
 	function.HasVarargs = seenVarargs
 	function.HasKwargs = seenKwargs
+	function.AllowRecursion = r.opts.AllowRecursion
+	nparams := len(function.Locals)
 	r.stmts(function.Body)
+	r.vars = append(r.vars, function.Locals[nparams:]...)
 
 	// Resolve all uses of this function's local vars,
 	// and keep just the remaining uses of free/global vars.
-	b.resolveLocalUses()
+	r.resolveLocalUses(b)
 
 	// Leave function block.
 	r.pop()
@@ -786,6 +1083,9 @@ func (r *resolver) lookupLexical(id *syntax.Ident, env *block) (bind binding) {
 		bind = r.lookupLexical(id, env.parent)
 		if env.function != nil && (bind.scope == Local || bind.scope == Free) {
 			// Found in parent block, which belongs to enclosing function.
+			if bind.scope == Local {
+				r.markLocalUsed(container(env.parent), bind.index)
+			}
 			id := &syntax.Ident{
 				Name:  id.Name,
 				Scope: uint8(bind.scope),
@@ -24,13 +24,19 @@ func TestResolve(t *testing.T) {
 		}
 
 		// A chunk may set options by containing e.g. "option:float".
-		resolve.AllowNestedDef = option(chunk.Source, "nesteddef")
-		resolve.AllowLambda = option(chunk.Source, "lambda")
-		resolve.AllowFloat = option(chunk.Source, "float")
-		resolve.AllowSet = option(chunk.Source, "set")
-		resolve.AllowGlobalReassign = option(chunk.Source, "global_reassign")
+		opts := &resolve.Options{
+			AllowNestedDef:      option(chunk.Source, "nesteddef"),
+			AllowLambda:         option(chunk.Source, "lambda"),
+			AllowFloat:          option(chunk.Source, "float"),
+			AllowSet:            option(chunk.Source, "set"),
+			AllowBytes:          option(chunk.Source, "bytes"),
+			AllowGlobalReassign: option(chunk.Source, "global_reassign"),
+			AllowWhile:          option(chunk.Source, "while"),
+			AllowToplevelLoops:  option(chunk.Source, "toplevelloops"),
+			Pragma:              true,
+		}
 
-		if err := resolve.File(f, isPredeclared, isUniversal); err != nil {
+		if err := resolve.FileOptions(f, isPredeclared, isUniversal, opts); err != nil {
 			for _, err := range err.(resolve.ErrorList) {
 				chunk.GotError(int(err.Pos.Line), err.Msg)
 			}
@@ -39,6 +45,32 @@ func TestResolve(t *testing.T) {
 	}
 }
 
+func TestWarnings(t *testing.T) {
+	filename := starlarktest.DataFile(".", "testdata/warnings.star")
+	for _, chunk := range chunkedfile.Read(filename, t) {
+		f, err := syntax.Parse(filename, chunk.Source, 0)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+
+		opts := &resolve.Options{
+			AllowNestedDef: option(chunk.Source, "nesteddef"),
+			AllowLambda:    option(chunk.Source, "lambda"),
+			Warn: func(w resolve.Error) {
+				if w.Severity != resolve.Warning {
+					t.Errorf("%s: severity of warning is %s", w.Pos, w.Severity)
+				}
+				chunk.GotError(int(w.Pos.Line), w.Code+": "+w.Msg)
+			},
+		}
+		if err := resolve.FileOptions(f, isPredeclared, isUniversal, opts); err != nil {
+			t.Error(err)
+		}
+		chunk.Done()
+	}
+}
+
 func option(chunk, name string) bool {
 	return strings.Contains(chunk, "option:"+name)
 }
@@ -80,6 +112,31 @@ func TestLambdaVarargsAndKwargsSet(t *testing.T) {
 	}
 }
 
+// TestLegacyOptions checks that the deprecated package-level
+// variables apply only when the options are nil.
+func TestLegacyOptions(t *testing.T) {
+	defer func(prev bool) { resolve.AllowLambda = prev }(resolve.AllowLambda)
+	resolve.AllowLambda = true
+
+	for _, test := range []struct {
+		opts *resolve.Options
+		ok   bool
+	}{
+		{nil, true},
+		{&resolve.Options{}, false},
+		{&resolve.Options{AllowLambda: true}, true},
+	} {
+		file, err := syntax.Parse("foo.star", "f = lambda: 0\n", 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = resolve.FileOptions(file, isPredeclared, isUniversal, test.opts)
+		if (err == nil) != test.ok {
+			t.Errorf("FileOptions(%+v) returned error %v, want ok=%t", test.opts, err, test.ok)
+		}
+	}
+}
+
 func isPredeclared(name string) bool { return name == "M" }
 
-func isUniversal(name string) bool { return name == "U" || name == "float" }
+func isUniversal(name string) bool { return name == "U" || name == "float" || name == "bytes" }
@@ -0,0 +1,249 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkcoverage measures the coverage of Starlark code:
+// how many times each statement executed, and each branch of each
+// if statement and conditional expression was taken.
+//
+// A Coverage collects these counts from the trace events of the
+// threads that use its Trace method, and writes them as an LCOV
+// tracefile or as an HTML report:
+//
+//	cov := starlarkcoverage.New()
+//	thread := &starlark.Thread{Trace: cov.Trace}
+//	... execute Starlark code ...
+//	err := cov.WriteLCOV(file)
+//
+// Statements and branches are reported only by the TreeWalker engine,
+// so code executed by other engines is not covered.
+package starlarkcoverage
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// A Coverage records the statements and branches executed by the
+// threads that report to it.  A Coverage may be shared by threads
+// that execute concurrently.
+type Coverage struct {
+	mu    sync.Mutex
+	files map[string]*file // by name
+}
+
+// A file records the coverage of a Starlark source file.
+type file struct {
+	stmts    map[position]int     // execution counts, by start of statement
+	branches map[position]*[2]int // counts of true and false conditions, by 'if' or 'elif'
+}
+
+// A position is a line and column of a file.
+type position struct{ line, col int32 }
+
+func key(pos syntax.Position) position { return position{pos.Line, pos.Col} }
+
+// New returns a Coverage that has recorded nothing.
+func New() *Coverage {
+	return &Coverage{files: make(map[string]*file)}
+}
+
+// Trace records an event.  It is suitable for use as the Trace
+// function of a starlark.Thread.
+//
+// The statements and branches of a file are known to the Coverage,
+// and appear in its reports even if they never execute, once a thread
+// executes the file's toplevel.
+func (c *Coverage) Trace(thread *starlark.Thread, event *starlark.TraceEvent) {
+	switch event.Kind {
+	case starlark.TraceCall:
+		if f, ok := event.Node.(*syntax.File); ok {
+			c.register(f)
+		}
+
+	case starlark.TraceStmt:
+		start, _ := event.Node.Span()
+		if !start.IsValid() {
+			return // synthesized, as is the body of a lambda
+		}
+		c.mu.Lock()
+		c.file(start.Filename()).stmts[key(start)]++
+		c.mu.Unlock()
+
+	case starlark.TraceBranch:
+		var pos syntax.Position
+		switch node := event.Node.(type) {
+		case *syntax.IfStmt:
+			pos = node.If
+		case *syntax.CondExpr:
+			pos = node.If
+		default:
+			return
+		}
+		c.mu.Lock()
+		counts := c.file(pos.Filename()).branch(key(pos))
+		if event.Result.Truth() {
+			counts[0]++
+		} else {
+			counts[1]++
+		}
+		c.mu.Unlock()
+	}
+}
+
+// register records the statements and branches of a file, with a
+// count of zero unless they have already executed.
+func (c *Coverage) register(f *syntax.File) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, stmt := range f.Stmts {
+		syntax.Walk(stmt, func(n syntax.Node) bool {
+			switch n := n.(type) {
+			case *syntax.IfStmt:
+				c.file(n.If.Filename()).branch(key(n.If))
+			case *syntax.CondExpr:
+				c.file(n.If.Filename()).branch(key(n.If))
+			}
+			if stmt, ok := n.(syntax.Stmt); ok {
+				start, _ := stmt.Span()
+				if !start.IsValid() {
+					return true
+				}
+				stmts := c.file(start.Filename()).stmts
+				if _, ok := stmts[key(start)]; !ok {
+					stmts[key(start)] = 0
+				}
+			}
+			return true
+		})
+	}
+}
+
+// file returns the record of the named file, creating it if needed.
+// It is called with c.mu held.
+func (c *Coverage) file(name string) *file {
+	f := c.files[name]
+	if f == nil {
+		f = &file{
+			stmts:    make(map[position]int),
+			branches: make(map[position]*[2]int),
+		}
+		c.files[name] = f
+	}
+	return f
+}
+
+// branch returns the counts of the branch point at pos, creating
+// them if needed.
+func (f *file) branch(pos position) *[2]int {
+	counts := f.branches[pos]
+	if counts == nil {
+		counts = new([2]int)
+		f.branches[pos] = counts
+	}
+	return counts
+}
+
+// Stmt returns the number of times the statement that begins at pos
+// has executed.  It reports whether a statement is known to begin
+// there.
+func (c *Coverage) Stmt(pos syntax.Position) (count int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.files[pos.Filename()]; f != nil {
+		count, ok = f.stmts[key(pos)]
+	}
+	return count, ok
+}
+
+// Branch returns the number of times the condition of the if
+// statement or conditional expression whose 'if' (or 'elif') keyword
+// is at pos was true and false.  It reports whether such a branch
+// point is known to be there.
+func (c *Coverage) Branch(pos syntax.Position) (ifTrue, ifFalse int, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f := c.files[pos.Filename()]; f != nil {
+		if counts := f.branches[key(pos)]; counts != nil {
+			return counts[0], counts[1], true
+		}
+	}
+	return 0, 0, false
+}
+
+// A fileSummary summarizes the coverage of a file, by line.
+type fileSummary struct {
+	name                       string
+	lines                      []*lineSummary // in order
+	linesFound, linesHit       int
+	branchesFound, branchesHit int
+}
+
+// A lineSummary summarizes the coverage of a line on which statements
+// begin or branch points lie.
+type lineSummary struct {
+	line     int32
+	stmts    bool     // statements begin on the line
+	count    int      // greatest execution count of those statements
+	branches [][2]int // true and false counts of branch points, in order of column
+}
+
+// summarize returns the summaries of the files, in order of name.
+func (c *Coverage) summarize() []*fileSummary {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var summaries []*fileSummary
+	for name, f := range c.files {
+		s := &fileSummary{name: name}
+		byLine := make(map[int32]*lineSummary)
+		line := func(n int32) *lineSummary {
+			l := byLine[n]
+			if l == nil {
+				l = &lineSummary{line: n}
+				byLine[n] = l
+				s.lines = append(s.lines, l)
+			}
+			return l
+		}
+		for pos, count := range f.stmts {
+			l := line(pos.line)
+			if !l.stmts || count > l.count {
+				l.count = count
+			}
+			l.stmts = true
+		}
+		var branches []position
+		for pos := range f.branches {
+			branches = append(branches, pos)
+		}
+		sort.Slice(branches, func(i, j int) bool { return branches[i].col < branches[j].col })
+		for _, pos := range branches {
+			l := line(pos.line)
+			l.branches = append(l.branches, *f.branches[pos])
+		}
+
+		sort.Slice(s.lines, func(i, j int) bool { return s.lines[i].line < s.lines[j].line })
+		for _, l := range s.lines {
+			if l.stmts {
+				s.linesFound++
+				if l.count > 0 {
+					s.linesHit++
+				}
+			}
+			for _, counts := range l.branches {
+				for _, n := range counts {
+					s.branchesFound++
+					if n > 0 {
+						s.branchesHit++
+					}
+				}
+			}
+		}
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].name < summaries[j].name })
+	return summaries
+}
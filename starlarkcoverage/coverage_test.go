@@ -0,0 +1,139 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkcoverage_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkcoverage"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+const src = `def f(x):
+	if x > 0:
+		return "pos"
+	elif x < 0:
+		return "neg"
+	return "zero" if x == 0 else "nan"
+
+def g():
+	pass
+
+f(1)
+f(0)
+`
+
+// execute executes src, as the file lib.star, and returns its
+// coverage.
+func execute(t *testing.T) (cov *starlarkcoverage.Coverage, filename string) {
+	filename = filepath.Join(t.TempDir(), "lib.star")
+	if err := os.WriteFile(filename, []byte(src), 0666); err != nil {
+		t.Fatal(err)
+	}
+	cov = starlarkcoverage.New()
+	thread := &starlark.Thread{Trace: cov.Trace}
+	if _, err := starlark.ExecFile(thread, filename, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return cov, filename
+}
+
+func TestCounts(t *testing.T) {
+	cov, filename := execute(t)
+	pos := func(line, col int32) syntax.Position { return syntax.MakePosition(&filename, line, col) }
+
+	for _, test := range []struct {
+		line, col int32
+		count     int
+	}{
+		{2, 2, 2},
+		{3, 3, 1},
+		{5, 3, 0}, // never executed
+		{9, 2, 0},
+		{12, 1, 1},
+	} {
+		if count, ok := cov.Stmt(pos(test.line, test.col)); !ok || count != test.count {
+			t.Errorf("Stmt(%d:%d) = %d, %t, want %d, true", test.line, test.col, count, ok, test.count)
+		}
+	}
+	if _, ok := cov.Stmt(pos(7, 1)); ok {
+		t.Errorf("Stmt(7:1) reports a statement on an empty line")
+	}
+
+	for _, test := range []struct {
+		line, col       int32
+		ifTrue, ifFalse int
+	}{
+		{2, 2, 1, 1},
+		{4, 2, 0, 1},  // elif
+		{6, 16, 1, 0}, // conditional expression
+	} {
+		ifTrue, ifFalse, ok := cov.Branch(pos(test.line, test.col))
+		if !ok || ifTrue != test.ifTrue || ifFalse != test.ifFalse {
+			t.Errorf("Branch(%d:%d) = %d, %d, %t, want %d, %d, true",
+				test.line, test.col, ifTrue, ifFalse, ok, test.ifTrue, test.ifFalse)
+		}
+	}
+}
+
+func TestWriteLCOV(t *testing.T) {
+	cov, filename := execute(t)
+	var buf bytes.Buffer
+	if err := cov.WriteLCOV(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `TN:
+SF:` + filename + `
+BRDA:2,0,0,1
+BRDA:2,0,1,1
+BRDA:4,0,0,0
+BRDA:4,0,1,1
+BRDA:6,0,0,1
+BRDA:6,0,1,0
+BRF:6
+BRH:4
+DA:1,1
+DA:2,2
+DA:3,1
+DA:4,1
+DA:5,0
+DA:6,1
+DA:8,1
+DA:9,0
+DA:11,1
+DA:12,1
+LF:10
+LH:8
+end_of_record
+`
+	if got := buf.String(); got != want {
+		t.Errorf("LCOV:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestWriteHTML(t *testing.T) {
+	cov, filename := execute(t)
+	var buf bytes.Buffer
+	if err := cov.WriteHTML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{
+		`">` + filename + `</a></td><td>8/10 (80.0%)</td><td>4/6 (66.7%)</td>`,
+		`<tr class="covered"><td class="num">3</td><td class="count">1</td><td class="src">		return &#34;pos&#34;</td></tr>`,
+		`<tr class="partial"><td class="num">4</td><td class="count">1</td><td class="src" title="branch: 0 true, 1 false">	elif x &lt; 0:</td></tr>`,
+		`<tr class="uncovered"><td class="num">5</td><td class="count">0</td>`,
+		`<tr class=""><td class="num">7</td><td class="count"></td><td class="src"></td></tr>`,
+	} {
+		if !strings.Contains(got, want) {
+			t.Errorf("HTML report does not contain %q:\n%s", want, got)
+		}
+	}
+}
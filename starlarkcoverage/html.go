@@ -0,0 +1,143 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkcoverage
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"os"
+	"strings"
+)
+
+// WriteHTML writes the coverage as an HTML report: a summary of the
+// line and branch coverage of each file, followed by its source
+// listing, which is read from the file system.  A line is marked
+// covered if its statements executed and each of its branches was
+// taken, partially covered if its statements executed but some branch
+// was not taken, and not covered if its statements never executed.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	var files []*htmlFile
+	for i, f := range c.summarize() {
+		hf := &htmlFile{
+			ID:       fmt.Sprintf("file%d", i),
+			Name:     f.name,
+			Lines:    ratio(f.linesHit, f.linesFound),
+			Branches: ratio(f.branchesHit, f.branchesFound),
+		}
+		files = append(files, hf)
+
+		data, err := os.ReadFile(f.name)
+		if err != nil {
+			hf.Err = err
+			continue
+		}
+		byLine := make(map[int32]*lineSummary)
+		for _, l := range f.lines {
+			byLine[l.line] = l
+		}
+		text := strings.TrimSuffix(string(data), "\n")
+		for i, src := range strings.Split(text, "\n") {
+			hl := htmlLine{Num: i + 1, Text: src}
+			if l := byLine[int32(i+1)]; l != nil {
+				hl.Class, hl.Count, hl.Title = lineStatus(l)
+			}
+			hf.Listing = append(hf.Listing, hl)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := htmlTemplate.Execute(&buf, files); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// An htmlFile is the data of the report of one file.
+type htmlFile struct {
+	ID, Name        string
+	Lines, Branches string
+	Err             error // reading the source
+	Listing         []htmlLine
+}
+
+// An htmlLine is the data of one line of a source listing.
+type htmlLine struct {
+	Num   int
+	Class string // "covered", "partial", "uncovered", or "" for lines without code
+	Count string // execution count of the line
+	Title string // counts of the branches of the line
+	Text  string
+}
+
+// lineStatus returns the class, execution count, and description of
+// the branches of a line.
+func lineStatus(l *lineSummary) (class, count, title string) {
+	class = "covered"
+	if l.stmts {
+		count = fmt.Sprint(l.count)
+		if l.count == 0 {
+			class = "uncovered"
+		}
+	}
+	var branches []string
+	evaluated := false
+	for _, counts := range l.branches {
+		branches = append(branches, fmt.Sprintf("branch: %d true, %d false", counts[0], counts[1]))
+		if counts[0]+counts[1] > 0 {
+			evaluated = true
+		}
+		if class == "covered" && (counts[0] == 0 || counts[1] == 0) {
+			class = "partial"
+		}
+	}
+	if !l.stmts && !evaluated {
+		class = "uncovered"
+	}
+	return class, count, strings.Join(branches, "; ")
+}
+
+// ratio formats the proportion of n items out of total.
+func ratio(n, total int) string {
+	if total == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%d/%d (%.1f%%)", n, total, 100*float64(n)/float64(total))
+}
+
+var htmlTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Starlark coverage</title>
+<style>
+body { font-family: sans-serif; }
+table.summary th, table.summary td { padding: 0 1em; text-align: right; }
+table.summary th:first-child, table.summary td:first-child { text-align: left; }
+table.source { border-collapse: collapse; font-family: monospace; tab-size: 4; }
+table.source td { padding: 0 0.5em; white-space: pre; }
+td.num, td.count { text-align: right; color: #888; }
+tr.covered td.src { background: #cfc; }
+tr.partial td.src { background: #ffc; }
+tr.uncovered td.src { background: #fcc; }
+</style>
+</head>
+<body>
+<h1>Starlark coverage</h1>
+<table class="summary">
+<tr><th>File</th><th>Lines</th><th>Branches</th></tr>
+{{range .}}<tr><td><a href="#{{.ID}}">{{.Name}}</a></td><td>{{.Lines}}</td><td>{{.Branches}}</td></tr>
+{{end}}</table>
+{{range .}}
+<h2 id="{{.ID}}">{{.Name}}</h2>
+{{if .Err}}<p>Source not available: {{.Err}}</p>
+{{else}}<table class="source">
+{{range .Listing}}<tr class="{{.Class}}"><td class="num">{{.Num}}</td><td class="count">{{.Count}}</td><td class="src"{{if .Title}} title="{{.Title}}"{{end}}>{{.Text}}</td></tr>
+{{end}}</table>
+{{end}}{{end}}</body>
+</html>
+`))
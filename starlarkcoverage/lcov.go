@@ -0,0 +1,45 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkcoverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// WriteLCOV writes the coverage in the LCOV tracefile format, as read
+// by genhtml and by most coverage services.  See geninfo(1).
+//
+// Each line on which statements begin has a DA record, whose count is
+// that of the line's most executed statement.  Each branch point has
+// two BRDA records, for the true and false outcomes of its condition,
+// numbered as blocks in order of column within the line.  The count of
+// a branch point whose condition was never evaluated is "-".
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	out := bufio.NewWriter(w)
+	for _, f := range c.summarize() {
+		fmt.Fprintf(out, "TN:\nSF:%s\n", f.name)
+		for _, l := range f.lines {
+			for block, counts := range l.branches {
+				for branch, n := range counts {
+					taken := "-"
+					if counts[0]+counts[1] > 0 {
+						taken = fmt.Sprint(n)
+					}
+					fmt.Fprintf(out, "BRDA:%d,%d,%d,%s\n", l.line, block, branch, taken)
+				}
+			}
+		}
+		fmt.Fprintf(out, "BRF:%d\nBRH:%d\n", f.branchesFound, f.branchesHit)
+		for _, l := range f.lines {
+			if l.stmts {
+				fmt.Fprintf(out, "DA:%d,%d\n", l.line, l.count)
+			}
+		}
+		fmt.Fprintf(out, "LF:%d\nLH:%d\nend_of_record\n", f.linesFound, f.linesHit)
+	}
+	return out.Flush()
+}
@@ -0,0 +1,160 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkencoding defines the Starlark 'encoding' module,
+// which converts between binary data and text in the base64 and
+// hexadecimal encodings.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"encoding": starlarkencoding.Module,
+//	}
+//
+// The functions of the module are:
+//
+//	base64_encode(x, url=False)   the base64 encoding of x
+//	base64_decode(x, url=False)   the data whose base64 encoding is x
+//	hex_encode(x)                 the hexadecimal encoding of x
+//	hex_decode(x)                 the data whose hexadecimal encoding is x
+//
+// The argument of an encoder is a string or bytes, of which it encodes
+// the bytes.  The argument of a decoder is a string, and its result is
+// a string that holds the decoded bytes, which need not be UTF-8; the
+// built-in bytes function converts it to bytes without loss.
+//
+// The base64 functions use the standard alphabet of RFC 4648, or, if
+// url is true, the alphabet for URLs and file names, with '-' and '_'
+// in place of '+' and '/'.  Encodings are padded with '='; decoders
+// require the padding.  The hexadecimal encoding uses lowercase
+// digits; its decoder accepts either case.
+//
+// The work of encoding and decoding is charged to the thread's
+// computation steps in proportion to the length of x, so that a limit
+// set by starlark.Thread.SetMaxExecutionSteps bounds it too.
+// The results are charged to the thread's allocations.
+package starlarkencoding
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+)
+
+// Module is the Starlark 'encoding' module.
+var Module = &starlarkstruct.Module{
+	Name: "encoding",
+	Members: starlark.StringDict{
+		"base64_encode": starlark.NewBuiltin("encoding.base64_encode", base64Encode),
+		"base64_decode": starlark.NewBuiltin("encoding.base64_decode", base64Decode),
+		"hex_encode":    starlark.NewBuiltin("encoding.hex_encode", hexEncode),
+		"hex_decode":    starlark.NewBuiltin("encoding.hex_decode", hexDecode),
+	},
+}
+
+// asData returns the bytes of x, a string or bytes.
+func asData(b *starlark.Builtin, x starlark.Value) (string, error) {
+	switch x := x.(type) {
+	case starlark.String:
+		return string(x), nil
+	case starlark.Bytes:
+		return string(x), nil
+	}
+	return "", fmt.Errorf("%s: for parameter 1: got %s, want string or bytes", b.Name(), x.Type())
+}
+
+// base64Encoding returns the base64 encoding, standard or for URLs.
+func base64Encoding(url bool) *base64.Encoding {
+	if url {
+		return base64.URLEncoding
+	}
+	return base64.StdEncoding
+}
+
+// base64_encode(x, url=False) returns the base64 encoding of x.
+func base64Encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Value
+	var url bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x, "url?", &url); err != nil {
+		return nil, err
+	}
+	data, err := asData(b, x)
+	if err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(data)); err != nil {
+		return nil, err
+	}
+	enc := base64Encoding(url)
+	if err := thread.CheckAllocs(int64(enc.EncodedLen(len(data)))); err != nil {
+		return nil, err
+	}
+	res := starlark.String(enc.EncodeToString([]byte(data)))
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// base64_decode(x, url=False) returns the data whose base64 encoding is x.
+func base64Decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x string
+	var url bool
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x, "url?", &url); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(x)); err != nil {
+		return nil, err
+	}
+	enc := base64Encoding(url)
+	if err := thread.CheckAllocs(int64(enc.DecodedLen(len(x)))); err != nil {
+		return nil, err
+	}
+	data, err := enc.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	res := starlark.String(data)
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// hex_encode(x) returns the hexadecimal encoding of x.
+func hexEncode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x); err != nil {
+		return nil, err
+	}
+	data, err := asData(b, x)
+	if err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(data)); err != nil {
+		return nil, err
+	}
+	if err := thread.CheckAllocs(int64(hex.EncodedLen(len(data)))); err != nil {
+		return nil, err
+	}
+	res := starlark.String(hex.EncodeToString([]byte(data)))
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// hex_decode(x) returns the data whose hexadecimal encoding is x.
+func hexDecode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(x)); err != nil {
+		return nil, err
+	}
+	if err := thread.CheckAllocs(int64(hex.DecodedLen(len(x)))); err != nil {
+		return nil, err
+	}
+	data, err := hex.DecodeString(x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	res := starlark.String(data)
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
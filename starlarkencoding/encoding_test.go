@@ -0,0 +1,104 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkencoding_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarkencoding"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	filename := filepath.Join(testdata, "testdata/encoding.star")
+	predeclared := starlark.StringDict{
+		"encoding": starlarkencoding.Module,
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true, AllowBytes: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// TestSteps ensures that encoding and decoding are charged to the
+// thread's computation steps.
+func TestSteps(t *testing.T) {
+	const src = `
+def f():
+	for i in range(10):
+		encoding.hex_decode(encoding.hex_encode("x" * 3200))
+f()
+`
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{"encoding": starlarkencoding.Module}
+	if _, err := starlark.ExecFile(thread, "steps.star", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	// 2 toplevel statements, 1 call of f, 1 statement in f,
+	// 10 iterations of 1 statement, 10 encodings of 3200 bytes,
+	// and 10 decodings of 6400 bytes.
+	if got, want := thread.ExecutionSteps(), uint64(2+1+1+10+10*50+10*100); got != want {
+		t.Errorf("executed %d steps, want %d", got, want)
+	}
+
+	thread = new(starlark.Thread)
+	thread.SetMaxExecutionSteps(500)
+	_, err := starlark.ExecFile(thread, "steps.star", src, predeclared)
+	var stepErr *starlark.StepLimitError
+	if !errors.As(err, &stepErr) {
+		t.Errorf("with limit 500: got %v, want StepLimitError", err)
+	}
+}
+
+// TestAllocs ensures that the decoders check the size of their result
+// against the thread's allocation limit before allocating it.
+func TestAllocs(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"encoding": starlarkencoding.Module,
+		"b64":      starlark.String(strings.Repeat("AAAA", 1000)),
+		"hex":      starlark.String(strings.Repeat("00", 2000)),
+	}
+	for _, expr := range []string{"encoding.base64_decode(b64)", "encoding.hex_decode(hex)"} {
+		thread := new(starlark.Thread)
+		thread.SetMaxAllocs(1000)
+		_, err := starlark.Eval(thread, "allocs.star", expr, predeclared)
+		var allocErr *starlark.AllocLimitError
+		if !errors.As(err, &allocErr) {
+			t.Errorf("%s: got %v, want AllocLimitError", expr, err)
+		} else if thread.Allocs() != 0 {
+			t.Errorf("%s: charged %d bytes, want 0", expr, thread.Allocs())
+		}
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
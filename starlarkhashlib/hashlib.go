@@ -0,0 +1,103 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkhashlib defines the Starlark 'hashlib' module, which
+// computes cryptographic digests and checksums, suitable for cache
+// keys and fingerprints of artifacts.  Unlike the built-in hash
+// function, which is meant only for hash tables, the results are
+// standard and stable.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"hashlib": starlarkhashlib.Module,
+//	}
+//
+// The functions of the module are:
+//
+//	md5(x)      the MD5 digest of x
+//	sha1(x)     the SHA-1 digest of x
+//	sha256(x)   the SHA-256 digest of x
+//	crc32(x)    the CRC-32 checksum of x, with the IEEE polynomial
+//
+// The argument x is a string or bytes; the digest is of its bytes,
+// which for a string are conventionally its UTF-8 encoding.  A digest
+// is a string of lowercase hexadecimal digits, such as
+// "d41d8cd98f00b204e9800998ecf8427e" for the MD5 digest of "".  The
+// checksum is a non-negative int.
+//
+// MD5 and SHA-1 are broken as cryptographic hashes; they are provided
+// for compatibility with existing fingerprints.
+//
+// The work of hashing is charged to the thread's computation steps in
+// proportion to the length of x, so that a limit set by
+// starlark.Thread.SetMaxExecutionSteps bounds it too.
+package starlarkhashlib
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+)
+
+// Module is the Starlark 'hashlib' module.
+var Module = &starlarkstruct.Module{
+	Name: "hashlib",
+	Members: starlark.StringDict{
+		"md5":    newDigestBuiltin("md5", md5.New),
+		"sha1":   newDigestBuiltin("sha1", sha1.New),
+		"sha256": newDigestBuiltin("sha256", sha256.New),
+		"crc32":  starlark.NewBuiltin("hashlib.crc32", crc32_),
+	},
+}
+
+// unpackData unpacks the sole argument of a built-in, a string or
+// bytes, and charges the work of hashing it to the thread.
+func unpackData(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (string, error) {
+	var x starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x); err != nil {
+		return "", err
+	}
+	var data string
+	switch x := x.(type) {
+	case starlark.String:
+		data = string(x)
+	case starlark.Bytes:
+		data = string(x)
+	default:
+		return "", fmt.Errorf("%s: for parameter 1: got %s, want string or bytes", b.Name(), x.Type())
+	}
+	return data, thread.AddByteSteps(len(data))
+}
+
+// newDigestBuiltin returns a built-in function of a string or bytes
+// whose result is its digest, in hexadecimal, by the hash of newHash.
+func newDigestBuiltin(name string, newHash func() hash.Hash) *starlark.Builtin {
+	return starlark.NewBuiltin("hashlib."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		data, err := unpackData(thread, b, args, kwargs)
+		if err != nil {
+			return nil, err
+		}
+		h := newHash()
+		h.Write([]byte(data))
+		res := starlark.String(hex.EncodeToString(h.Sum(nil)))
+		return res, thread.AddAllocs(starlark.EstimateSize(res))
+	})
+}
+
+// crc32(x) returns the IEEE CRC-32 checksum of x.
+func crc32_(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	data, err := unpackData(thread, b, args, kwargs)
+	if err != nil {
+		return nil, err
+	}
+	return starlark.MakeUint64(uint64(crc32.ChecksumIEEE([]byte(data)))), nil
+}
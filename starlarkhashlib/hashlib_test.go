@@ -0,0 +1,81 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkhashlib_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarkhashlib"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	filename := filepath.Join(testdata, "testdata/hashlib.star")
+	predeclared := starlark.StringDict{
+		"hashlib": starlarkhashlib.Module,
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true, AllowBytes: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// TestSteps ensures that hashing is charged to the thread's
+// computation steps.
+func TestSteps(t *testing.T) {
+	const src = `
+def f():
+	for h in [hashlib.md5, hashlib.sha1, hashlib.sha256, hashlib.crc32]:
+		h("x" * 6400)
+f()
+`
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{"hashlib": starlarkhashlib.Module}
+	if _, err := starlark.ExecFile(thread, "steps.star", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	// 2 toplevel statements, 1 call of f, 1 statement in f,
+	// 4 iterations of 1 statement, and 4 hashes of 6400 bytes.
+	if got, want := thread.ExecutionSteps(), uint64(2+1+1+4+4*100); got != want {
+		t.Errorf("executed %d steps, want %d", got, want)
+	}
+
+	thread = new(starlark.Thread)
+	thread.SetMaxExecutionSteps(200)
+	_, err := starlark.ExecFile(thread, "steps.star", src, predeclared)
+	var stepErr *starlark.StepLimitError
+	if !errors.As(err, &stepErr) {
+		t.Errorf("with limit 200: got %v, want StepLimitError", err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
@@ -0,0 +1,644 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkjson defines the Starlark 'json' module, which
+// encodes Starlark values as JSON text and decodes JSON text as
+// Starlark values.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"json": starlarkjson.Module,
+//	}
+//
+// The module has three functions:
+//
+//	json.encode(x)
+//
+// encode returns the JSON encoding of x, which may be None, a bool,
+// an int, a finite float, a string, a dict whose keys are strings,
+// a list, tuple or set, or a struct, or any Go value that implements
+// json.Marshaler, which determines its own encoding.  Dicts are
+// encoded in insertion order, and structs in order of field name.
+// Ints are encoded exactly, however large.  A float is encoded with
+// a decimal point or exponent, so that decoding it yields a float.
+// encode fails if x contains a value of another type, a non-finite
+// float, or a cycle, and the error gives the path from x to the value,
+// for example `at ["deps"][2].name`.
+//
+//	json.decode(x)
+//
+// decode returns the Starlark value encoded by the JSON text x:
+// None, a bool, an int (for a number without a fraction or exponent),
+// a float, a string, a list, or a dict, whose keys are in the order of
+// the text.  Of duplicate keys, the last prevails.
+//
+// Both encode and decode fail if arrays and objects are nested more
+// than 1000 deep.  All three functions charge their work to the
+// thread's computation steps, and the values they create to its
+// allocations, so that the thread's limits bound them.
+//
+//	json.indent(x, prefix="", indent="\t")
+//
+// indent returns the JSON text x, reformatted so that each element of
+// an array or object begins on a new line, which begins with prefix
+// followed by one copy of indent for each level of nesting.
+package starlarkjson
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+)
+
+// Module is the Starlark 'json' module.
+var Module = &starlarkstruct.Module{
+	Name: "json",
+	Members: starlark.StringDict{
+		"encode": starlark.NewBuiltin("json.encode", encode),
+		"decode": starlark.NewBuiltin("json.decode", decode),
+		"indent": starlark.NewBuiltin("json.indent", indent),
+	},
+}
+
+// maxDepth is the greatest nesting of arrays and objects that encode
+// produces and decode accepts, which bounds the depth of their recursion.
+const maxDepth = 1000
+
+func encode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x starlark.Value
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	e := encoder{thread: thread}
+	if err := e.encode(x); err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	res := starlark.String(e.buf.String())
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// An encoder encodes a Starlark value as JSON.
+type encoder struct {
+	thread *starlark.Thread // charged for the work and the output
+	buf    bytes.Buffer
+	path   []string         // the path to the current value: "[1]", `["key"]` or ".field"
+	stack  []starlark.Value // the lists and dicts being encoded, to detect cycles
+}
+
+// errorf returns an error at the current value.
+func (e *encoder) errorf(format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if len(e.path) > 0 {
+		msg = "at " + strings.Join(e.path, "") + ": " + msg
+	}
+	return errors.New(msg)
+}
+
+// grow charges the thread one step for a value, and the steps to
+// write n more bytes, and checks that the output would not then exceed
+// the thread's allocation limit.
+func (e *encoder) grow(n int) error {
+	if err := e.thread.AddExecutionSteps(1); err != nil {
+		return err
+	}
+	if err := e.thread.AddByteSteps(n); err != nil {
+		return err
+	}
+	return e.thread.CheckAllocs(int64(e.buf.Len() + n))
+}
+
+// writeString writes s as a JSON string, after charging for it.
+func (e *encoder) writeString(s string) error {
+	if err := e.grow(len(s)); err != nil {
+		return err
+	}
+	encodeString(&e.buf, s)
+	return nil
+}
+
+func (e *encoder) encode(x starlark.Value) error {
+	if m, ok := x.(json.Marshaler); ok {
+		data, err := m.MarshalJSON()
+		if err != nil {
+			return e.errorf("cannot encode %s: %v", x.Type(), err)
+		}
+		if !json.Valid(data) {
+			return e.errorf("cannot encode %s: MarshalJSON returned invalid JSON", x.Type())
+		}
+		if err := e.grow(len(data)); err != nil {
+			return err
+		}
+		return json.Compact(&e.buf, data)
+	}
+	if _, ok := x.(starlark.String); !ok {
+		if err := e.grow(0); err != nil {
+			return err
+		}
+	}
+
+	switch x := x.(type) {
+	case starlark.NoneType:
+		e.buf.WriteString("null")
+
+	case starlark.Bool:
+		if x {
+			e.buf.WriteString("true")
+		} else {
+			e.buf.WriteString("false")
+		}
+
+	case starlark.Int:
+		e.buf.WriteString(x.String())
+
+	case starlark.Float:
+		f := float64(x)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return e.errorf("cannot encode non-finite float %v", x)
+		}
+		s := strconv.FormatFloat(f, 'g', -1, 64)
+		e.buf.WriteString(s)
+		if !strings.ContainsAny(s, ".e") {
+			e.buf.WriteString(".0") // distinguish from an int
+		}
+
+	case starlark.String:
+		return e.writeString(string(x))
+
+	case *starlark.Dict:
+		if err := e.push(x); err != nil {
+			return err
+		}
+		e.buf.WriteByte('{')
+		for i, item := range x.Items() {
+			k, ok := item[0].(starlark.String)
+			if !ok {
+				return e.errorf("cannot encode dict with %s key", item[0].Type())
+			}
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.writeString(string(k)); err != nil {
+				return err
+			}
+			e.buf.WriteByte(':')
+			e.path = append(e.path, "["+k.String()+"]")
+			if err := e.encode(item[1]); err != nil {
+				return err
+			}
+			e.path = e.path[:len(e.path)-1]
+		}
+		e.buf.WriteByte('}')
+		e.pop()
+
+	case *starlarkstruct.Struct:
+		if err := e.push(x); err != nil {
+			return err
+		}
+		e.buf.WriteByte('{')
+		for i, name := range x.AttrNames() {
+			v, err := x.Attr(name)
+			if err != nil {
+				return e.errorf("%v", err)
+			}
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			if err := e.writeString(name); err != nil {
+				return err
+			}
+			e.buf.WriteByte(':')
+			e.path = append(e.path, "."+name)
+			if err := e.encode(v); err != nil {
+				return err
+			}
+			e.path = e.path[:len(e.path)-1]
+		}
+		e.buf.WriteByte('}')
+		e.pop()
+
+	case starlark.Iterable: // list, tuple, set
+		if err := e.push(x); err != nil {
+			return err
+		}
+		e.buf.WriteByte('[')
+		iter := x.Iterate()
+		defer iter.Done()
+		var elem starlark.Value
+		for i := 0; iter.Next(&elem); i++ {
+			if i > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.path = append(e.path, fmt.Sprintf("[%d]", i))
+			if err := e.encode(elem); err != nil {
+				return err
+			}
+			e.path = e.path[:len(e.path)-1]
+		}
+		e.buf.WriteByte(']')
+		e.pop()
+
+	default:
+		return e.errorf("cannot encode %s as JSON", x.Type())
+	}
+	return nil
+}
+
+// push records that the encoder is encoding the elements of x, which
+// must not already be in the stack, nor make it deeper than maxDepth.
+func (e *encoder) push(x starlark.Value) error {
+	if len(e.stack) == maxDepth {
+		return e.errorf("nesting depth exceeds %d", maxDepth)
+	}
+	switch x.(type) {
+	case *starlark.List, *starlark.Dict:
+		for _, y := range e.stack {
+			if y == x {
+				return e.errorf("cycle in JSON structure")
+			}
+		}
+		e.stack = append(e.stack, x)
+	default:
+		e.stack = append(e.stack, nil) // values of other types are acyclic, or not comparable
+	}
+	return nil
+}
+
+func (e *encoder) pop() { e.stack = e.stack[:len(e.stack)-1] }
+
+// encodeString writes s as a JSON string.  Invalid UTF-8 sequences
+// are replaced by U+FFFD.
+func encodeString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+	buf.WriteByte('"')
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(byte(r))
+		case r == '\n':
+			buf.WriteString(`\n`)
+		case r == '\r':
+			buf.WriteString(`\r`)
+		case r == '\t':
+			buf.WriteString(`\t`)
+		case r < 0x20:
+			buf.WriteString(`\u00`)
+			buf.WriteByte(hex[r>>4])
+			buf.WriteByte(hex[r&0xf])
+		case r == utf8.RuneError && size == 1:
+			buf.WriteString("\ufffd")
+		default:
+			buf.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	buf.WriteByte('"')
+}
+
+func decode(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &s); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	d := decoder{thread: thread, s: s}
+	x, err := d.value()
+	if err == nil {
+		if d.skipSpace(); d.i < len(d.s) {
+			err = d.errorf("unexpected character %q after value", d.s[d.i])
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b.Name(), err)
+	}
+	return x, nil
+}
+
+// A decoder decodes JSON text as a Starlark value.
+type decoder struct {
+	thread *starlark.Thread // charged for the values decoded
+	s      string
+	i      int // offset of the next byte
+	depth  int // number of arrays and objects being decoded
+}
+
+// errorf returns an error at the current offset.
+func (d *decoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("at offset %d, %s", d.i, fmt.Sprintf(format, args...))
+}
+
+func (d *decoder) skipSpace() {
+	for d.i < len(d.s) && strings.IndexByte(" \t\n\r", d.s[d.i]) >= 0 {
+		d.i++
+	}
+}
+
+// value decodes the value that begins at the current offset,
+// after optional space.
+func (d *decoder) value() (starlark.Value, error) {
+	d.skipSpace()
+	if d.i == len(d.s) {
+		return nil, d.errorf("unexpected end of input")
+	}
+	switch c := d.s[d.i]; {
+	case c == '{' || c == '[':
+		if d.depth == maxDepth {
+			return nil, d.errorf("nesting depth exceeds %d", maxDepth)
+		}
+		d.depth++
+		defer func() { d.depth-- }()
+		if c == '{' {
+			return d.object()
+		}
+		return d.array()
+	case c == '"':
+		s, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		return d.charge(starlark.String(s))
+	case c == '-' || '0' <= c && c <= '9':
+		x, err := d.number()
+		if err != nil {
+			return nil, err
+		}
+		return d.charge(x)
+	}
+	for _, lit := range []struct {
+		text  string
+		value starlark.Value
+	}{
+		{"null", starlark.None},
+		{"true", starlark.True},
+		{"false", starlark.False},
+	} {
+		if strings.HasPrefix(d.s[d.i:], lit.text) {
+			d.i += len(lit.text)
+			return lit.value, nil
+		}
+	}
+	return nil, d.errorf("unexpected character %q", d.s[d.i])
+}
+
+// charge charges the allocation of the decoded value x to the thread.
+func (d *decoder) charge(x starlark.Value) (starlark.Value, error) {
+	return x, d.thread.AddAllocs(starlark.EstimateSize(x))
+}
+
+// expect consumes the byte c, after optional space.  If the next
+// byte is not c, it returns an error saying what it wanted.
+func (d *decoder) expect(c byte, want string) error {
+	d.skipSpace()
+	if d.i == len(d.s) {
+		return d.errorf("unexpected end of input, want %s", want)
+	}
+	if d.s[d.i] != c {
+		return d.errorf("unexpected character %q, want %s", d.s[d.i], want)
+	}
+	d.i++
+	return nil
+}
+
+// more consumes the separator after an element of an array or
+// object, or its closing bracket, and reports whether another
+// element follows.
+func (d *decoder) more(close byte) (bool, error) {
+	d.skipSpace()
+	if d.i < len(d.s) && d.s[d.i] == close {
+		d.i++
+		return false, nil
+	}
+	if err := d.expect(',', fmt.Sprintf("',' or '%c'", close)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (d *decoder) array() (starlark.Value, error) {
+	d.i++ // '['
+	var elems []starlark.Value
+	if d.skipSpace(); d.i < len(d.s) && d.s[d.i] == ']' {
+		d.i++
+		return d.charge(starlark.NewList(elems))
+	}
+	for {
+		elem, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, elem)
+		if err := d.thread.CheckAllocs(starlark.EstimateSize(starlark.Tuple(elems))); err != nil {
+			return nil, err
+		}
+		if more, err := d.more(']'); err != nil {
+			return nil, err
+		} else if !more {
+			return d.charge(starlark.NewList(elems))
+		}
+	}
+}
+
+func (d *decoder) object() (starlark.Value, error) {
+	d.i++ // '{'
+	dict := new(starlark.Dict)
+	if d.skipSpace(); d.i < len(d.s) && d.s[d.i] == '}' {
+		d.i++
+		return d.charge(dict)
+	}
+	for {
+		if err := d.expect('"', "string"); err != nil {
+			return nil, err
+		}
+		d.i-- // the opening quote
+		k, err := d.string()
+		if err != nil {
+			return nil, err
+		}
+		if err := d.expect(':', "':'"); err != nil {
+			return nil, err
+		}
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		key, err := d.charge(starlark.String(k))
+		if err != nil {
+			return nil, err
+		}
+		if err := dict.Set(key, v); err != nil {
+			return nil, err // can't happen
+		}
+		if err := d.thread.CheckAllocs(starlark.EstimateSize(dict)); err != nil {
+			return nil, err
+		}
+		if more, err := d.more('}'); err != nil {
+			return nil, err
+		} else if !more {
+			return d.charge(dict)
+		}
+	}
+}
+
+// string decodes the string that begins at the current offset.
+func (d *decoder) string() (string, error) {
+	start := d.i
+	d.i++ // '"'
+	var buf strings.Builder
+	for {
+		if d.i == len(d.s) {
+			d.i = start
+			return "", d.errorf("unterminated string")
+		}
+		switch c := d.s[d.i]; {
+		case c == '"':
+			d.i++
+			return buf.String(), nil
+		case c < 0x20:
+			return "", d.errorf("control character %q in string", c)
+		case c != '\\':
+			buf.WriteByte(c)
+			d.i++
+			continue
+		}
+
+		// escape sequence
+		if d.i+1 == len(d.s) {
+			return "", d.errorf("unterminated string")
+		}
+		switch c := d.s[d.i+1]; c {
+		case '"', '\\', '/':
+			buf.WriteByte(c)
+		case 'b':
+			buf.WriteByte('\b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'u':
+			r, ok := d.hex4(d.i + 2)
+			if !ok {
+				return "", d.errorf("invalid escape %q", d.s[d.i:min(d.i+6, len(d.s))])
+			}
+			d.i += 4
+			if utf16.IsSurrogate(r) {
+				// A surrogate pair encodes a rune beyond the
+				// Basic Multilingual Plane.
+				if r2, ok := d.hex4(d.i + 4); ok && d.s[d.i+2:d.i+4] == `\u` {
+					if dec := utf16.DecodeRune(r, r2); dec != utf8.RuneError {
+						r = dec
+						d.i += 6
+					}
+				}
+			}
+			buf.WriteRune(r)
+		default:
+			return "", d.errorf("invalid escape %q", d.s[d.i:d.i+2])
+		}
+		d.i += 2
+	}
+}
+
+// hex4 decodes the four hexadecimal digits at offset i.
+func (d *decoder) hex4(i int) (rune, bool) {
+	if i+4 > len(d.s) {
+		return 0, false
+	}
+	x, err := strconv.ParseUint(d.s[i:i+4], 16, 32)
+	return rune(x), err == nil
+}
+
+// number decodes the number that begins at the current offset.
+func (d *decoder) number() (starlark.Value, error) {
+	start := d.i
+	digits := func() int {
+		n := 0
+		for d.i < len(d.s) && '0' <= d.s[d.i] && d.s[d.i] <= '9' {
+			d.i++
+			n++
+		}
+		return n
+	}
+	if d.s[d.i] == '-' {
+		d.i++
+	}
+	if d.i < len(d.s) && d.s[d.i] == '0' {
+		d.i++
+	} else if digits() == 0 {
+		return nil, d.errorf("invalid number %q", d.s[start:d.i])
+	}
+	isFloat := false
+	if d.i < len(d.s) && d.s[d.i] == '.' {
+		isFloat = true
+		d.i++
+		if digits() == 0 {
+			return nil, d.errorf("invalid number %q", d.s[start:d.i])
+		}
+	}
+	if d.i < len(d.s) && (d.s[d.i] == 'e' || d.s[d.i] == 'E') {
+		isFloat = true
+		d.i++
+		if d.i < len(d.s) && (d.s[d.i] == '+' || d.s[d.i] == '-') {
+			d.i++
+		}
+		if digits() == 0 {
+			return nil, d.errorf("invalid number %q", d.s[start:d.i])
+		}
+	}
+
+	text := d.s[start:d.i]
+	if isFloat {
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil {
+			d.i = start
+			return nil, d.errorf("floating-point number %s out of range", text)
+		}
+		return starlark.Float(f), nil
+	}
+	if x, err := strconv.ParseInt(text, 10, 64); err == nil {
+		return starlark.MakeInt64(x), nil
+	}
+	x, _ := new(big.Int).SetString(text, 10)
+	return starlark.MakeBigInt(x), nil
+}
+
+func indent(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	prefix, indent := "", "\t"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &s, "prefix?", &prefix, "indent?", &indent); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	if err := thread.CheckAllocs(int64(len(s))); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, []byte(s), prefix, indent); err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	if err := thread.AddByteSteps(buf.Len()); err != nil {
+		return nil, err
+	}
+	res := starlark.String(buf.String())
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
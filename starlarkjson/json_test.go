@@ -0,0 +1,118 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkjson_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarkjson"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	filename := filepath.Join(testdata, "testdata/json.star")
+	predeclared := starlark.StringDict{
+		"json":         starlarkjson.Module,
+		"struct":       starlark.NewBuiltin("struct", starlarkstruct.Make),
+		"marshaler":    marshaler{`{"go": [1, 2]}`, nil},
+		"badmarshaler": marshaler{"", errors.New("oops")},
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true, AllowFloat: true, AllowSet: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// TestLimits ensures that encoding, decoding and indenting are charged
+// to the thread's computation steps and allocations, and fail once they
+// exceed the thread's limits.
+func TestLimits(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"json":  starlarkjson.Module,
+		"zeros": starlark.String("[" + strings.Repeat("0,", 1000000) + "0]"),
+	}
+	exprs := []string{
+		`json.indent(json.encode([["a" * 1000] * 1000] * 10))`,
+		`json.encode([["a" * 1000] * 1000] * 10)`,
+		`json.decode(zeros)`,
+	}
+	for _, expr := range exprs {
+		thread := new(starlark.Thread)
+		thread.SetMaxAllocs(1 << 20)
+		_, err := starlark.Eval(thread, "limits.star", expr, predeclared)
+		var allocErr *starlark.AllocLimitError
+		if !errors.As(err, &allocErr) {
+			t.Errorf("%s: got %v, want AllocLimitError", expr, err)
+		}
+
+		thread = new(starlark.Thread)
+		thread.SetMaxExecutionSteps(10000)
+		_, err = starlark.Eval(thread, "limits.star", expr, predeclared)
+		var stepErr *starlark.StepLimitError
+		if !errors.As(err, &stepErr) {
+			t.Errorf("%s: got %v, want StepLimitError", expr, err)
+		}
+	}
+
+	// Without limits, the charge covers the text produced.
+	thread := new(starlark.Thread)
+	v, err := starlark.Eval(thread, "limits.star", `json.indent(json.encode(["a" * 1000] * 100))`, predeclared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := int64(len(v.(starlark.String))); thread.Allocs() < 2*n {
+		t.Errorf("charged %d bytes for %d bytes of JSON and its indentation, want at least %d", thread.Allocs(), n, 2*n)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
+
+// A marshaler is a Starlark value that provides its own JSON encoding.
+type marshaler struct {
+	data string
+	err  error
+}
+
+func (m marshaler) String() string { return "marshaler" }
+func (m marshaler) Type() string {
+	if m.err != nil {
+		return "badmarshaler"
+	}
+	return "marshaler"
+}
+func (m marshaler) Freeze()               {}
+func (m marshaler) Truth() starlark.Bool  { return true }
+func (m marshaler) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable") }
+
+func (m marshaler) MarshalJSON() ([]byte, error) { return []byte(m.data), m.err }
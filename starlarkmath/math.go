@@ -0,0 +1,211 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkmath defines the Starlark 'math' module, which
+// provides mathematical constants and functions of floating-point
+// numbers.  It is intended for programs that use floats, which
+// require resolve.AllowFloat.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"math": starlarkmath.Module,
+//	}
+//
+// Each argument of the module's functions may be an int or a float;
+// an int is converted to the nearest float.  Except as noted, the
+// functions return floats, and follow IEEE 754 as do Go's: for
+// example, sqrt(-1) is nan and exp(1000) is +inf.
+//
+// The constants are:
+//
+//	e    the base of natural logarithms
+//	pi   the ratio of a circle's circumference to its diameter
+//	inf  positive infinity
+//	nan  not-a-number
+//
+// The functions are:
+//
+//	ceil(x)          the least int greater than or equal to x
+//	floor(x)         the greatest int less than or equal to x
+//	round(x)         the nearest int to x, rounding half away from zero
+//	trunc(x)         the int x truncated towards zero
+//	fabs(x)          the absolute value of x
+//	copysign(x, y)   x with the sign of y
+//	mod(x, y)        the remainder of x/y, with the sign of x
+//	remainder(x, y)  the IEEE 754 remainder of x/y
+//	pow(x, y)        x raised to the power y
+//	sqrt(x)          the square root of x
+//	exp(x)           e raised to the power x
+//	log(x, base=e)   the logarithm of x to the given base
+//	hypot(x, y)      the Euclidean norm, sqrt(x*x + y*y)
+//	sin(x), cos(x), tan(x), asin(x), acos(x), atan(x), atan2(y, x)
+//	sinh(x), cosh(x), tanh(x), asinh(x), acosh(x), atanh(x)
+//	degrees(x)       the angle x, in radians, converted to degrees
+//	radians(x)       the angle x, in degrees, converted to radians
+//	isnan(x)         whether x is nan
+//	isinf(x)         whether x is positive or negative infinity
+//	isfinite(x)      whether x is neither infinite nor nan
+//
+// ceil, floor, round and trunc return ints, which are exact however
+// large the argument, and fail if it is infinite or nan.  An int
+// argument is returned unchanged.  The predicates return bools.
+package starlarkmath
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+)
+
+// Module is the Starlark 'math' module.
+var Module = &starlarkstruct.Module{
+	Name: "math",
+	Members: starlark.StringDict{
+		"e":   starlark.Float(math.E),
+		"pi":  starlark.Float(math.Pi),
+		"inf": starlark.Float(math.Inf(1)),
+		"nan": starlark.Float(math.NaN()),
+
+		"ceil":  newIntBuiltin("ceil", math.Ceil),
+		"floor": newIntBuiltin("floor", math.Floor),
+		"round": newIntBuiltin("round", math.Round),
+		"trunc": newIntBuiltin("trunc", math.Trunc),
+
+		"fabs":    newUnaryBuiltin("fabs", math.Abs),
+		"sqrt":    newUnaryBuiltin("sqrt", math.Sqrt),
+		"exp":     newUnaryBuiltin("exp", math.Exp),
+		"sin":     newUnaryBuiltin("sin", math.Sin),
+		"cos":     newUnaryBuiltin("cos", math.Cos),
+		"tan":     newUnaryBuiltin("tan", math.Tan),
+		"asin":    newUnaryBuiltin("asin", math.Asin),
+		"acos":    newUnaryBuiltin("acos", math.Acos),
+		"atan":    newUnaryBuiltin("atan", math.Atan),
+		"sinh":    newUnaryBuiltin("sinh", math.Sinh),
+		"cosh":    newUnaryBuiltin("cosh", math.Cosh),
+		"tanh":    newUnaryBuiltin("tanh", math.Tanh),
+		"asinh":   newUnaryBuiltin("asinh", math.Asinh),
+		"acosh":   newUnaryBuiltin("acosh", math.Acosh),
+		"atanh":   newUnaryBuiltin("atanh", math.Atanh),
+		"degrees": newUnaryBuiltin("degrees", func(x float64) float64 { return x * 180 / math.Pi }),
+		"radians": newUnaryBuiltin("radians", func(x float64) float64 { return x * math.Pi / 180 }),
+
+		"copysign":  newBinaryBuiltin("copysign", "x", "y", math.Copysign),
+		"mod":       newBinaryBuiltin("mod", "x", "y", math.Mod),
+		"remainder": newBinaryBuiltin("remainder", "x", "y", math.Remainder),
+		"pow":       newBinaryBuiltin("pow", "x", "y", math.Pow),
+		"hypot":     newBinaryBuiltin("hypot", "x", "y", math.Hypot),
+		"atan2":     newBinaryBuiltin("atan2", "y", "x", math.Atan2),
+
+		"isnan":    newPredicateBuiltin("isnan", math.IsNaN),
+		"isinf":    newPredicateBuiltin("isinf", func(x float64) bool { return math.IsInf(x, 0) }),
+		"isfinite": newPredicateBuiltin("isfinite", func(x float64) bool { return !math.IsInf(x, 0) && !math.IsNaN(x) }),
+
+		"log": starlark.NewBuiltin("math.log", log),
+	},
+}
+
+// unpackFloats unpacks the named arguments of a built-in, each an int
+// or float, as floats.  Names ending in "?" are optional; the
+// corresponding elements of the result are then left unchanged.
+func unpackFloats(b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple, names []string, floats []float64) error {
+	values := make([]starlark.Value, len(names))
+	pairs := make([]interface{}, 0, 2*len(names))
+	for i, name := range names {
+		pairs = append(pairs, name, &values[i])
+	}
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, pairs...); err != nil {
+		return err
+	}
+	for i, v := range values {
+		if v == nil {
+			continue // optional, and absent
+		}
+		f, ok := starlark.AsFloat(v)
+		if !ok {
+			return fmt.Errorf("%s: for parameter %d: got %s, want float or int", b.Name(), i+1, v.Type())
+		}
+		floats[i] = f
+	}
+	return nil
+}
+
+// newUnaryBuiltin returns a built-in function of one number whose
+// result is the float f(x).
+func newUnaryBuiltin(name string, f func(float64) float64) *starlark.Builtin {
+	return starlark.NewBuiltin("math."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		x := make([]float64, 1)
+		if err := unpackFloats(b, args, kwargs, []string{"x"}, x); err != nil {
+			return nil, err
+		}
+		return starlark.Float(f(x[0])), nil
+	})
+}
+
+// newBinaryBuiltin returns a built-in function of two numbers, with
+// the specified parameter names, whose result is the float f(x, y).
+func newBinaryBuiltin(name, xname, yname string, f func(float64, float64) float64) *starlark.Builtin {
+	return starlark.NewBuiltin("math."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		xy := make([]float64, 2)
+		if err := unpackFloats(b, args, kwargs, []string{xname, yname}, xy); err != nil {
+			return nil, err
+		}
+		return starlark.Float(f(xy[0], xy[1])), nil
+	})
+}
+
+// newPredicateBuiltin returns a built-in function of one number whose
+// result is the bool f(x).
+func newPredicateBuiltin(name string, f func(float64) bool) *starlark.Builtin {
+	return starlark.NewBuiltin("math."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		x := make([]float64, 1)
+		if err := unpackFloats(b, args, kwargs, []string{"x"}, x); err != nil {
+			return nil, err
+		}
+		return starlark.Bool(f(x[0])), nil
+	})
+}
+
+// newIntBuiltin returns a built-in function of one number whose result
+// is the int f(x).  f must return an integral float, which is
+// converted exactly.  An int argument is returned unchanged.
+func newIntBuiltin(name string, f func(float64) float64) *starlark.Builtin {
+	return starlark.NewBuiltin("math."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var x starlark.Value
+		if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x); err != nil {
+			return nil, err
+		}
+		switch x := x.(type) {
+		case starlark.Int:
+			return x, nil
+		case starlark.Float:
+			i, err := starlark.NumberToInt(starlark.Float(f(float64(x))))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", b.Name(), err)
+			}
+			return i, nil
+		}
+		return nil, fmt.Errorf("%s: for parameter 1: got %s, want float or int", b.Name(), x.Type())
+	})
+}
+
+// log(x, base=e) returns the logarithm of x to the given base.
+func log(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	xbase := []float64{0, math.E}
+	if err := unpackFloats(b, args, kwargs, []string{"x", "base?"}, xbase); err != nil {
+		return nil, err
+	}
+	x, base := xbase[0], xbase[1]
+	switch base {
+	case math.E:
+		return starlark.Float(math.Log(x)), nil
+	case 2:
+		return starlark.Float(math.Log2(x)), nil
+	case 10:
+		return starlark.Float(math.Log10(x)), nil
+	}
+	return starlark.Float(math.Log(x) / math.Log(base)), nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkmath_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarkmath"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	filename := filepath.Join(testdata, "testdata/math.star")
+	predeclared := starlark.StringDict{
+		"math": starlarkmath.Module,
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true, AllowFloat: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
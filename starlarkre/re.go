@@ -0,0 +1,681 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarkre defines the Starlark 're' module, which provides
+// regular expressions.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"re": starlarkre.Module,
+//	}
+//
+// Regular expressions have the syntax and semantics of Go's regexp
+// package, which are those of RE2: matching takes time linear in the
+// length of the input, and backreferences and lookaround assertions
+// are not supported.  Offsets are byte indices into the string, as
+// elsewhere in Starlark.
+//
+// The module's functions are:
+//
+//	compile(pattern)                     the compiled pattern
+//	escape(s)                            a pattern that matches the literal text s
+//	match(pattern, s)                    see the methods of a pattern below
+//	fullmatch(pattern, s)
+//	search(pattern, s)
+//	findall(pattern, s)
+//	finditer(pattern, s)
+//	split(pattern, s, maxsplit=0)
+//	sub(pattern, repl, s, count=0)
+//
+// The pattern argument of each function may be a string or a compiled
+// pattern.  Compiled patterns are cached by the module, so a function
+// that uses the same pattern repeatedly does not compile it again;
+// each use of a string is nonetheless charged as a compilation, so
+// that the charge does not depend on what other threads have done.
+//
+// A compiled pattern, of type re.pattern, is immutable and hashable.
+// It has the attributes pattern, the text of the pattern; groups, the
+// number of its capturing groups; and groupindex, a dict that maps the
+// name of each named group to its number.  Its methods are:
+//
+//	match(s)        the match of the pattern at the start of s, or None
+//	fullmatch(s)    the match of the pattern with all of s, or None
+//	search(s)       the leftmost match of the pattern in s, or None
+//	findall(s)      a list of the successive non-overlapping matches in s:
+//	                the text of each match if the pattern has no groups,
+//	                of its group if it has one, or a tuple of its groups
+//	finditer(s)     a list of the match objects of the successive
+//	                non-overlapping matches in s
+//	split(s, maxsplit=0)
+//	                the list of the substrings of s separated by the
+//	                matches of the pattern, interleaved with the text of
+//	                each group of each match; at most maxsplit splits
+//	                occur, if it is positive
+//	sub(repl, s, count=0)
+//	                s with the first count matches of the pattern, or
+//	                all of them if count is not positive, replaced by
+//	                repl: either a template in which $1 or ${1} denotes
+//	                the text of the first group, ${name} that of a named
+//	                group, and $$ a dollar sign, as in Go's
+//	                Regexp.Expand; or a function that is called with the
+//	                match object and returns the replacement string
+//
+// A match object, of type re.match, has the attributes string, the
+// string that was searched, and pattern, the compiled pattern.  A
+// group is denoted by its number, 0 for the entire match, or its name.
+// Its methods are:
+//
+//	group(*groups)          the text of a group, by default 0, or None
+//	                        if it did not participate in the match; with
+//	                        several arguments, a tuple of their texts
+//	groups(default=None)    a tuple of the texts of groups 1 and on
+//	groupdict(default=None) a dict of the texts of the named groups
+//	start(group=0)          the start offset of the group, or -1
+//	end(group=0)            the end offset of the group, or -1
+//	span(group=0)           the tuple (start(group), end(group))
+//
+// In groups and groupdict, the text of a group that did not
+// participate in the match is the default.
+//
+// The work of compiling and matching is charged to the thread's
+// computation steps in proportion to the length of the pattern or of
+// the string searched, so that a limit set by
+// starlark.Thread.SetMaxExecutionSteps bounds it too.  The results are
+// charged to the thread's allocations.
+package starlarkre
+
+import (
+	"fmt"
+	"regexp"
+	"sync"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// Module is the Starlark 're' module.
+var Module = &starlarkstruct.Module{
+	Name: "re",
+	Members: starlark.StringDict{
+		"compile": starlark.NewBuiltin("re.compile", compile),
+		"escape":  starlark.NewBuiltin("re.escape", escape),
+	},
+}
+
+func init() {
+	for name, method := range patternMethods {
+		Module.Members[name] = newPatternFunction(name, method)
+	}
+}
+
+// compile(pattern) returns the compiled pattern.
+func compile(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var pattern starlark.Value
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "pattern", &pattern); err != nil {
+		return nil, err
+	}
+	p, err := compilePattern(thread, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return p, nil
+}
+
+// escape(s) returns a pattern that matches the literal text s.
+func escape(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &s); err != nil {
+		return nil, err
+	}
+	res := starlark.String(regexp.QuoteMeta(s))
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// ---- the cache ----
+
+// maxCache is the number of patterns that the cache holds before it
+// is emptied.
+const maxCache = 256
+
+// cache holds the patterns compiled by all threads, by their text.
+var cache struct {
+	mu       sync.Mutex
+	patterns map[string]*Pattern
+}
+
+// compilePattern returns the compiled form of pattern, a string or a
+// *Pattern, from the cache if possible.
+func compilePattern(thread *starlark.Thread, pattern starlark.Value) (*Pattern, error) {
+	var expr string
+	switch pattern := pattern.(type) {
+	case *Pattern:
+		return pattern, nil
+	case starlark.String:
+		expr = string(pattern)
+	default:
+		return nil, fmt.Errorf("got %s for pattern, want string or re.pattern", pattern.Type())
+	}
+
+	if err := thread.AddByteSteps(len(expr)); err != nil {
+		return nil, err
+	}
+	cache.mu.Lock()
+	p, ok := cache.patterns[expr]
+	cache.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	p = &Pattern{re: re}
+	cache.mu.Lock()
+	if cache.patterns == nil || len(cache.patterns) >= maxCache {
+		cache.patterns = make(map[string]*Pattern)
+	}
+	cache.patterns[expr] = p
+	cache.mu.Unlock()
+	return p, nil
+}
+
+// ---- patterns ----
+
+// A Pattern is a compiled regular expression, a Starlark value of
+// type re.pattern.
+type Pattern struct {
+	re *regexp.Regexp
+
+	// anchored forms of re, for match and fullmatch, compiled on
+	// demand, perhaps by several threads at once
+	prefixOnce, fullOnce sync.Once
+	prefix, full         *regexp.Regexp
+}
+
+var (
+	_ starlark.Comparable = (*Pattern)(nil)
+	_ starlark.HasAttrs   = (*Pattern)(nil)
+)
+
+func (p *Pattern) String() string {
+	return "re.compile(" + starlark.String(p.re.String()).String() + ")"
+}
+func (p *Pattern) Type() string          { return "re.pattern" }
+func (p *Pattern) Freeze()               {} // immutable
+func (p *Pattern) Truth() starlark.Bool  { return true }
+func (p *Pattern) Hash() (uint32, error) { return starlark.String(p.re.String()).Hash() }
+
+func (p *Pattern) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	q := y.(*Pattern)
+	switch op {
+	case syntax.EQL:
+		return p.re.String() == q.re.String(), nil
+	case syntax.NEQ:
+		return p.re.String() != q.re.String(), nil
+	}
+	return false, fmt.Errorf("%s %s %s not implemented", p.Type(), op, q.Type())
+}
+
+// Regexp returns the Go regular expression of the pattern.
+func (p *Pattern) Regexp() *regexp.Regexp { return p.re }
+
+// anchored returns the form of the pattern that must match at the
+// start of the string, or all of it if full is set.
+func (p *Pattern) anchored(full bool) *regexp.Regexp {
+	// The pattern is already valid, and wrapping it in a
+	// non-capturing group preserves the numbers of its groups.
+	if full {
+		p.fullOnce.Do(func() { p.full = regexp.MustCompile(`\A(?:` + p.re.String() + `)\z`) })
+		return p.full
+	}
+	p.prefixOnce.Do(func() { p.prefix = regexp.MustCompile(`\A(?:` + p.re.String() + `)`) })
+	return p.prefix
+}
+
+var patternAttrNames = []string{"findall", "finditer", "fullmatch", "groupindex", "groups", "match", "pattern", "search", "split", "sub"}
+
+func (p *Pattern) AttrNames() []string { return patternAttrNames }
+
+func (p *Pattern) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "pattern":
+		return starlark.String(p.re.String()), nil
+	case "groups":
+		return starlark.MakeInt(p.re.NumSubexp()), nil
+	case "groupindex":
+		dict := new(starlark.Dict)
+		for i, name := range p.re.SubexpNames() {
+			if name != "" {
+				dict.Set(starlark.String(name), starlark.MakeInt(i))
+			}
+		}
+		return dict, nil
+	}
+	if method, ok := patternMethods[name]; ok {
+		return starlark.NewBuiltin("pattern."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			return method(thread, b.Name(), b.Receiver().(*Pattern), args, kwargs)
+		}).BindReceiver(p), nil
+	}
+	return nil, nil
+}
+
+// A patternMethod implements a method of a pattern, which is also a
+// function of the module whose first parameter is the pattern.
+type patternMethod func(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error)
+
+var patternMethods = map[string]patternMethod{
+	"match":     match,
+	"fullmatch": fullmatch,
+	"search":    search,
+	"findall":   findall,
+	"finditer":  finditer,
+	"split":     split,
+	"sub":       sub,
+}
+
+// newPatternFunction returns the function of the module that applies
+// the named method to its first argument, a pattern or a string.
+func newPatternFunction(name string, method patternMethod) *starlark.Builtin {
+	return starlark.NewBuiltin("re."+name, func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+		var pattern starlark.Value
+		if len(args) > 0 {
+			pattern, args = args[0], args[1:]
+		} else {
+			for i, kv := range kwargs {
+				if kv[0] == starlark.String("pattern") {
+					pattern = kv[1]
+					kwargs = append(kwargs[:i:i], kwargs[i+1:]...)
+					break
+				}
+			}
+			if pattern == nil {
+				return nil, fmt.Errorf("%s: missing argument for pattern", b.Name())
+			}
+		}
+		p, err := compilePattern(thread, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		return method(thread, b.Name(), p, args, kwargs)
+	})
+}
+
+// p.match(s) returns the match of the pattern at the start of s.
+func match(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return find(thread, fnname, p, p.anchored(false), args, kwargs)
+}
+
+// p.fullmatch(s) returns the match of the pattern with all of s.
+func fullmatch(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return find(thread, fnname, p, p.anchored(true), args, kwargs)
+}
+
+// p.search(s) returns the leftmost match of the pattern in s.
+func search(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	return find(thread, fnname, p, p.re, args, kwargs)
+}
+
+// find returns the leftmost match of re, a form of p, in the string
+// argument, or None.
+func find(thread *starlark.Thread, fnname string, p *Pattern, re *regexp.Regexp, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackArgs(fnname, args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil {
+		return starlark.None, nil
+	}
+	m := &Match{pattern: p, s: s, loc: loc}
+	return m, thread.AddAllocs(m.size())
+}
+
+// p.findall(s) returns the texts of the successive matches in s.
+func findall(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackArgs(fnname, args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	var elems []starlark.Value
+	var size int64
+	err := eachMatch(p.re, s, -1, func(loc []int) error {
+		m := &Match{pattern: p, s: s, loc: loc}
+		var elem starlark.Value
+		switch n := p.re.NumSubexp(); n {
+		case 0:
+			elem = starlark.String(m.text(0))
+		case 1:
+			elem = starlark.String(m.text(1))
+		default:
+			groups := make(starlark.Tuple, n)
+			for i := range groups {
+				groups[i] = starlark.String(m.text(i + 1))
+				size += starlark.EstimateSize(groups[i])
+			}
+			elem = groups
+		}
+		size += starlark.EstimateSize(elem)
+		elems = append(elems, elem)
+		return thread.CheckAllocs(size + starlark.EstimateSize(starlark.Tuple(elems)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := starlark.NewList(elems)
+	return list, thread.AddAllocs(size + starlark.EstimateSize(list))
+}
+
+// p.finditer(s) returns the match objects of the successive matches in s.
+func finditer(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	if err := starlark.UnpackArgs(fnname, args, kwargs, "s", &s); err != nil {
+		return nil, err
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	var elems []starlark.Value
+	var size int64
+	err := eachMatch(p.re, s, -1, func(loc []int) error {
+		m := &Match{pattern: p, s: s, loc: loc}
+		size += m.size()
+		elems = append(elems, m)
+		return thread.CheckAllocs(size + starlark.EstimateSize(starlark.Tuple(elems)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	list := starlark.NewList(elems)
+	return list, thread.AddAllocs(size + starlark.EstimateSize(list))
+}
+
+// p.split(s, maxsplit=0) returns the substrings of s separated by
+// matches of the pattern, and the texts of their groups.
+func split(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var s string
+	var maxsplit int
+	if err := starlark.UnpackArgs(fnname, args, kwargs, "s", &s, "maxsplit?", &maxsplit); err != nil {
+		return nil, err
+	}
+	if maxsplit <= 0 {
+		maxsplit = -1
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+	var elems []starlark.Value
+	var size int64
+	add := func(elem starlark.Value) {
+		size += starlark.EstimateSize(elem)
+		elems = append(elems, elem)
+	}
+	start := 0
+	err := eachMatch(p.re, s, maxsplit, func(loc []int) error {
+		add(starlark.String(s[start:loc[0]]))
+		m := &Match{pattern: p, s: s, loc: loc}
+		for i := 1; i <= p.re.NumSubexp(); i++ {
+			add(m.group(i, starlark.None))
+		}
+		start = loc[1]
+		return thread.CheckAllocs(size + starlark.EstimateSize(starlark.Tuple(elems)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	add(starlark.String(s[start:]))
+	list := starlark.NewList(elems)
+	return list, thread.AddAllocs(size + starlark.EstimateSize(list))
+}
+
+// p.sub(repl, s, count=0) returns s with matches of the pattern
+// replaced by repl, a template or a function of the match.
+func sub(thread *starlark.Thread, fnname string, p *Pattern, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var repl starlark.Value
+	var s string
+	var count int
+	if err := starlark.UnpackArgs(fnname, args, kwargs, "repl", &repl, "s", &s, "count?", &count); err != nil {
+		return nil, err
+	}
+	if count <= 0 {
+		count = -1
+	}
+	template, isTemplate := repl.(starlark.String)
+	if !isTemplate {
+		if _, ok := repl.(starlark.Callable); !ok {
+			return nil, fmt.Errorf("%s: for parameter repl: got %s, want string or function", fnname, repl.Type())
+		}
+	}
+	if err := thread.AddByteSteps(len(s)); err != nil {
+		return nil, err
+	}
+
+	var buf []byte
+	start := 0
+	err := eachMatch(p.re, s, count, func(loc []int) error {
+		buf = append(buf, s[start:loc[0]]...)
+		if isTemplate {
+			buf = p.re.ExpandString(buf, string(template), s, loc)
+		} else {
+			m := &Match{pattern: p, s: s, loc: loc}
+			if err := thread.AddAllocs(m.size()); err != nil {
+				return err
+			}
+			res, err := starlark.Call(thread, repl, starlark.Tuple{m}, nil)
+			if err != nil {
+				return err
+			}
+			r, ok := starlark.AsString(res)
+			if !ok {
+				return fmt.Errorf("%s: replacement function returned %s, want string", fnname, res.Type())
+			}
+			buf = append(buf, r...)
+		}
+		start = loc[1]
+		return thread.CheckAllocs(int64(len(buf)))
+	})
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, s[start:]...)
+	res := starlark.String(buf)
+	return res, thread.AddAllocs(starlark.EstimateSize(res))
+}
+
+// eachMatch calls f with the offsets of each successive match of re
+// in s, as by FindAllStringSubmatchIndex, up to n matches if n is not
+// negative.  It stops at the first error from f, which should check
+// the thread's allocation limit.  Since Go's regexp package cannot
+// resume a search where it left off, eachMatch finds the matches in
+// batches of doubling size, so that it holds at most twice as many as
+// f has accepted, at the cost of searching the start of s again.
+func eachMatch(re *regexp.Regexp, s string, n int, f func(loc []int) error) error {
+	done := 0
+	for batch := 64; ; batch *= 2 {
+		if n >= 0 && batch > n {
+			batch = n
+		}
+		locs := re.FindAllStringSubmatchIndex(s, batch)
+		for _, loc := range locs[done:] {
+			if err := f(loc); err != nil {
+				return err
+			}
+		}
+		if len(locs) < batch || batch == n {
+			return nil
+		}
+		done = len(locs)
+	}
+}
+
+// ---- matches ----
+
+// A Match is a match of a pattern in a string, a Starlark value of
+// type re.match.
+type Match struct {
+	pattern *Pattern
+	s       string
+	loc     []int // the offsets of each group, in pairs, as by FindStringSubmatchIndex
+}
+
+var _ starlark.HasAttrs = (*Match)(nil)
+
+// sizeofMatch is the estimated size, in bytes, of a Match, excluding
+// its offsets: a pointer, a string header that shares the searched
+// string, and a slice header.
+const sizeofMatch = 8 + 16 + 24
+
+// size returns the estimated number of bytes allocated to represent m.
+func (m *Match) size() int64 { return sizeofMatch + 8*int64(len(m.loc)) }
+
+func (m *Match) String() string {
+	return fmt.Sprintf("<re.match object; span=(%d, %d), match=%s>", m.loc[0], m.loc[1], starlark.String(m.text(0)))
+}
+func (m *Match) Type() string          { return "re.match" }
+func (m *Match) Freeze()               {} // immutable
+func (m *Match) Truth() starlark.Bool  { return true }
+func (m *Match) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable type: re.match") }
+
+// text returns the text of group i, or "" if it did not participate
+// in the match.
+func (m *Match) text(i int) string {
+	if m.loc[2*i] < 0 {
+		return ""
+	}
+	return m.s[m.loc[2*i]:m.loc[2*i+1]]
+}
+
+// group returns the text of group i, or def if it did not participate
+// in the match.
+func (m *Match) group(i int, def starlark.Value) starlark.Value {
+	if m.loc[2*i] < 0 {
+		return def
+	}
+	return starlark.String(m.text(i))
+}
+
+// index returns the number of the group denoted by x, a number or a name.
+func (m *Match) index(x starlark.Value) (int, error) {
+	switch x := x.(type) {
+	case starlark.String:
+		if i := m.pattern.re.SubexpIndex(string(x)); i >= 0 {
+			return i, nil
+		}
+	case starlark.Int:
+		if i, err := starlark.AsInt32(x); err == nil && i >= 0 && i <= m.pattern.re.NumSubexp() {
+			return i, nil
+		}
+	default:
+		return 0, fmt.Errorf("got %s for group, want int or string", x.Type())
+	}
+	return 0, fmt.Errorf("no such group: %s", x)
+}
+
+var matchAttrNames = []string{"end", "group", "groupdict", "groups", "pattern", "span", "start", "string"}
+
+func (m *Match) AttrNames() []string { return matchAttrNames }
+
+func (m *Match) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "string":
+		return starlark.String(m.s), nil
+	case "pattern":
+		return m.pattern, nil
+	}
+	if method, ok := matchMethods[name]; ok {
+		return starlark.NewBuiltin("match."+name, method).BindReceiver(m), nil
+	}
+	return nil, nil
+}
+
+var matchMethods = map[string]func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error){
+	"group":     matchGroup,
+	"groups":    matchGroups,
+	"groupdict": matchGroupdict,
+	"start":     matchSpan,
+	"end":       matchSpan,
+	"span":      matchSpan,
+}
+
+// m.group(*groups) returns the texts of the specified groups.
+func matchGroup(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	m := b.Receiver().(*Match)
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", b.Name())
+	}
+	if len(args) == 0 {
+		return m.group(0, starlark.None), nil
+	}
+	groups := make(starlark.Tuple, len(args))
+	for i, arg := range args {
+		j, err := m.index(arg)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", b.Name(), err)
+		}
+		groups[i] = m.group(j, starlark.None)
+	}
+	if len(groups) == 1 {
+		return groups[0], nil
+	}
+	return groups, nil
+}
+
+// m.groups(default=None) returns the texts of groups 1 and on.
+func matchGroups(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	m := b.Receiver().(*Match)
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "default?", &def); err != nil {
+		return nil, err
+	}
+	groups := make(starlark.Tuple, m.pattern.re.NumSubexp())
+	for i := range groups {
+		groups[i] = m.group(i+1, def)
+	}
+	return groups, nil
+}
+
+// m.groupdict(default=None) returns the texts of the named groups.
+func matchGroupdict(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	m := b.Receiver().(*Match)
+	var def starlark.Value = starlark.None
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "default?", &def); err != nil {
+		return nil, err
+	}
+	dict := new(starlark.Dict)
+	for i, name := range m.pattern.re.SubexpNames() {
+		if name != "" {
+			dict.Set(starlark.String(name), m.group(i, def))
+		}
+	}
+	return dict, nil
+}
+
+// m.start(group=0), m.end(group=0) and m.span(group=0) return the
+// offsets of a group.
+func matchSpan(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	m := b.Receiver().(*Match)
+	var group starlark.Value = starlark.MakeInt(0)
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "group?", &group); err != nil {
+		return nil, err
+	}
+	i, err := m.index(group)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	start, end := starlark.MakeInt(m.loc[2*i]), starlark.MakeInt(m.loc[2*i+1])
+	switch b.Name() {
+	case "match.start":
+		return start, nil
+	case "match.end":
+		return end, nil
+	}
+	return starlark.Tuple{start, end}, nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarkre_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarkre"
+	"github.com/aabbtree77/determinism/starlarktest"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	filename := filepath.Join(testdata, "testdata/re.star")
+	predeclared := starlark.StringDict{
+		"re": starlarkre.Module,
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+// TestSteps ensures that compiling and matching are charged to the
+// thread's computation steps, whether or not the pattern was cached.
+func TestSteps(t *testing.T) {
+	const src = `
+p = "[a-z]+" * 64
+def f():
+	for i in range(10):
+		re.search(p, "x" * 6400)
+f()
+`
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{"re": starlarkre.Module}
+	if _, err := starlark.ExecFile(thread, "steps.star", src, predeclared); err != nil {
+		t.Fatal(err)
+	}
+	// 3 toplevel statements, 1 call of f, 1 statement in f,
+	// 10 iterations of 1 statement, 10 searches of 6400 bytes,
+	// and 10 compilations of a 384-byte pattern.
+	if got, want := thread.ExecutionSteps(), uint64(3+1+1+10+10*100+10*6); got != want {
+		t.Errorf("executed %d steps, want %d", got, want)
+	}
+
+	thread = new(starlark.Thread)
+	thread.SetMaxExecutionSteps(500)
+	_, err := starlark.ExecFile(thread, "steps.star", src, predeclared)
+	var stepErr *starlark.StepLimitError
+	if !errors.As(err, &stepErr) {
+		t.Errorf("with limit 500: got %v, want StepLimitError", err)
+	}
+}
+
+// TestAllocs ensures that match objects are charged to the thread's
+// allocations.
+func TestAllocs(t *testing.T) {
+	predeclared := starlark.StringDict{"re": starlarkre.Module}
+	for _, test := range []struct {
+		expr string
+		want int64
+	}{
+		// A match of a pattern with one group has 4 offsets.
+		{`re.search("(a)", "xa")`, 48 + 4*8},
+		// A list with 4 elements, and 4 matches with 2 offsets.
+		{`re.finditer("a", "aaaa")`, 48 + 4*16 + 4*(48+2*8)},
+	} {
+		thread := new(starlark.Thread)
+		if _, err := starlark.Eval(thread, "allocs.star", test.expr, predeclared); err != nil {
+			t.Errorf("%s: %v", test.expr, err)
+		} else if got := thread.Allocs(); got != test.want {
+			t.Errorf("%s: charged %d bytes, want %d", test.expr, got, test.want)
+		}
+	}
+}
+
+// TestAllocLimit ensures that the functions that find all the matches
+// in a string fail once their results exceed the thread's allocation
+// limit, as they find the matches, not after.
+func TestAllocLimit(t *testing.T) {
+	predeclared := starlark.StringDict{
+		"re": starlarkre.Module,
+		"s":  starlark.String(strings.Repeat("x", 1000000)),
+	}
+	for _, expr := range []string{
+		`re.findall("", s)`,
+		`re.finditer("", s)`,
+		`re.split("", s)`,
+		`re.sub("", "yy", s)`,
+	} {
+		thread := new(starlark.Thread)
+		thread.SetMaxAllocs(1 << 16)
+		_, err := starlark.Eval(thread, "allocs.star", expr, predeclared)
+		var allocErr *starlark.AllocLimitError
+		if !errors.As(err, &allocErr) {
+			t.Errorf("%s: got %v, want AllocLimitError", expr, err)
+		}
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
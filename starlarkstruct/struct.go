@@ -222,6 +222,7 @@ func (s *Struct) Attr(name string) (starlark.Value, error) {
 	// features are incomplete and underspecified.
 	//
 	// to_{json,proto} are deprecated, appropriately; see Google issue b/36412967.
+	// Programs should use json.encode (see package starlarkjson) instead.
 	switch name {
 	case "to_json", "to_proto":
 		return starlark.NewBuiltin(name, func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
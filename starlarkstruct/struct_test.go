@@ -23,14 +23,20 @@ func init() {
 	resolve.AllowSet = true
 }
 
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
 func Test(t *testing.T) {
 	testdata := starlarktest.DataFile(".", ".")
 	thread := &starlark.Thread{Load: load}
 	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
 	filename := filepath.Join(testdata, "testdata/struct.star")
 	predeclared := starlark.StringDict{
 		"struct": starlark.NewBuiltin("struct", starlarkstruct.Make),
 		"gensym": starlark.NewBuiltin("gensym", gensym),
+		"module": starlark.NewBuiltin("module", starlarkstruct.MakeModule),
 	}
 	if _, err := starlark.ExecFile(thread, filename, nil, predeclared); err != nil {
 		if err, ok := err.(*starlark.EvalError); ok {
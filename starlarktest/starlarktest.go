@@ -10,20 +10,40 @@
 //
 // The assert.error function, which reports errors to the current Go
 // testing.T, requires that clients call SetTest(thread, t) before use.
+//
+// Tests may also report the coverage of the Starlark code they execute.
+// A package opts in by running its tests with Main, which adds the
+// -starlark.coverprofile and -starlark.coverhtml flags, and by calling
+// RecordCoverage on the threads whose coverage is of interest:
+//
+//	func TestMain(m *testing.M) { starlarktest.Main(m) }
+//
+// For example:
+//
+//	go test . -starlark.coverprofile=starlark.lcov -starlark.coverhtml=starlark.html
+//
+// Coverage is recorded only by the TreeWalker engine.
 package starlarktest
 
 import (
 	"bytes"
+	"flag"
 	"fmt"
+	"io"
+	"os"
 	"path/filepath"
 	"regexp"
 	"sync"
 
 	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkcoverage"
 	"github.com/aabbtree77/determinism/starlarkstruct"
 )
 
-const localKey = "Reporter"
+const (
+	localKey    = "Reporter"
+	coverageKey = "starlarktest.coverage"
+)
 
 // A Reporter is a value to which errors may be reported.
 // It is satisfied by *testing.T.
@@ -68,11 +88,89 @@ func LoadAssertModule(prePath string) (starlark.StringDict, error) {
 		filename := DataFile("starlarktest", "assert.star")
 		filename = filepath.Join(prePath, filename)
 		thread := new(starlark.Thread)
+		RecordCoverage(thread)
 		assert, assertErr = starlark.ExecFile(thread, filename, nil, predeclared)
 	})
 	return assert, assertErr
 }
 
+// coverage is the coverage shared by the threads of the tests, or nil
+// unless Main was called with a coverage flag.
+var coverage *starlarkcoverage.Coverage
+
+// Main runs the tests of m, which is the *testing.M of the package's
+// TestMain function, and exits with their status.  It adds to the
+// command line the -starlark.coverprofile and -starlark.coverhtml
+// flags, which name the files to which it writes, once the tests have
+// run, the coverage recorded by the threads passed to RecordCoverage,
+// as an LCOV profile and an HTML report.  Relative names are relative
+// to the directory of the package under test.
+func Main(m interface{ Run() int }) {
+	profile := flag.String("starlark.coverprofile", "", "write an LCOV coverage profile of Starlark code to `file`")
+	html := flag.String("starlark.coverhtml", "", "write an HTML coverage report of Starlark code to `file`")
+	flag.Parse()
+	if *profile != "" || *html != "" {
+		coverage = starlarkcoverage.New()
+	}
+	code := m.Run()
+	if err := writeCoverage(*profile, *html); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		code = 1
+	}
+	os.Exit(code)
+}
+
+// RecordCoverage arranges for the thread to record the coverage of
+// the code it executes, if requested by the flags of Main.  The
+// thread's existing Trace function, if any, continues to be called;
+// a Trace function set later should call the one it replaces.
+func RecordCoverage(thread *starlark.Thread) {
+	cov := coverage
+	if cov == nil || thread.Local(coverageKey) != nil {
+		return
+	}
+	thread.SetLocal(coverageKey, cov)
+	if trace := thread.Trace; trace != nil {
+		thread.Trace = func(thread *starlark.Thread, event *starlark.TraceEvent) {
+			trace(thread, event)
+			cov.Trace(thread, event)
+		}
+	} else {
+		thread.Trace = cov.Trace
+	}
+}
+
+// writeCoverage writes the recorded coverage to the named files, as
+// an LCOV profile and an HTML report.  It skips an empty name.
+func writeCoverage(profile, html string) error {
+	if coverage == nil {
+		return nil
+	}
+	for _, out := range []struct {
+		filename string
+		write    func(w io.Writer) error
+	}{
+		{profile, coverage.WriteLCOV},
+		{html, coverage.WriteHTML},
+	} {
+		if out.filename == "" {
+			continue
+		}
+		f, err := os.Create(out.filename)
+		if err != nil {
+			return err
+		}
+		err = out.write(f)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return fmt.Errorf("writing Starlark coverage: %v", err)
+		}
+	}
+	return nil
+}
+
 // catch(f) evaluates f() and returns its evaluation error message
 // if it failed or None if it succeeded.
 func catch(thread *starlark.Thread, _ *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
@@ -0,0 +1,540 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarktime defines the Starlark 'time' module, which
+// provides instants of time and durations, with arithmetic,
+// comparison, parsing and formatting.
+//
+// An application can add the module to the Starlark environment like so:
+//
+//	predeclared := starlark.StringDict{
+//		"time": starlarktime.Module,
+//	}
+//
+// The module is deterministic: the results of a program that uses it
+// depend only on the program and the thread's clock.  The current time,
+// time.now(), is that of the clock set by SetClock; without a clock,
+// time.now() fails.  Time zones come from a copy of the IANA Time Zone
+// Database embedded in the package, not from the host, and the local
+// time zone of the host is not available.
+//
+// The members of the module are:
+//
+//	now()                          the current time, from the thread's clock
+//	time(year, month, day, hour=0, minute=0, second=0, nanosecond=0, location="UTC")
+//	                               the time of the specified date and time of day
+//	from_timestamp(sec, nsec=0)    the time sec seconds and nsec nanoseconds
+//	                               after 1970-01-01T00:00:00Z, in UTC
+//	parse_time(x, format=RFC 3339, location="UTC")
+//	                               the time that x denotes; see below
+//	parse_duration(x)              the duration that x, such as "1h30m", denotes
+//	is_valid_timezone(name)        whether the time zone name is known
+//	nanosecond, microsecond, millisecond, second, minute, hour
+//	                               durations of one unit
+//
+// A duration is a signed number of nanoseconds, at most about 292
+// years.  Its string form is that of Go, such as "1h30m0s".  Durations
+// support the operators:
+//
+//	d + d, d - d           sum, difference
+//	d * n, n * d           the product of a duration and an int
+//	d / d                  the ratio of two durations, a float
+//	d / n                  the duration divided by an int, truncated toward zero
+//	d // d, d % d          the floored quotient, an int, and remainder
+//	d // n                 the duration divided by an int, floored
+//	==, !=, <, <=, >, >=   comparison
+//
+// Arithmetic that overflows a duration fails.  A duration is true if
+// it is non-zero.  Its attributes are hours, minutes, seconds,
+// milliseconds and microseconds, floats, and nanoseconds, an int.
+//
+// A time is an instant, with a time zone in which to present it.  Its
+// string form is that of Go, such as "2006-01-02 15:04:05 +0000 UTC".
+// Times support the operators:
+//
+//	t + d, d + t, t - d    the time a duration after or before t
+//	t - t                  the duration between two times
+//	==, !=, <, <=, >, >=   comparison of instants
+//
+// Times in different time zones are equal if they denote the same
+// instant.  The attributes of a time are year, month (1-12), day,
+// hour, minute, second, nanosecond, weekday (0-6, Sunday is 0), unix
+// and unix_nano, the seconds or nanoseconds since the Unix epoch,
+// and location, the name of its time zone; and the methods:
+//
+//	format(layout)       the time formatted according to layout, as by
+//	                     Go's time.Time.Format, such as "2006-01-02"
+//	in_location(name)    the same instant in the named time zone
+//
+// parse_time parses x according to a Go layout, by default RFC 3339,
+// such as "2006-01-02T15:04:05Z07:00".  A time without a time zone
+// offset is in the named location.
+package starlarktime
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/starlarkstruct"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// Module is the Starlark 'time' module.
+var Module = &starlarkstruct.Module{
+	Name: "time",
+	Members: starlark.StringDict{
+		"now":               starlark.NewBuiltin("time.now", now),
+		"time":              starlark.NewBuiltin("time.time", makeTime),
+		"from_timestamp":    starlark.NewBuiltin("time.from_timestamp", fromTimestamp),
+		"parse_time":        starlark.NewBuiltin("time.parse_time", parseTime),
+		"parse_duration":    starlark.NewBuiltin("time.parse_duration", parseDuration),
+		"is_valid_timezone": starlark.NewBuiltin("time.is_valid_timezone", isValidTimezone),
+
+		"nanosecond":  Duration(time.Nanosecond),
+		"microsecond": Duration(time.Microsecond),
+		"millisecond": Duration(time.Millisecond),
+		"second":      Duration(time.Second),
+		"minute":      Duration(time.Minute),
+		"hour":        Duration(time.Hour),
+	},
+}
+
+// clockKey is the key of the thread-local clock.
+const clockKey = "starlarktime.clock"
+
+// SetClock sets the clock of the thread, a function that returns the
+// current time, which time.now() reports.  A nil clock causes
+// time.now() to fail, as it does in a thread whose clock is not set.
+//
+// The clock is typically a fixed time, so that a program's results
+// are reproducible:
+//
+//	starlarktime.SetClock(thread, func() time.Time { return buildTime })
+func SetClock(thread *starlark.Thread, clock func() time.Time) {
+	thread.SetLocal(clockKey, clock)
+}
+
+// now() returns the current time, from the thread's clock.
+func now(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 0); err != nil {
+		return nil, err
+	}
+	clock, _ := thread.Local(clockKey).(func() time.Time)
+	if clock == nil {
+		return nil, fmt.Errorf("%s: the thread has no clock", b.Name())
+	}
+	return Time(clock().Round(0)), nil // strip the monotonic clock reading
+}
+
+// time(year, month, day, hour=0, minute=0, second=0, nanosecond=0,
+// location="UTC") returns the time of the specified date and time of
+// day in the named time zone.  Values outside their usual ranges are
+// normalized, as by Go's time.Date.
+func makeTime(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var year, month, day, hour, minute, second, nanosecond int
+	location := "UTC"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs,
+		"year", &year,
+		"month", &month,
+		"day", &day,
+		"hour?", &hour,
+		"minute?", &minute,
+		"second?", &second,
+		"nanosecond?", &nanosecond,
+		"location?", &location,
+	); err != nil {
+		return nil, err
+	}
+	loc, err := loadLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return Time(time.Date(year, time.Month(month), day, hour, minute, second, nanosecond, loc)), nil
+}
+
+// from_timestamp(sec, nsec=0) returns the time sec seconds and nsec
+// nanoseconds after the Unix epoch, in UTC.
+func fromTimestamp(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var sec, nsec starlark.Int
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "sec", &sec, "nsec?", &nsec); err != nil {
+		return nil, err
+	}
+	s, ok := sec.Int64()
+	if !ok {
+		return nil, fmt.Errorf("%s: sec out of range: %v", b.Name(), sec)
+	}
+	ns, ok := nsec.Int64()
+	if !ok {
+		return nil, fmt.Errorf("%s: nsec out of range: %v", b.Name(), nsec)
+	}
+	return Time(time.Unix(s, ns).UTC()), nil
+}
+
+// parse_time(x, format=RFC 3339, location="UTC") returns the time
+// that x denotes according to the layout format.
+func parseTime(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x string
+	format, location := time.RFC3339, "UTC"
+	if err := starlark.UnpackArgs(b.Name(), args, kwargs, "x", &x, "format?", &format, "location?", &location); err != nil {
+		return nil, err
+	}
+	loc, err := loadLocation(location)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	t, err := time.ParseInLocation(format, x, loc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return Time(t), nil
+}
+
+// parse_duration(x) returns the duration that x, such as "1h30m",
+// denotes, as by Go's time.ParseDuration.
+func parseDuration(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var x string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &x); err != nil {
+		return nil, err
+	}
+	d, err := time.ParseDuration(x)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return Duration(d), nil
+}
+
+// is_valid_timezone(name) reports whether the time zone name is known.
+func isValidTimezone(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	_, err := loadLocation(name)
+	return starlark.Bool(err == nil), nil
+}
+
+// ---- durations ----
+
+// A Duration is a Starlark duration, a signed number of nanoseconds.
+type Duration time.Duration
+
+var (
+	_ starlark.Comparable = Duration(0)
+	_ starlark.HasBinary  = Duration(0)
+	_ starlark.HasAttrs   = Duration(0)
+)
+
+func (d Duration) String() string        { return time.Duration(d).String() }
+func (d Duration) Type() string          { return "time.duration" }
+func (d Duration) Freeze()               {} // immutable
+func (d Duration) Truth() starlark.Bool  { return d != 0 }
+func (d Duration) Hash() (uint32, error) { return uint32(d) ^ uint32(int64(d)>>32), nil }
+
+func (d Duration) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	return threeway(op, cmp(int64(d), int64(y.(Duration)))), nil
+}
+
+var durationAttrNames = []string{"hours", "microseconds", "milliseconds", "minutes", "nanoseconds", "seconds"}
+
+func (d Duration) AttrNames() []string { return durationAttrNames }
+
+func (d Duration) Attr(name string) (starlark.Value, error) {
+	switch name {
+	case "hours":
+		return starlark.Float(time.Duration(d).Hours()), nil
+	case "minutes":
+		return starlark.Float(time.Duration(d).Minutes()), nil
+	case "seconds":
+		return starlark.Float(time.Duration(d).Seconds()), nil
+	case "milliseconds":
+		return starlark.Float(float64(d) / float64(time.Millisecond)), nil
+	case "microseconds":
+		return starlark.Float(float64(d) / float64(time.Microsecond)), nil
+	case "nanoseconds":
+		return starlark.MakeInt64(int64(d)), nil
+	}
+	return nil, nil
+}
+
+func (d Duration) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	x := int64(d)
+	switch y := y.(type) {
+	case Duration:
+		l, r := x, int64(y)
+		if side == starlark.Right {
+			l, r = r, l
+		}
+		switch op {
+		case syntax.PLUS:
+			return add(l, r)
+		case syntax.MINUS:
+			if r == math.MinInt64 {
+				return nil, errOverflow
+			}
+			return add(l, -r)
+		case syntax.SLASH:
+			if r == 0 {
+				return nil, fmt.Errorf("real division by zero")
+			}
+			return starlark.Float(float64(l) / float64(r)), nil
+		case syntax.SLASHSLASH:
+			if r == 0 {
+				return nil, fmt.Errorf("floored division by zero")
+			}
+			if l == math.MinInt64 && r == -1 {
+				return starlark.MakeInt64(l).Mul(starlark.MakeInt(-1)), nil
+			}
+			return starlark.MakeInt64(floorDiv(l, r)), nil
+		case syntax.PERCENT:
+			if r == 0 {
+				return nil, fmt.Errorf("duration modulo by zero")
+			}
+			if r == -1 {
+				return Duration(0), nil // avoid overflow of MinInt64 % -1
+			}
+			return Duration(l - floorDiv(l, r)*r), nil
+		}
+
+	case Time:
+		if op == syntax.PLUS {
+			return Time(time.Time(y).Add(time.Duration(d))), nil
+		}
+
+	case starlark.Int:
+		n, ok := y.Int64()
+		switch op {
+		case syntax.STAR:
+			if !ok {
+				return nil, errOverflow
+			}
+			return mul(x, n)
+		case syntax.SLASH, syntax.SLASHSLASH:
+			if side == starlark.Right {
+				return nil, nil // n / d is not defined
+			}
+			if y.Sign() == 0 {
+				if op == syntax.SLASH {
+					return nil, fmt.Errorf("real division by zero")
+				}
+				return nil, fmt.Errorf("floored division by zero")
+			}
+			if !ok {
+				// |n| exceeds any duration.
+				if op == syntax.SLASHSLASH && x != 0 && (x < 0) != (y.Sign() < 0) {
+					return Duration(-1), nil
+				}
+				return Duration(0), nil
+			}
+			if n == -1 {
+				if x == math.MinInt64 {
+					return nil, errOverflow
+				}
+				return Duration(-x), nil
+			}
+			if op == syntax.SLASH {
+				return Duration(x / n), nil
+			}
+			return Duration(floorDiv(x, n)), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+var errOverflow = fmt.Errorf("duration overflow")
+
+// add returns the duration x+y, or an error if it overflows.
+func add(x, y int64) (starlark.Value, error) {
+	z := x + y
+	if (z > x) != (y > 0) {
+		return nil, errOverflow
+	}
+	return Duration(z), nil
+}
+
+// mul returns the duration x*y, or an error if it overflows.
+func mul(x, y int64) (starlark.Value, error) {
+	if x == 0 || y == 0 {
+		return Duration(0), nil
+	}
+	z := x * y
+	if z/y != x || (x == math.MinInt64 && y == -1) || (y == math.MinInt64 && x == -1) {
+		return nil, errOverflow
+	}
+	return Duration(z), nil
+}
+
+// floorDiv returns x/y rounded toward negative infinity.
+// y must be neither 0 nor, if x is math.MinInt64, -1.
+func floorDiv(x, y int64) int64 {
+	q := x / y
+	if (x%y != 0) && ((x < 0) != (y < 0)) {
+		q--
+	}
+	return q
+}
+
+// ---- times ----
+
+// A Time is a Starlark time, an instant with a time zone in which to
+// present it.
+type Time time.Time
+
+var (
+	_ starlark.Comparable = Time{}
+	_ starlark.HasBinary  = Time{}
+	_ starlark.HasAttrs   = Time{}
+)
+
+func (t Time) String() string       { return time.Time(t).String() }
+func (t Time) Type() string         { return "time.time" }
+func (t Time) Freeze()              {} // immutable
+func (t Time) Truth() starlark.Bool { return true }
+
+func (t Time) Hash() (uint32, error) {
+	// Equal instants in different time zones must hash alike.
+	u := time.Time(t)
+	sec := u.Unix()
+	return uint32(sec) ^ uint32(sec>>32) ^ uint32(u.Nanosecond()), nil
+}
+
+func (t Time) CompareSameType(op syntax.Token, y starlark.Value, depth int) (bool, error) {
+	return threeway(op, time.Time(t).Compare(time.Time(y.(Time)))), nil
+}
+
+var timeAttrNames = func() []string {
+	names := []string{"day", "hour", "location", "minute", "month", "nanosecond",
+		"second", "unix", "unix_nano", "weekday", "year"}
+	for name := range timeMethods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}()
+
+func (t Time) AttrNames() []string { return timeAttrNames }
+
+func (t Time) Attr(name string) (starlark.Value, error) {
+	u := time.Time(t)
+	switch name {
+	case "year":
+		return starlark.MakeInt(u.Year()), nil
+	case "month":
+		return starlark.MakeInt(int(u.Month())), nil
+	case "day":
+		return starlark.MakeInt(u.Day()), nil
+	case "hour":
+		return starlark.MakeInt(u.Hour()), nil
+	case "minute":
+		return starlark.MakeInt(u.Minute()), nil
+	case "second":
+		return starlark.MakeInt(u.Second()), nil
+	case "nanosecond":
+		return starlark.MakeInt(u.Nanosecond()), nil
+	case "weekday":
+		return starlark.MakeInt(int(u.Weekday())), nil
+	case "unix":
+		return starlark.MakeInt64(u.Unix()), nil
+	case "unix_nano":
+		// UnixNano is undefined outside about 1678-2262.
+		nsec := starlark.MakeInt64(u.Unix()).Mul(starlark.MakeInt(1e9))
+		return nsec.Add(starlark.MakeInt(u.Nanosecond())), nil
+	case "location":
+		return starlark.String(u.Location().String()), nil
+	}
+	if method, ok := timeMethods[name]; ok {
+		return starlark.NewBuiltin("time."+name, method).BindReceiver(t), nil
+	}
+	return nil, nil
+}
+
+var timeMethods = map[string]func(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error){
+	"format":      timeFormat,
+	"in_location": timeInLocation,
+}
+
+// t.format(layout) returns the time formatted according to layout.
+func timeFormat(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var layout string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &layout); err != nil {
+		return nil, err
+	}
+	return starlark.String(time.Time(b.Receiver().(Time)).Format(layout)), nil
+}
+
+// t.in_location(name) returns the same instant in the named time zone.
+func timeInLocation(thread *starlark.Thread, b *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var name string
+	if err := starlark.UnpackPositionalArgs(b.Name(), args, kwargs, 1, &name); err != nil {
+		return nil, err
+	}
+	loc, err := loadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", b.Name(), err)
+	}
+	return Time(time.Time(b.Receiver().(Time)).In(loc)), nil
+}
+
+func (t Time) Binary(op syntax.Token, y starlark.Value, side starlark.Side) (starlark.Value, error) {
+	u := time.Time(t)
+	switch y := y.(type) {
+	case Duration:
+		switch {
+		case op == syntax.PLUS:
+			return Time(u.Add(time.Duration(y))), nil
+		case op == syntax.MINUS && side == starlark.Left:
+			if y == math.MinInt64 {
+				return nil, errOverflow
+			}
+			return Time(u.Add(-time.Duration(y))), nil
+		}
+	case Time:
+		if op == syntax.MINUS {
+			l, r := u, time.Time(y)
+			if side == starlark.Right {
+				l, r = r, l
+			}
+			// Sub saturates; report overflow instead.
+			d := l.Sub(r)
+			if d == math.MaxInt64 || d == math.MinInt64 {
+				return nil, errOverflow
+			}
+			return Duration(d), nil
+		}
+	}
+	return nil, nil // unhandled
+}
+
+// cmp returns the three-way comparison of x and y.
+func cmp(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return +1
+	}
+	return 0
+}
+
+// threeway interprets a three-way comparison value cmp (-1, 0, +1)
+// as a boolean comparison (e.g. x < y).
+func threeway(op syntax.Token, cmp int) bool {
+	switch op {
+	case syntax.EQL:
+		return cmp == 0
+	case syntax.NEQ:
+		return cmp != 0
+	case syntax.LE:
+		return cmp <= 0
+	case syntax.LT:
+		return cmp < 0
+	case syntax.GE:
+		return cmp >= 0
+	case syntax.GT:
+		return cmp > 0
+	}
+	panic(op)
+}
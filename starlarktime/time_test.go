@@ -0,0 +1,67 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktime_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/resolve"
+	"github.com/aabbtree77/determinism/starlarktest"
+	"github.com/aabbtree77/determinism/starlarktime"
+)
+
+// TestMain runs the tests, reporting the coverage of the Starlark code
+// they execute if requested.  See starlarktest.Main.
+func TestMain(m *testing.M) { starlarktest.Main(m) }
+
+// testNow is the time of the clock of the tests.
+var testNow = time.Date(2021, time.March, 4, 5, 6, 7, 8, time.UTC)
+
+func Test(t *testing.T) {
+	testdata := starlarktest.DataFile(".", ".")
+	thread := &starlark.Thread{Load: load}
+	starlarktest.SetReporter(thread, t)
+	starlarktest.RecordCoverage(thread)
+	starlarktime.SetClock(thread, func() time.Time { return testNow })
+	filename := filepath.Join(testdata, "testdata/time.star")
+	predeclared := starlark.StringDict{
+		"time": starlarktime.Module,
+	}
+	_, err := starlark.Exec(starlark.ExecOptions{
+		Thread:      thread,
+		Filename:    filename,
+		Predeclared: predeclared,
+		Dialect:     &resolve.Options{AllowLambda: true, AllowFloat: true},
+	})
+	if err != nil {
+		if err, ok := err.(*starlark.EvalError); ok {
+			t.Fatal(err.Backtrace())
+		}
+		t.Fatal(err)
+	}
+}
+
+func TestNowWithoutClock(t *testing.T) {
+	thread := new(starlark.Thread)
+	predeclared := starlark.StringDict{"time": starlarktime.Module}
+	_, err := starlark.ExecFile(thread, "now.star", "time.now()", predeclared)
+	const want = "time.now: the thread has no clock"
+	if err == nil || !strings.Contains(err.Error(), want) {
+		t.Errorf("time.now() without a clock: got error %v, want %q", err, want)
+	}
+}
+
+// load implements the 'load' operation as used in the evaluator tests.
+func load(thread *starlark.Thread, module string) (starlark.StringDict, error) {
+	if module == "assert.star" {
+		return starlarktest.LoadAssertModule("..")
+	}
+	return nil, fmt.Errorf("load not implemented")
+}
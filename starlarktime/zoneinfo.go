@@ -0,0 +1,67 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktime
+
+// This file loads time zones from the embedded copy of the IANA Time
+// Zone Database, release 2026c, so that the results of programs do
+// not depend on the database, if any, of the host.  zoneinfo.zip is
+// a copy of $GOROOT/lib/time/zoneinfo.zip; to update it, copy that
+// file from a Go release that has the desired data.
+
+import (
+	"archive/zip"
+	_ "embed"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed zoneinfo.zip
+var zoneinfoZip string
+
+var (
+	zoneMu    sync.Mutex
+	zoneinfo  *zip.Reader               // the database, once opened
+	locations map[string]*time.Location // locations loaded so far, by name
+)
+
+// loadLocation returns the time zone of the specified name, such as
+// "America/New_York".  The name "UTC", or "", denotes UTC.  The local
+// time zone of the host, "Local", is not available.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" || name == "UTC" {
+		return time.UTC, nil
+	}
+	zoneMu.Lock()
+	defer zoneMu.Unlock()
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	if zoneinfo == nil {
+		r, err := zip.NewReader(strings.NewReader(zoneinfoZip), int64(len(zoneinfoZip)))
+		if err != nil {
+			panic(fmt.Sprintf("invalid embedded time zone database: %v", err))
+		}
+		zoneinfo = r
+		locations = make(map[string]*time.Location)
+	}
+	f, err := zoneinfo.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", name)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %s", name) // a directory
+	}
+	loc, err := time.LoadLocationFromTZData(name, data)
+	if err != nil {
+		return nil, fmt.Errorf("time zone %s: %v", name, err)
+	}
+	locations[name] = loc
+	return loc, nil
+}
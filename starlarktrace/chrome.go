@@ -0,0 +1,150 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package starlarktrace records the execution of Starlark threads.
+//
+// A ChromeTracer writes the calls and statements executed by a thread
+// as trace events in the JSON format read by chrome://tracing and by
+// Perfetto (https://ui.perfetto.dev), which display them on a
+// timeline:
+//
+//	tracer := starlarktrace.NewChromeTracer(file)
+//	thread := &starlark.Thread{Trace: tracer.Trace}
+//	... execute Starlark code ...
+//	err := tracer.Close()
+//
+// The output is a JSON array of "B" (begin) and "E" (end) events in
+// the Trace Event Format of the Chromium project's trace viewer.
+package starlarktrace
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aabbtree77/determinism"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+// A ChromeTracer writes Chrome trace events.  Each Starlark function
+// call, module execution and statement becomes a slice of the
+// timeline of its thread.  A ChromeTracer may be shared by threads
+// that execute concurrently.
+type ChromeTracer struct {
+	mu    sync.Mutex
+	w     *bufio.Writer
+	start time.Time
+	now   func() time.Time // the clock, replaced by tests
+	tids  map[*starlark.Thread]int
+	n     int   // number of events written
+	err   error // first write error
+}
+
+// NewChromeTracer returns a tracer that writes to w.
+// The client must call Close to complete the output.
+func NewChromeTracer(w io.Writer) *ChromeTracer {
+	return &ChromeTracer{
+		w:    bufio.NewWriter(w),
+		now:  time.Now,
+		tids: make(map[*starlark.Thread]int),
+	}
+}
+
+// A chromeEvent is a trace event in the Chrome format.
+type chromeEvent struct {
+	Name string            `json:"name"`
+	Cat  string            `json:"cat"`
+	Ph   string            `json:"ph"` // "B" (begin) or "E" (end)
+	Ts   float64           `json:"ts"` // microseconds since the start of the trace
+	Pid  int               `json:"pid"`
+	Tid  int               `json:"tid"`
+	Args map[string]string `json:"args,omitempty"`
+}
+
+// Trace records an event.  It is suitable for use as the Trace
+// function of a starlark.Thread.
+func (t *ChromeTracer) Trace(thread *starlark.Thread, event *starlark.TraceEvent) {
+	ev := chromeEvent{Ph: "B", Pid: 1}
+	var pos syntax.Position
+	switch node := event.Node.(type) {
+	case *syntax.File:
+		ev.Name, ev.Cat = node.Path, "module"
+		pos, _ = node.Span()
+	case *syntax.Function:
+		ev.Name, ev.Cat = event.Frame.Function().Name(), "function"
+		pos = event.Frame.Function().Position()
+	case syntax.Stmt:
+		pos, _ = node.Span()
+		ev.Name, ev.Cat = fmt.Sprintf("%s:%d", filepath.Base(pos.Filename()), pos.Line), "statement"
+	default:
+		return
+	}
+	switch event.Kind {
+	case starlark.TraceCall, starlark.TraceStmt:
+		ev.Args = map[string]string{"position": pos.String()}
+	case starlark.TraceReturn, starlark.TraceStmtEnd:
+		ev.Ph = "E"
+		if event.Err != nil {
+			ev.Args = map[string]string{"error": event.Err.Error()}
+		}
+	default:
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	now := t.now()
+	if t.n == 0 {
+		t.start = now
+	}
+	ev.Ts = float64(now.Sub(t.start).Nanoseconds()) / 1e3
+	tid, ok := t.tids[thread]
+	if !ok {
+		tid = len(t.tids) + 1
+		t.tids[thread] = tid
+	}
+	ev.Tid = tid
+	t.write(&ev)
+}
+
+// write writes an event, preceded by the start of the array or by
+// the separator from the previous event.
+// It is called with t.mu held.
+func (t *ChromeTracer) write(ev *chromeEvent) {
+	if t.err != nil {
+		return
+	}
+	data, err := json.Marshal(ev)
+	if err != nil {
+		t.err = err
+		return
+	}
+	sep := ",\n"
+	if t.n == 0 {
+		sep = "[\n"
+	}
+	t.n++
+	t.w.WriteString(sep)
+	_, t.err = t.w.Write(data)
+}
+
+// Close completes the output, and returns the first error, if any,
+// that occurred while writing it.  The tracer must not be used
+// afterwards.
+func (t *ChromeTracer) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.err != nil {
+		return t.err
+	}
+	if t.n == 0 {
+		t.w.WriteString("[")
+	}
+	t.w.WriteString("\n]\n")
+	return t.w.Flush()
+}
@@ -0,0 +1,81 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package starlarktrace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/aabbtree77/determinism"
+)
+
+func TestChromeTracer(t *testing.T) {
+	var buf bytes.Buffer
+	tracer := NewChromeTracer(&buf)
+	var clock time.Time
+	tracer.now = func() time.Time {
+		clock = clock.Add(1500 * time.Nanosecond)
+		return clock
+	}
+
+	thread := &starlark.Thread{Trace: tracer.Trace}
+	const src = `
+def f():
+	return 1 // 0
+f()
+`
+	if _, err := starlark.ExecFile(thread, "trace.star", src, nil); err == nil {
+		t.Fatal("ExecFile succeeded unexpectedly")
+	}
+	if err := tracer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	const want = `[
+{"name":"trace.star","cat":"module","ph":"B","ts":0,"pid":1,"tid":1,"args":{"position":"trace.star:2:1"}},
+{"name":"trace.star:2","cat":"statement","ph":"B","ts":1.5,"pid":1,"tid":1,"args":{"position":"trace.star:2:1"}},
+{"name":"trace.star:2","cat":"statement","ph":"E","ts":3,"pid":1,"tid":1},
+{"name":"trace.star:4","cat":"statement","ph":"B","ts":4.5,"pid":1,"tid":1,"args":{"position":"trace.star:4:1"}},
+{"name":"f","cat":"function","ph":"B","ts":6,"pid":1,"tid":1,"args":{"position":"trace.star:2:1"}},
+{"name":"trace.star:3","cat":"statement","ph":"B","ts":7.5,"pid":1,"tid":1,"args":{"position":"trace.star:3:2"}},
+{"name":"trace.star:3","cat":"statement","ph":"E","ts":9,"pid":1,"tid":1,"args":{"error":"floored division by zero"}},
+{"name":"f","cat":"function","ph":"E","ts":10.5,"pid":1,"tid":1,"args":{"error":"floored division by zero"}},
+{"name":"trace.star:4","cat":"statement","ph":"E","ts":12,"pid":1,"tid":1,"args":{"error":"floored division by zero"}},
+{"name":"trace.star","cat":"module","ph":"E","ts":13.5,"pid":1,"tid":1,"args":{"error":"floored division by zero"}}
+]
+`
+	if got := buf.String(); got != want {
+		t.Errorf("trace:\n%s\nwant:\n%s", got, want)
+	}
+	var events []chromeEvent
+	if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+		t.Errorf("invalid JSON: %v", err)
+	}
+
+	// Each thread has its own timeline.
+	buf.Reset()
+	tracer = NewChromeTracer(&buf)
+	for i := 0; i < 2; i++ {
+		thread := &starlark.Thread{Trace: tracer.Trace}
+		starlark.ExecFile(thread, "empty.star", "", nil)
+	}
+	tracer.Close()
+	events = nil
+	if err := json.Unmarshal(buf.Bytes(), &events); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(events) != 4 || events[0].Tid != 1 || events[2].Tid != 2 {
+		t.Errorf("events = %+v", events)
+	}
+
+	// An empty trace is an empty array.
+	buf.Reset()
+	NewChromeTracer(&buf).Close()
+	if got := buf.String(); got != "[\n]\n" {
+		t.Errorf("empty trace = %q", got)
+	}
+}
@@ -0,0 +1,734 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syntax
+
+// This file defines the canonical printer for syntax trees.
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Format returns the canonical text of the syntax tree f.
+//
+// The layout of each construct is fixed: statements are indented by
+// four spaces, operators are surrounded by single spaces, and strings
+// are double-quoted where this requires no escapes.  The printer does
+// not wrap long lines, but it respects the line structure of the
+// input: a list, dict, tuple, call, parameter list, comprehension or
+// load statement that spanned several lines (or contains comments) is
+// printed one element per line with a trailing comma, and a line
+// break after a binary operator within parentheses is preserved.
+// Comments are retained if f was parsed in RetainComments mode, and
+// runs of blank lines between statements are collapsed to one.
+//
+// Formatting is idempotent, and the result parses to the same tree as f.
+// A partial tree returned by Parse along with syntax errors may be
+// formatted too: each BadStmt and BadExpr is printed as its source
+// text.
+func Format(f *File) []byte {
+	p := &printer{bol: true}
+	var prev int32
+	if len(f.Stmts) > 0 {
+		p.stmts(f.Stmts)
+		prev = endLine(f.Stmts[len(f.Stmts)-1])
+	}
+	if c := f.Comments(); c != nil && len(c.After) > 0 {
+		if len(f.Stmts) > 0 {
+			p.newline()
+		}
+		p.comments(c.After, prev, 0)
+	} else if len(f.Stmts) > 0 {
+		p.newline()
+	}
+	return p.buf.Bytes()
+}
+
+// A printer holds the state of the canonical printer.
+type printer struct {
+	buf    bytes.Buffer
+	indent int       // indentation level of the current line
+	depth  int       // nesting depth of brackets
+	bol    bool      // at beginning of line; indentation not yet written
+	suffix []Comment // end-of-line comments pending the next newline
+}
+
+const indentation = "    "
+
+// print writes s to the current line, indenting the line first if necessary.
+func (p *printer) print(s string) {
+	if p.bol {
+		for i := 0; i < p.indent; i++ {
+			p.buf.WriteString(indentation)
+		}
+		p.bol = false
+	}
+	p.buf.WriteString(s)
+}
+
+// newline ends the current line, after any pending suffix comments.
+func (p *printer) newline() {
+	for _, c := range p.suffix {
+		if p.bol {
+			p.print(c.Text)
+		} else {
+			p.print("  " + c.Text)
+		}
+	}
+	p.suffix = p.suffix[:0]
+	p.buf.WriteByte('\n')
+	p.bol = true
+}
+
+// comments prints a group of whole-line comments, each followed by a
+// newline.  Blank lines are preserved between the comments, between
+// the previous line (if prev > 0) and the first comment, and between
+// the last comment and the line next (if next > 0).
+func (p *printer) comments(list []Comment, prev, next int32) {
+	for _, c := range list {
+		if prev > 0 && c.Start.Line > prev+1 {
+			p.newline()
+		}
+		p.print(strings.TrimRight(c.Text, " \t"))
+		p.newline()
+		prev = c.Start.Line
+	}
+	if next > 0 && prev > 0 && next > prev+1 {
+		p.newline()
+	}
+}
+
+// firstLine returns the first source line of n, including the
+// comments that precede it, or zero if n has no position.
+func firstLine(n Node) int32 {
+	if c := n.Comments(); c != nil && len(c.Before) > 0 {
+		return c.Before[0].Start.Line
+	}
+	return Start(n).Line
+}
+
+// endLine returns the last source line of n, including its suffix comment.
+func endLine(n Node) int32 {
+	line := End(n).Line
+	if c := n.Comments(); c != nil {
+		for _, s := range c.Suffix {
+			if s.Start.Line > line {
+				line = s.Start.Line
+			}
+		}
+	}
+	return line
+}
+
+// separate ends the line preceding n, and inserts a blank line if
+// there was one between prev and n in the source.
+func (p *printer) separate(prev, n Node) {
+	p.newline()
+	end, start := endLine(prev), firstLine(n)
+	if end > 0 && start > end+1 {
+		p.newline()
+	}
+}
+
+// before prints the whole-line comments preceding n.
+func (p *printer) before(n Node) {
+	c := n.Comments()
+	if c == nil || len(c.Before) == 0 {
+		return
+	}
+	if !p.bol {
+		if p.depth == 0 {
+			// Within a line, comments may be printed only
+			// where brackets permit a line break.
+			p.suffix = append(p.suffix, c.Before...)
+			return
+		}
+		p.newline()
+	}
+	p.comments(c.Before, 0, Start(n).Line)
+}
+
+// after records the suffix comments of n, to be printed at the end
+// of the current line.
+func (p *printer) after(n Node) {
+	if c := n.Comments(); c != nil {
+		p.suffix = append(p.suffix, c.Suffix...)
+	}
+}
+
+// hasComments reports whether any node within n has comments.
+func hasComments(n Node) bool {
+	found := false
+	Walk(n, func(n Node) bool {
+		if n != nil && !found {
+			if c := n.Comments(); c != nil && len(c.Before)+len(c.Suffix) > 0 {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+// hasInnerComments reports whether any node within n has comments,
+// other than a suffix comment of n itself.
+func hasInnerComments(n Node) bool {
+	if c := n.Comments(); c != nil && len(c.Before) > 0 {
+		return true
+	}
+	found := false
+	Walk(n, func(x Node) bool {
+		if x != nil && x != n && !found {
+			found = hasComments(x)
+		}
+		return x == n
+	})
+	return found
+}
+
+// anyComments reports whether any node within the list has comments.
+func anyComments(list []Expr) bool {
+	for _, e := range list {
+		if hasComments(e) {
+			return true
+		}
+	}
+	return false
+}
+
+// spansLines reports whether the construct between the brackets at
+// open and close spanned several lines in the source, or whether any
+// of its elements has comments.
+func spansLines(open, close Position, elems []Expr) bool {
+	return open.Line != close.Line || anyComments(elems)
+}
+
+// stmts prints a non-empty block of statements, without a final newline.
+func (p *printer) stmts(list []Stmt) {
+	for i, stmt := range list {
+		if i > 0 {
+			p.separate(list[i-1], stmt)
+		}
+		p.before(stmt)
+		p.stmt(stmt)
+		p.after(stmt)
+	}
+}
+
+// block prints the body of a compound statement, following its colon.
+func (p *printer) block(list []Stmt) {
+	p.indent++
+	p.newline()
+	p.stmts(list)
+	p.indent--
+}
+
+func (p *printer) stmt(stmt Stmt) {
+	switch stmt := stmt.(type) {
+	case *ExprStmt:
+		p.expr(stmt.X, precExpr)
+
+	case *BranchStmt:
+		p.print(stmt.Token.String())
+
+	case *IfStmt:
+		p.ifStmt(stmt, "if ")
+
+	case *AssignStmt:
+		p.expr(stmt.LHS, precExpr)
+		p.print(" " + stmt.Op.String() + " ")
+		p.expr(stmt.RHS, precExpr)
+
+	case *DefStmt:
+		p.print("def ")
+		p.expr(stmt.Name, precPrimary)
+		// A DefStmt records no parenthesis positions, so the
+		// parameters are deemed to span lines if the first does
+		// not follow the name.
+		// A suffix comment of the last parameter follows the colon.
+		multi := false
+		if n := len(stmt.Params); n > 0 {
+			last := stmt.Params[n-1]
+			multi = Start(stmt.Params[0]).Line > stmt.Def.Line ||
+				anyComments(stmt.Params[:n-1]) ||
+				hasInnerComments(last)
+		}
+		p.seq("(", stmt.Params, ")", multi, allowsTrailingComma(stmt.Params), false, p.arg)
+		p.print(":")
+		p.block(stmt.Body)
+
+	case *ForStmt:
+		p.print("for ")
+		p.expr(stmt.Vars, precExpr)
+		p.print(" in ")
+		p.expr(stmt.X, precExpr)
+		p.print(":")
+		p.block(stmt.Body)
+
+	case *WhileStmt:
+		p.print("while ")
+		p.expr(stmt.Cond, precTest)
+		p.print(":")
+		p.block(stmt.Body)
+
+	case *ReturnStmt:
+		p.print("return")
+		if stmt.Result != nil {
+			p.print(" ")
+			p.expr(stmt.Result, precExpr)
+		}
+
+	case *LoadStmt:
+		p.load(stmt)
+
+	case *BadStmt:
+		p.source(stmt.Text)
+
+	default:
+		panic(fmt.Sprintf("unexpected stmt %T", stmt))
+	}
+}
+
+// ifStmt prints an if statement, or the elif clause of one,
+// introduced by keyword.
+func (p *printer) ifStmt(stmt *IfStmt, keyword string) {
+	p.print(keyword)
+	p.expr(stmt.Cond, precTest)
+	p.print(":")
+	p.block(stmt.True)
+	if len(stmt.False) == 0 {
+		return
+	}
+	// The parser assigns a suffix comment of the else line to the
+	// last node of the preceding block; keep it on the else line.
+	var elseComments []Comment
+	if stmt.ElsePos.IsValid() {
+		kept := p.suffix[:0]
+		for _, c := range p.suffix {
+			if c.Start.Line == stmt.ElsePos.Line {
+				elseComments = append(elseComments, c)
+			} else {
+				kept = append(kept, c)
+			}
+		}
+		p.suffix = kept
+	}
+	p.newline()
+	// The parser desugars elif into a nested IfStmt at the ELIF token.
+	if elif, ok := stmt.False[0].(*IfStmt); ok && len(stmt.False) == 1 && elif.If == stmt.ElsePos {
+		p.before(elif)
+		p.ifStmt(elif, "elif ")
+		p.after(elif)
+		return
+	}
+	p.print("else:")
+	p.suffix = append(p.suffix, elseComments...)
+	p.block(stmt.False)
+}
+
+// source prints text, the source of a statement or expression that
+// the parser could not parse, unchanged.  Its first line is indented
+// as usual; later lines keep their own indentation.
+func (p *printer) source(text string) {
+	lines := strings.Split(text, "\n")
+	p.print(lines[0])
+	for _, line := range lines[1:] {
+		p.buf.WriteByte('\n')
+		p.buf.WriteString(strings.TrimRight(line, " \t\r"))
+	}
+}
+
+func (p *printer) load(stmt *LoadStmt) {
+	multi := stmt.Load.Line != stmt.Rparen.Line
+	for i := range stmt.To {
+		if hasComments(stmt.To[i]) || hasComments(stmt.From[i]) {
+			multi = true
+		}
+	}
+
+	p.print("load(")
+	if multi {
+		p.indent++
+		p.depth++
+		p.newline()
+	}
+	p.expr(stmt.Module, precTest)
+	for i, to := range stmt.To {
+		from := stmt.From[i]
+		p.print(",")
+		if multi {
+			p.newline()
+		} else {
+			p.print(" ")
+		}
+		p.before(to)
+		if to.Name != from.Name {
+			p.print(to.Name + "=")
+		}
+		p.print(fmt.Sprintf("%q", from.Name))
+		p.after(to)
+		if from != to {
+			p.after(from)
+		}
+	}
+	if multi {
+		p.print(",")
+		p.depth--
+		p.indent--
+		p.newline()
+	}
+	p.print(")")
+}
+
+// Operator precedence levels of expressions, from loosest to tightest.
+// The operators of the binary operator table of the parser occupy the
+// levels from precOr to precUnary-1.
+const (
+	precExpr    = iota // unparenthesized tuple
+	precTest           // conditional or lambda
+	precOr             // first binary operator
+	precUnary   = precOr + len(preclevels)
+	precPrimary = precUnary + 1
+)
+
+// exprPrec returns the precedence level of the expression e.
+func exprPrec(e Expr) int {
+	switch e := e.(type) {
+	case *TupleExpr:
+		if !e.Lparen.IsValid() && len(e.List) > 0 {
+			return precExpr
+		}
+	case *CondExpr, *LambdaExpr:
+		return precTest
+	case *BinaryExpr:
+		return precOr + int(precedence[e.Op])
+	case *UnaryExpr:
+		switch e.Op {
+		case NOT:
+			return precOr + int(precedence[NOT])
+		case STAR, STARSTAR:
+			return precTest
+		}
+		return precUnary
+	}
+	return precPrimary
+}
+
+// expr prints e, and its comments, enclosing it in parentheses if its
+// precedence is lower than prec.
+func (p *printer) expr(e Expr, prec int) {
+	p.before(e)
+	if exprPrec(e) < prec {
+		p.print("(")
+		p.depth++
+		p.expr1(e)
+		p.depth--
+		p.print(")")
+	} else {
+		p.expr1(e)
+	}
+	p.after(e)
+}
+
+func (p *printer) expr1(e Expr) {
+	switch e := e.(type) {
+	case *Ident:
+		p.print(e.Name)
+
+	case *Literal:
+		if e.Token == STRING || e.Token == BYTES {
+			p.print(doubleQuote(e.Raw))
+		} else {
+			p.print(e.Raw)
+		}
+
+	case *ParenExpr:
+		if tuple, ok := e.X.(*TupleExpr); ok && !tuple.Lparen.IsValid() {
+			p.seq("(", tuple.List, ")", spansLines(e.Lparen, e.Rparen, tuple.List), true, true, p.elem)
+			break
+		}
+		p.print("(")
+		p.depth++
+		p.expr(e.X, precExpr)
+		p.depth--
+		p.print(")")
+
+	case *TupleExpr:
+		if e.Lparen.IsValid() || len(e.List) == 0 {
+			// The parser uses Lparen only for the empty tuple.
+			p.seq("(", e.List, ")", spansLines(e.Lparen, e.Rparen, e.List), true, true, p.elem)
+			break
+		}
+		for i, x := range e.List {
+			if i > 0 {
+				p.print(", ")
+			}
+			p.expr(x, precTest)
+		}
+		if len(e.List) == 1 {
+			p.print(",")
+		}
+
+	case *ListExpr:
+		p.seq("[", e.List, "]", spansLines(e.Lbrack, e.Rbrack, e.List), true, false, p.elem)
+
+	case *DictExpr:
+		p.seq("{", e.List, "}", spansLines(e.Lbrace, e.Rbrace, e.List), true, false, p.elem)
+
+	case *DictEntry:
+		p.expr(e.Key, precTest)
+		p.print(": ")
+		p.expr(e.Value, precTest)
+
+	case *Comprehension:
+		p.comprehension(e)
+
+	case *CallExpr:
+		p.expr(e.Fn, precPrimary)
+		multi := spansLines(e.Lparen, e.Rparen, e.Args) && !hugsParens(e)
+		p.seq("(", e.Args, ")", multi, allowsTrailingComma(e.Args), false, p.arg)
+
+	case *DotExpr:
+		p.expr(e.X, precPrimary)
+		p.print(".")
+		p.expr(e.Name, precPrimary)
+
+	case *IndexExpr:
+		p.expr(e.X, precPrimary)
+		p.print("[")
+		p.depth++
+		p.expr(e.Y, precExpr)
+		p.depth--
+		p.print("]")
+
+	case *SliceExpr:
+		p.expr(e.X, precPrimary)
+		p.print("[")
+		p.depth++
+		if e.Lo != nil {
+			p.expr(e.Lo, precExpr)
+		}
+		p.print(":")
+		if e.Hi != nil {
+			p.expr(e.Hi, precTest)
+		}
+		if e.Step != nil {
+			p.print(":")
+			p.expr(e.Step, precTest)
+		}
+		p.depth--
+		p.print("]")
+
+	case *UnaryExpr:
+		switch e.Op {
+		case NOT:
+			p.print("not ")
+			p.expr(e.X, precOr+int(precedence[NOT])+1)
+		case STAR, STARSTAR:
+			p.print(e.Op.String())
+			p.expr(e.X, precTest)
+		default:
+			p.print(e.Op.String())
+			p.expr(e.X, precUnary)
+		}
+
+	case *BinaryExpr:
+		prec := precOr + int(precedence[e.Op])
+		lprec := prec
+		if precedence[e.Op] == precedence[EQL] {
+			lprec++ // comparisons are non-associative
+		}
+		p.expr(e.X, lprec)
+		p.print(" " + e.Op.String())
+		if p.depth > 0 && firstLine(e.Y) > End(e.X).Line && End(e.X).Line > 0 {
+			// Preserve a line break after the operator.
+			p.indent++
+			p.newline()
+			p.expr(e.Y, prec+1)
+			p.indent--
+		} else {
+			p.print(" ")
+			p.expr(e.Y, prec+1)
+		}
+
+	case *CondExpr:
+		p.expr(e.True, precOr)
+		p.print(" if ")
+		p.expr(e.Cond, precOr)
+		p.print(" else ")
+		p.expr(e.False, precTest)
+
+	case *LambdaExpr:
+		p.print("lambda")
+		for i, param := range e.Params {
+			if i > 0 {
+				p.print(",")
+			}
+			p.print(" ")
+			p.arg(param)
+		}
+		p.print(": ")
+		p.expr(e.Body[0].(*ReturnStmt).Result, precTest)
+
+	case *BadExpr:
+		p.source(e.Text)
+
+	default:
+		panic(fmt.Sprintf("unexpected expr %T", e))
+	}
+}
+
+// hugsParens reports whether the sole argument of a call is a
+// bracketed literal that begins and ends on the same lines as the
+// parentheses, as in f([...]), in which case the call remains compact
+// even if the argument spans several lines.
+func hugsParens(call *CallExpr) bool {
+	if len(call.Args) != 1 {
+		return false
+	}
+	arg := call.Args[0]
+	switch arg.(type) {
+	case *ListExpr, *DictExpr, *Comprehension:
+	default:
+		return false
+	}
+	if c := arg.Comments(); c != nil && len(c.Before) > 0 {
+		return false
+	}
+	return Start(arg).Line == call.Lparen.Line && End(arg).Line == call.Rparen.Line
+}
+
+// elem prints an element of a list, tuple or dict.
+func (p *printer) elem(e Expr) { p.expr(e, precTest) }
+
+// arg prints an argument of a call or a parameter of a function.
+func (p *printer) arg(e Expr) {
+	if bin, ok := e.(*BinaryExpr); ok && bin.Op == EQ {
+		p.before(bin)
+		p.expr(bin.X, precPrimary)
+		p.print("=")
+		p.expr(bin.Y, precTest)
+		p.after(bin)
+		return
+	}
+	p.expr(e, precTest)
+}
+
+// allowsTrailingComma reports whether a list of arguments or
+// parameters may end with a comma, which the grammar forbids after
+// *args or **kwargs.
+func allowsTrailingComma(args []Expr) bool {
+	for _, arg := range args {
+		if u, ok := arg.(*UnaryExpr); ok && (u.Op == STAR || u.Op == STARSTAR) {
+			return false
+		}
+	}
+	return true
+}
+
+// seq prints a bracketed, comma-separated sequence of elements, either
+// on one line or, if multi, one element per line followed by a comma
+// if trailingComma permits.  A lone element of a tuple is always
+// followed by a comma.
+func (p *printer) seq(open string, list []Expr, close string, multi, trailingComma, tuple bool, elem func(Expr)) {
+	p.print(open)
+	p.depth++
+	if multi && len(list) > 0 {
+		p.indent++
+		p.newline()
+		for i, x := range list {
+			if i > 0 {
+				p.separate(list[i-1], x)
+			}
+			elem(x)
+			if trailingComma || i < len(list)-1 {
+				p.print(",")
+			}
+		}
+		p.indent--
+		p.newline()
+	} else {
+		for i, x := range list {
+			if i > 0 {
+				p.print(", ")
+			}
+			elem(x)
+		}
+		if tuple && len(list) == 1 {
+			p.print(",")
+		}
+	}
+	p.depth--
+	p.print(close)
+}
+
+func (p *printer) comprehension(e *Comprehension) {
+	open, close := "[", "]"
+	if e.Curly {
+		open, close = "{", "}"
+	}
+	multi := e.Lbrack.Line != e.Rbrack.Line
+	for _, clause := range e.Clauses {
+		if hasComments(clause) {
+			multi = true
+		}
+	}
+
+	p.print(open)
+	p.depth++
+	if multi {
+		p.indent++
+		p.newline()
+	}
+	p.expr(e.Body, precTest)
+	for _, clause := range e.Clauses {
+		if multi {
+			p.newline()
+		} else {
+			p.print(" ")
+		}
+		p.before(clause)
+		switch clause := clause.(type) {
+		case *ForClause:
+			p.print("for ")
+			p.expr(clause.Vars, precExpr)
+			p.print(" in ")
+			p.expr(clause.X, precOr)
+		case *IfClause:
+			// The condition may be a lambda but not a conditional.
+			prec := precTest
+			if _, ok := clause.Cond.(*CondExpr); ok {
+				prec = precOr
+			}
+			p.print("if ")
+			p.expr(clause.Cond, prec)
+		}
+		p.after(clause)
+	}
+	if multi {
+		p.indent--
+		p.newline()
+	}
+	p.depth--
+	p.print(close)
+}
+
+// doubleQuote returns the raw text of a string or bytes literal,
+// converted from single to double quotes if that requires no escapes.
+func doubleQuote(raw string) string {
+	i := strings.IndexAny(raw, `'"`)
+	if i < 0 || raw[i] != '\'' || !strings.HasSuffix(raw, "'") {
+		return raw
+	}
+	if len(raw) < i+2 {
+		return raw
+	}
+	body := raw[i+1 : len(raw)-1]
+	if strings.ContainsAny(body, `'"`) {
+		return raw // quotes within, triple-quoted, or concatenated
+	}
+	return raw[:i] + `"` + body + `"`
+}
@@ -0,0 +1,233 @@
+// Copyright 2017 The Bazel Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package syntax_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aabbtree77/determinism/internal/chunkedfile"
+	"github.com/aabbtree77/determinism/starlarktest"
+	"github.com/aabbtree77/determinism/syntax"
+)
+
+func TestFormat(t *testing.T) {
+	for _, test := range []struct {
+		input, want string
+	}{
+		{``, ``},
+		{`x=1`, "x = 1\n"},
+		{`x=-y+f(a,b,*c,**d)[1:2:3]`, "x = -y + f(a, b, *c, **d)[1:2:3]\n"},
+		{`print('a', 'it\'s', b'c', r'\d', '''x''')`,
+			`print("a", 'it\'s', b"c", r"\d", '''x''')` + "\n"},
+		{`x = a if not b else lambda: c`, "x = a if not b else lambda: c\n"},
+		{`t = (1,) + (1, 2) + ()`, "t = (1,) + (1, 2) + ()\n"},
+		{`for x,y in z: pass`, "for x, y in z:\n    pass\n"},
+		{`if a: pass
+elif b: pass
+else:
+  if c: pass`, `if a:
+    pass
+elif b:
+    pass
+else:
+    if c:
+        pass
+`},
+		{`def f(a, b = 1, *args, **kwargs): return [x*2 for x in a if x] + {k: v for k, v in b}`,
+			`def f(a, b=1, *args, **kwargs):
+    return [x * 2 for x in a if x] + {k: v for k, v in b}
+`},
+		{`load('a.star', 'x', y = 'z', w = 'w')`, "load(\"a.star\", \"x\", y=\"z\", \"w\")\n"},
+		// Layout of bracketed constructs follows the input.
+		{`x = [1,
+  2]`, `x = [
+    1,
+    2,
+]
+`},
+		{`f(a,
+  *b)`, `f(
+    a,
+    *b
+)
+`},
+		{`def f(
+  a, b): pass`, `def f(
+    a,
+    b,
+):
+    pass
+`},
+		{`x = f([1,
+  2])`, `x = f([
+    1,
+    2,
+])
+`},
+		{`x = [y
+  for y in z
+  if y]`, `x = [
+    y
+    for y in z
+    if y
+]
+`},
+		{`x = (a and
+    b or
+  c)`, `x = (a and
+    b or
+    c)
+`},
+		// Comments and blank lines.
+		{`# header
+
+# doc
+x = 1 # suffix
+
+
+
+y = 2
+# trailer`, `# header
+
+# doc
+x = 1  # suffix
+
+y = 2
+# trailer
+`},
+		{`x = {  # open
+  # before
+  "a": 1,  # a
+
+  "b": 2,
+}`, `x = {  # open
+    # before
+    "a": 1,  # a
+
+    "b": 2,
+}
+`},
+		{`def f(x):  # f
+  if x:
+    return 1 # one
+  # two
+  return 2`, `def f(x):  # f
+    if x:
+        return 1  # one
+    # two
+    return 2
+`},
+		{`if a:
+    pass  # one
+else:  # two
+    pass  # three
+`, `if a:
+    pass  # one
+else:  # two
+    pass  # three
+`},
+		{`if a:
+    for x in y:
+        f(x)
+else:  # note
+    pass
+`, `if a:
+    for x in y:
+        f(x)
+else:  # note
+    pass
+`},
+	} {
+		f, err := syntax.Parse("in.star", test.input, syntax.RetainComments)
+		if err != nil {
+			t.Errorf("parse `%s` failed: %v", test.input, err)
+			continue
+		}
+		if got := string(syntax.Format(f)); got != test.want {
+			t.Errorf("format `%s` = \n%s, want \n%s", test.input, got, test.want)
+		}
+	}
+}
+
+// TestFormatFiles checks that formatting the test scripts is
+// idempotent and preserves their syntax trees and comments.
+func TestFormatFiles(t *testing.T) {
+	files, err := filepath.Glob(starlarktest.DataFile(".", "../testdata/*.star"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files = append(files, starlarktest.DataFile(".", "testdata/errors.star"))
+	for _, filename := range files {
+		for _, chunk := range chunkedfile.Read(filename, t) {
+			checkFormat(t, filename, chunk.Source)
+		}
+	}
+
+	filename := starlarktest.DataFile(".", "testdata/def.bzl")
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFormat(t, filename, string(data))
+}
+
+// TestFormatErrors checks that partial trees are formatted with the
+// source text of the parts that did not parse.
+func TestFormatErrors(t *testing.T) {
+	for _, test := range []struct {
+		input, want string
+	}{
+		{"x=1\ny = 1 + * 2  # bad\nz=3", "x = 1\ny = 1 + * 2  # bad\nz = 3\n"},
+		{"f(a,  1 2 , b)", "f(a, 1, 2, b)\n"},
+		{"x = [1,\n  * 2,\n  3]", "x = [\n    1,\n    * 2,\n    3,\n]\n"},
+		{"x = [1,\n  $,\n  3]", "x = [1,\n  $,\n  3]\n"},
+		{"def f(x, y=g(1 + , 2)):\n  pass", "def f(x, y=g(1 +, 2)):\n    pass\n"},
+		{"if x:\n    def f(:\n        pass\n    y=1", "if x:\n    def f(:\n        pass\n    y = 1\n"},
+	} {
+		f, err := syntax.Parse("in.star", test.input, syntax.RetainComments)
+		if err == nil {
+			t.Errorf("parse `%s` succeeded unexpectedly", test.input)
+			continue
+		}
+		if got := string(syntax.Format(f)); got != test.want {
+			t.Errorf("format `%s` = \n%s, want \n%s", test.input, got, test.want)
+		}
+	}
+}
+
+func checkFormat(t *testing.T, filename, src string) {
+	f, err := syntax.Parse(filename, src, syntax.RetainComments)
+	if err != nil {
+		// A test of an error.  The partial tree must be printable.
+		if f != nil {
+			syntax.Format(f)
+		}
+		return
+	}
+	formatted := syntax.Format(f)
+	f2, err := syntax.Parse(filename, formatted, syntax.RetainComments)
+	if err != nil {
+		t.Errorf("%s: formatted output does not parse: %v\n%s", filename, err, formatted)
+		return
+	}
+	if got, want := len(f2.Stmts), len(f.Stmts); got != want {
+		t.Errorf("%s: formatting changed the number of statements from %d to %d", filename, want, got)
+		return
+	}
+	for i := range f.Stmts {
+		if got, want := treeString(f2.Stmts[i]), treeString(f.Stmts[i]); got != want {
+			t.Errorf("%s: formatting changed syntax tree:\n%s\nwant:\n%s", filename, got, want)
+		}
+	}
+	if again := syntax.Format(f2); string(again) != string(formatted) {
+		t.Errorf("%s: formatting is not idempotent:\n%s\nthen:\n%s", filename, formatted, again)
+	}
+	if got, want := strings.Count(string(formatted), "#"), strings.Count(src, "#"); got < want {
+		t.Errorf("%s: formatting lost comments:\n%s", filename, formatted)
+	}
+}
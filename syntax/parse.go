@@ -11,7 +11,12 @@ package syntax
 // package.  Verify that error positions are correct using the
 // chunkedfile mechanism.
 
-import "log"
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+)
 
 // Enable this flag to print the token stream and log.Fatal on the first error.
 const debug = false
@@ -30,18 +35,27 @@ const (
 // The type of the argument for the src parameter must be string,
 // []byte, or io.Reader.
 // If src == nil, ParseFile parses the file specified by filename.
+//
+// The parser does not stop at the first syntax error.  It skips to the
+// start of the next statement and continues, so that the error, an
+// ErrorList, reports all the syntax errors of the file.  In that case
+// Parse also returns the partial syntax tree, in which a BadStmt
+// replaces each statement that could not be parsed, and a BadExpr
+// each malformed element within brackets.
 func Parse(filename string, src interface{}, mode Mode) (f *File, err error) {
 	in, err := newScanner(filename, src, mode&RetainComments != 0)
 	if err != nil {
 		return nil, err
 	}
 	p := parser{in: in}
-	defer p.in.recover(&err)
+	defer p.recover(&err)
 
-	p.nextToken() // read first lookahead token
+	p.advance() // read first lookahead token
+	p.in.header = false
 	f = p.parseFile()
 	if f != nil {
 		f.Path = filename
+		f.Dialect = p.in.dialect
 	}
 	p.assignComments(f)
 	return f, nil
@@ -49,15 +63,17 @@ func Parse(filename string, src interface{}, mode Mode) (f *File, err error) {
 
 // ParseExpr parses a Starlark expression.
 // See Parse for explanation of parameters.
+// The error, if any, is an ErrorList; the expression is returned only
+// if the errors were confined to elements within brackets.
 func ParseExpr(filename string, src interface{}, mode Mode) (expr Expr, err error) {
 	in, err := newScanner(filename, src, mode&RetainComments != 0)
 	if err != nil {
 		return nil, err
 	}
 	p := parser{in: in}
-	defer p.in.recover(&err)
+	defer p.recover(&err)
 
-	p.nextToken() // read first lookahead token
+	p.advance() // read first lookahead token
 	expr = p.parseTest()
 
 	// A following newline (e.g. "f()\n") appears outside any brackets,
@@ -77,12 +93,16 @@ type parser struct {
 	in     *scanner
 	tok    Token
 	tokval tokenValue
+	last   Position  // position of the token before tok, or of tok after a scan error
+	errors ErrorList // errors from which the parser has recovered
 }
 
 // nextToken advances the scanner and returns the position of the
-// previous token.
+// previous token.  If the scanner reports an error, nextToken panics,
+// leaving the current token unchanged.
 func (p *parser) nextToken() Position {
 	oldpos := p.tokval.pos
+	p.last = oldpos
 	p.tok = p.in.nextToken(&p.tokval)
 	// enable to see the token stream
 	if debug {
@@ -104,13 +124,28 @@ func (p *parser) parseFile() *File {
 	return &File{Stmts: stmts}
 }
 
-func (p *parser) parseStmt(stmts []Stmt) []Stmt {
+// parseStmt parses a statement, or a line of simple statements, and
+// appends it to stmts.  If the statement contains a syntax error,
+// parseStmt records the error, skips to the start of the next
+// statement, and appends a BadStmt instead.
+func (p *parser) parseStmt(stmts []Stmt) (res []Stmt) {
+	from := p.tokval.pos
+	defer func() {
+		if e := recover(); e != nil {
+			p.recordError(e)
+			p.sync(from)
+			res = append(stmts, &BadStmt{From: from, To: p.tokval.pos, Text: p.in.text(from, p.tokval.pos)})
+		}
+	}()
+
 	if p.tok == DEF {
 		return append(stmts, p.parseDefStmt())
 	} else if p.tok == IF {
 		return append(stmts, p.parseIfStmt())
 	} else if p.tok == FOR {
 		return append(stmts, p.parseForStmt())
+	} else if p.tok == WHILE {
+		return append(stmts, p.parseWhileStmt())
 	}
 	return p.parseSimpleStmt(stmts)
 }
@@ -182,6 +217,18 @@ func (p *parser) parseForStmt() Stmt {
 	}
 }
 
+func (p *parser) parseWhileStmt() Stmt {
+	whilepos := p.nextToken() // consume WHILE
+	cond := p.parseTest()
+	p.consume(COLON)
+	body := p.parseSuite()
+	return &WhileStmt{
+		While: whilepos,
+		Cond:  cond,
+		Body:  body,
+	}
+}
+
 // Equivalent to 'exprlist' production in Python grammar.
 //
 // loop_variables = primary_with_suffix (COMMA primary_with_suffix)* COMMA?
@@ -223,11 +270,13 @@ func (p *parser) parseSimpleStmt(stmts []Stmt) []Stmt {
 	return stmts
 }
 
-// small_stmt = RETURN expr?
-//            | PASS | BREAK | CONTINUE
-//            | LOAD ...
-//            | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=') expr   // assign
-//            | expr
+// parseSmallStmt parses a small statement:
+//
+//	small_stmt = RETURN expr?
+//	           | PASS | BREAK | CONTINUE
+//	           | LOAD ...
+//	           | expr ('=' | '+=' | '-=' | '*=' | '/=' | '%=') expr   // assign
+//	           | expr
 func (p *parser) parseSmallStmt() Stmt {
 	switch p.tok {
 	case RETURN:
@@ -250,7 +299,8 @@ func (p *parser) parseSmallStmt() Stmt {
 	// Assignment
 	x := p.parseExpr(false)
 	switch p.tok {
-	case EQ, PLUS_EQ, MINUS_EQ, STAR_EQ, SLASH_EQ, SLASHSLASH_EQ, PERCENT_EQ:
+	case EQ, PLUS_EQ, MINUS_EQ, STAR_EQ, SLASH_EQ, SLASHSLASH_EQ, PERCENT_EQ,
+		AMP_EQ, PIPE_EQ, CIRCUMFLEX_EQ, LTLT_EQ, GTGT_EQ:
 		op := p.tok
 		pos := p.nextToken() // consume op
 		rhs := p.parseExpr(false)
@@ -363,20 +413,22 @@ func (p *parser) consume(t Token) Position {
 	return p.nextToken()
 }
 
-// params = (param COMMA)* param
-//        |
+// parseParams parses a parameter list:
+//
+//	params = (param COMMA)* param
+//	       |
 //
-// param = IDENT
-//       | IDENT EQ test
-//       | STAR IDENT
-//       | STARSTAR IDENT
+//	param = IDENT
+//	      | IDENT EQ test
+//	      | STAR IDENT
+//	      | STARSTAR IDENT
 //
-// parseParams parses a parameter list.  The resulting expressions are of the form:
+// The resulting expressions are of the form:
 //
-//      *Ident
-//      *Binary{Op: EQ, X: *Ident, Y: Expr}
-//      *Unary{Op: STAR, X: *Ident}
-//      *Unary{Op: STARSTAR, X: *Ident}
+//	*Ident
+//	*Binary{Op: EQ, X: *Ident, Y: Expr}
+//	*Unary{Op: STAR, X: *Ident}
+//	*Unary{Op: STARSTAR, X: *Ident}
 func (p *parser) parseParams() []Expr {
 	var params []Expr
 	stars := false
@@ -450,23 +502,34 @@ func (p *parser) parseExpr(inParens bool) Expr {
 	}
 
 	// tuple
-	exprs := p.parseExprs([]Expr{x}, inParens)
+	closer := ILLEGAL
+	if inParens {
+		closer = RPAREN
+	}
+	exprs := p.parseExprs([]Expr{x}, closer)
 	return &TupleExpr{List: exprs}
 }
 
 // parseExprs parses a comma-separated list of expressions, starting with the comma.
 // It is used to parse tuples and list elements.
+// closer is the token that closes the enclosing brackets, or ILLEGAL
+// if there are none.  A trailing comma is allowed only within
+// brackets, where each malformed element is replaced by a BadExpr.
 // expr_list = (',' expr)* ','?
-func (p *parser) parseExprs(exprs []Expr, allowTrailingComma bool) []Expr {
+func (p *parser) parseExprs(exprs []Expr, closer Token) []Expr {
 	for p.tok == COMMA {
 		pos := p.nextToken()
 		if terminatesExprList(p.tok) {
-			if !allowTrailingComma {
+			if closer == ILLEGAL {
 				p.in.error(pos, "unparenthesized tuple with trailing comma")
 			}
 			break
 		}
-		exprs = append(exprs, p.parseTest())
+		if closer != ILLEGAL {
+			exprs = append(exprs, p.parseElem(closer, p.parseTest))
+		} else {
+			exprs = append(exprs, p.parseTest())
+		}
 	}
 	return exprs
 }
@@ -588,17 +651,19 @@ var precedence [maxToken]int8
 
 // preclevels groups operators of equal precedence.
 // Comparisons are nonassociative; other binary operators associate to the left.
-// Unary MINUS and PLUS have higher precedence so are handled in parsePrimary.
+// Unary MINUS, PLUS and TILDE have higher precedence so are handled in parsePrimary.
 // See https://github.com/aabbtree77/determinism/blob/master/doc/spec.md#binary-operators
 var preclevels = [...][]Token{
-	{OR},  // or
-	{AND}, // and
-	{NOT}, // not (unary)
+	{OR},                                   // or
+	{AND},                                  // and
+	{NOT},                                  // not (unary)
 	{EQL, NEQ, LT, GT, LE, GE, IN, NOT_IN}, // == != < > <= >= in not in
-	{PIPE},                             // |
-	{AMP},                              // &
-	{MINUS, PLUS},                      // -
-	{STAR, PERCENT, SLASH, SLASHSLASH}, // * % / //
+	{PIPE},                                 // |
+	{CIRCUMFLEX},                           // ^
+	{AMP},                                  // &
+	{LTLT, GTGT},                           // << >>
+	{MINUS, PLUS},                          // -
+	{STAR, PERCENT, SLASH, SLASHSLASH},     // * % / //
 }
 
 func init() {
@@ -631,10 +696,12 @@ func makeBinaryExpr(op Token, pos Position, x, y Expr) Expr {
 	return &BinaryExpr{OpPos: pos, Op: op, X: x, Y: y}
 }
 
-// primary_with_suffix = primary
-//                     | primary '.' IDENT
-//                     | primary slice_suffix
-//                     | primary call_suffix
+// parsePrimaryWithSuffix parses a primary expression and its suffixes:
+//
+//	primary_with_suffix = primary
+//	                    | primary '.' IDENT
+//	                    | primary slice_suffix
+//	                    | primary call_suffix
 func (p *parser) parsePrimaryWithSuffix() Expr {
 	x := p.parsePrimary()
 	for {
@@ -707,81 +774,87 @@ func (p *parser) parseArgs() []Expr {
 	var args []Expr
 	stars := false
 	for p.tok != RPAREN && p.tok != EOF {
-		if len(args) > 0 {
-			p.consume(COMMA)
-		}
-		if p.tok == RPAREN {
-			// list can end with a COMMA if there is neither * nor **
-			if stars {
-				p.in.errorf(p.in.pos, `got %#v, want argument`, p.tok)
+		first := len(args) == 0
+		arg := p.parseElem(RPAREN, func() Expr {
+			if !first {
+				p.consume(COMMA)
+			}
+			if p.tok == RPAREN {
+				// list can end with a COMMA if there is neither * nor **
+				if stars {
+					p.in.errorf(p.in.pos, `got %#v, want argument`, p.tok)
+				}
+				return nil
 			}
-			break
-		}
 
-		// *args
-		if p.tok == STAR {
-			stars = true
-			pos := p.nextToken()
-			x := p.parseTest()
-			args = append(args, &UnaryExpr{
-				OpPos: pos,
-				Op:    STAR,
-				X:     x,
-			})
-			continue
-		}
+			// *args
+			if p.tok == STAR {
+				stars = true
+				pos := p.nextToken()
+				x := p.parseTest()
+				return &UnaryExpr{
+					OpPos: pos,
+					Op:    STAR,
+					X:     x,
+				}
+			}
 
-		// **kwargs
-		if p.tok == STARSTAR {
-			stars = true
-			pos := p.nextToken()
-			x := p.parseTest()
-			args = append(args, &UnaryExpr{
-				OpPos: pos,
-				Op:    STARSTAR,
-				X:     x,
-			})
-			continue
-		}
+			// **kwargs
+			if p.tok == STARSTAR {
+				stars = true
+				pos := p.nextToken()
+				x := p.parseTest()
+				return &UnaryExpr{
+					OpPos: pos,
+					Op:    STARSTAR,
+					X:     x,
+				}
+			}
 
-		// We use a different strategy from Bazel here to stay within LL(1).
-		// Instead of looking ahead two tokens (IDENT, EQ) we parse
-		// 'test = test' then check that the first was an IDENT.
-		x := p.parseTest()
+			// We use a different strategy from Bazel here to stay within LL(1).
+			// Instead of looking ahead two tokens (IDENT, EQ) we parse
+			// 'test = test' then check that the first was an IDENT.
+			x := p.parseTest()
 
-		if p.tok == EQ {
-			// name = value
-			if _, ok := x.(*Ident); !ok {
-				p.in.errorf(p.in.pos, "keyword argument must have form name=expr")
-			}
-			eq := p.nextToken()
-			y := p.parseTest()
-			x = &BinaryExpr{
-				X:     x,
-				OpPos: eq,
-				Op:    EQ,
-				Y:     y,
+			if p.tok == EQ {
+				// name = value
+				if _, ok := x.(*Ident); !ok {
+					p.in.errorf(p.in.pos, "keyword argument must have form name=expr")
+				}
+				eq := p.nextToken()
+				y := p.parseTest()
+				x = &BinaryExpr{
+					X:     x,
+					OpPos: eq,
+					Op:    EQ,
+					Y:     y,
+				}
 			}
+			return x
+		})
+		if arg == nil {
+			break // trailing comma
 		}
-
-		args = append(args, x)
+		args = append(args, arg)
 	}
 	return args
 }
 
-//  primary = IDENT
-//          | INT | FLOAT
-//          | STRING
-//          | '[' ...                    // list literal or comprehension
-//          | '{' ...                    // dict literal or comprehension
-//          | '(' ...                    // tuple or parenthesized expression
-//          | ('-'|'+') primary_with_suffix
+// parsePrimary parses a primary expression:
+//
+//	primary = IDENT
+//	        | INT | FLOAT
+//	        | STRING | BYTES
+//	        | '[' ...                    // list literal or comprehension
+//	        | '{' ...                    // dict literal or comprehension
+//	        | '(' ...                    // tuple or parenthesized expression
+//	        | ('-'|'+') primary_with_suffix
 func (p *parser) parsePrimary() Expr {
 	switch p.tok {
 	case IDENT:
 		return p.parseIdent()
 
-	case INT, FLOAT, STRING:
+	case INT, FLOAT, STRING, BYTES:
 		var val interface{}
 		tok := p.tok
 		switch tok {
@@ -793,7 +866,7 @@ func (p *parser) parsePrimary() Expr {
 			}
 		case FLOAT:
 			val = p.tokval.float
-		case STRING:
+		case STRING, BYTES:
 			val = p.tokval.string
 		}
 		raw := p.tokval.raw
@@ -821,8 +894,8 @@ func (p *parser) parsePrimary() Expr {
 			Rparen: rparen,
 		}
 
-	case MINUS, PLUS:
-		// unary minus/plus:
+	case MINUS, PLUS, TILDE:
+		// unary minus/plus/complement:
 		tok := p.tok
 		pos := p.nextToken()
 		x := p.parsePrimaryWithSuffix()
@@ -836,10 +909,12 @@ func (p *parser) parsePrimary() Expr {
 	panic("unreachable")
 }
 
-// list = '[' ']'
-//      | '[' expr ']'
-//      | '[' expr expr_list ']'
-//      | '[' expr (FOR loop_variables IN expr)+ ']'
+// parseList parses a list literal or comprehension:
+//
+//	list = '[' ']'
+//	     | '[' expr ']'
+//	     | '[' expr expr_list ']'
+//	     | '[' expr (FOR loop_variables IN expr)+ ']'
 func (p *parser) parseList() Expr {
 	lbrack := p.nextToken()
 	if p.tok == RBRACK {
@@ -858,16 +933,18 @@ func (p *parser) parseList() Expr {
 	exprs := []Expr{x}
 	if p.tok == COMMA {
 		// multi-item list literal
-		exprs = p.parseExprs(exprs, true) // allow trailing comma
+		exprs = p.parseExprs(exprs, RBRACK) // allow trailing comma
 	}
 
 	rbrack := p.consume(RBRACK)
 	return &ListExpr{Lbrack: lbrack, List: exprs, Rbrack: rbrack}
 }
 
-// dict = '{' '}'
-//      | '{' dict_entry_list '}'
-//      | '{' dict_entry FOR loop_variables IN expr '}'
+// parseDict parses a dict literal or comprehension:
+//
+//	dict = '{' '}'
+//	     | '{' dict_entry_list '}'
+//	     | '{' dict_entry FOR loop_variables IN expr '}'
 func (p *parser) parseDict() Expr {
 	lbrace := p.nextToken()
 	if p.tok == RBRACE {
@@ -904,9 +981,11 @@ func (p *parser) parseDictEntry() *DictEntry {
 	return &DictEntry{Key: k, Colon: colon, Value: v}
 }
 
-// comp_suffix = FOR loopvars IN expr comp_suffix
-//             | IF expr comp_suffix
-//             | ']'  or  ')'                              (end)
+// parseComprehensionSuffix parses the clauses of a comprehension:
+//
+//	comp_suffix = FOR loopvars IN expr comp_suffix
+//	            | IF expr comp_suffix
+//	            | ']'  or  ')'                              (end)
 //
 // There can be multiple FOR/IF clauses; the first is always a FOR.
 func (p *parser) parseComprehensionSuffix(lbrace Position, body Expr, endBrace Token) Expr {
@@ -951,6 +1030,178 @@ func terminatesExprList(tok Token) bool {
 	return false
 }
 
+// Error recovery.
+
+// An ErrorList is a non-empty list of syntax errors.
+type ErrorList []Error // len > 0
+
+// Error returns the messages of all the errors, one per line.
+func (e ErrorList) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// recover is like scanner.recover, but it reports a syntax error
+// along with those recorded during error recovery, as an ErrorList.
+func (p *parser) recover(err *error) {
+	switch e := recover().(type) {
+	case nil:
+		if len(p.errors) > 0 {
+			*err = p.errors
+		}
+	case Error:
+		*err = append(p.errors, e)
+	case bailout:
+		*err = p.errors
+	default:
+		*err = Error{p.in.pos, fmt.Sprintf("internal error: %v", e)}
+		if debug {
+			log.Fatal(*err)
+		}
+	}
+}
+
+// A bailout panic abandons the current statement after its error
+// has been recorded.
+type bailout struct{}
+
+// recordError records the syntax error e, the value of a recovered
+// panic, or re-panics if e is not a syntax error.
+func (p *parser) recordError(e interface{}) {
+	switch e := e.(type) {
+	case Error:
+		p.errors = append(p.errors, e)
+	case bailout:
+		// already recorded
+	default:
+		panic(e)
+	}
+}
+
+// advance is like nextToken, but in case of a scanner error, it
+// records the error and continues with the following token.
+func (p *parser) advance() {
+	for {
+		rest := len(p.in.rest)
+		err := func() (err interface{}) {
+			defer func() { err = recover() }()
+			p.nextToken()
+			return nil
+		}()
+		if err == nil {
+			return
+		}
+		p.recordError(err)
+		if len(p.in.rest) == rest && !p.in.eof() {
+			p.in.readRune() // ensure progress
+		}
+	}
+}
+
+// sync skips tokens after a syntax error in the statement starting
+// at from, until the start of the next statement: the token following
+// a NEWLINE, or the OUTDENT or EOF that ends the current block.
+// A block that follows the erroneous line, such as the body of a def
+// statement with a malformed header, is skipped too, as are the elif
+// and else clauses of an if statement.
+//
+// If the statement has an unclosed bracket, the scanner reports no
+// NEWLINE, so sync instead assumes that the next statement begins
+// with the first line indented no further than the statement itself,
+// unless it starts with a closing bracket.
+func (p *parser) sync(from Position) {
+	depth := 0 // of INDENTs skipped
+	line := p.last.Line
+	for p.tok != EOF {
+		pos := p.tokval.pos
+		if p.in.depth > 0 && pos.Line > line && pos.Col <= from.Col &&
+			p.tok != RPAREN && p.tok != RBRACK && p.tok != RBRACE {
+			p.in.restartLine(pos)
+			p.advance()
+			if p.tok != INDENT {
+				return
+			}
+		}
+		line = pos.Line
+
+		switch p.tok {
+		case INDENT:
+			depth++
+		case OUTDENT:
+			if depth == 0 {
+				return
+			}
+			depth--
+			if depth == 0 {
+				p.advance()
+				if p.tok != ELIF && p.tok != ELSE {
+					return
+				}
+				continue
+			}
+		case NEWLINE:
+			if depth == 0 {
+				p.advance()
+				if p.tok != INDENT {
+					return
+				}
+				continue
+			}
+		}
+		p.advance()
+	}
+}
+
+// parseElem calls parse to parse an element of a bracketed list,
+// which closer closes.  If the element contains a syntax error,
+// parseElem records the error, skips to the next comma or to closer,
+// and returns a BadExpr.  It skips other closing brackets that have
+// no opening bracket in the element, so that the caller, which stops
+// only at closer, makes progress.  If closer is missing, parseElem
+// abandons the enclosing statement too.
+func (p *parser) parseElem(closer Token, parse func() Expr) (x Expr) {
+	from := p.tokval.pos
+	defer func() {
+		e := recover()
+		if e == nil {
+			return
+		}
+		if _, ok := e.(Error); !ok {
+			panic(e)
+		}
+		p.recordError(e)
+		depth := 0 // of brackets skipped
+	skip:
+		for p.tok != EOF {
+			switch p.tok {
+			case LPAREN, LBRACK, LBRACE:
+				depth++
+			case RPAREN, RBRACK, RBRACE:
+				if depth == 0 {
+					if p.tok == closer {
+						break skip
+					}
+					break // an unmatched closing bracket: skip it
+				}
+				depth--
+			case COMMA:
+				if depth == 0 {
+					break skip
+				}
+			}
+			p.advance()
+		}
+		if p.tok == EOF {
+			panic(bailout{})
+		}
+		x = &BadExpr{From: from, To: p.tokval.pos, Text: p.in.text(from, p.tokval.pos)}
+	}()
+	return parse()
+}
+
 // Comment assignment.
 // We build two lists of all subnodes, preorder and postorder.
 // The preorder list is ordered by start location, with outer nodes first.
@@ -973,6 +1224,13 @@ func flattenAST(root Node) (pre, post []Node) {
 		}
 		return true
 	})
+
+	// Walk does not always visit children in source order
+	// (for example, it visits the RHS of an assignment first),
+	// so sort the lists, preserving the order of nested nodes
+	// that start or end at the same position.
+	sort.SliceStable(pre, func(i, j int) bool { return Start(pre[i]).isBefore(Start(pre[j])) })
+	sort.SliceStable(post, func(i, j int) bool { return End(post[i]).isBefore(End(post[j])) })
 	return pre, post
 }
 
@@ -985,8 +1243,39 @@ func (p *parser) assignComments(n Node) {
 
 	pre, post := flattenAST(n)
 
+	// Comments among the tokens skipped by a bad node are part of
+	// its Text.
+	var bad []Node
+	for _, x := range pre {
+		switch x.(type) {
+		case *BadStmt, *BadExpr:
+			bad = append(bad, x)
+		}
+	}
+	skipped := func(c Comment) bool {
+		for _, x := range bad {
+			from, to := x.Span()
+			if !c.Start.isBefore(from) && c.Start.isBefore(to) {
+				return true
+			}
+		}
+		return false
+	}
+	unskipped := func(list []Comment) []Comment {
+		if len(bad) == 0 {
+			return list
+		}
+		var res []Comment
+		for _, c := range list {
+			if !skipped(c) {
+				res = append(res, c)
+			}
+		}
+		return res
+	}
+
 	// Assign line comments to syntax immediately following.
-	line := p.in.lineComments
+	line := unskipped(p.in.lineComments)
 	for _, x := range pre {
 		start, _ := x.Span()
 
@@ -1009,7 +1298,7 @@ func (p *parser) assignComments(n Node) {
 	}
 
 	// Assign suffix comments to syntax immediately before.
-	suffix := p.in.suffixComments
+	suffix := unskipped(p.in.suffixComments)
 	for i := len(post) - 1; i >= 0; i-- {
 		x := post[i]
 
@@ -1020,7 +1309,7 @@ func (p *parser) assignComments(n Node) {
 		}
 
 		_, end := x.Span()
-		if len(suffix) > 0 && end.isBefore(suffix[len(suffix)-1].Start) {
+		for len(suffix) > 0 && end.isBefore(suffix[len(suffix)-1].Start) {
 			x.AllocComments()
 			x.Comments().Suffix = append(x.Comments().Suffix, suffix[len(suffix)-1])
 			suffix = suffix[:len(suffix)-1]
@@ -26,6 +26,16 @@ func TestExprParseTrees(t *testing.T) {
 			`(CallExpr Fn=print Args=(1))`},
 		{`x + 1`,
 			`(BinaryExpr X=x Op=+ Y=1)`},
+		{`b"a" + "b"`,
+			`(BinaryExpr X=b"a" Op=+ Y="b")`},
+		{`~x`,
+			`(UnaryExpr Op=~ X=x)`},
+		{`a | b ^ c & d << e + f`,
+			`(BinaryExpr X=a Op=| Y=(BinaryExpr X=b Op=^ Y=(BinaryExpr X=c Op=& Y=(BinaryExpr X=d Op=<< Y=(BinaryExpr X=e Op=+ Y=f)))))`},
+		{`a >> b << c`,
+			`(BinaryExpr X=(BinaryExpr X=a Op=>> Y=b) Op=<< Y=c)`},
+		{`~a & -b`,
+			`(BinaryExpr X=(UnaryExpr Op=~ X=a) Op=& Y=(UnaryExpr Op=- X=b))`},
 		{`[x for x in y]`,
 			`(Comprehension Body=x Clauses=((ForClause Vars=x X=y)))`},
 		{`[x for x in (a if b else c)]`,
@@ -135,6 +145,10 @@ func TestStmtParseTrees(t *testing.T) {
 			`(ForStmt Vars=i X="abc" Body=((BranchStmt Token=continue)))`},
 		{`for x, y in z: pass`,
 			`(ForStmt Vars=(TupleExpr List=(x y)) X=z Body=((BranchStmt Token=pass)))`},
+		{`while x: pass`,
+			`(WhileStmt Cond=x Body=((BranchStmt Token=pass)))`},
+		{`while x < y: break`,
+			`(WhileStmt Cond=(BinaryExpr X=x Op=< Y=y) Body=((BranchStmt Token=break)))`},
 		{`if True: pass`,
 			`(IfStmt Cond=True True=((BranchStmt Token=pass)))`},
 		{`if True: break`,
@@ -153,6 +167,10 @@ else:
 			`(AssignStmt Op== LHS=(IndexExpr X=x Y=i) RHS=1)`},
 		{`x.f = 1`,
 			`(AssignStmt Op== LHS=(DotExpr X=x Name=f) RHS=1)`},
+		{`x <<= 1`,
+			`(AssignStmt Op=<<= LHS=x RHS=1)`},
+		{`x ^= y`,
+			`(AssignStmt Op=^= LHS=x RHS=y)`},
 		{`(x, y) = 1`,
 			`(AssignStmt Op== LHS=(ParenExpr X=(TupleExpr List=(x y))) RHS=1)`},
 		{`load("", "a", b="c")`,
@@ -276,6 +294,8 @@ func writeTree(out *bytes.Buffer, x reflect.Value) {
 		case syntax.Literal:
 			if v.Token == syntax.STRING {
 				fmt.Fprintf(out, "%q", v.Value)
+			} else if v.Token == syntax.BYTES {
+				fmt.Fprintf(out, "b%q", v.Value)
 			} else if v.Token == syntax.INT {
 				fmt.Fprintf(out, "%d", v.Value)
 			}
@@ -338,8 +358,10 @@ func TestParseErrors(t *testing.T) {
 		switch err := err.(type) {
 		case nil:
 			// ok
-		case syntax.Error:
-			chunk.GotError(int(err.Pos.Line), err.Msg)
+		case syntax.ErrorList:
+			for _, err := range err {
+				chunk.GotError(int(err.Pos.Line), err.Msg)
+			}
 		default:
 			t.Error(err)
 		}
@@ -347,6 +369,66 @@ func TestParseErrors(t *testing.T) {
 	}
 }
 
+// TestParseErrorRecovery ensures that the parser terminates, and
+// reports the right errors, when a closing bracket does not match the
+// list that it ends.
+func TestParseErrorRecovery(t *testing.T) {
+	for _, test := range []struct{ src, want string }{
+		{"f(])", "a.star:1:4: got ']', want primary expression\na.star:1:4: indentation error"},
+		{"f(x])", "a.star:1:5: got ']', want ','\na.star:1:5: indentation error"},
+		{`f([\])`, "a.star:1:5: stray backslash in program"},
+		{`f([x for x \in y])`, "a.star:1:13: stray backslash in program"},
+		{"[1, ), 2]", "a.star:1:6: got ')', want ']'\na.star:1:9: indentation error"},
+		{"x = (1, ], 2)\ny = 2", "a.star:1:10: got ']', want ')'\na.star:1:13: indentation error"},
+	} {
+		_, err := syntax.Parse("a.star", test.src, 0)
+		if got := fmt.Sprint(err); got != test.want {
+			t.Errorf("Parse(%q) = %q, want %q", test.src, got, test.want)
+		}
+	}
+}
+
+// TestParseUnclosedBracket ensures that the statements following an
+// unclosed bracket survive it, as do their errors.
+func TestParseUnclosedBracket(t *testing.T) {
+	const src = "x = [1, 2\ny = 3\nz = *\nw = 4\n"
+	f, err := syntax.Parse("a.star", src, 0)
+	want := "a.star:2:2: got identifier, want ']'\na.star:3:6: got '*', want primary expression"
+	if got := fmt.Sprint(err); got != want {
+		t.Errorf("Parse(%q) = %q, want %q", src, got, want)
+	}
+	if f == nil {
+		t.Fatalf("Parse(%q) returned no tree", src)
+	}
+	var got []string
+	for _, stmt := range f.Stmts {
+		got = append(got, fmt.Sprintf("%T", stmt))
+	}
+	if want := "[*syntax.BadStmt *syntax.AssignStmt *syntax.BadStmt *syntax.AssignStmt]"; fmt.Sprint(got) != want {
+		t.Errorf("Parse(%q) statements = %v, want %s", src, got, want)
+	}
+}
+
+func TestDialectPragma(t *testing.T) {
+	const src = `#!/usr/bin/env starlark
+# dialect: lambda,  set
+#dialect:float
+x = 1
+# dialect: while
+`
+	f, err := syntax.Parse("a.star", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, id := range f.Dialect {
+		got = append(got, fmt.Sprintf("%s@%d:%d", id.Name, id.NamePos.Line, id.NamePos.Col))
+	}
+	if want := "[lambda@2:12 set@2:21 float@3:10]"; fmt.Sprint(got) != want {
+		t.Errorf("Dialect = %v, want %s", got, want)
+	}
+}
+
 func TestWalk(t *testing.T) {
 	const src = `
 for x in y:
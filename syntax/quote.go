@@ -49,14 +49,21 @@ var esc = [256]byte{
 const notEsc = " !#$%&()*+,-./:;<=>?@ABCDEFGHIJKLMNOPQRSTUVWXYZ{|}~"
 
 // unquote unquotes the quoted string, returning the actual
-// string value, whether the original was triple-quoted, and
+// string value, whether the original was triple-quoted,
+// whether it was a byte string literal, and
 // an error describing invalid input.
-func unquote(quoted string) (s string, triple bool, err error) {
-	// Check for raw prefix: means don't interpret the inner \.
+func unquote(quoted string) (s string, triple, isByte bool, err error) {
+	// Check for raw and byte prefixes, in either order.
+	// A raw prefix means don't interpret the inner \.
 	raw := false
-	if strings.HasPrefix(quoted, "r") {
-		raw = true
-		quoted = quoted[1:]
+	for i := 0; i < 2 && len(quoted) > 0; i++ {
+		if !raw && quoted[0] == 'r' {
+			raw = true
+			quoted = quoted[1:]
+		} else if !isByte && quoted[0] == 'b' {
+			isByte = true
+			quoted = quoted[1:]
+		}
 	}
 
 	if len(quoted) < 2 {
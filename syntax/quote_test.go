@@ -46,6 +46,11 @@ world"""`, "hello\nworld", true},
 		"cat $(SRCS) | grep '\\s*ip_block:' | sed -e 's/\\s*ip_block: \"\\([^ ]*\\)\"/    '\\1',/g' >> $@; ",
 		true,
 	},
+	{`b"hello"`, `hello`, false},
+	{`b'\x00\xff'`, "\x00\xff", false},
+	{`rb"\x00"`, `\x00`, false},
+	{`br'\x00'`, `\x00`, false},
+	{`b"""a"b"""`, `a"b`, false},
 }
 
 func TestQuote(t *testing.T) {
@@ -62,10 +67,12 @@ func TestQuote(t *testing.T) {
 
 func TestUnquote(t *testing.T) {
 	for _, tt := range quoteTests {
-		s, triple, err := unquote(tt.q)
-		wantTriple := strings.HasPrefix(tt.q, `"""`) || strings.HasPrefix(tt.q, `'''`)
-		if s != tt.s || triple != wantTriple || err != nil {
-			t.Errorf("unquote(%s) = %#q, %v, %v want %#q, %v, nil", tt.q, s, triple, err, tt.s, wantTriple)
+		s, triple, isByte, err := unquote(tt.q)
+		q := strings.TrimLeft(tt.q, "rb")
+		wantTriple := strings.HasPrefix(q, `"""`) || strings.HasPrefix(q, `'''`)
+		wantByte := strings.Contains(tt.q[:len(tt.q)-len(q)], "b")
+		if s != tt.s || triple != wantTriple || isByte != wantByte || err != nil {
+			t.Errorf("unquote(%s) = %#q, %v, %v, %v want %#q, %v, %v, nil", tt.q, s, triple, isByte, err, tt.s, wantTriple, wantByte)
 		}
 	}
 }
@@ -34,6 +34,7 @@ const (
 	INT    // 123
 	FLOAT  // 1.23e45
 	STRING // "foo" or 'foo' or '''foo''' or r'foo' or r"foo"
+	BYTES  // b"foo", etc
 
 	// Punctuation
 	PLUS          // +
@@ -44,6 +45,10 @@ const (
 	PERCENT       // %
 	AMP           // &
 	PIPE          // |
+	CIRCUMFLEX    // ^
+	LTLT          // <<
+	GTGT          // >>
+	TILDE         // ~
 	DOT           // .
 	COMMA         // ,
 	EQ            // =
@@ -61,12 +66,17 @@ const (
 	LE            // <=
 	EQL           // ==
 	NEQ           // !=
-	PLUS_EQ       // +=    (keep order consistent with PLUS..PERCENT)
+	PLUS_EQ       // +=    (keep order consistent with PLUS..GTGT)
 	MINUS_EQ      // -=
 	STAR_EQ       // *=
 	SLASH_EQ      // /=
 	SLASHSLASH_EQ // //=
 	PERCENT_EQ    // %=
+	AMP_EQ        // &=
+	PIPE_EQ       // |=
+	CIRCUMFLEX_EQ // ^=
+	LTLT_EQ       // <<=
+	GTGT_EQ       // >>=
 	STARSTAR      // **
 
 	// Keywords
@@ -86,6 +96,7 @@ const (
 	OR
 	PASS
 	RETURN
+	WHILE
 
 	maxToken
 )
@@ -111,6 +122,7 @@ var tokenNames = [...]string{
 	INT:           "int literal",
 	FLOAT:         "float literal",
 	STRING:        "string literal",
+	BYTES:         "bytes literal",
 	PLUS:          "+",
 	MINUS:         "-",
 	STAR:          "*",
@@ -119,6 +131,10 @@ var tokenNames = [...]string{
 	PERCENT:       "%",
 	AMP:           "&",
 	PIPE:          "|",
+	CIRCUMFLEX:    "^",
+	LTLT:          "<<",
+	GTGT:          ">>",
+	TILDE:         "~",
 	DOT:           ".",
 	COMMA:         ",",
 	EQ:            "=",
@@ -142,6 +158,11 @@ var tokenNames = [...]string{
 	SLASH_EQ:      "/=",
 	SLASHSLASH_EQ: "//=",
 	PERCENT_EQ:    "%=",
+	AMP_EQ:        "&=",
+	PIPE_EQ:       "|=",
+	CIRCUMFLEX_EQ: "^=",
+	LTLT_EQ:       "<<=",
+	GTGT_EQ:       ">>=",
 	STARSTAR:      "**",
 	AND:           "and",
 	BREAK:         "break",
@@ -159,6 +180,7 @@ var tokenNames = [...]string{
 	OR:            "or",
 	PASS:          "pass",
 	RETURN:        "return",
+	WHILE:         "while",
 }
 
 // A Position describes the location of a rune of input.
@@ -168,6 +190,9 @@ type Position struct {
 	Col  int32   // 1-based column number (strictly: rune)
 }
 
+// MakePosition returns position with the specified components.
+func MakePosition(file *string, line, col int32) Position { return Position{file, line, col} }
+
 // IsValid reports whether the position is valid.
 func (p Position) IsValid() bool {
 	return p.Line >= 1
@@ -212,10 +237,14 @@ type scanner struct {
 	depth          int       // nesting of [ ] { } ( )
 	indentstk      []int     // stack of indentation levels
 	dents          int       // number of saved INDENT (>0) or OUTDENT (<0) tokens to return
+	eofIndentstk   []int     // indentstk before the OUTDENTs at end of file, for restartLine
 	lineStart      bool      // after NEWLINE; convert spaces to indentation tokens
 	keepComments   bool      // accumulate comments in slice
 	lineComments   []Comment // list of full line comments (if keepComments)
 	suffixComments []Comment // list of suffix comments (if keepComments)
+	header         bool      // no token has been scanned yet
+	dialect        []*Ident  // features named by dialect pragmas in the header
+	lines          []int     // offset of the start of each line, computed by offset
 }
 
 func newScanner(filename string, src interface{}, keepComments bool) (*scanner, error) {
@@ -230,6 +259,7 @@ func newScanner(filename string, src interface{}, keepComments bool) (*scanner,
 		indentstk:    make([]int, 1, 10), // []int{0} + spare capacity
 		lineStart:    true,
 		keepComments: keepComments,
+		header:       true,
 	}, nil
 }
 
@@ -373,6 +403,84 @@ func (sc *scanner) endToken(val *tokenValue) {
 	}
 }
 
+// text returns the source text from position from up to position to,
+// without trailing spaces and newlines.
+func (sc *scanner) text(from, to Position) string {
+	start, end := sc.offset(from), sc.offset(to)
+	if end < start {
+		end = start
+	}
+	return strings.TrimRight(string(sc.complete[start:end]), " \t\r\n")
+}
+
+// offset returns the byte offset of position pos in the input.
+func (sc *scanner) offset(pos Position) int {
+	if sc.lines == nil {
+		sc.lines = []int{0}
+		for i, b := range sc.complete {
+			if b == '\n' || b == '\r' && (i+1 == len(sc.complete) || sc.complete[i+1] != '\n') {
+				sc.lines = append(sc.lines, i+1)
+			}
+		}
+	}
+	if pos.Line < 1 {
+		return 0
+	}
+	if int(pos.Line) > len(sc.lines) {
+		return len(sc.complete)
+	}
+	i := sc.lines[pos.Line-1]
+	for col := int32(1); col < pos.Col && i < len(sc.complete); col++ {
+		_, size := utf8.DecodeRune(sc.complete[i:])
+		i += size
+	}
+	return i
+}
+
+// restartLine resumes scanning at the start of the line of the
+// current token, at position pos, as if outside any brackets.
+// The parser uses it to recover from an unclosed bracket.
+//
+// Within brackets, only the end of file changes the indentation state,
+// so restartLine undoes its OUTDENTs; the line's own indentation is
+// computed afresh.
+func (sc *scanner) restartLine(pos Position) {
+	start := len(sc.complete) - len(sc.token)
+	for start > 0 && sc.complete[start-1] != '\n' {
+		start--
+	}
+	sc.rest = sc.complete[start:]
+	sc.pos = Position{file: pos.file, Line: pos.Line, Col: 1}
+	sc.depth = 0
+	sc.lineStart = true
+	if sc.eofIndentstk != nil {
+		sc.indentstk = sc.eofIndentstk
+		sc.eofIndentstk = nil
+	}
+	sc.dents = 0
+}
+
+// scanPragma records the features named by a comment of the form
+// "# dialect: a, b, c" starting at pos.  Other comments are ignored.
+func (sc *scanner) scanPragma(pos Position, text []byte) {
+	const prefix = "dialect:"
+	s := strings.TrimLeft(string(text[1:]), " \t")
+	if !strings.HasPrefix(s, prefix) {
+		return
+	}
+	offset := len(text) - len(s) + len(prefix)
+	for _, field := range strings.Split(s[len(prefix):], ",") {
+		lead := len(field) - len(strings.TrimLeft(field, " \t"))
+		if name := strings.TrimSpace(field); name != "" {
+			sc.dialect = append(sc.dialect, &Ident{
+				NamePos: pos.add(string(text[:offset+lead])),
+				Name:    name,
+			})
+		}
+		offset += len(field) + 1
+	}
+}
+
 // nextToken is called by the parser to obtain the next input token.
 // It returns the token value and sets val to the data associated with
 // the token.
@@ -476,11 +584,15 @@ start:
 		if sc.keepComments {
 			sc.startToken(val)
 		}
+		pos, text := sc.pos, sc.rest
 		// Consume up to newline (included).
 		for c != 0 && c != '\n' {
 			sc.readRune()
 			c = sc.peekRune()
 		}
+		if sc.header && blank {
+			sc.scanPragma(pos, text[:len(text)-len(sc.rest)])
+		}
 		if sc.keepComments {
 			sc.endToken(val)
 			if blank {
@@ -512,6 +624,9 @@ start:
 		// preceded by a NEWLINE if we haven't just emitted one.
 		if len(sc.indentstk) > 1 {
 			if savedLineStart {
+				if sc.eofIndentstk == nil {
+					sc.eofIndentstk = sc.indentstk
+				}
 				sc.dents = 1 - len(sc.indentstk)
 				sc.indentstk = sc.indentstk[1:]
 				goto start
@@ -555,11 +670,19 @@ start:
 
 	// identifier or keyword
 	if isIdentStart(c) {
-		// raw string literal
-		if c == 'r' && len(sc.rest) > 1 && (sc.rest[1] == '"' || sc.rest[1] == '\'') {
-			sc.readRune()
-			c = sc.peekRune()
-			return sc.scanString(val, c)
+		// raw string literal, or byte string literal (maybe raw)
+		if c == 'r' || c == 'b' {
+			n := 1 // length of prefix
+			if len(sc.rest) > 1 && (sc.rest[1] == 'r' || sc.rest[1] == 'b') && sc.rest[1] != sc.rest[0] {
+				n = 2 // rb or br
+			}
+			if len(sc.rest) > n && (sc.rest[n] == '"' || sc.rest[n] == '\'') {
+				for i := 0; i < n; i++ {
+					sc.readRune()
+				}
+				c = sc.peekRune()
+				return sc.scanString(val, c)
+			}
 		}
 
 		for isIdent(c) {
@@ -592,7 +715,9 @@ start:
 
 	case ']', ')', '}':
 		if sc.depth == 0 {
-			sc.error(sc.pos, "indentation error")
+			pos := sc.pos
+			sc.readRune() // skip it, for error recovery
+			sc.error(pos, "indentation error")
 		} else {
 			sc.depth--
 		}
@@ -617,9 +742,24 @@ start:
 	// other punctuation
 	defer sc.endToken(val)
 	switch c {
-	case '=', '<', '>', '!', '+', '-', '%', '/': // possibly followed by '='
+	case '=', '<', '>', '!', '+', '-', '%', '/', '&', '|', '^': // possibly followed by '='
 		start := sc.pos
 		sc.readRune()
+		if (c == '<' || c == '>') && sc.peekRune() == c {
+			// shift operator: << or >>, possibly followed by '='
+			sc.readRune()
+			if sc.peekRune() == '=' {
+				sc.readRune()
+				if c == '<' {
+					return LTLT_EQ
+				}
+				return GTGT_EQ
+			}
+			if c == '<' {
+				return LTLT
+			}
+			return GTGT
+		}
 		if sc.peekRune() == '=' {
 			sc.readRune()
 			switch c {
@@ -639,6 +779,12 @@ start:
 				return SLASH_EQ
 			case '%':
 				return PERCENT_EQ
+			case '&':
+				return AMP_EQ
+			case '|':
+				return PIPE_EQ
+			case '^':
+				return CIRCUMFLEX_EQ
 			}
 		}
 		switch c {
@@ -667,20 +813,24 @@ start:
 			return SLASH
 		case '%':
 			return PERCENT
+		case '&':
+			return AMP
+		case '|':
+			return PIPE
+		case '^':
+			return CIRCUMFLEX
 		}
 		panic("unreachable")
 
-	case ':', ';', '|', '&': // single-char tokens (except comma)
+	case ':', ';', '~': // single-char tokens (except comma)
 		sc.readRune()
 		switch c {
 		case ':':
 			return COLON
 		case ';':
 			return SEMI
-		case '|':
-			return PIPE
-		case '&':
-			return AMP
+		case '~':
+			return TILDE
 		}
 		panic("unreachable")
 
@@ -697,7 +847,9 @@ start:
 		return STAR
 	}
 
-	sc.errorf(sc.pos, "unexpected input character %#q", c)
+	pos := sc.pos
+	sc.readRune() // skip it, for error recovery
+	sc.errorf(pos, "unexpected input character %#q", c)
 	panic("unreachable")
 }
 
@@ -715,10 +867,11 @@ func (sc *scanner) scanString(val *tokenValue, quote rune) Token {
 		if sc.eof() {
 			sc.error(val.pos, "unexpected EOF in string")
 		}
-		c := sc.readRune()
-		if c == '\n' && !triple {
+		if sc.peekRune() == '\n' && !triple {
+			// Leave the newline, for error recovery.
 			sc.error(val.pos, "unexpected newline in string")
 		}
+		c := sc.readRune()
 		if c == quote {
 			quoteCount++
 			if !triple || quoteCount == 3 {
@@ -736,11 +889,14 @@ func (sc *scanner) scanString(val *tokenValue, quote rune) Token {
 	}
 
 	sc.endToken(val)
-	s, _, err := unquote(val.raw)
+	s, _, isByte, err := unquote(val.raw)
 	if err != nil {
 		sc.error(start, err.Error())
 	}
 	val.string = s
+	if isByte {
+		return BYTES
+	}
 	return STRING
 }
 
@@ -944,6 +1100,7 @@ var keywordToken = map[string]Token{
 	"or":       OR,
 	"pass":     PASS,
 	"return":   RETURN,
+	"while":    WHILE,
 
 	// reserved words:
 	"as": ILLEGAL,
@@ -959,7 +1116,6 @@ var keywordToken = map[string]Token{
 	"nonlocal": ILLEGAL,
 	"raise":    ILLEGAL,
 	"try":      ILLEGAL,
-	"while":    ILLEGAL,
 	"with":     ILLEGAL,
 	"yield":    ILLEGAL,
 }
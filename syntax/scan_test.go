@@ -43,6 +43,8 @@ func scan(src interface{}) (tokens string, err error) {
 			fmt.Fprintf(&buf, "%e", val.float)
 		case STRING:
 			fmt.Fprintf(&buf, "%q", val.string)
+		case BYTES:
+			fmt.Fprintf(&buf, "b%q", val.string)
 		default:
 			buf.WriteString(tok.String())
 		}
@@ -66,6 +68,9 @@ func TestScanner(t *testing.T) {
 		{`print(x); print(y)`, "print ( x ) ; print ( y ) EOF"},
 		{"\nprint(\n1\n)\n", "print ( 1 ) newline EOF"}, // final \n is at toplevel on non-blank line => token
 		{`/ // /= //= ///=`, "/ // /= //= // /= EOF"},
+		{`& &= | |= ^ ^= ~`, "& &= | |= ^ ^= ~ EOF"},
+		{`< << <<= <= > >> >>= >=`, "< << <<= <= > >> >>= >= EOF"},
+		{`x<<<y`, "x << < y EOF"},
 		{`# hello
 print(x)`, "print ( x ) EOF"},
 		{`# hello
@@ -188,6 +193,12 @@ pass`, "pass newline pass EOF"}, // consecutive newlines are consolidated
 		{"012834", `foo.star:1:1: invalid int literal`},
 		{"012934", `foo.star:1:1: invalid int literal`},
 		{"i = 012934", `foo.star:1:5: invalid int literal`},
+		// byte string literals
+		{`b"abc" b'\xff' rb"\x00" br'\n'`, `b"abc" b"\xff" b"\\x00" b"\\n" EOF`},
+		{`b'''x
+y'''`, `b"x\ny" EOF`},
+		{`b r br bb"x"`, `b r br bb "x" EOF`},
+		{`rr"x"`, `rr "x" EOF`},
 		// octal escapes in string literals
 		{`"\037"`, `"\x1f" EOF`},
 		{`"\377"`, `"\xff" EOF`},
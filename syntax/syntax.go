@@ -70,6 +70,11 @@ type File struct {
 	Path  string
 	Stmts []Stmt
 
+	// Dialect holds the names of the features enabled by
+	// pragma comments of the form "# dialect: a, b, c"
+	// preceding the first statement.  The resolver interprets them.
+	Dialect []*Ident
+
 	// set by resolver:
 	Locals  []*Ident // this file's (comprehension-)local variables
 	Globals []*Ident // this file's global variables
@@ -91,6 +96,7 @@ type Stmt interface {
 }
 
 func (*AssignStmt) stmt() {}
+func (*BadStmt) stmt()    {}
 func (*BranchStmt) stmt() {}
 func (*DefStmt) stmt()    {}
 func (*ExprStmt) stmt()   {}
@@ -98,6 +104,7 @@ func (*ForStmt) stmt()    {}
 func (*IfStmt) stmt()     {}
 func (*LoadStmt) stmt()   {}
 func (*ReturnStmt) stmt() {}
+func (*WhileStmt) stmt()  {}
 
 // An AssignStmt represents an assignment:
 //	x = 0
@@ -125,10 +132,11 @@ type Function struct {
 	Body     []Stmt
 
 	// set by resolver:
-	HasVarargs bool     // whether params includes *args (convenience)
-	HasKwargs  bool     // whether params includes **kwargs (convenience)
-	Locals     []*Ident // this function's local variables, parameters first
-	FreeVars   []*Ident // enclosing local variables to capture in closure
+	HasVarargs     bool     // whether params includes *args (convenience)
+	HasKwargs      bool     // whether params includes **kwargs (convenience)
+	AllowRecursion bool     // whether the dialect permits recursion (checked by the evaluator)
+	Locals         []*Ident // this function's local variables, parameters first
+	FreeVars       []*Ident // enclosing local variables to capture in closure
 }
 
 func (x *Function) Span() (start, end Position) {
@@ -203,6 +211,18 @@ func (x *LoadStmt) Span() (start, end Position) {
 // ModuleName returns the name of the module loaded by this statement.
 func (x *LoadStmt) ModuleName() string { return x.Module.Value.(string) }
 
+// A BadStmt is a placeholder for a statement containing a syntax error,
+// in the partial tree returned along with the errors by Parse.
+type BadStmt struct {
+	commentsRef
+	From, To Position // extent of the skipped tokens
+	Text     string   // source text of the skipped tokens, and any comments among them
+}
+
+func (x *BadStmt) Span() (start, end Position) {
+	return x.From, x.To
+}
+
 // A BranchStmt changes the flow of control: break, continue, pass.
 type BranchStmt struct {
 	commentsRef
@@ -235,6 +255,7 @@ type Expr interface {
 	expr()
 }
 
+func (*BadExpr) expr()       {}
 func (*BinaryExpr) expr()    {}
 func (*CallExpr) expr()      {}
 func (*Comprehension) expr() {}
@@ -252,6 +273,18 @@ func (*SliceExpr) expr()     {}
 func (*TupleExpr) expr()     {}
 func (*UnaryExpr) expr()     {}
 
+// A BadExpr is a placeholder for a malformed element within brackets,
+// in the partial tree returned along with the errors by Parse.
+type BadExpr struct {
+	commentsRef
+	From, To Position // extent of the skipped tokens
+	Text     string   // source text of the skipped tokens, and any comments among them
+}
+
+func (x *BadExpr) Span() (start, end Position) {
+	return x.From, x.To
+}
+
 // An Ident represents an identifier.
 type Ident struct {
 	commentsRef
@@ -268,10 +301,10 @@ func (x *Ident) Span() (start, end Position) {
 	return x.NamePos, x.NamePos.add(x.Name)
 }
 
-// A Literal represents a literal string or number.
+// A Literal represents a literal string, byte string, or number.
 type Literal struct {
 	commentsRef
-	Token    Token // = STRING | INT
+	Token    Token // = STRING | BYTES | INT | FLOAT
 	TokenPos Position
 	Raw      string      // uninterpreted text
 	Value    interface{} // = string | int64 | *big.Int
@@ -351,6 +384,19 @@ func (x *ForStmt) Span() (start, end Position) {
 	return x.For, end
 }
 
+// A WhileStmt represents a while loop: while Cond: Body.
+type WhileStmt struct {
+	commentsRef
+	While Position
+	Cond  Expr
+	Body  []Stmt
+}
+
+func (x *WhileStmt) Span() (start, end Position) {
+	_, end = x.Body[len(x.Body)-1].Span()
+	return x.While, end
+}
+
 // A ForClause represents a for clause in a list comprehension: for Vars in X.
 type ForClause struct {
 	commentsRef
@@ -22,7 +22,7 @@ func Walk(n Node, f func(Node) bool) {
 	case *ExprStmt:
 		Walk(n.X, f)
 
-	case *BranchStmt:
+	case *BranchStmt, *BadStmt:
 		// no-op
 
 	case *IfStmt:
@@ -46,6 +46,10 @@ func Walk(n Node, f func(Node) bool) {
 		Walk(n.X, f)
 		walkStmts(n.Body, f)
 
+	case *WhileStmt:
+		Walk(n.Cond, f)
+		walkStmts(n.Body, f)
+
 	case *ReturnStmt:
 		if n.Result != nil {
 			Walk(n.Result, f)
@@ -60,7 +64,7 @@ func Walk(n Node, f func(Node) bool) {
 			Walk(to, f)
 		}
 
-	case *Ident, *Literal:
+	case *Ident, *Literal, *BadExpr:
 		// no-op
 
 	case *ListExpr:
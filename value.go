@@ -12,6 +12,7 @@
 //      Int             -- int
 //      Float           -- float
 //      String          -- string
+//      Bytes           -- bytes
 //      *List           -- list
 //      Tuple           -- tuple
 //      *Dict           -- dict
@@ -132,6 +133,7 @@ var (
 	_ Comparable = False
 	_ Comparable = Float(0)
 	_ Comparable = String("")
+	_ Comparable = Bytes("")
 	_ Comparable = (*Dict)(nil)
 	_ Comparable = (*List)(nil)
 	_ Comparable = Tuple(nil)
@@ -191,6 +193,7 @@ var (
 	_ HasSetIndex = (*List)(nil)
 	_ Indexable   = Tuple(nil)
 	_ Indexable   = String("")
+	_ Indexable   = Bytes("")
 )
 
 // An Iterator provides a sequence of values to the caller.
@@ -229,7 +232,7 @@ type Mapping interface {
 var _ Mapping = (*Dict)(nil)
 
 // A HasBinary value may be used as either operand of these binary operators:
-//     +   -   *   /   %   in   not in   |   &
+//     +   -   *   /   %   in   not in   |   &   ^   <<   >>
 // The Side argument indicates whether the receiver is the left or right operand.
 //
 // An implementation may decline to handle an operation by returning (nil, nil).
@@ -463,15 +466,98 @@ func (it *stringIterator) Next(p *Value) bool {
 
 func (*stringIterator) Done() {}
 
+// Bytes is the type of a Starlark binary string.
+//
+// A Bytes is an immutable sequence of bytes.  Unlike a String, indexing
+// a Bytes yields an int, the numeric value of the byte.  Bytes are not
+// directly iterable; the elems method returns an iterable view of the
+// numeric values of the elements.
+type Bytes string
+
+func (b Bytes) String() string        { return quoteBytes(string(b)) }
+func (b Bytes) Type() string          { return "bytes" }
+func (b Bytes) Freeze()               {} // immutable
+func (b Bytes) Truth() Bool           { return len(b) > 0 }
+func (b Bytes) Hash() (uint32, error) { return hashString(string(b)), nil }
+func (b Bytes) Len() int              { return len(b) }
+func (b Bytes) Index(i int) Value     { return smallints[b[i]] }
+
+func (b Bytes) Attr(name string) (Value, error) { return builtinAttr(b, name, bytesMethods) }
+func (b Bytes) AttrNames() []string             { return builtinAttrNames(bytesMethods) }
+
+func (x Bytes) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error) {
+	y := y_.(Bytes)
+	return threeway(op, strings.Compare(string(x), string(y))), nil
+}
+
+// quoteBytes returns the Starlark literal denoting the byte string s,
+// using a hexadecimal escape for each byte that is not printable ASCII.
+func quoteBytes(s string) string {
+	const hex = "0123456789abcdef"
+	var buf bytes.Buffer
+	buf.WriteString(`b"`)
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '"', '\\':
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if c < 0x20 || c >= 0x7f {
+				buf.WriteString(`\x`)
+				buf.WriteByte(hex[c>>4])
+				buf.WriteByte(hex[c&0xf])
+			} else {
+				buf.WriteByte(c)
+			}
+		}
+	}
+	buf.WriteByte('"')
+	return buf.String()
+}
+
+// A bytesIterable is an iterable whose iterator yields the numeric
+// values of the elements of a byte string.
+type bytesIterable struct{ b Bytes }
+
+var _ Iterable = bytesIterable{}
+
+func (bi bytesIterable) String() string        { return bi.b.String() + ".elems()" }
+func (bi bytesIterable) Type() string          { return "bytes.elems" }
+func (bi bytesIterable) Freeze()               {} // immutable
+func (bi bytesIterable) Truth() Bool           { return True }
+func (bi bytesIterable) Hash() (uint32, error) { return 0, fmt.Errorf("unhashable: %s", bi.Type()) }
+func (bi bytesIterable) Iterate() Iterator     { return &bytesIterator{bi.b} }
+
+type bytesIterator struct{ b Bytes }
+
+func (it *bytesIterator) Next(p *Value) bool {
+	if it.b == "" {
+		return false
+	}
+	*p = smallints[it.b[0]]
+	it.b = it.b[1:]
+	return true
+}
+
+func (*bytesIterator) Done() {}
+
 // A Function is a function defined by a Starlark def statement.
 type Function struct {
 	name        string          // "lambda" for anonymous functions
 	position    syntax.Position // position of def or lambda token
 	syntax      *syntax.Function
-	predeclared StringDict // names predeclared in the current module
-	globals     []Value    // globals of the current module
+	predeclared StringDict      // names predeclared in the current module
+	globals     []Value         // globals of the current module
+	globalNames []*syntax.Ident // names of globals, for Frame.Globals
 	defaults    Tuple
 	freevars    Tuple
+	funcode     *funcode // compiled code, if created by the bytecode interpreter
 }
 
 func (fn *Function) Name() string          { return fn.name }
@@ -518,6 +604,9 @@ func (b *Builtin) Receiver() Value { return b.recv }
 func (b *Builtin) String() string  { return toString(b) }
 func (b *Builtin) Type() string    { return "builtin_function_or_method" }
 func (b *Builtin) Call(thread *Thread, args Tuple, kwargs []Tuple) (Value, error) {
+	if thread != nil && thread.prof != nil {
+		return b.profiledCall(thread, args, kwargs)
+	}
 	return b.fn(thread, b, args, kwargs)
 }
 func (b *Builtin) Truth() Bool { return true }
@@ -796,6 +885,9 @@ func (s *Set) Truth() Bool                            { return s.Len() > 0 }
 func (s *Set) Attr(name string) (Value, error) { return builtinAttr(s, name, setMethods) }
 func (s *Set) AttrNames() []string             { return builtinAttrNames(setMethods) }
 
+// CompareSameType compares sets by inclusion:
+// x <= y reports whether x is a subset of y,
+// and x < y whether it is a proper subset.
 func (x *Set) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error) {
 	y := y_.(*Set)
 	switch op {
@@ -805,6 +897,14 @@ func (x *Set) CompareSameType(op syntax.Token, y_ Value, depth int) (bool, error
 	case syntax.NEQ:
 		ok, err := setsEqual(x, y, depth)
 		return !ok, err
+	case syntax.LE:
+		return isSubset(x, y), nil
+	case syntax.LT:
+		return x.Len() < y.Len() && isSubset(x, y), nil
+	case syntax.GE:
+		return isSubset(y, x), nil
+	case syntax.GT:
+		return x.Len() > y.Len() && isSubset(y, x), nil
 	default:
 		return false, fmt.Errorf("%s %s %s not implemented", x.Type(), op, y.Type())
 	}
@@ -822,11 +922,44 @@ func setsEqual(x, y *Set, depth int) (bool, error) {
 	return true, nil
 }
 
-func (s *Set) Union(iter Iterator) (Value, error) {
+// isSubset reports whether every element of x is an element of y.
+func isSubset(x, y *Set) bool {
+	if x.Len() > y.Len() {
+		return false
+	}
+	for _, elem := range x.elems() {
+		if found, _ := y.Has(elem); !found {
+			return false
+		}
+	}
+	return true
+}
+
+// clone returns a new, unfrozen set with the same elements as s.
+func (s *Set) clone() *Set {
 	set := new(Set)
 	for _, elem := range s.elems() {
 		set.Insert(elem) // can't fail
 	}
+	return set
+}
+
+// setOf returns a new set containing the elements yielded by iter.
+func setOf(iter Iterator) (*Set, error) {
+	set := new(Set)
+	var x Value
+	for iter.Next(&x) {
+		if err := set.Insert(x); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Union returns a new set containing the elements of s
+// followed by those elements yielded by iter that are not in s.
+func (s *Set) Union(iter Iterator) (Value, error) {
+	set := s.clone()
 	var x Value
 	for iter.Next(&x) {
 		if err := set.Insert(x); err != nil {
@@ -836,6 +969,92 @@ func (s *Set) Union(iter Iterator) (Value, error) {
 	return set, nil
 }
 
+// Difference returns a new set containing the elements of s
+// that are not yielded by iter.
+func (s *Set) Difference(iter Iterator) (Value, error) {
+	set := s.clone()
+	var x Value
+	for iter.Next(&x) {
+		if _, err := set.Delete(x); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// Intersection returns a new set containing the elements of s
+// that are also yielded by iter, in the order of s.
+func (s *Set) Intersection(iter Iterator) (Value, error) {
+	other, err := setOf(iter)
+	if err != nil {
+		return nil, err
+	}
+	set := new(Set)
+	for _, elem := range s.elems() {
+		if found, _ := other.Has(elem); found {
+			set.Insert(elem) // can't fail
+		}
+	}
+	return set, nil
+}
+
+// SymmetricDifference returns a new set containing the elements of s
+// that are not yielded by iter, followed by those elements yielded by
+// iter that are not in s.
+func (s *Set) SymmetricDifference(iter Iterator) (Value, error) {
+	other, err := setOf(iter)
+	if err != nil {
+		return nil, err
+	}
+	set := new(Set)
+	for _, elem := range s.elems() {
+		if found, _ := other.Has(elem); !found {
+			set.Insert(elem) // can't fail
+		}
+	}
+	for _, elem := range other.elems() {
+		if found, _ := s.Has(elem); !found {
+			set.Insert(elem) // can't fail
+		}
+	}
+	return set, nil
+}
+
+// IsSubset reports whether every element of s is yielded by iter.
+func (s *Set) IsSubset(iter Iterator) (bool, error) {
+	other, err := setOf(iter)
+	if err != nil {
+		return false, err
+	}
+	return isSubset(s, other), nil
+}
+
+// IsSuperset reports whether every element yielded by iter is in s.
+func (s *Set) IsSuperset(iter Iterator) (bool, error) {
+	var x Value
+	for iter.Next(&x) {
+		if found, err := s.Has(x); err != nil {
+			return false, err
+		} else if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// IsDisjoint reports whether no element yielded by iter is in s.
+func (s *Set) IsDisjoint(iter Iterator) (bool, error) {
+	var x Value
+	for iter.Next(&x) {
+		if found, err := s.Has(x); err != nil {
+			return false, err
+		} else if found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 // toString returns the string form of value v.
 // It may be more efficient than v.String() for larger values.
 func toString(v Value) string {
@@ -1088,6 +1307,8 @@ func Len(x Value) int {
 	switch x := x.(type) {
 	case String:
 		return x.Len()
+	case Bytes:
+		return x.Len()
 	case Sequence:
 		return x.Len()
 	}